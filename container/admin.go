@@ -0,0 +1,30 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// Report whether a request carries the ADMIN_TOKEN as bearer token.
+// Responds with 401 and returns false otherwise; admin endpoints are disabled without a token.
+func requireAdmin(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	if isAdmin(r) {
+		return true
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if r.Header.Get("Authorization") == "" {
+		unauthorized(ctx, w, "admin", authRequired, "admin token required!")
+	} else {
+		unauthorized(ctx, w, "admin", authInvalidToken, "invalid admin token!")
+	}
+	return false
+}
+
+// Report whether a request carries the ADMIN_TOKEN as bearer token, without responding
+func isAdmin(r *http.Request) bool {
+	token := config.AdminToken
+	supplied := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return token != "" && subtle.ConstantTimeCompare([]byte(token), []byte(supplied)) == 1
+}
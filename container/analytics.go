@@ -0,0 +1,356 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Layout of rollup dates
+const rollupDate = "2006-01-02"
+
+// Default time between two flushes of pending clicks
+const defaultRollupInterval = time.Minute
+
+// Visitors remembered per rollup for counting uniques, beyond that uniques are estimates
+const maxRollupVisitors = 5000
+
+// Number of attempts to merge pending clicks into a rollup before keeping them for the next flush
+const rollupAttempts = 3
+
+// struct dailyRollup aggregates the clicks of a short code on a single UTC day.
+type dailyRollup struct {
+	// Short code the clicks belong to
+	Code string `json:"code"`
+	// Day in YYYY-MM-DD format
+	Date string `json:"date"`
+	// Number of redirects
+	Clicks int64 `json:"clicks"`
+	// Number of redirects per hour of the day
+	Hours [24]int64 `json:"hours"`
+	// Redirects by referring host ("" for direct traffic)
+	Referrers map[string]int64 `json:"referrers,omitempty"`
+	// Anonymised visitor identifiers, used to count uniques
+	Visitors []string `json:"visitors,omitempty"`
+	// Number of visitors not remembered because the list was full
+	UnlistedVisitors int64 `json:"unlisted_visitors,omitempty"`
+	// Clicks of visitors who asked not to be tracked, counted without visitor identifier
+	Untracked int64 `json:"untracked,omitempty"`
+	// Conversions reported for clicks on the link
+	Conversions int64 `json:"conversions,omitempty"`
+	// Sum of the values reported with the conversions
+	ConversionValue float64 `json:"conversion_value,omitempty"`
+	// Time of the last redirect
+	LastClick time.Time `json:"last_click"`
+	// Listed visitors as a set, built on first use so adding a click doesn't scan the list
+	seen map[string]bool
+}
+
+// Number of unique visitors of the day
+func (d *dailyRollup) uniques() int64 {
+	return int64(len(d.Visitors)) + d.UnlistedVisitors
+}
+
+// Merge the clicks of another rollup of the same code and day
+func (d *dailyRollup) merge(other *dailyRollup) {
+	d.Clicks += other.Clicks
+	for hour, clicks := range other.Hours {
+		d.Hours[hour] += clicks
+	}
+	for referrer, clicks := range other.Referrers {
+		if d.Referrers == nil {
+			d.Referrers = map[string]int64{}
+		}
+		d.Referrers[referrer] += clicks
+	}
+	for _, visitor := range other.Visitors {
+		d.addVisitor(visitor)
+	}
+	d.UnlistedVisitors += other.UnlistedVisitors
+	d.Untracked += other.Untracked
+	d.Conversions += other.Conversions
+	d.ConversionValue += other.ConversionValue
+	if other.LastClick.After(d.LastClick) {
+		d.LastClick = other.LastClick
+	}
+}
+
+// Count a visitor unless it is listed already, beyond maxRollupVisitors without listing it
+func (d *dailyRollup) addVisitor(visitor string) {
+	if d.seen == nil {
+		d.seen = make(map[string]bool, len(d.Visitors))
+		for _, listed := range d.Visitors {
+			d.seen[listed] = true
+		}
+	}
+	if d.seen[visitor] {
+		return
+	}
+	if len(d.Visitors) < maxRollupVisitors {
+		d.Visitors = append(d.Visitors, visitor)
+		d.seen[visitor] = true
+	} else {
+		d.UnlistedVisitors++
+	}
+}
+
+// Add a single click in place, which is what redirects do, so it avoids the allocations of merge
+func (d *dailyRollup) add(c click) {
+	d.Clicks++
+	d.Hours[c.Time.Hour()]++
+	if d.Referrers == nil {
+		d.Referrers = map[string]int64{}
+	}
+	d.Referrers[c.Referrer]++
+	if c.Visitor != "" {
+		d.addVisitor(c.Visitor)
+	} else {
+		d.Untracked++
+	}
+	if c.Time.After(d.LastClick) {
+		d.LastClick = c.Time
+	}
+}
+
+// struct click is a single redirect to be aggregated.
+type click struct {
+	// Short code which was followed
+	Code string
+	// Time of the redirect
+	Time time.Time
+	// Host of the referring page
+	Referrer string
+	// Anonymised identifier of the visitor
+	Visitor string
+	// Browser and country of the visitor, only kept for the click export
+	UserAgent string
+	Country   string
+}
+
+// Clicks waiting to be merged into the stored rollups, by object name
+var pendingClicks = struct {
+	sync.Mutex
+	rollups map[string]*dailyRollup
+}{rollups: map[string]*dailyRollup{}}
+
+// Name of the GCS object holding a rollup
+func rollupObject(code string, date string) string {
+	// Built by hand, it's named for every click
+	return "rollups/" + code + "/" + date + ".json"
+}
+
+// Report whether a visitor opted out of tracking through Do Not Track or Global Privacy Control.
+// ANALYTICS_PRIVACY=strict treats every visitor as opted out.
+func trackingRefused(r *http.Request) bool {
+	return config.AnalyticsPrivacy == "strict" || r.Header.Get("DNT") == "1" || r.Header.Get("Sec-GPC") == "1"
+}
+
+// Build the click record of a redirect without keeping personal data
+func newClick(code string, r *http.Request, now time.Time) click {
+	c := click{Code: code, Time: now.UTC()}
+	if r.Referer() != "" {
+		if referrer, err := url.Parse(r.Referer()); err == nil {
+			c.Referrer = strings.ToLower(referrer.Hostname())
+		}
+	}
+	// Opted out visitors only count towards aggregates, nothing is derived from their IP or user agent
+	if trackingRefused(r) {
+		return c
+	}
+	// Daily salted hash, so visitors can't be followed across days or reversed into IPs
+	// Assembled in a buffer on the stack, the parts don't need a string of their own
+	identity := make([]byte, 0, 512)
+	identity = append(identity, config.SigningSecret...)
+	identity = append(identity, '|')
+	identity = c.Time.AppendFormat(identity, rollupDate)
+	identity = append(identity, '|')
+	identity = append(identity, clientIP(r)...)
+	identity = append(identity, '|')
+	identity = append(identity, r.UserAgent()...)
+	hash := sha256.Sum256(identity)
+	c.Visitor = hex.EncodeToString(hash[:6])
+	if clickExport != nil {
+		header := config.ClickCountryHeader
+		if header == "" {
+			header = defaultCountryHeader
+		}
+		c.UserAgent = r.UserAgent()
+		c.Country = r.Header.Get(header)
+	}
+	return c
+}
+
+// Queue a click for the next flush
+func recordClick(c click) {
+	date := c.Time.Format(rollupDate)
+	name := rollupObject(c.Code, date)
+	pendingClicks.Lock()
+	defer pendingClicks.Unlock()
+	rollup, ok := pendingClicks.rollups[name]
+	if !ok {
+		rollup = &dailyRollup{Code: c.Code, Date: date}
+		pendingClicks.rollups[name] = rollup
+	}
+	rollup.add(c)
+	countClick(c)
+	exportClick(c)
+	publishClick(c)
+}
+
+// Periodically merge pending clicks into the stored rollups and bandit stats, every ROLLUP_INTERVAL
+func startRollups() {
+	interval := config.RollupInterval
+	if interval <= 0 {
+		interval = defaultRollupInterval
+	}
+	go func() {
+		for range time.Tick(interval) {
+			err := enqueue(context.Background(), "flush-analytics", nil)
+			if err != nil {
+				slog.Error("unable to queue analytics flush", "err", err)
+			}
+		}
+	}()
+}
+
+// Merge all pending clicks into their rollups, keeping those which fail for the next round
+func flushClicks(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "flushClicks")
+	defer span.End()
+	pendingClicks.Lock()
+	pending := pendingClicks.rollups
+	pendingClicks.rollups = map[string]*dailyRollup{}
+	pendingClicks.Unlock()
+
+	for name, rollup := range pending {
+		err := mergeRollup(ctx, name, rollup)
+		if err == nil {
+			continue
+		}
+		slog.Error("unable to flush clicks", "object", name, "err", err)
+		pendingClicks.Lock()
+		if newer, ok := pendingClicks.rollups[name]; ok {
+			rollup.merge(newer)
+		}
+		pendingClicks.rollups[name] = rollup
+		pendingClicks.Unlock()
+	}
+	flushCounts(ctx)
+}
+
+// Add pending clicks to a stored rollup, retrying when another instance wrote concurrently
+func mergeRollup(ctx context.Context, name string, pending *dailyRollup) error {
+	ctx, span := tracer.Start(ctx, "mergeRollup")
+	defer span.End()
+	var err error
+	for attempt := 0; attempt < rollupAttempts; attempt++ {
+		stored := &dailyRollup{Code: pending.Code, Date: pending.Date}
+		content, generation, readErr := gcsReadGeneration(ctx, name)
+		if readErr != nil && readErr != storage.ErrObjectNotExist {
+			return readErr
+		}
+		if readErr == nil {
+			err = json.Unmarshal([]byte(content), stored)
+			if err != nil {
+				return err
+			}
+		}
+		stored.merge(pending)
+		var marshalled []byte
+		marshalled, err = json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		err = gcsWriteIfGeneration(ctx, name, "application/json", marshalled, generation)
+		if !isPreconditionFailed(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %s after %d attempts", errWriteConflict, name, rollupAttempts)
+}
+
+// Read the stored rollup of a code for a day, empty if there were no clicks
+func readRollup(ctx context.Context, code string, date string) (*dailyRollup, error) {
+	ctx, span := tracer.Start(ctx, "readRollup")
+	defer span.End()
+	rollup := &dailyRollup{Code: code, Date: date}
+	data, _, err := gcsReadBlob(ctx, rollupObject(code, date))
+	if err == storage.ErrObjectNotExist {
+		return rollup, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, rollup)
+	if err != nil {
+		return nil, err
+	}
+	return rollup, nil
+}
+
+// Read the rollups of a code for every day in [from, to], in chronological order
+func readRollups(ctx context.Context, code string, from time.Time, to time.Time) ([]*dailyRollup, error) {
+	ctx, span := tracer.Start(ctx, "readRollups")
+	defer span.End()
+	days := map[string]bool{}
+	for day := from.UTC().Truncate(24 * time.Hour); !day.After(to); day = day.Add(24 * time.Hour) {
+		days[day.Format(rollupDate)] = true
+	}
+	// Listing finds the days with clicks in one call instead of probing every day
+	rollups := []*dailyRollup{}
+	err := gcsListPrefix(ctx, fmt.Sprintf("rollups/%s/", code), func(name string) error {
+		date := strings.TrimSuffix(name[strings.LastIndex(name, "/")+1:], ".json")
+		if !days[date] {
+			return nil
+		}
+		rollup, err := readRollup(ctx, code, date)
+		if err != nil {
+			return err
+		}
+		rollups = append(rollups, rollup)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rollups, func(i, j int) bool { return rollups[i].Date < rollups[j].Date })
+	return rollups, nil
+}
+
+// Parse a [from, to] date range from query parameters, defaulting to the last 30 days
+func parseRange(from string, to string, now time.Time) (time.Time, time.Time, error) {
+	end := now.UTC().Truncate(24 * time.Hour)
+	if to != "" {
+		t, err := time.Parse(rollupDate, to)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		end = t
+	}
+	start := end.AddDate(0, 0, -29)
+	if from != "" {
+		t, err := time.Parse(rollupDate, from)
+		if err != nil {
+			return time.Time{}, time.Time{}, err
+		}
+		start = t
+	}
+	if start.After(end) {
+		return time.Time{}, time.Time{}, fmt.Errorf("range starts after it ends")
+	}
+	if end.Sub(start) > 366*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("range exceeds a year")
+	}
+	return start, end, nil
+}
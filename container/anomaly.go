@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+// Largest link object considered sane, anything bigger isn't a URL record
+const maxLinkObjectSize = 16 << 10
+
+// Kinds of anomalies detected on stored link objects
+const (
+	anomalyOversized = "oversized"
+	anomalyNotURL    = "not_url"
+	anomalyScheme    = "bad_scheme"
+)
+
+// Error returned for link objects which must not be redirected to
+var errAnomalousLink = errors.New("anomalous link object")
+
+// struct anomaly records a link object found unfit for redirecting, for later repair.
+type anomaly struct {
+	// Short code of the affected link
+	Code string `json:"code"`
+	// Kind of anomaly (oversized, not_url, bad_scheme)
+	Kind string `json:"kind"`
+	// Size of the stored object in bytes
+	Size int64 `json:"size"`
+	// Time the anomaly was detected
+	Detected time.Time `json:"detected"`
+}
+
+// Name of the GCS object recording the anomaly of a short code
+func anomalyObject(code string) string {
+	return "anomalies/" + code
+}
+
+// Inspect a stored link object and return the kind of anomaly, if any
+func inspectLink(data []byte, size int64) (*link, string) {
+	if size > maxLinkObjectSize {
+		return nil, anomalyOversized
+	}
+	l, err := decodeLink(data)
+	if err == nil && !l.Consumed.IsZero() {
+		return l, ""
+	}
+	if err == nil && l.Payload != nil {
+		if l.Payload.validate() != nil || l.URL != l.Payload.uri() {
+			return nil, anomalyScheme
+		}
+		return l, ""
+	}
+	if err != nil || l.URL == "" || strings.ContainsAny(l.URL, " \n\r\t") {
+		return nil, anomalyNotURL
+	}
+	uri, err := url.Parse(l.URL)
+	if err == nil && contactSchemes[uri.Scheme] != "" && uri.Opaque != "" {
+		return l, ""
+	}
+	if err != nil || uri.Host == "" {
+		return nil, anomalyNotURL
+	}
+	if uri.Scheme != "https" && uri.Scheme != "http" {
+		return nil, anomalyScheme
+	}
+	return l, ""
+}
+
+// Count an anomaly and have the code recorded for repair by the task runner, so redirects don't wait for it
+func flagAnomaly(ctx context.Context, code string, kind string, size int64) {
+	ctx, span := tracer.Start(ctx, "flagAnomaly")
+	defer span.End()
+	record(ctx, []tag.Mutator{tag.Upsert(keyAnomaly, kind)}, linkAnomalies.M(1))
+	slog.Warn("anomalous link object", "code", code, "kind", kind, "size", size)
+	err := enqueue(ctx, "store-anomaly", anomaly{code, kind, size, clock().UTC()})
+	if err != nil {
+		slog.Error("unable to queue anomaly", "code", code, "err", err)
+	}
+}
+
+// Record an anomaly under anomalies/
+func storeAnomaly(ctx context.Context, a anomaly) error {
+	ctx, span := tracer.Start(ctx, "storeAnomaly")
+	defer span.End()
+	marshalled, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	return gcsWriteBlob(ctx, anomalyObject(a.Code), "application/json", marshalled)
+}
+
+// GET handler listing all recorded anomalies
+func anomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "anomaliesHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	anomalies := []anomaly{}
+	err := gcsListPrefix(ctx, "anomalies/", func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			return err
+		}
+		a := anomaly{}
+		err = json.Unmarshal(data, &a)
+		if err != nil {
+			return nil
+		}
+		anomalies = append(anomalies, a)
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	respond(ctx, anomalies, http.StatusOK, w)
+}
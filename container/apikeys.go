@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Objects of API keys, named after the hash of the key so the key itself is never stored
+const apiKeyPrefix = "apikeys/"
+
+// Prefix of issued keys, so they are recognisable in configs and by secret scanners
+const apiKeyMarker = "uwk_"
+
+// Caching of looked up keys
+const (
+	// How long a looked up key is trusted before it is read again, so revocations apply within this time
+	apiKeyCacheTTL = time.Minute
+	// Keys remembered, the cache starts over beyond that so made up keys can't fill the memory
+	maxCachedAPIKeys = 10000
+)
+
+// struct apiKey is an issued API key, without the key itself.
+type apiKey struct {
+	// Start of the key's hash, to refer to the key without knowing it
+	ID   string `json:"id"`
+	Name string `json:"name"`
+	// Owner the key was issued for, informational
+	Owner   string    `json:"owner,omitempty"`
+	Created time.Time `json:"created"`
+}
+
+// struct apiKeyResponse is the answer to issuing a key, the only time the key is shown.
+type apiKeyResponse struct {
+	response
+	apiKey
+	Key string `json:"key"`
+}
+
+// Keys looked up recently by hash, nil entries for unknown keys
+var apiKeys = struct {
+	sync.Mutex
+	entries map[string]*apiKey
+	fetched map[string]time.Time
+}{entries: map[string]*apiKey{}, fetched: map[string]time.Time{}}
+
+// Report whether write endpoints require an API key (API_KEYS_REQUIRED=true), otherwise anonymous use is allowed
+func apiKeysRequired() bool {
+	return config.APIKeysRequired
+}
+
+// Hex encoded SHA-256 of a key
+func apiKeyHash(key string) string {
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// Key supplied with a request, as X-Api-Key or bearer token other than an ID token
+func suppliedAPIKey(r *http.Request) string {
+	if key := r.Header.Get("X-Api-Key"); key != "" {
+		return key
+	}
+	if idToken(r) != "" {
+		return ""
+	}
+	return strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
+
+// Look up a key, from memory if it was looked up within apiKeyCacheTTL. Returns nil for unknown keys.
+func lookupAPIKey(ctx context.Context, key string) (*apiKey, error) {
+	hash := apiKeyHash(key)
+	apiKeys.Lock()
+	cached, ok := apiKeys.entries[hash]
+	fresh := ok && time.Since(apiKeys.fetched[hash]) < apiKeyCacheTTL
+	apiKeys.Unlock()
+	if fresh {
+		return cached, nil
+	}
+	ctx, span := tracer.Start(ctx, "lookupAPIKey")
+	defer span.End()
+	var found *apiKey
+	data, _, err := gcsReadBlob(ctx, apiKeyPrefix+hash+".json")
+	if err != nil && err != storage.ErrObjectNotExist {
+		return nil, err
+	}
+	if err == nil {
+		found = &apiKey{}
+		err = json.Unmarshal(data, found)
+		if err != nil {
+			return nil, err
+		}
+	}
+	apiKeys.Lock()
+	if len(apiKeys.entries) >= maxCachedAPIKeys {
+		apiKeys.entries = map[string]*apiKey{}
+		apiKeys.fetched = map[string]time.Time{}
+	}
+	apiKeys.entries[hash] = found
+	apiKeys.fetched[hash] = time.Now()
+	apiKeys.Unlock()
+	return found, nil
+}
+
+// Wrap a write endpoint so it requires a valid API key, the admin token or an ID token with API_KEYS_REQUIRED.
+// Keys which are supplied are checked either way, so clients notice revoked keys before they become mandatory.
+// ID tokens are verified by the endpoint, which attributes the links to the user.
+func withAPIKey(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodOptions || isAdmin(r) {
+			next(w, r)
+			return
+		}
+		ctx := context.Background()
+		ctx, span := tracer.Start(ctx, "withAPIKey")
+		defer span.End()
+		key := suppliedAPIKey(r)
+		if key == "" {
+			if apiKeysRequired() && idToken(r) == "" {
+				w.Header().Set("Access-Control-Allow-Origin", "*")
+				w.Header().Set("Content-Type", "application/json")
+				unauthorized(ctx, w, "api", authRequired, "API key required!")
+				return
+			}
+			next(w, r)
+			return
+		}
+		found, err := lookupAPIKey(ctx, key)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		if found == nil {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+			w.Header().Set("Content-Type", "application/json")
+			unauthorized(ctx, w, "api", authInvalidToken, "invalid API key!")
+			return
+		}
+		span.SetAttributes(attribute.String("key", found.ID))
+		next(w, r)
+	}
+}
+
+// Admin handler for API keys: GET lists them, POST issues one for {"name", "owner"}, DELETE ?id= revokes one
+func apiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "apiKeysHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		req := struct {
+			Name  string `json:"name"`
+			Owner string `json:"owner"`
+		}{}
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || strings.TrimSpace(req.Name) == "" {
+			respond(ctx, response{"", "name required!"}, http.StatusBadRequest, w)
+			return
+		}
+		random := make([]byte, 32)
+		_, err = rand.Read(random)
+		if err != nil {
+			respond(ctx, response{"", "unable to create key!"}, http.StatusInternalServerError, w)
+			return
+		}
+		key := apiKeyMarker + base64.RawURLEncoding.EncodeToString(random)
+		hash := apiKeyHash(key)
+		issued := apiKey{ID: hash[:12], Name: strings.TrimSpace(req.Name), Owner: strings.TrimSpace(req.Owner), Created: clock().UTC()}
+		marshalled, err := json.Marshal(issued)
+		if err == nil {
+			err = gcsWriteIfGeneration(ctx, apiKeyPrefix+hash+".json", "application/json", marshalled, 0)
+		}
+		if err != nil {
+			respond(ctx, response{"", "unable to store key!"}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(ctx, apiKeyResponse{response{"", "key issued, it won't be shown again!"}, issued, key}, http.StatusCreated, w)
+		return
+	case http.MethodDelete:
+		id := r.URL.Query().Get("id")
+		if len(id) != 12 {
+			respond(ctx, response{"", "invalid key id!"}, http.StatusBadRequest, w)
+			return
+		}
+		revoked := 0
+		err := gcsListPrefix(ctx, apiKeyPrefix+id, func(name string) error {
+			revoked++
+			return gcsDelete(ctx, name)
+		})
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		if revoked == 0 {
+			respond(ctx, response{"", "unable to find key!"}, http.StatusNotFound, w)
+			return
+		}
+		respond(ctx, response{"", "key revoked, instances stop accepting it within a minute!"}, http.StatusOK, w)
+		return
+	}
+
+	keys := []apiKey{}
+	err := gcsListPrefix(ctx, apiKeyPrefix, func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			// Revoked while listing
+			return nil
+		}
+		key := apiKey{}
+		if json.Unmarshal(data, &key) == nil {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Created.Before(keys[j].Created) })
+	respond(ctx, keys, http.StatusOK, w)
+}
@@ -0,0 +1,313 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Prefix of archived links in the archive bucket
+const archivePrefix = "archive/"
+
+// Storage class of archived links, unless ARCHIVE_STORAGE_CLASS says otherwise
+const defaultArchiveStorageClass = "COLDLINE"
+
+// How often idle links are archived by default
+const defaultArchiveInterval = 24 * time.Hour
+
+// Store moving idle links into the archive and back, nil unless ARCHIVE_AFTER_MONTHS is set
+var linkArchive *archivingLinkStore
+
+// struct archivingLinkStore keeps idle links in a cold archive outside the wrapped store.
+// Reading an archived link moves it back, so archived links keep working, just slower on first access.
+type archivingLinkStore struct {
+	linkStore
+}
+
+// struct archiveRun reports what a pass over all links archived.
+type archiveRun struct {
+	response
+	// Links without clicks since then were archived
+	Cutoff   time.Time `json:"cutoff"`
+	Scanned  int       `json:"scanned"`
+	Archived int       `json:"archived"`
+}
+
+// Months without clicks after which links are archived, ARCHIVE_AFTER_MONTHS (0 only rehydrates)
+func archiveAfterMonths() int {
+	return config.ArchiveAfterMonths
+}
+
+// Bucket holding archived links, ARCHIVE_BUCKET or BUCKET
+func archiveBucket() string {
+	if bucket := config.ArchiveBucket; bucket != "" {
+		return bucket
+	}
+	return config.Bucket
+}
+
+// Name of the object holding the archived record of a code
+func archiveObject(code string) string {
+	return archivePrefix + code + ".json"
+}
+
+// Wrap the link store to rehydrate archived links if ARCHIVE_AFTER_MONTHS is set.
+// Setting it to 0 stops archiving while archived links are still brought back.
+func setupArchive() {
+	// Set to 0, archived links are still brought back
+	if settingValues["ARCHIVE_AFTER_MONTHS"] == "" {
+		return
+	}
+	linkArchive = &archivingLinkStore{linkStorage}
+	linkStorage = linkArchive
+}
+
+// Archive idle links every ARCHIVE_INTERVAL on one instance
+func startArchiver() {
+	if linkArchive == nil || archiveAfterMonths() <= 0 {
+		return
+	}
+	interval := config.ArchiveInterval
+	if interval <= 0 {
+		interval = defaultArchiveInterval
+	}
+	startSingleton("archive-links", interval, func(ctx context.Context) error {
+		run, err := linkArchive.archiveIdle(ctx, clock().AddDate(0, -archiveAfterMonths(), 0))
+		if err == nil && run.Archived > 0 {
+			slog.Info("archived links", "archived", run.Archived, "scanned", run.Scanned)
+		}
+		return err
+	})
+}
+
+// Primitive to read the record of an archived link
+func archiveRead(ctx context.Context, code string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "archiveRead")
+	defer span.End()
+	countOperation(opRead, 1)
+	if localBucket != nil {
+		data, _, _, err := localBucket.read(archiveObject(code))
+		return data, err
+	}
+
+	client, err := gcsClient()
+	if err != nil {
+		return nil, err
+	}
+
+	reader, err := client.Bucket(archiveBucket()).Object(archiveObject(code)).NewReader(ctx)
+	if err != nil {
+		return nil, gcsCheck(client, err)
+	}
+	defer reader.Close()
+
+	buffer := new(bytes.Buffer)
+	_, err = buffer.ReadFrom(reader)
+	if err != nil {
+		return nil, gcsCheck(client, err)
+	}
+	return buffer.Bytes(), nil
+}
+
+// Primitive to write the record of a link to the archive in its storage class
+func archiveWrite(ctx context.Context, code string, data []byte) error {
+	ctx, span := tracer.Start(ctx, "archiveWrite")
+	defer span.End()
+	countOperation(opWrite, 1)
+	if localBucket != nil {
+		return localBucket.write(archiveObject(code), "application/json", data, anyGeneration)
+	}
+
+	client, err := gcsClient()
+	if err != nil {
+		return err
+	}
+
+	writer := client.Bucket(archiveBucket()).Object(archiveObject(code)).NewWriter(ctx)
+	writer.ContentType = "application/json"
+	writer.StorageClass = config.ArchiveStorageClass
+	if writer.StorageClass == "" {
+		writer.StorageClass = defaultArchiveStorageClass
+	}
+	_, err = writer.Write(data)
+	if err != nil {
+		writer.Close()
+		return gcsCheck(client, err)
+	}
+	return gcsCheck(client, writer.Close())
+}
+
+// Primitive to remove the record of an archived link
+func archiveDelete(ctx context.Context, code string) error {
+	ctx, span := tracer.Start(ctx, "archiveDelete")
+	defer span.End()
+	countOperation(opDelete, 1)
+	if localBucket != nil {
+		return localBucket.delete(archiveObject(code))
+	}
+
+	client, err := gcsClient()
+	if err != nil {
+		return err
+	}
+
+	return gcsCheck(client, client.Bucket(archiveBucket()).Object(archiveObject(code)).Delete(ctx))
+}
+
+func (s *archivingLinkStore) read(ctx context.Context, code string, limit int64) (*storedLink, error) {
+	rec, err := s.linkStore.read(ctx, code, limit)
+	if err != storage.ErrObjectNotExist {
+		return rec, err
+	}
+	err = s.rehydrate(ctx, code)
+	if err != nil {
+		return nil, err
+	}
+	return s.linkStore.read(ctx, code, limit)
+}
+
+func (s *archivingLinkStore) write(ctx context.Context, code string, data []byte, generation int64) error {
+	// An archived link still holds its code
+	if generation == 0 {
+		err := s.rehydrate(ctx, code)
+		if err == nil {
+			return fmt.Errorf("%w: %s was archived", errWriteConflict, code)
+		}
+		if err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+	return s.linkStore.write(ctx, code, data, generation)
+}
+
+func (s *archivingLinkStore) delete(ctx context.Context, code string) error {
+	err := s.linkStore.delete(ctx, code)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return err
+	}
+	archiveErr := archiveDelete(ctx, code)
+	if err == nil && archiveErr == storage.ErrObjectNotExist {
+		return nil
+	}
+	return archiveErr
+}
+
+// Move an archived link back into the wrapped store, storage.ErrObjectNotExist if it isn't archived
+func (s *archivingLinkStore) rehydrate(ctx context.Context, code string) error {
+	ctx, span := tracer.Start(ctx, "rehydrateLink")
+	defer span.End()
+	data, err := archiveRead(ctx, code)
+	if err != nil {
+		return err
+	}
+	err = s.linkStore.write(ctx, code, data, 0)
+	// A concurrent request brought it back first
+	if err != nil && !isPreconditionFailed(err) {
+		return err
+	}
+	err = archiveDelete(ctx, code)
+	if err != nil && err != storage.ErrObjectNotExist {
+		slog.Error("unable to remove archived copy", "code", code, "err", err)
+	}
+	return nil
+}
+
+// Report whether a link had no clicks since the cutoff, according to its counter and rollups
+func idleSince(ctx context.Context, code string, l *link, cutoff time.Time, now time.Time) (bool, error) {
+	if l.Created.After(cutoff) || l.LastClick.After(cutoff) {
+		return false, nil
+	}
+	// Links without a counter only show their clicks in the rollups
+	rollups, err := readRollups(ctx, code, cutoff, now)
+	if err != nil {
+		return false, err
+	}
+	for _, rollup := range rollups {
+		if rollup.Clicks > 0 {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// Move all links without clicks since the cutoff from the wrapped store into the archive.
+// Links with undelivered events stay until the outbox is dispatched.
+func (s *archivingLinkStore) archiveIdle(ctx context.Context, cutoff time.Time) (archiveRun, error) {
+	ctx, span := tracer.Start(ctx, "archiveIdle")
+	defer span.End()
+	now := clock()
+	run := archiveRun{Cutoff: cutoff.UTC()}
+	err := s.linkStore.list(ctx, "", func(code string) error {
+		rec, err := s.linkStore.read(ctx, code, 0)
+		if err != nil {
+			// Removed while listing
+			return nil
+		}
+		run.Scanned++
+		l, err := decodeLink(rec.data)
+		if err != nil || len(l.Outbox) > 0 {
+			return nil
+		}
+		idle, err := idleSince(ctx, code, l, cutoff, now)
+		if err != nil || !idle {
+			return err
+		}
+		err = archiveWrite(ctx, code, rec.data)
+		if err != nil {
+			return err
+		}
+		// Changed since it was read, so it's not idle after all
+		current, err := s.linkStore.read(ctx, code, 1)
+		if err != nil || current.generation != rec.generation {
+			return archiveDelete(ctx, code)
+		}
+		err = s.linkStore.delete(ctx, code)
+		if err != nil {
+			return err
+		}
+		run.Archived++
+		return nil
+	})
+	return run, err
+}
+
+// Admin handler archiving idle links right away instead of waiting for the next ARCHIVE_INTERVAL.
+// Takes ?months= to archive links idle for a different number of months than ARCHIVE_AFTER_MONTHS.
+func archiveHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "archiveHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	if linkArchive == nil {
+		respond(ctx, response{"", "archival isn't configured, set ARCHIVE_AFTER_MONTHS!"}, http.StatusNotImplemented, w)
+		return
+	}
+	months := archiveAfterMonths()
+	if raw := r.URL.Query().Get("months"); raw != "" {
+		var err error
+		months, err = strconv.Atoi(raw)
+		if err != nil {
+			months = 0
+		}
+	}
+	if months <= 0 {
+		respond(ctx, response{"", "months should be a positive number!"}, http.StatusBadRequest, w)
+		return
+	}
+	run, err := linkArchive.archiveIdle(ctx, clock().AddDate(0, -months, 0))
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	run.Message = fmt.Sprintf("archived %d of %d links", run.Archived, run.Scanned)
+	respond(ctx, run, http.StatusOK, w)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+)
+
+// Machine readable reasons of authentication and authorization failures
+const (
+	// No credentials were supplied (401)
+	authRequired = "authentication_required"
+	// The bearer token isn't valid here (401)
+	authInvalidToken = "invalid_token"
+	// Credentials were supplied but don't grant access (403)
+	authForbidden = "forbidden"
+)
+
+// struct authFailure is the body of every 401 and 403 response.
+type authFailure struct {
+	response
+	Error string `json:"error"`
+}
+
+// Respond with 401, challenging for a bearer token of a realm (admin, link or api)
+func unauthorized(ctx context.Context, w http.ResponseWriter, realm string, reason string, message string) {
+	challenge := fmt.Sprintf(`Bearer realm="urly-wurly %s"`, realm)
+	if reason == authInvalidToken {
+		challenge += `, error="invalid_token"`
+	}
+	w.Header().Set("WWW-Authenticate", challenge)
+	respond(ctx, authFailure{response{"", message}, reason}, http.StatusUnauthorized, w)
+}
+
+// Respond with 403 for credentials or signatures which don't grant access
+func forbidden(ctx context.Context, w http.ResponseWriter, message string) {
+	respond(ctx, authFailure{response{"", message}, authForbidden}, http.StatusForbidden, w)
+}
+
+// Deny a request to an endpoint taking a signature or the admin token:
+// 401 if it carries neither, 403 if what it carries is wrong
+func denyAccess(ctx context.Context, w http.ResponseWriter, r *http.Request, sig string) {
+	if sig == "" && r.Header.Get("Authorization") == "" {
+		unauthorized(ctx, w, "api", authRequired, "signature or admin token required!")
+		return
+	}
+	forbidden(ctx, w, "invalid signature!")
+}
+
+// struct authWriter completes 401 and 403 responses of any handler.
+type authWriter struct {
+	http.ResponseWriter
+}
+
+func (w authWriter) WriteHeader(code int) {
+	if code == http.StatusUnauthorized || code == http.StatusForbidden {
+		// Failures depend on credentials, they mustn't be served to others
+		w.Header().Set("Cache-Control", "no-store")
+		w.Header().Add("Vary", "Authorization")
+		if code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="urly-wurly"`)
+		}
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Middleware making 401 and 403 responses consistent across endpoints.
+// Registered before negotiate, so handlers still see the negotiatedWriter.
+func authHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(authWriter{w}, r)
+	})
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+)
+
+// Badge colors
+const (
+	badgeGreen = "#4c1"
+	badgeBlue  = "#007ec6"
+	badgeRed   = "#e05d44"
+	badgeGrey  = "#9f9f9f"
+)
+
+// Default and maximum number of days of clicks shown on a badge
+const (
+	defaultBadgeDays = 30
+	maxBadgeDays     = 365
+)
+
+// Flat badge in the style of shields.io, label on the left and value on the right
+const badgeSVG = `<svg xmlns="http://www.w3.org/2000/svg" width="%[1]d" height="20" role="img" aria-label="%[4]s: %[5]s">
+<title>%[4]s: %[5]s</title>
+<linearGradient id="s" x2="0" y2="100%%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>
+<clipPath id="r"><rect width="%[1]d" height="20" rx="3" fill="#fff"/></clipPath>
+<g clip-path="url(#r)"><rect width="%[2]d" height="20" fill="#555"/><rect x="%[2]d" width="%[3]d" height="20" fill="%[6]s"/><rect width="%[1]d" height="20" fill="url(#s)"/></g>
+<g fill="#fff" text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">
+<text x="%[7]d" y="15" fill="#010101" fill-opacity=".3">%[4]s</text><text x="%[7]d" y="14">%[4]s</text>
+<text x="%[8]d" y="15" fill="#010101" fill-opacity=".3">%[5]s</text><text x="%[8]d" y="14">%[5]s</text>
+</g>
+</svg>
+`
+
+// Render a badge, estimating text widths from the character count
+func renderBadge(label string, value string, color string) []byte {
+	width := func(text string) int {
+		return 7*len([]rune(text)) + 10
+	}
+	left, right := width(label), width(value)
+	return []byte(fmt.Sprintf(badgeSVG, left+right, left, right, html.EscapeString(label), html.EscapeString(value), color, left/2, left+right/2))
+}
+
+// Shorten large counts like shields.io does (1234 becomes 1.2k)
+func badgeCount(n int64) string {
+	switch {
+	case n >= 1000000:
+		return strconv.FormatFloat(float64(n)/1000000, 'f', 1, 64) + "M"
+	case n >= 1000:
+		return strconv.FormatFloat(float64(n)/1000, 'f', 1, 64) + "k"
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// GET handler returning an SVG badge for embedding a link's clicks or status in READMEs and wikis.
+// ?show=clicks (default, over the last ?days=) or status, ?label= replaces the text on the left.
+func badgeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "badgeHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	query := r.URL.Query()
+	show := query.Get("show")
+	if show == "" {
+		show = "clicks"
+	}
+	days, err := strconv.Atoi(query.Get("days"))
+	if err != nil || days <= 0 {
+		days = defaultBadgeDays
+	}
+	if days > maxBadgeDays {
+		days = maxBadgeDays
+	}
+	if show != "clicks" && show != "status" {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "show should be clicks or status!"}, http.StatusBadRequest, w)
+		return
+	}
+	label := query.Get("label")
+	if label == "" && show == "clicks" {
+		label = fmt.Sprintf("clicks (%dd)", days)
+	}
+	if label == "" {
+		label = "link"
+	}
+
+	// Badges are embedded as images, so problems are shown on the badge rather than as an error
+	value, color := badgeValue(ctx, mux.Vars(r)["id"], show, days)
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "public, max-age=300")
+	w.Write(renderBadge(label, value, color))
+}
+
+// Value and color shown on the badge of a code
+func badgeValue(ctx context.Context, code string, show string, days int) (string, string) {
+	l, err := readLink(ctx, code)
+	if err != nil {
+		return "not found", badgeGrey
+	}
+	now := clock()
+	if show == "status" {
+		switch {
+		case !l.Consumed.IsZero():
+			return "consumed", badgeRed
+		case l.expired(now):
+			return "expired", badgeRed
+		case l.Quarantine != nil:
+			return "quarantined", badgeRed
+		}
+		return "alive", badgeGreen
+	}
+	if l.NoAnalytics {
+		return "n/a", badgeGrey
+	}
+	summary, err := summarizeClicks(ctx, code, now.AddDate(0, 0, -days+1), now)
+	if err != nil {
+		return "unavailable", badgeGrey
+	}
+	return badgeCount(summary.Clicks), badgeBlue
+}
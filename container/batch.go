@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// Limits of synchronous batches, larger imports should go through jobs
+const (
+	maxBatchItems = 1000
+	// Links created in parallel per batch
+	batchWorkers = 8
+)
+
+// struct batchResult is the outcome of a single item of a batch, in the position of the item.
+type batchResult struct {
+	shortenResponse
+	// HTTP status the item would have gotten from POST /api/v1/links
+	Status int `json:"status"`
+}
+
+// struct batchResponse holds the results of a batch in request order.
+type batchResponse struct {
+	response
+	Created int           `json:"created"`
+	Failed  int           `json:"failed"`
+	Results []batchResult `json:"results"`
+}
+
+// Decode an item of a batch, either a plain URL or a link object as accepted by POST /api/v1/links
+func decodeBatchItem(raw json.RawMessage) (shortenRequest, error) {
+	req := shortenRequest{}
+	if bytes.HasPrefix(bytes.TrimSpace(raw), []byte(`"`)) {
+		err := json.Unmarshal(raw, &req.URL)
+		return req, err
+	}
+	err := json.Unmarshal(raw, &req)
+	return req, err
+}
+
+// POST handler shortening a JSON array of URLs (or link objects) in one request.
+// Answers with a result per item in the same order, each holding the short URL or the error.
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "batchHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	uid, ok := signedInUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	items := []json.RawMessage{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 16<<20)).Decode(&items)
+	if err != nil {
+		respond(ctx, response{"", "body should be a JSON array of URLs or links!"}, http.StatusBadRequest, w)
+		return
+	}
+	if len(items) == 0 || len(items) > maxBatchItems {
+		respond(ctx, response{"", fmt.Sprintf("batches should have 1 to %d items, use a job for more!", maxBatchItems)}, http.StatusBadRequest, w)
+		return
+	}
+
+	// Who creates the links, the same for every item
+	caller := shortenRequest{UID: uid, Registrant: registrant(r, uid), ClaimToken: r.Header.Get("X-Claim-Token")}
+	results := make([]batchResult, len(items))
+	inParallel(len(items), func(i int) {
+		results[i] = shortenBatchItem(ctx, items[i], caller)
+	})
+
+	resp := batchResponse{Results: results}
+	for _, result := range results {
+		if result.Status == http.StatusOK {
+			resp.Created++
+		} else {
+			resp.Failed++
+		}
+	}
+	resp.Message = fmt.Sprintf("%d urls shortened, %d failed", resp.Created, resp.Failed)
+	respond(ctx, resp, http.StatusOK, w)
+}
+
+// Create the link of a single batch item on behalf of the caller (UID, registrant and claim token)
+func shortenBatchItem(ctx context.Context, raw json.RawMessage, caller shortenRequest) batchResult {
+	ctx, span := tracer.Start(ctx, "shortenBatchItem")
+	defer span.End()
+	req, err := decodeBatchItem(raw)
+	if err != nil {
+		return batchResult{shortenResponse{response: response{"", "unable to decode item!"}}, http.StatusBadRequest}
+	}
+	req.URL = strings.TrimSpace(req.URL)
+	if req.URL == "" && len(req.Variants) > 0 {
+		req.URL = req.Variants[0].URL
+	}
+	if req.URL == "" && req.Payload == nil {
+		return batchResult{shortenResponse{response: response{"", "no url to shorten provided!"}}, http.StatusBadRequest}
+	}
+	req.UID = caller.UID
+	req.Registrant = caller.Registrant
+	req.ClaimToken = caller.ClaimToken
+	resp, status := createLink(ctx, req)
+	return batchResult{resp, status}
+}
+
+// Call do for 0 to n-1, batchWorkers at a time
+func inParallel(n int, do func(i int)) {
+	indexes := make(chan int)
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < batchWorkers; worker++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				do(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+}
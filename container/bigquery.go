@@ -0,0 +1,123 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Limits of the click export
+const (
+	// Clicks buffered for export, more are dropped instead of slowing down redirects
+	clickExportBuffer = 10000
+	// Rows per streaming insert
+	clickExportBatch = 500
+	// Longest time a click waits for its batch
+	clickExportInterval = time.Second
+)
+
+// Header the load balancer puts the visitor's country into, unless CLICK_COUNTRY_HEADER says otherwise
+const defaultCountryHeader = "X-Client-Region"
+
+// struct clickRow is a redirect as exported to BigQuery.
+type clickRow struct {
+	Code      string    `bigquery:"code"`
+	Timestamp time.Time `bigquery:"timestamp"`
+	// Host of the referring page, empty for direct traffic
+	Referrer string `bigquery:"referrer"`
+	// Empty for visitors who refused tracking
+	UserAgent string `bigquery:"user_agent"`
+	Country   string `bigquery:"country"`
+}
+
+// Clicks waiting for export, nil unless CLICK_EXPORT_TABLE is set
+var clickExport chan *clickRow
+
+// Clicks dropped because the export fell behind
+var droppedExports int64
+
+// Stream every click into the BigQuery table CLICK_EXPORT_TABLE ("dataset.table" of GOOGLE_CLOUD_PROJECT,
+// or "project.dataset.table"), batching rows in the background
+func setupClickExport(ctx context.Context) error {
+	name := config.ClickExportTable
+	if name == "" {
+		return nil
+	}
+	project := config.Project
+	parts := strings.Split(name, ".")
+	switch len(parts) {
+	case 2:
+		parts = append([]string{project}, parts...)
+	case 3:
+	default:
+		return fmt.Errorf("CLICK_EXPORT_TABLE must be dataset.table or project.dataset.table, not %q", name)
+	}
+	client, err := bigquery.NewClient(ctx, project)
+	if err != nil {
+		return err
+	}
+	inserter := client.DatasetInProject(parts[0], parts[1]).Table(parts[2]).Inserter()
+	clickExport = make(chan *clickRow, clickExportBuffer)
+	go exportClicks(inserter)
+	return nil
+}
+
+// Queue a click for export, dropping it if the buffer is full
+func exportClick(c click) {
+	if clickExport == nil {
+		return
+	}
+	select {
+	case clickExport <- &clickRow{c.Code, c.Time, c.Referrer, c.UserAgent, c.Country}:
+	default:
+		atomic.AddInt64(&droppedExports, 1)
+	}
+}
+
+// Insert queued clicks in batches of clickExportBatch, or whatever arrived within clickExportInterval
+func exportClicks(inserter *bigquery.Inserter) {
+	ticker := time.NewTicker(clickExportInterval)
+	defer ticker.Stop()
+	rows := make([]*clickRow, 0, clickExportBatch)
+	for {
+		select {
+		case row := <-clickExport:
+			rows = append(rows, row)
+			if len(rows) < clickExportBatch {
+				continue
+			}
+		case <-ticker.C:
+			if len(rows) == 0 {
+				continue
+			}
+		}
+		insertClicks(context.Background(), inserter, rows)
+		rows = make([]*clickRow, 0, clickExportBatch)
+	}
+}
+
+// Stream a batch of clicks into the table. Failed rows are logged and dropped, the rollups still have them.
+func insertClicks(ctx context.Context, inserter *bigquery.Inserter, rows []*clickRow) {
+	ctx, span := tracer.Start(ctx, "insertClicks")
+	defer span.End()
+	span.SetAttributes(attribute.Int64("rows", int64(len(rows))))
+	if dropped := atomic.SwapInt64(&droppedExports, 0); dropped > 0 {
+		slog.Warn("dropped clicks, the export fell behind", "clicks", dropped)
+	}
+	err := inserter.Put(ctx, rows)
+	if multi, ok := err.(bigquery.PutMultiError); ok {
+		slog.Error("unable to export clicks", "failed", len(multi), "clicks", len(rows), "example", fmt.Sprint(multi[0].Errors))
+		return
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		slog.Error("unable to export clicks", "clicks", len(rows), "err", err)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+// Error returned when a burn-after-reading link has already been used
+var errLinkConsumed = errors.New("link has been consumed")
+
+// Mark a burn-after-reading link as consumed and return it for the single redirect it allows.
+// The generation precondition guarantees only one concurrent request wins.
+// The consumed record keeps no trace of the destination.
+func consumeLink(ctx context.Context, code string) (*link, error) {
+	ctx, span := tracer.Start(ctx, "consumeLink")
+	defer span.End()
+	rec, err := linkStorage.read(ctx, code, 0)
+	if err != nil {
+		return nil, err
+	}
+	l, err := decodeLink(rec.data)
+	if err != nil {
+		return nil, err
+	}
+	if !l.Consumed.IsZero() {
+		return nil, errLinkConsumed
+	}
+
+	consumed := &link{Created: l.Created, Owner: l.Owner, UID: l.UID, Tags: l.Tags, Consumed: clock().UTC(), Outbox: l.Outbox, Clicks: l.Clicks, LastClick: l.LastClick, Fallback: l.Fallback}
+	consumed.emit(eventLinkConsumed, code, nil)
+	marshalled, err := json.Marshal(consumed)
+	if err != nil {
+		return nil, err
+	}
+	err = linkStorage.write(ctx, code, marshalled, rec.generation)
+	if isPreconditionFailed(err) {
+		return nil, errLinkConsumed
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(consumed.Outbox) > 0 {
+		dispatchLater(ctx, code)
+	}
+	return l, nil
+}
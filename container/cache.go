@@ -0,0 +1,137 @@
+package main
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Default time a cached link is served before it is read again
+const defaultRedirectCacheTTL = 30 * time.Second
+
+// struct linkCache keeps the most recently redirected links of this instance in memory.
+type linkCache struct {
+	sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+// struct cachedLink is an entry of the linkCache.
+type cachedLink struct {
+	code    string
+	rec     *storedLink
+	fetched time.Time
+}
+
+// Cache in front of the link store for redirects, nil unless REDIRECT_CACHE_SIZE is set
+var redirectCache *linkCache
+
+// Configure the redirect cache from REDIRECT_CACHE_SIZE (links kept per instance) and REDIRECT_CACHE_TTL.
+// Redirect-only instances cache by default.
+// Writes through linkStorage invalidate entries, changes made by other instances show after the TTL.
+func setupRedirectCache() {
+	size := config.RedirectCacheSize
+	if size <= 0 && redirectOnly() {
+		size = replicaCacheSize
+	}
+	if size <= 0 {
+		return
+	}
+	ttl := config.RedirectCacheTTL
+	if ttl <= 0 {
+		ttl = defaultRedirectCacheTTL
+		if redirectOnly() {
+			ttl = replicaCacheTTL
+		}
+	}
+	redirectCache = &linkCache{size: size, ttl: ttl, order: list.New(), entries: map[string]*list.Element{}}
+	linkStorage = invalidatingLinkStore{linkStorage, redirectCache}
+}
+
+// Fresh cached record of a code, nil if there is none
+func (c *linkCache) get(code string, now time.Time) *storedLink {
+	c.Lock()
+	defer c.Unlock()
+	element, ok := c.entries[code]
+	if !ok {
+		return nil
+	}
+	entry := element.Value.(*cachedLink)
+	if now.Sub(entry.fetched) > c.ttl {
+		c.order.Remove(element)
+		delete(c.entries, code)
+		return nil
+	}
+	c.order.MoveToFront(element)
+	return entry.rec
+}
+
+// Remember the record of a code, evicting the least recently used one when full
+func (c *linkCache) put(code string, rec *storedLink, now time.Time) {
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.entries[code]; ok {
+		element.Value = &cachedLink{code, rec, now}
+		c.order.MoveToFront(element)
+		return
+	}
+	c.entries[code] = c.order.PushFront(&cachedLink{code, rec, now})
+	if c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cachedLink).code)
+	}
+}
+
+// Forget the record of a code
+func (c *linkCache) invalidate(code string) {
+	c.Lock()
+	defer c.Unlock()
+	if element, ok := c.entries[code]; ok {
+		c.order.Remove(element)
+		delete(c.entries, code)
+	}
+}
+
+// Read the record of a code for a redirect, from the cache if it is enabled
+func readForRedirect(ctx context.Context, code string, limit int64) (*storedLink, error) {
+	if redirectCache == nil {
+		return linkStorage.read(ctx, code, limit)
+	}
+	ctx, span := tracer.Start(ctx, "readForRedirect")
+	defer span.End()
+	now := time.Now()
+	if rec := redirectCache.get(code, now); rec != nil {
+		span.SetAttributes(attribute.Bool("cached", true))
+		return rec, nil
+	}
+	rec, err := linkStorage.read(ctx, code, limit)
+	if err != nil {
+		return nil, err
+	}
+	redirectCache.put(code, rec, now)
+	return rec, nil
+}
+
+// struct invalidatingLinkStore drops cached records of the codes written or deleted through it.
+type invalidatingLinkStore struct {
+	linkStore
+	cache *linkCache
+}
+
+func (s invalidatingLinkStore) write(ctx context.Context, code string, data []byte, generation int64) error {
+	err := s.linkStore.write(ctx, code, data, generation)
+	s.cache.invalidate(code)
+	return err
+}
+
+func (s invalidatingLinkStore) delete(ctx context.Context, code string) error {
+	err := s.linkStore.delete(ctx, code)
+	s.cache.invalidate(code)
+	return err
+}
@@ -0,0 +1,586 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// Objects of domain claims, named after the claimed domain
+const claimPrefix = "claims/"
+
+// Where domain owners publish the verification value of a claim
+const (
+	// Prefix of the DNS TXT record on the claimed domain
+	claimRecordPrefix = "urly-wurly-verification="
+	// Path of the file served over HTTPS by the claimed domain
+	claimFilePath = "/.well-known/urly-wurly-verification.txt"
+)
+
+// Lifetimes of claims
+const (
+	// How long an unverified claim keeps others from claiming the domain
+	claimPendingTTL = 24 * time.Hour
+	// How long instances trust a claim read before
+	claimCacheTTL = time.Minute
+	// Domains remembered, the cache starts over beyond that
+	maxCachedClaims = 10000
+)
+
+// Machine readable reason of destinations rejected by the policy of a domain claim
+const errDomainClaimed = "domain_claimed"
+
+// Domains which can be claimed, at least one dot and no wildcards
+var claimDomainPattern = regexp.MustCompile(`^([a-z0-9]([a-z0-9-]*[a-z0-9])?\.)+[a-z0-9-]{2,}$`)
+
+// Claims read recently, nil for unclaimed domains
+var claims = struct {
+	sync.Mutex
+	entries map[string]*domainClaim
+	fetched map[string]time.Time
+}{entries: map[string]*domainClaim{}, fetched: map[string]time.Time{}}
+
+// struct domainClaim is the claim of a destination domain by its owner.
+type domainClaim struct {
+	Domain string `json:"domain"`
+	// Contact of whoever claimed the domain
+	Contact string `json:"contact,omitempty"`
+	// Value to publish in DNS or the well-known file
+	Verification string    `json:"verification"`
+	Created      time.Time `json:"created"`
+	// Time ownership was verified, nil while pending
+	Verified *time.Time `json:"verified,omitempty"`
+	// How ownership was verified, "dns" or "file"
+	Method string `json:"method,omitempty"`
+	// Policy: only the claimant may create links to the domain
+	BlockNewLinks bool `json:"block_new_links"`
+}
+
+// struct claimRequest starts a claim.
+type claimRequest struct {
+	Domain  string `json:"domain"`
+	Contact string `json:"contact"`
+}
+
+// struct claimPolicy holds the policies a claimant may set.
+type claimPolicy struct {
+	BlockNewLinks bool `json:"block_new_links"`
+}
+
+// struct claimResponse describes a claim along with how to verify it.
+type claimResponse struct {
+	response
+	Claim domainClaim `json:"claim"`
+	// Bearer token for managing the claim and the links to the domain, only returned on creation
+	Token string `json:"token,omitempty"`
+	// TXT record to add to the domain, while pending
+	DNSRecord string `json:"dns_record,omitempty"`
+	// URL to serve the verification value at, while pending
+	FileURL string `json:"file_url,omitempty"`
+}
+
+// struct claimLinksResponse lists the links pointing at a claimed domain.
+type claimLinksResponse struct {
+	response
+	Domain string       `json:"domain"`
+	Links  []listedLink `json:"links"`
+}
+
+// Object of a domain's claim
+func claimObject(domain string) string {
+	return claimPrefix + domain + ".json"
+}
+
+// Subject signed for the token of a claim, which a new claim of the same domain invalidates
+func claimSubject(c *domainClaim) string {
+	return fmt.Sprintf("claim:%s:%d", c.Domain, c.Created.UnixNano())
+}
+
+// Normalize a domain to claim, empty if it can't be claimed
+func claimDomain(raw string) string {
+	domain := strings.TrimSuffix(strings.ToLower(strings.TrimSpace(raw)), ".")
+	if !claimDomainPattern.MatchString(domain) || domain == ownHost() {
+		return ""
+	}
+	return domain
+}
+
+// Describe a claim, with the verification instructions while it is pending
+func describeClaim(c *domainClaim, message string) claimResponse {
+	resp := claimResponse{response: response{"", message}, Claim: *c}
+	if c.Verified == nil {
+		resp.DNSRecord = claimRecordPrefix + c.Verification
+		resp.FileURL = "https://" + c.Domain + claimFilePath
+	}
+	return resp
+}
+
+// Read the claim of a domain, from memory if it was read within claimCacheTTL. Returns nil for unclaimed domains.
+func readClaim(ctx context.Context, domain string) (*domainClaim, error) {
+	claims.Lock()
+	c, ok := claims.entries[domain]
+	fresh := time.Since(claims.fetched[domain]) < claimCacheTTL
+	claims.Unlock()
+	if ok && fresh {
+		return c, nil
+	}
+	data, _, err := gcsReadBlob(ctx, claimObject(domain))
+	if err != nil && err != storage.ErrObjectNotExist {
+		return nil, err
+	}
+	c = nil
+	if err == nil {
+		c = &domainClaim{}
+		err = json.Unmarshal(data, c)
+		if err != nil {
+			return nil, err
+		}
+	}
+	claims.Lock()
+	if len(claims.entries) >= maxCachedClaims {
+		claims.entries = map[string]*domainClaim{}
+		claims.fetched = map[string]time.Time{}
+	}
+	claims.entries[domain] = c
+	claims.fetched[domain] = time.Now()
+	claims.Unlock()
+	return c, nil
+}
+
+// Forget a cached claim after changing it
+func forgetClaim(domain string) {
+	claims.Lock()
+	delete(claims.entries, domain)
+	delete(claims.fetched, domain)
+	claims.Unlock()
+}
+
+// Verified claim covering the host of a destination, claims of parent domains included.
+// Nil if there is none or claims can't be read, so an outage doesn't stop shortening.
+func claimOf(ctx context.Context, destination string) *domainClaim {
+	uri, err := url.Parse(destination)
+	if err != nil || uri.Host == "" {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(uri.Hostname()), ".")
+	for strings.Contains(host, ".") {
+		c, err := readClaim(ctx, host)
+		if err != nil {
+			slog.Error("unable to read claim", "domain", host, "err", err)
+			return nil
+		}
+		if c != nil && c.Verified != nil {
+			return c
+		}
+		host = host[strings.Index(host, ".")+1:]
+	}
+	return nil
+}
+
+// Report whether a bearer token is the token of a claim
+func holdsClaim(c *domainClaim, token string) bool {
+	return token != "" && verifySignature(claimSubject(c), token)
+}
+
+// Domain of the first destination whose claim keeps others from linking to it, empty if none.
+// The token of the claim lifts the policy.
+func blockedByClaim(ctx context.Context, token string, destinations ...string) string {
+	for _, destination := range destinations {
+		if c := claimOf(ctx, destination); c != nil && c.BlockNewLinks && !holdsClaim(c, token) {
+			return c.Domain
+		}
+	}
+	return ""
+}
+
+// Response rejecting a destination on a domain whose owner blocks new links
+func domainClaimedFailure(domain string) shortenResponse {
+	message := fmt.Sprintf("the owner of %s only allows links created with their claim token!", domain)
+	return shortenResponse{response: response{"", message}, Error: errDomainClaimed}
+}
+
+// Read the claim named in the route for its claimant, responding and returning false unless
+// the request carries the admin or claim token
+func requireClaimant(ctx context.Context, w http.ResponseWriter, r *http.Request) (*domainClaim, bool) {
+	domain := claimDomain(mux.Vars(r)["domain"])
+	if domain == "" {
+		respond(ctx, response{"", "invalid domain!"}, http.StatusBadRequest, w)
+		return nil, false
+	}
+	c, err := readClaim(ctx, domain)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return nil, false
+	}
+	if c == nil {
+		respond(ctx, response{"", "unable to find claim!"}, http.StatusNotFound, w)
+		return nil, false
+	}
+	if isAdmin(r) {
+		return c, true
+	}
+	supplied := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if supplied == "" {
+		unauthorized(ctx, w, "claim", authRequired, "claim token required!")
+		return nil, false
+	}
+	if !holdsClaim(c, supplied) {
+		forbidden(ctx, w, "token doesn't grant access to this claim!")
+		return nil, false
+	}
+	return c, true
+}
+
+// Like requireClaimant, but also responds and returns false if the claim isn't verified yet
+func requireVerifiedClaim(ctx context.Context, w http.ResponseWriter, r *http.Request) (*domainClaim, bool) {
+	c, ok := requireClaimant(ctx, w, r)
+	if ok && c.Verified == nil {
+		forbidden(ctx, w, "ownership of the domain isn't verified yet!")
+		return nil, false
+	}
+	return c, ok
+}
+
+// Change a claim with a read/modify/write cycle, failing if it was replaced or removed in the meantime
+func updateClaim(ctx context.Context, c *domainClaim, modify func(c *domainClaim)) (*domainClaim, error) {
+	ctx, span := tracer.Start(ctx, "updateClaim")
+	defer span.End()
+	defer forgetClaim(c.Domain)
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		content, generation, err := gcsReadGeneration(ctx, claimObject(c.Domain))
+		if err != nil {
+			return nil, err
+		}
+		current := &domainClaim{}
+		err = json.Unmarshal([]byte(content), current)
+		if err != nil {
+			return nil, err
+		}
+		if !current.Created.Equal(c.Created) {
+			return nil, storage.ErrObjectNotExist
+		}
+		modify(current)
+		marshalled, err := json.Marshal(current)
+		if err != nil {
+			return nil, err
+		}
+		err = gcsWriteIfGeneration(ctx, claimObject(c.Domain), "application/json", marshalled, generation)
+		if err == nil {
+			return current, nil
+		}
+		if !isPreconditionFailed(err) {
+			return nil, err
+		}
+	}
+	return nil, fmt.Errorf("claim of %s kept changing, giving up", c.Domain)
+}
+
+// Look for the verification value of a claim in DNS, then in the well-known file.
+// Returns the method which found it, empty if neither did.
+func findVerification(ctx context.Context, c *domainClaim) string {
+	ctx, span := tracer.Start(ctx, "findVerification")
+	defer span.End()
+	records, err := net.DefaultResolver.LookupTXT(ctx, c.Domain)
+	if err == nil {
+		for _, record := range records {
+			if strings.TrimSpace(record) == claimRecordPrefix+c.Verification {
+				return "dns"
+			}
+		}
+	}
+	body, _, err := safeFetch(ctx, "https://"+c.Domain+claimFilePath, 1024)
+	if err == nil && strings.TrimSpace(string(body)) == c.Verification {
+		return "file"
+	}
+	return ""
+}
+
+// POST handler starting the claim of a domain with {"domain", "contact"}. Returns the claim token,
+// which is only shown once, along with the DNS record or file proving ownership. A domain can't be
+// claimed again while it has a verified claim or one pending for less than a day (admins may replace those).
+func createClaimHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "createClaimHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if config.SigningSecret == "" {
+		respond(ctx, response{"", "domain claims need a signing secret!"}, http.StatusNotImplemented, w)
+		return
+	}
+	req := claimRequest{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		respond(ctx, response{"", "unable to decode request body!"}, http.StatusBadRequest, w)
+		return
+	}
+	domain := claimDomain(req.Domain)
+	if domain == "" {
+		respond(ctx, response{"", "invalid domain!"}, http.StatusBadRequest, w)
+		return
+	}
+	content, generation, err := gcsReadGeneration(ctx, claimObject(domain))
+	if err != nil && err != storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if err == nil {
+		existing := domainClaim{}
+		if json.Unmarshal([]byte(content), &existing) == nil {
+			if existing.Verified != nil && !isAdmin(r) {
+				respond(ctx, response{"", "domain is claimed already!"}, http.StatusConflict, w)
+				return
+			}
+			if clock().Sub(existing.Created) < claimPendingTTL && !isAdmin(r) {
+				respond(ctx, response{"", "a claim of this domain is pending verification, try again later!"}, http.StatusConflict, w)
+				return
+			}
+		}
+	}
+
+	random := make([]byte, 16)
+	_, err = rand.Read(random)
+	if err != nil {
+		respond(ctx, response{"", "unable to start claim!"}, http.StatusInternalServerError, w)
+		return
+	}
+	c := &domainClaim{Domain: domain, Contact: strings.TrimSpace(req.Contact), Verification: hex.EncodeToString(random), Created: clock().UTC()}
+	marshalled, err := json.Marshal(c)
+	if err == nil {
+		err = gcsWriteIfGeneration(ctx, claimObject(domain), "application/json", marshalled, generation)
+	}
+	if isPreconditionFailed(err) {
+		respond(ctx, response{"", "domain was claimed at the same time, try again!"}, http.StatusConflict, w)
+		return
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	forgetClaim(domain)
+	resp := describeClaim(c, "claim started, publish the dns_record or serve the verification at file_url, then verify!")
+	resp.Token = sign(claimSubject(c))
+	respond(ctx, resp, http.StatusOK, w)
+}
+
+// Handler of a claim for its claimant or admins: GET describes it, DELETE withdraws it
+func claimHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "claimHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := requireClaimant(ctx, w, r)
+	if !ok {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		err := gcsDelete(ctx, claimObject(c.Domain))
+		forgetClaim(c.Domain)
+		if err != nil && err != storage.ErrObjectNotExist {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(ctx, response{"", "claim withdrawn!"}, http.StatusOK, w)
+		return
+	}
+	respond(ctx, describeClaim(c, ""), http.StatusOK, w)
+}
+
+// POST handler verifying ownership of a claimed domain through its DNS record or well-known file
+func verifyClaimHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "verifyClaimHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := requireClaimant(ctx, w, r)
+	if !ok {
+		return
+	}
+	if c.Verified != nil {
+		respond(ctx, describeClaim(c, "domain verified already!"), http.StatusOK, w)
+		return
+	}
+	method := findVerification(ctx, c)
+	if method == "" {
+		respond(ctx, describeClaim(c, "unable to find the verification in DNS or at file_url!"), http.StatusBadRequest, w)
+		return
+	}
+	c, err := updateClaim(ctx, c, func(c *domainClaim) {
+		now := clock().UTC()
+		c.Verified = &now
+		c.Method = method
+	})
+	if err == storage.ErrObjectNotExist {
+		respond(ctx, response{"", "claim was withdrawn or replaced!"}, http.StatusConflict, w)
+		return
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	slog.Info("claim verified", "domain", c.Domain, "method", method)
+	respond(ctx, describeClaim(c, "domain verified!"), http.StatusOK, w)
+}
+
+// PUT handler setting the policies of a verified claim, {"block_new_links"}
+func claimPolicyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "claimPolicyHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := requireVerifiedClaim(ctx, w, r)
+	if !ok {
+		return
+	}
+	policy := claimPolicy{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&policy)
+	if err != nil {
+		respond(ctx, response{"", "unable to decode request body!"}, http.StatusBadRequest, w)
+		return
+	}
+	c, err = updateClaim(ctx, c, func(c *domainClaim) {
+		c.BlockNewLinks = policy.BlockNewLinks
+	})
+	if err == storage.ErrObjectNotExist {
+		respond(ctx, response{"", "claim was withdrawn or replaced!"}, http.StatusConflict, w)
+		return
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	respond(ctx, describeClaim(c, "policy updated!"), http.StatusOK, w)
+}
+
+// Report whether a link points at a claimed domain or one of its subdomains
+func linkOnDomain(l *link, domain string) bool {
+	uri, err := url.Parse(l.URL)
+	if err != nil {
+		return false
+	}
+	return domainMatches(strings.TrimSuffix(strings.ToLower(uri.Hostname()), "."), domain)
+}
+
+// GET handler listing the links pointing at a verified claim's domain, for its claimant or admins
+func claimLinksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "claimLinksHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := requireVerifiedClaim(ctx, w, r)
+	if !ok {
+		return
+	}
+	resp := claimLinksResponse{Domain: c.Domain, Links: []listedLink{}}
+	err := linkStorage.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil || !linkOnDomain(l, c.Domain) {
+			return nil
+		}
+		listed := describeLink(code, l)
+		resp.Links = append(resp.Links, listed)
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	resp.Message = fmt.Sprintf("%d links", len(resp.Links))
+	respond(ctx, resp, http.StatusOK, w)
+}
+
+// DELETE handler taking down a link pointing at a verified claim's domain, for its claimant or admins
+func claimTakedownHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "claimTakedownHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	c, ok := requireVerifiedClaim(ctx, w, r)
+	if !ok {
+		return
+	}
+	code := mux.Vars(r)["id"]
+	l, err := readLink(ctx, code)
+	if err == storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if !linkOnDomain(l, c.Domain) {
+		forbidden(ctx, w, "link doesn't point at "+c.Domain+"!")
+		return
+	}
+	err = deleteLink(ctx, code, false)
+	if err != nil && err != storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	slog.Warn("link taken down by claimant", "code", code, "domain", c.Domain)
+	respond(ctx, response{shortLink(code), "link taken down!"}, http.StatusOK, w)
+}
+
+// Admin handler for domain claims: GET lists them, newest first. DELETE ?domain= revokes one.
+func claimsAdminHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "claimsAdminHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		domain := claimDomain(r.URL.Query().Get("domain"))
+		if domain == "" {
+			respond(ctx, response{"", "invalid domain!"}, http.StatusBadRequest, w)
+			return
+		}
+		err := gcsDelete(ctx, claimObject(domain))
+		forgetClaim(domain)
+		if err == storage.ErrObjectNotExist {
+			respond(ctx, response{"", "unable to find claim!"}, http.StatusNotFound, w)
+			return
+		}
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(ctx, response{"", "claim revoked!"}, http.StatusOK, w)
+		return
+	}
+	found := []domainClaim{}
+	err := gcsListPrefix(ctx, claimPrefix, func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			// Withdrawn while listing
+			return nil
+		}
+		c := domainClaim{}
+		if json.Unmarshal(data, &c) == nil {
+			found = append(found, c)
+		}
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].Created.After(found[j].Created) })
+	respond(ctx, found, http.StatusOK, w)
+}
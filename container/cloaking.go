@@ -0,0 +1,305 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"html"
+	"log/slog"
+	"math/bits"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Settings of the destination change detection
+const (
+	// Bytes of a destination read for its fingerprint
+	fingerprintLimit = 512 << 10
+	// Default clicks within a day that make a link worth re-checking
+	defaultCloakingMinClicks = 100
+	// Default number of differing simhash bits from which content counts as replaced
+	defaultCloakingDistance = 24
+)
+
+// Patterns used to reduce a page to its visible words
+var (
+	invisibleBlocks = regexp.MustCompile(`(?is)<(script|style|noscript)[^>]*>.*?</(script|style|noscript)>`)
+	markupTags      = regexp.MustCompile(`(?s)<[^>]*>`)
+	pageTitle       = regexp.MustCompile(`(?is)<title[^>]*>(.*?)</title>`)
+	words           = regexp.MustCompile(`[\pL\pN]+`)
+)
+
+// struct fingerprint summarises what a destination served at some point in time.
+type fingerprint struct {
+	// Destination which was fetched
+	URL string `json:"url"`
+	// Time of the fetch
+	Fetched time.Time `json:"fetched"`
+	// Media type of the response, without parameters
+	ContentType string `json:"content_type"`
+	// Title of HTML pages
+	Title string `json:"title,omitempty"`
+	// Number of visible words
+	Words int `json:"words"`
+	// Locality sensitive hash of the visible text, similar pages differ in few bits
+	Simhash uint64 `json:"simhash"`
+}
+
+// struct destinationChange records a link whose destination no longer serves what it did at creation.
+type destinationChange struct {
+	// Short code of the affected link
+	Code string `json:"code"`
+	// Clicks of the link in the day before the check
+	Clicks int64 `json:"clicks"`
+	// Fingerprint taken at creation
+	Baseline fingerprint `json:"baseline"`
+	// Fingerprint taken at the check
+	Current fingerprint `json:"current"`
+	// Differing simhash bits (out of 64)
+	Distance int `json:"distance"`
+	// Why the change counts as drastic
+	Reasons []string `json:"reasons"`
+	// Time the change was detected
+	Detected time.Time `json:"detected"`
+}
+
+// Name of the GCS object holding the creation fingerprint of a link
+func fingerprintObject(code string) string {
+	return "fingerprints/" + code + ".json"
+}
+
+// Name of the GCS object recording a drastic destination change for review
+func destinationChangeObject(code string) string {
+	return "cloaking/" + code + ".json"
+}
+
+// Whether destinations are fingerprinted and re-checked, enabled by CLOAKING_INTERVAL
+func cloakingEnabled() bool {
+	return config.CloakingInterval > 0
+}
+
+// Fetch a destination and fingerprint its content
+func takeFingerprint(ctx context.Context, destination string) (*fingerprint, error) {
+	ctx, span := tracer.Start(ctx, "takeFingerprint")
+	defer span.End()
+	body, contentType, err := safeFetch(ctx, destination, fingerprintLimit)
+	if err != nil {
+		return nil, err
+	}
+	f := &fingerprint{URL: destination, Fetched: clock().UTC()}
+	f.ContentType, _, _ = mime.ParseMediaType(contentType)
+	text := string(body)
+	if f.ContentType == "text/html" {
+		if match := pageTitle.FindStringSubmatch(text); match != nil {
+			f.Title = strings.TrimSpace(html.UnescapeString(match[1]))
+		}
+		text = html.UnescapeString(markupTags.ReplaceAllString(invisibleBlocks.ReplaceAllString(text, " "), " "))
+	}
+	tokens := words.FindAllString(strings.ToLower(text), -1)
+	f.Words = len(tokens)
+	f.Simhash = simhash(tokens)
+	return f, nil
+}
+
+// Simhash over word trigrams
+func simhash(tokens []string) uint64 {
+	var weights [64]int
+	for start := 0; start < len(tokens); start++ {
+		end := start + 3
+		if end > len(tokens) {
+			end = len(tokens)
+		}
+		h := fnv.New64a()
+		h.Write([]byte(strings.Join(tokens[start:end], " ")))
+		sum := h.Sum64()
+		for bit := uint(0); bit < 64; bit++ {
+			if sum&(1<<bit) != 0 {
+				weights[bit]++
+			} else {
+				weights[bit]--
+			}
+		}
+		if end == len(tokens) {
+			break
+		}
+	}
+	var hash uint64
+	for bit, weight := range weights {
+		if weight > 0 {
+			hash |= 1 << uint(bit)
+		}
+	}
+	return hash
+}
+
+// Fingerprint a new link's destination as baseline for later checks, run as a background task
+func captureFingerprint(ctx context.Context, code string, destination string) error {
+	ctx, span := tracer.Start(ctx, "captureFingerprint")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+	f, err := takeFingerprint(ctx, destination)
+	recordFetchOutcome(ctx, destinationDomain(destination), err == nil)
+	if err != nil {
+		return fmt.Errorf("fingerprint %s: %v", code, err)
+	}
+	return writeFingerprint(ctx, code, f)
+}
+
+// Store the baseline fingerprint of a link
+func writeFingerprint(ctx context.Context, code string, f *fingerprint) error {
+	marshalled, err := json.Marshal(f)
+	if err != nil {
+		return err
+	}
+	return gcsWriteBlob(ctx, fingerprintObject(code), "application/json", marshalled)
+}
+
+// Compare two fingerprints and return the reasons for considering the change drastic
+func compareFingerprints(baseline *fingerprint, current *fingerprint, threshold int) (int, []string) {
+	distance := bits.OnesCount64(baseline.Simhash ^ current.Simhash)
+	reasons := []string{}
+	if baseline.ContentType != current.ContentType {
+		reasons = append(reasons, "content type changed from "+baseline.ContentType+" to "+current.ContentType)
+	}
+	if distance >= threshold {
+		reasons = append(reasons, "text changed in "+strconv.Itoa(distance)+" of 64 simhash bits")
+	}
+	if baseline.Title != "" && current.Title != "" && !strings.EqualFold(baseline.Title, current.Title) && distance >= threshold/2 {
+		reasons = append(reasons, "title changed from "+strconv.Quote(baseline.Title)+" to "+strconv.Quote(current.Title))
+	}
+	return distance, reasons
+}
+
+// Re-check destinations of busy links every CLOAKING_INTERVAL on one instance.
+// Links need CLOAKING_MIN_CLICKS clicks in the last day, CLOAKING_DISTANCE tunes the sensitivity.
+func startCloakingDetector() {
+	interval := config.CloakingInterval
+	if interval <= 0 {
+		return
+	}
+	minClicks := int64(config.CloakingMinClicks)
+	if minClicks <= 0 {
+		minClicks = defaultCloakingMinClicks
+	}
+	distance := config.CloakingDistance
+	if distance <= 0 || distance > 64 {
+		distance = defaultCloakingDistance
+	}
+	startSingleton("cloaking-detector", interval, func(ctx context.Context) error {
+		return checkDestinations(ctx, minClicks, distance)
+	})
+}
+
+// Re-fingerprint the destinations of busy links and record drastic changes
+func checkDestinations(ctx context.Context, minClicks int64, threshold int) error {
+	ctx, span := tracer.Start(ctx, "checkDestinations")
+	defer span.End()
+	now := clock().UTC()
+	return linkStorage.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil || !l.Consumed.IsZero() || l.expired(now) || !l.webDestination() {
+			return nil
+		}
+		summary, err := summarizeClicks(ctx, code, now.Add(-24*time.Hour), now)
+		if err != nil {
+			return err
+		}
+		if summary.Clicks < minClicks {
+			return nil
+		}
+		fetchCtx, cancel := context.WithTimeout(ctx, 30*time.Second)
+		current, err := takeFingerprint(fetchCtx, l.URL)
+		cancel()
+		recordFetchOutcome(ctx, destinationDomain(l.URL), err == nil)
+		if err != nil {
+			slog.Error("unable to fingerprint destination", "code", code, "err", err)
+			return nil
+		}
+		data, _, err := gcsReadBlob(ctx, fingerprintObject(code))
+		if err == storage.ErrObjectNotExist {
+			// Links from before fingerprinting get their baseline now
+			return writeFingerprint(ctx, code, current)
+		}
+		if err != nil {
+			return err
+		}
+		baseline := &fingerprint{}
+		err = json.Unmarshal(data, baseline)
+		if err != nil || baseline.URL != l.URL {
+			return writeFingerprint(ctx, code, current)
+		}
+		distance, reasons := compareFingerprints(baseline, current, threshold)
+		if len(reasons) == 0 {
+			return nil
+		}
+		slog.Warn("destination changed drastically", "code", code, "reasons", strings.Join(reasons, ", "))
+		marshalled, err := json.Marshal(destinationChange{code, summary.Clicks, *baseline, *current, distance, reasons, now})
+		if err != nil {
+			return err
+		}
+		return gcsWriteBlob(ctx, destinationChangeObject(code), "application/json", marshalled)
+	})
+}
+
+// GET handler listing links whose destinations changed drastically, most recent first.
+// DELETE with ?code= dismisses a reviewed change and accepts the current content as new baseline.
+func cloakingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "cloakingHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		code := r.URL.Query().Get("code")
+		data, _, err := gcsReadBlob(ctx, destinationChangeObject(code))
+		if err != nil {
+			respond(ctx, response{"", "no change recorded for this code!"}, http.StatusNotFound, w)
+			return
+		}
+		change := destinationChange{}
+		err = json.Unmarshal(data, &change)
+		if err == nil {
+			err = writeFingerprint(ctx, code, &change.Current)
+		}
+		if err == nil {
+			err = gcsDelete(ctx, destinationChangeObject(code))
+		}
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(ctx, response{shortLink(code), "change dismissed!"}, http.StatusOK, w)
+		return
+	}
+
+	changes := []destinationChange{}
+	err := gcsListPrefix(ctx, "cloaking/", func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			return err
+		}
+		change := destinationChange{}
+		if json.Unmarshal(data, &change) != nil {
+			return nil
+		}
+		changes = append(changes, change)
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Detected.After(changes[j].Detected) })
+	respond(ctx, changes, http.StatusOK, w)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Formats of the logs read
+const (
+	formatAuto         = "auto"
+	formatCloudLogging = "cloudlogging"
+	formatCombined     = "combined"
+	formatClicks       = "clicks"
+)
+
+// Lines not holding a request, e.g. log entries of the application itself
+var errNoRequest = errors.New("no request")
+
+// struct request is a recorded request to replay.
+type request struct {
+	Time   time.Time
+	Method string
+	// Path and query, without scheme and host
+	Path      string
+	Referer   string
+	UserAgent string
+	// Status answered originally, 0 if unknown
+	Status int
+}
+
+// struct logEntry is the part of a Cloud Logging entry describing a request, as exported by sinks
+// or by gcloud logging read --format=json (run.googleapis.com/requests).
+type logEntry struct {
+	Timestamp   time.Time `json:"timestamp"`
+	HTTPRequest *struct {
+		RequestMethod string `json:"requestMethod"`
+		RequestURL    string `json:"requestUrl"`
+		Status        int    `json:"status"`
+		UserAgent     string `json:"userAgent"`
+		Referer       string `json:"referer"`
+	} `json:"httpRequest"`
+}
+
+// struct clickRow is a row of the BigQuery click export, extracted as newline-delimited JSON.
+type clickRow struct {
+	Code      string `json:"code"`
+	Timestamp string `json:"timestamp"`
+	// Host of the referring page
+	Referrer  string `json:"referrer"`
+	UserAgent string `json:"user_agent"`
+}
+
+// Layouts of timestamps in click rows, BigQuery extracts them in the first one
+var clickTimeLayouts = []string{"2006-01-02 15:04:05.999999 MST", "2006-01-02 15:04:05 MST", time.RFC3339Nano}
+
+// Line of the combined log format of Apache and nginx
+var combinedPattern = regexp.MustCompile(`^\S+ \S+ \S+ \[([^\]]+)\] "(\S+) (\S+)[^"]*" (\d{3}) \S+(?: "([^"]*)" "([^"]*)")?`)
+
+// Time layout of the combined log format
+const combinedTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+// Guess the format of a log from its first line
+func detectFormat(line string) string {
+	switch {
+	case !strings.HasPrefix(line, "{"):
+		return formatCombined
+	case strings.Contains(line, `"httpRequest"`):
+		return formatCloudLogging
+	}
+	return formatClicks
+}
+
+// Parse a line of a log in a format
+func parseLine(format string, line string) (request, error) {
+	switch format {
+	case formatCloudLogging:
+		return parseLogEntry([]byte(line))
+	case formatClicks:
+		return parseClickRow([]byte(line))
+	}
+	return parseCombined(line)
+}
+
+func parseLogEntry(data []byte) (request, error) {
+	entry := logEntry{}
+	err := json.Unmarshal(data, &entry)
+	if err != nil {
+		return request{}, err
+	}
+	if entry.HTTPRequest == nil {
+		return request{}, errNoRequest
+	}
+	target, err := url.Parse(entry.HTTPRequest.RequestURL)
+	if err != nil {
+		return request{}, err
+	}
+	return request{
+		Time:      entry.Timestamp,
+		Method:    entry.HTTPRequest.RequestMethod,
+		Path:      target.RequestURI(),
+		Referer:   entry.HTTPRequest.Referer,
+		UserAgent: entry.HTTPRequest.UserAgent,
+		Status:    entry.HTTPRequest.Status,
+	}, nil
+}
+
+func parseClickRow(data []byte) (request, error) {
+	row := clickRow{}
+	err := json.Unmarshal(data, &row)
+	if err != nil {
+		return request{}, err
+	}
+	if row.Code == "" {
+		return request{}, errNoRequest
+	}
+	r := request{Method: "GET", Path: "/" + url.PathEscape(row.Code), UserAgent: row.UserAgent}
+	for _, layout := range clickTimeLayouts {
+		r.Time, err = time.Parse(layout, row.Timestamp)
+		if err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return request{}, err
+	}
+	if row.Referrer != "" {
+		// Only the host was exported
+		r.Referer = "https://" + row.Referrer + "/"
+	}
+	return r, nil
+}
+
+func parseCombined(line string) (request, error) {
+	match := combinedPattern.FindStringSubmatch(line)
+	if match == nil {
+		return request{}, errNoRequest
+	}
+	at, err := time.Parse(combinedTimeLayout, match[1])
+	if err != nil {
+		return request{}, err
+	}
+	status, _ := strconv.Atoi(match[4])
+	r := request{Time: at, Method: match[2], Path: match[3], Status: status, UserAgent: match[6]}
+	if match[5] != "-" {
+		r.Referer = match[5]
+	}
+	if r.UserAgent == "-" {
+		r.UserAgent = ""
+	}
+	return r, nil
+}
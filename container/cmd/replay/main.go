@@ -0,0 +1,374 @@
+// Command replay sends recorded traffic to a staging instance of urly-wurly, keeping the original pace
+// or a multiple of it, and compares the statuses it gets with the recorded ones.
+//
+//	replay -target https://staging.example.com -speed 2 requests.json
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Longest line read from a log
+const maxLineSize = 1 << 20
+
+// Time between two progress reports
+const progressInterval = 10 * time.Second
+
+// Mismatching requests listed in the report
+const maxListedMismatches = 20
+
+// Headers added to every request, -header can be passed several times
+type headerFlags []string
+
+func (h *headerFlags) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerFlags) Set(value string) error {
+	if !strings.Contains(value, ":") {
+		return fmt.Errorf("header %q should look like Name: value", value)
+	}
+	*h = append(*h, value)
+	return nil
+}
+
+// struct replay holds the settings of a replay and what it found.
+type replay struct {
+	target  *url.URL
+	client  *http.Client
+	headers http.Header
+	methods map[string]bool
+	speed   float64
+	slots   chan struct{}
+
+	sync.Mutex
+	sent       int
+	skipped    int
+	late       int
+	failed     int
+	statuses   map[int]int
+	mismatches []string
+	mismatched int
+	latencies  []time.Duration
+}
+
+func main() {
+	target := flag.String("target", "", "base URL of the instance receiving the traffic, e.g. https://staging.example.com")
+	format := flag.String("format", formatAuto, "format of the logs: cloudlogging, combined, clicks or auto")
+	speed := flag.Float64("speed", 1, "multiple of the recorded pace, 0 sends as fast as -concurrency allows")
+	concurrency := flag.Int("concurrency", 50, "requests in flight at most")
+	timeout := flag.Duration("timeout", 10*time.Second, "time a request may take")
+	limit := flag.Int("limit", 0, "stop after this many requests, 0 for all")
+	methods := flag.String("methods", "GET,HEAD", "methods replayed, others are skipped since logs hold no bodies")
+	headers := headerFlags{}
+	flag.Var(&headers, "header", "header added to every request, e.g. 'Authorization: Bearer ...' (repeatable)")
+	flag.Parse()
+
+	base, err := url.Parse(*target)
+	if err != nil || (base.Scheme != "http" && base.Scheme != "https") || base.Host == "" {
+		log.Fatal("-target must be an http(s) URL")
+	}
+	switch *format {
+	case formatAuto, formatCloudLogging, formatCombined, formatClicks:
+	default:
+		log.Fatalf("unknown -format %q", *format)
+	}
+	if *speed < 0 || *concurrency <= 0 {
+		log.Fatal("-speed must not be negative and -concurrency must be positive")
+	}
+
+	r := &replay{
+		target:   base,
+		headers:  http.Header{},
+		methods:  map[string]bool{},
+		speed:    *speed,
+		slots:    make(chan struct{}, *concurrency),
+		statuses: map[int]int{},
+		client: &http.Client{
+			Timeout:   *timeout,
+			Transport: &http.Transport{Proxy: http.ProxyFromEnvironment, MaxIdleConnsPerHost: *concurrency},
+			// Redirects are what is being replayed, not followed
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}
+	for _, header := range headers {
+		parts := strings.SplitN(header, ":", 2)
+		r.headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	}
+	for _, method := range strings.Split(*methods, ",") {
+		r.methods[strings.ToUpper(strings.TrimSpace(method))] = true
+	}
+
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	started := time.Now()
+	err = r.run(files, *format, *limit, stop)
+	if err != nil {
+		log.Printf("stopped reading: %v", err)
+	}
+	// Let requests in flight finish
+	for i := 0; i < cap(r.slots); i++ {
+		r.slots <- struct{}{}
+	}
+	if !r.report(os.Stdout, time.Since(started)) {
+		os.Exit(1)
+	}
+}
+
+// Replay the requests of all files, one after another, until the limit or a signal
+func (r *replay) run(files []string, format string, limit int, stop chan os.Signal) error {
+	var first time.Time
+	start := time.Now()
+	progress := time.NewTicker(progressInterval)
+	defer progress.Stop()
+	count := 0
+	for _, name := range files {
+		err := readRequests(name, format, func(req request) error {
+			select {
+			case sig := <-stop:
+				return fmt.Errorf("received %v", sig)
+			case <-progress.C:
+				r.Lock()
+				log.Printf("sent %d requests, %d skipped, %d late", r.sent, r.skipped, r.late)
+				r.Unlock()
+			default:
+			}
+			if !r.methods[req.Method] {
+				r.Lock()
+				r.skipped++
+				r.Unlock()
+				return nil
+			}
+			if limit > 0 && count >= limit {
+				return io.EOF
+			}
+			count++
+			if first.IsZero() {
+				first = req.Time
+			}
+			if r.speed > 0 {
+				due := start.Add(time.Duration(float64(req.Time.Sub(first)) / r.speed))
+				if wait := time.Until(due); wait > 0 {
+					select {
+					case sig := <-stop:
+						return fmt.Errorf("received %v", sig)
+					case <-time.After(wait):
+					}
+				}
+			}
+			r.send(req)
+			return nil
+		})
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Send a request once a slot is free, counting it as late if that took long enough to distort the pace
+func (r *replay) send(req request) {
+	waiting := time.Now()
+	r.slots <- struct{}{}
+	late := r.speed > 0 && time.Since(waiting) > 100*time.Millisecond
+	go func() {
+		defer func() { <-r.slots }()
+		status, latency, err := r.do(req)
+		r.Lock()
+		defer r.Unlock()
+		r.sent++
+		if late {
+			r.late++
+		}
+		if err != nil {
+			r.failed++
+			log.Printf("%s %s: %v", req.Method, req.Path, err)
+			return
+		}
+		r.statuses[status]++
+		r.latencies = append(r.latencies, latency)
+		if req.Status != 0 && req.Status != status {
+			r.mismatched++
+			if len(r.mismatches) < maxListedMismatches {
+				r.mismatches = append(r.mismatches, fmt.Sprintf("%s %s: %d instead of %d", req.Method, req.Path, status, req.Status))
+			}
+		}
+	}()
+}
+
+// Send a request to the target as the original visitor did, answering with the status and latency
+func (r *replay) do(req request) (int, time.Duration, error) {
+	target := strings.TrimSuffix(r.target.String(), "/") + req.Path
+	httpReq, err := http.NewRequest(req.Method, target, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	for name, values := range r.headers {
+		httpReq.Header[name] = values
+	}
+	if req.UserAgent != "" {
+		httpReq.Header.Set("User-Agent", req.UserAgent)
+	}
+	if req.Referer != "" {
+		httpReq.Header.Set("Referer", req.Referer)
+	}
+	start := time.Now()
+	resp, err := r.client.Do(httpReq)
+	if err != nil {
+		return 0, 0, err
+	}
+	io.Copy(ioutil.Discard, resp.Body)
+	resp.Body.Close()
+	return resp.StatusCode, time.Since(start), nil
+}
+
+// Print what the replay found, reporting whether every request got the recorded status
+func (r *replay) report(out io.Writer, took time.Duration) bool {
+	r.Lock()
+	defer r.Unlock()
+	fmt.Fprintf(out, "sent %d requests in %s (%.1f/s), skipped %d, %d late, %d failed\n",
+		r.sent, took.Round(time.Millisecond), float64(r.sent)/took.Seconds(), r.skipped, r.late, r.failed)
+	codes := []int{}
+	for code := range r.statuses {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	for _, code := range codes {
+		fmt.Fprintf(out, "  %d: %d\n", code, r.statuses[code])
+	}
+	if len(r.latencies) > 0 {
+		sort.Slice(r.latencies, func(i, j int) bool { return r.latencies[i] < r.latencies[j] })
+		percentile := func(p float64) time.Duration {
+			return r.latencies[int(p*float64(len(r.latencies)-1))].Round(time.Microsecond)
+		}
+		fmt.Fprintf(out, "latency p50 %s, p90 %s, p99 %s, max %s\n", percentile(0.5), percentile(0.9), percentile(0.99), percentile(1))
+	}
+	if r.mismatched > 0 {
+		fmt.Fprintf(out, "%d requests got another status than recorded:\n", r.mismatched)
+		for _, mismatch := range r.mismatches {
+			fmt.Fprintf(out, "  %s\n", mismatch)
+		}
+	}
+	return r.failed == 0 && r.mismatched == 0
+}
+
+// Read the requests of a log file, or stdin for "-", gunzipping files ending in .gz.
+// Logs are read line by line, except JSON arrays as written by gcloud logging read --format=json.
+func readRequests(name string, format string, replay func(request) error) error {
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		file, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		in = file
+	}
+	if strings.HasSuffix(name, ".gz") {
+		unzipped, err := gzip.NewReader(in)
+		if err != nil {
+			return err
+		}
+		defer unzipped.Close()
+		in = unzipped
+	}
+	buffered := bufio.NewReaderSize(in, 64*1024)
+	for {
+		peeked, err := buffered.Peek(1)
+		if err != nil {
+			return nil
+		}
+		if peeked[0] != ' ' && peeked[0] != '\n' && peeked[0] != '\r' && peeked[0] != '\t' {
+			break
+		}
+		buffered.ReadByte()
+	}
+	peeked, _ := buffered.Peek(1)
+	if peeked[0] == '[' {
+		return readArray(name, buffered, format, replay)
+	}
+
+	scanner := bufio.NewScanner(buffered)
+	scanner.Buffer(make([]byte, 64*1024), maxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" {
+			continue
+		}
+		if format == formatAuto {
+			format = detectFormat(text)
+		}
+		req, err := parseLine(format, text)
+		if err == errNoRequest {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s:%d: %v", name, line, err)
+			continue
+		}
+		err = replay(req)
+		if err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// Read the requests of a JSON array of log entries or click rows
+func readArray(name string, in io.Reader, format string, replay func(request) error) error {
+	decoder := json.NewDecoder(in)
+	_, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	for i := 0; decoder.More(); i++ {
+		element := json.RawMessage{}
+		err = decoder.Decode(&element)
+		if err != nil {
+			return err
+		}
+		if format == formatAuto {
+			format = detectFormat(string(element))
+		}
+		req, err := parseLine(format, string(element))
+		if err == errNoRequest {
+			continue
+		}
+		if err != nil {
+			log.Printf("%s[%d]: %v", name, i, err)
+			continue
+		}
+		err = replay(req)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// struct clickSummary totals the rollups of a code over a date range.
+type clickSummary struct {
+	Code      string           `json:"code"`
+	From      string           `json:"from"`
+	To        string           `json:"to"`
+	Clicks    int64            `json:"clicks"`
+	Uniques   int64            `json:"uniques"`
+	Referrers map[string]int64 `json:"referrers"`
+	// Conversions reported within the range and their share of clicks
+	Conversions     int64   `json:"conversions"`
+	ConversionRate  float64 `json:"conversion_rate"`
+	ConversionValue float64 `json:"conversion_value,omitempty"`
+}
+
+// struct referrerShift compares the share of traffic a referrer sent to both sides.
+type referrerShift struct {
+	// Referring host ("" for direct traffic)
+	Referrer string  `json:"referrer"`
+	A        int64   `json:"a"`
+	B        int64   `json:"b"`
+	ShareA   float64 `json:"share_a"`
+	ShareB   float64 `json:"share_b"`
+	// Change of share from A to B in percentage points
+	Shift float64 `json:"shift"`
+}
+
+// struct comparisonResponse holds both sides of a comparison and their differences.
+type comparisonResponse struct {
+	A *clickSummary `json:"a"`
+	B *clickSummary `json:"b"`
+	// Differences from A to B
+	ClicksDelta  int64 `json:"clicks_delta"`
+	UniquesDelta int64 `json:"uniques_delta"`
+	// Difference of conversion rates from A to B
+	ConversionRateDelta float64 `json:"conversion_rate_delta"`
+	// Relative change of clicks from A to B, omitted if A had none
+	ClicksChange *float64 `json:"clicks_change,omitempty"`
+	// Referrers by absolute shift, largest first
+	ReferrerShifts []referrerShift `json:"referrer_shifts"`
+}
+
+// Sum up the rollups of a code in [from, to]
+func summarizeClicks(ctx context.Context, code string, from time.Time, to time.Time) (*clickSummary, error) {
+	ctx, span := tracer.Start(ctx, "summarizeClicks")
+	defer span.End()
+	rollups, err := readRollups(ctx, code, from, to)
+	if err != nil {
+		return nil, err
+	}
+	summary := &clickSummary{Code: code, From: from.Format(rollupDate), To: to.Format(rollupDate), Referrers: map[string]int64{}}
+	for _, rollup := range rollups {
+		summary.Clicks += rollup.Clicks
+		summary.Uniques += rollup.uniques()
+		for referrer, clicks := range rollup.Referrers {
+			summary.Referrers[referrer] += clicks
+		}
+		summary.Conversions += rollup.Conversions
+		summary.ConversionValue += rollup.ConversionValue
+	}
+	if summary.Clicks > 0 {
+		summary.ConversionRate = float64(summary.Conversions) / float64(summary.Clicks)
+	}
+	return summary, nil
+}
+
+// Compare the referrer mix of two summaries
+func referrerShifts(a *clickSummary, b *clickSummary) []referrerShift {
+	share := func(clicks int64, total int64) float64 {
+		if total == 0 {
+			return 0
+		}
+		return float64(clicks) / float64(total)
+	}
+	referrers := map[string]bool{}
+	for referrer := range a.Referrers {
+		referrers[referrer] = true
+	}
+	for referrer := range b.Referrers {
+		referrers[referrer] = true
+	}
+	shifts := []referrerShift{}
+	for referrer := range referrers {
+		s := referrerShift{Referrer: referrer, A: a.Referrers[referrer], B: b.Referrers[referrer]}
+		s.ShareA = share(s.A, a.Clicks)
+		s.ShareB = share(s.B, b.Clicks)
+		s.Shift = (s.ShareB - s.ShareA) * 100
+		shifts = append(shifts, s)
+	}
+	abs := func(f float64) float64 {
+		if f < 0 {
+			return -f
+		}
+		return f
+	}
+	sort.Slice(shifts, func(i, j int) bool {
+		if abs(shifts[i].Shift) != abs(shifts[j].Shift) {
+			return abs(shifts[i].Shift) > abs(shifts[j].Shift)
+		}
+		return shifts[i].Referrer < shifts[j].Referrer
+	})
+	return shifts
+}
+
+// GET handler comparing two codes (a, b) or one code across two ranges (from, to and b_from, b_to).
+// Requires the admin token, or the insights signature of an owner holding both links.
+func compareHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "compareHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	query := r.URL.Query()
+	codeA := query.Get("a")
+	codeB := query.Get("b")
+	if codeB == "" {
+		codeB = codeA
+	}
+	if codeA == "" {
+		respond(ctx, response{"", "code a is required!"}, http.StatusBadRequest, w)
+		return
+	}
+	now := clock()
+	fromA, toA, err := parseRange(query.Get("from"), query.Get("to"), now)
+	if err != nil {
+		respond(ctx, response{"", "from and to should be dates (YYYY-MM-DD) at most a year apart!"}, http.StatusBadRequest, w)
+		return
+	}
+	fromB, toB := fromA, toA
+	if query.Get("b_from") != "" || query.Get("b_to") != "" {
+		fromB, toB, err = parseRange(query.Get("b_from"), query.Get("b_to"), now)
+		if err != nil {
+			respond(ctx, response{"", "b_from and b_to should be dates (YYYY-MM-DD) at most a year apart!"}, http.StatusBadRequest, w)
+			return
+		}
+	}
+	if codeA == codeB && fromA.Equal(fromB) && toA.Equal(toB) {
+		respond(ctx, response{"", "compare two codes or two different ranges!"}, http.StatusBadRequest, w)
+		return
+	}
+
+	owner := query.Get("owner")
+	if !isAdmin(r) {
+		if owner == "" || !verifySignature(insightsSubject(owner), query.Get("sig")) {
+			denyAccess(ctx, w, r, query.Get("sig"))
+			return
+		}
+		for _, code := range []string{codeA, codeB} {
+			l, err := readLink(ctx, code)
+			if err != nil || l.Owner != owner {
+				respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+				return
+			}
+		}
+	}
+
+	a, err := summarizeClicks(ctx, codeA, fromA, toA)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	b, err := summarizeClicks(ctx, codeB, fromB, toB)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	resp := comparisonResponse{A: a, B: b, ClicksDelta: b.Clicks - a.Clicks, UniquesDelta: b.Uniques - a.Uniques, ConversionRateDelta: b.ConversionRate - a.ConversionRate, ReferrerShifts: referrerShifts(a, b)}
+	if a.Clicks > 0 {
+		change := float64(b.Clicks-a.Clicks) / float64(a.Clicks)
+		resp.ClicksChange = &change
+	}
+	respond(ctx, resp, http.StatusOK, w)
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Sources of settings, from the lowest precedence to the highest
+const (
+	sourceDefault = "default"
+	sourceFile    = "file"
+	sourceEnv     = "env"
+	sourceFlag    = "flag"
+)
+
+// struct serverConfig holds every setting of the server, once all sources are loaded.
+// Fields are filled from the setting named by their tag. Unset values leave the setting's default, if it has one.
+type serverConfig struct {
+	// Port to listen on
+	Port string `setting:"PORT"`
+	// Host of short links
+	Domain string `setting:"DOMAIN"`
+	// Bucket holding links and everything else
+	Bucket string `setting:"BUCKET"`
+	// Project of BigQuery, Firestore, Pub/Sub and Cloud Trace
+	Project string `setting:"GOOGLE_CLOUD_PROJECT"`
+	// Secret of signed URLs
+	SigningSecret string `setting:"SIGNING_SECRET"`
+
+	// Serving
+	AdminToken      string        `setting:"ADMIN_TOKEN"`
+	RedirectOnly    bool          `setting:"REDIRECT_ONLY"`
+	ShutdownTimeout time.Duration `setting:"SHUTDOWN_TIMEOUT"`
+	LogFormat       string        `setting:"LOG_FORMAT"`
+	LogLevel        string        `setting:"LOG_LEVEL"`
+
+	// Link storage
+	Storage             string `setting:"STORAGE"`
+	StorageEmulatorHost string `setting:"STORAGE_EMULATOR_HOST"`
+	FirestoreCollection string `setting:"FIRESTORE_COLLECTION"`
+	RedisAddr           string `setting:"REDIS_ADDR"`
+	RedisPassword       string `setting:"REDIS_PASSWORD"`
+	RedisPrefix         string `setting:"REDIS_PREFIX"`
+	RedisTLS            bool   `setting:"REDIS_TLS"`
+
+	// API and transport of the GCS client
+	GCSAPI                   string        `setting:"GCS_API"`
+	GCSMaxIdleConns          int           `setting:"GCS_MAX_IDLE_CONNS"`
+	GCSMaxIdleConnsPerHost   int           `setting:"GCS_MAX_IDLE_CONNS_PER_HOST"`
+	GCSIdleConnTimeout       time.Duration `setting:"GCS_IDLE_CONN_TIMEOUT"`
+	GCSDialTimeout           time.Duration `setting:"GCS_DIAL_TIMEOUT"`
+	GCSTLSHandshakeTimeout   time.Duration `setting:"GCS_TLS_HANDSHAKE_TIMEOUT"`
+	GCSResponseHeaderTimeout time.Duration `setting:"GCS_RESPONSE_HEADER_TIMEOUT"`
+	GCSHTTP2                 bool          `setting:"GCS_HTTP2"`
+
+	// Short codes and redirects
+	CodeGeneration   string        `setting:"CODE_GENERATION"`
+	RandomCodeBytes  int           `setting:"RANDOM_CODE_BYTES"`
+	CodeReuse        string        `setting:"CODE_REUSE"`
+	RedirectStatus   int           `setting:"REDIRECT_STATUS"`
+	URLNormalization string        `setting:"URL_NORMALIZATION"`
+	ExtendPeriod     time.Duration `setting:"EXTEND_PERIOD"`
+	BanditEpsilon    float64       `setting:"BANDIT_EPSILON"`
+	ContactLinks     bool          `setting:"CONTACT_LINKS"`
+
+	// Settings the policy source can override, read through policySetting
+	AllowedSchemes    string        `setting:"ALLOWED_SCHEMES"`
+	ContactLinkOwners string        `setting:"CONTACT_LINK_OWNERS"`
+	DomainAllowlist   string        `setting:"DOMAIN_ALLOWLIST"`
+	DomainBlocklist   string        `setting:"DOMAIN_BLOCKLIST"`
+	LabelLogo         string        `setting:"LABEL_LOGO"`
+	RedactParams      string        `setting:"REDACT_PARAMS"`
+	RedactPatterns    string        `setting:"REDACT_PATTERNS"`
+	PolicySource      string        `setting:"POLICY_SOURCE"`
+	PolicyReload      time.Duration `setting:"POLICY_RELOAD"`
+	DomainListReload  time.Duration `setting:"DOMAIN_LIST_RELOAD"`
+
+	// Caching and replicas
+	RedirectCacheSize       int           `setting:"REDIRECT_CACHE_SIZE"`
+	RedirectCacheTTL        time.Duration `setting:"REDIRECT_CACHE_TTL"`
+	ReplicaSnapshotInterval time.Duration `setting:"REPLICA_SNAPSHOT_INTERVAL"`
+	ReplicaSnapshotSource   string        `setting:"REPLICA_SNAPSHOT_SOURCE"`
+	SnapshotPublishInterval time.Duration `setting:"SNAPSHOT_PUBLISH_INTERVAL"`
+	ReputationCacheTTL      time.Duration `setting:"REPUTATION_CACHE_TTL"`
+
+	// Analytics
+	AnalyticsPrivacy        string        `setting:"ANALYTICS_PRIVACY"`
+	ClickCountryHeader      string        `setting:"CLICK_COUNTRY_HEADER"`
+	ClickExportTable        string        `setting:"CLICK_EXPORT_TABLE"`
+	RollupInterval          time.Duration `setting:"ROLLUP_INTERVAL"`
+	UsageScanInterval       time.Duration `setting:"USAGE_SCAN_INTERVAL"`
+	TrafficAnomalyThreshold float64       `setting:"TRAFFIC_ANOMALY_THRESHOLD"`
+	TrafficMinClicks        float64       `setting:"TRAFFIC_MIN_CLICKS"`
+	TrafficWebhook          string        `setting:"TRAFFIC_WEBHOOK"`
+
+	// Events and background work
+	EventsTopic         string        `setting:"EVENTS_TOPIC"`
+	EventsWebhook       string        `setting:"EVENTS_WEBHOOK"`
+	EventsClickSample   float64       `setting:"EVENTS_CLICK_SAMPLE"`
+	ChangeFeed          bool          `setting:"CHANGE_FEED"`
+	FeedPollInterval    time.Duration `setting:"FEED_POLL_INTERVAL"`
+	FeedRetention       time.Duration `setting:"FEED_RETENTION"`
+	TaskExecutor        string        `setting:"TASK_EXECUTOR"`
+	TaskWorkers         int           `setting:"TASK_WORKERS"`
+	CloudTasksQueue     string        `setting:"CLOUD_TASKS_QUEUE"`
+	ArchiveAfterMonths  int           `setting:"ARCHIVE_AFTER_MONTHS"`
+	ArchiveBucket       string        `setting:"ARCHIVE_BUCKET"`
+	ArchiveInterval     time.Duration `setting:"ARCHIVE_INTERVAL"`
+	ArchiveStorageClass string        `setting:"ARCHIVE_STORAGE_CLASS"`
+	ScreenshotService   string        `setting:"SCREENSHOT_SERVICE"`
+
+	// Abuse protection
+	SafeBrowsingKey             string        `setting:"SAFE_BROWSING_KEY"`
+	SafeBrowsingOnRedirect      bool          `setting:"SAFE_BROWSING_ON_REDIRECT"`
+	SafeBrowsingRedirectTimeout time.Duration `setting:"SAFE_BROWSING_REDIRECT_TIMEOUT"`
+	CloakingInterval            time.Duration `setting:"CLOAKING_INTERVAL"`
+	CloakingMinClicks           int           `setting:"CLOAKING_MIN_CLICKS"`
+	CloakingDistance            int           `setting:"CLOAKING_DISTANCE"`
+	AbuseQuarantineReports      int           `setting:"ABUSE_QUARANTINE_REPORTS"`
+	RedirectRateLimit           int           `setting:"REDIRECT_RATE_LIMIT"`
+	RedirectBurst               int           `setting:"REDIRECT_BURST"`
+	FloodThreshold              int           `setting:"FLOOD_THRESHOLD"`
+	FloodCooldown               time.Duration `setting:"FLOOD_COOLDOWN"`
+	FloodResponse               string        `setting:"FLOOD_RESPONSE"`
+	RecaptchaSiteKey            string        `setting:"RECAPTCHA_SITE_KEY"`
+	RecaptchaSecret             string        `setting:"RECAPTCHA_SECRET"`
+	ScannerThreshold            int           `setting:"SCANNER_THRESHOLD"`
+	ScannerRateLimit            int           `setting:"SCANNER_RATE_LIMIT"`
+	HoneypotCodes               int           `setting:"HONEYPOT_CODES"`
+	AliasRateLimit              int           `setting:"ALIAS_RATE_LIMIT"`
+	AliasBurst                  int           `setting:"ALIAS_BURST"`
+
+	// API access and load
+	APIKeysRequired        bool          `setting:"API_KEYS_REQUIRED"`
+	FirebaseProject        string        `setting:"FIREBASE_PROJECT"`
+	LegacyAPIDeprecated    time.Time     `setting:"LEGACY_API_DEPRECATED"`
+	LegacyAPISunset        time.Time     `setting:"LEGACY_API_SUNSET"`
+	HeavyConcurrency       int           `setting:"HEAVY_CONCURRENCY"`
+	HeavyQueue             int           `setting:"HEAVY_QUEUE"`
+	HeavyQueueTimeout      time.Duration `setting:"HEAVY_QUEUE_TIMEOUT"`
+	HeavyRateLimit         int           `setting:"HEAVY_RATE_LIMIT"`
+	InstanceConcurrency    int           `setting:"INSTANCE_CONCURRENCY"`
+	ManagementConcurrency  int           `setting:"MANAGEMENT_CONCURRENCY"`
+	ManagementQueueTimeout time.Duration `setting:"MANAGEMENT_QUEUE_TIMEOUT"`
+
+	// Contacts published under /.well-known
+	SecurityContact   string    `setting:"SECURITY_CONTACT"`
+	SecurityExpires   time.Time `setting:"SECURITY_EXPIRES"`
+	SecurityLanguages string    `setting:"SECURITY_LANGUAGES"`
+	SecurityPolicy    string    `setting:"SECURITY_POLICY"`
+	AbuseContact      string    `setting:"ABUSE_CONTACT"`
+	AbusePolicy       string    `setting:"ABUSE_POLICY"`
+
+	// Tracing
+	TraceExporter      string  `setting:"TRACE_EXPORTER"`
+	OTLPEndpoint       string  `setting:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	OTLPTracesEndpoint string  `setting:"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"`
+	TracesSampler      string  `setting:"OTEL_TRACES_SAMPLER"`
+	TracesSamplerArg   float64 `setting:"OTEL_TRACES_SAMPLER_ARG"`
+}
+
+// Configuration of this instance
+var config serverConfig
+
+// Effective value of every setting which is set, as loaded by loadConfig
+var settingValues = map[string]string{}
+
+// Source of every setting which wasn't taken from the environment
+var settingSources = map[string]string{}
+
+// Settings by the names of their flags
+var settingFlags = map[string]string{}
+
+// Name of the flag of a setting, e.g. redis-addr for REDIS_ADDR
+func flagName(name string) string {
+	return strings.ToLower(strings.ReplaceAll(name, "_", "-"))
+}
+
+// Register a flag for every setting, to be called before flag.Parse
+func registerSettingFlags() {
+	for _, s := range settings {
+		usage := "sets " + s.Name
+		if s.Choices != nil {
+			usage += ": " + strings.Join(s.Choices, ", ")
+		}
+		if s.Default != "" {
+			usage += " (default " + s.Default + ")"
+		}
+		settingFlags[flagName(s.Name)] = s.Name
+		flag.String(flagName(s.Name), "", usage)
+	}
+}
+
+// Load the settings with flags taking precedence over the environment, which takes precedence over the file (if any)
+func loadConfig(path string) error {
+	values := map[string]string{}
+	settingSources = map[string]string{}
+	for _, s := range settings {
+		if value := os.Getenv(s.Name); value != "" {
+			values[s.Name] = value
+		}
+	}
+	if path != "" {
+		fileValues, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+		for name, value := range fileValues {
+			if values[name] == "" && value != "" {
+				values[name] = value
+				settingSources[name] = sourceFile
+			}
+		}
+	}
+	flag.Visit(func(f *flag.Flag) {
+		if name, ok := settingFlags[f.Name]; ok {
+			values[name] = f.Value.String()
+			settingSources[name] = sourceFlag
+		}
+	})
+	settingValues = values
+	config = serverConfig{}
+	return config.fill(values)
+}
+
+// Set the fields of the configuration from the values of their settings, or the settings' defaults.
+// Values which can't be parsed are reported, their fields keep the default.
+func (c *serverConfig) fill(values map[string]string) error {
+	defaults := map[string]string{}
+	for _, s := range settings {
+		defaults[s.Name] = s.Default
+	}
+	var invalid []error
+	fields := reflect.ValueOf(c).Elem()
+	for i := 0; i < fields.NumField(); i++ {
+		name := fields.Type().Field(i).Tag.Get("setting")
+		if values[name] != "" && setConfigField(fields.Field(i), values[name]) {
+			continue
+		}
+		if values[name] != "" {
+			invalid = append(invalid, fmt.Errorf("%s from %s: invalid value %q", name, settingSource(name), values[name]))
+		}
+		if defaults[name] != "" {
+			setConfigField(fields.Field(i), defaults[name])
+		}
+	}
+	return errors.Join(invalid...)
+}
+
+// Parse the non-empty value of a setting into a field of the configuration, reporting whether it was valid
+func setConfigField(field reflect.Value, value string) bool {
+	switch field.Interface().(type) {
+	case string:
+		field.SetString(value)
+	case bool:
+		// Like checkSetting, only "true" and "false" are valid
+		if value != "true" && value != "false" {
+			return false
+		}
+		field.SetBool(value == "true")
+	case int:
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return false
+		}
+		field.SetInt(int64(n))
+	case float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return false
+		}
+		field.SetFloat(f)
+	case time.Duration:
+		d, err := time.ParseDuration(value)
+		if err != nil || d <= 0 {
+			return false
+		}
+		field.SetInt(int64(d))
+	case time.Time:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return false
+		}
+		field.Set(reflect.ValueOf(t))
+	default:
+		return false
+	}
+	return true
+}
+
+// Read a YAML (or JSON) file mapping settings to their values, e.g. "DOMAIN: go.example.com" or "domain: go.example.com".
+// Lists stand for comma-separated values. Unknown settings are rejected, so typos don't go unnoticed.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	raw := map[string]interface{}{}
+	err = yaml.Unmarshal(data, &raw)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	known := map[string]bool{}
+	for _, s := range settings {
+		known[s.Name] = true
+	}
+	values := map[string]string{}
+	keys := make([]string, 0, len(raw))
+	for key := range raw {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		name := strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if !known[name] {
+			if suggestion := closestSetting(name); suggestion != "" {
+				return nil, fmt.Errorf("%s: unknown setting %s, did you mean %s?", path, key, suggestion)
+			}
+			return nil, fmt.Errorf("%s: unknown setting %s", path, key)
+		}
+		value, err := configString(raw[key])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s %v", path, key, err)
+		}
+		values[name] = value
+	}
+	return values, nil
+}
+
+// Value of a setting in a file as the environment would hold it
+func configString(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return v, nil
+	case bool, int, int64, uint64, float64:
+		return fmt.Sprint(v), nil
+	case time.Time:
+		return v.Format(time.RFC3339), nil
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := configString(item)
+			if err != nil {
+				return "", err
+			}
+			if strings.Contains(s, ",") {
+				return "", fmt.Errorf("item %q contains a comma", s)
+			}
+			items[i] = s
+		}
+		return strings.Join(items, ","), nil
+	}
+	return "", fmt.Errorf("should be a string, number, boolean or list, not %T", value)
+}
+
+// Source of a setting's value
+func settingSource(name string) string {
+	if source, ok := settingSources[name]; ok {
+		return source
+	}
+	return sourceEnv
+}
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Kinds of values settings take
+const (
+	settingString = "string"
+	// Only "true" turns it on
+	settingBool     = "bool"
+	settingInt      = "int"
+	settingFloat    = "float"
+	settingDuration = "duration"
+	// RFC 3339
+	settingTime = "time"
+	settingURL  = "url"
+	// Comma separated URLs
+	settingURLs = "urls"
+)
+
+// Prefix of the configuration digests instances report, apart from the managed configuration in config/
+const configPrefix = "config/instances/"
+
+// How often instances report their configuration digest, and when a report is considered stale or is removed
+const (
+	configReportInterval = time.Hour
+	configReportStale    = 2 * configReportInterval
+	configReportExpiry   = 7 * 24 * time.Hour
+)
+
+// struct setting describes an environment variable configuring the server.
+type setting struct {
+	Name string
+	Kind string
+	// Values accepted besides the empty one, any if nil
+	Choices []string
+	// Value used while unset, empty if there is none or it depends on other settings
+	Default string
+	// Masked in reports
+	Secret bool
+	// Setting (NAME or NAME=value) without which this one has no effect
+	Requires string
+	// What replaces a setting which shouldn't be used anymore
+	Deprecated string
+}
+
+// Every setting read by the server
+var settings = []setting{
+	{Name: "ABUSE_CONTACT", Kind: settingString},
+	{Name: "ABUSE_POLICY", Kind: settingURL},
+	{Name: "ABUSE_QUARANTINE_REPORTS", Kind: settingInt, Default: strconv.Itoa(defaultQuarantineReports)},
+	{Name: "ADMIN_TOKEN", Kind: settingString, Secret: true},
+	{Name: "ALIAS_BURST", Kind: settingInt, Default: strconv.Itoa(defaultAliasBurst), Requires: "ALIAS_RATE_LIMIT"},
+	{Name: "ALIAS_RATE_LIMIT", Kind: settingInt},
+	{Name: "ALLOWED_SCHEMES", Kind: settingString, Default: defaultAllowedSchemes},
+	{Name: "ANALYTICS_PRIVACY", Kind: settingString, Choices: []string{"strict"}},
+	{Name: "API_KEYS_REQUIRED", Kind: settingBool},
+	{Name: "ARCHIVE_AFTER_MONTHS", Kind: settingInt},
+	{Name: "ARCHIVE_BUCKET", Kind: settingString, Requires: "ARCHIVE_AFTER_MONTHS"},
+	{Name: "ARCHIVE_INTERVAL", Kind: settingDuration, Default: defaultArchiveInterval.String(), Requires: "ARCHIVE_AFTER_MONTHS"},
+	{Name: "ARCHIVE_STORAGE_CLASS", Kind: settingString, Default: defaultArchiveStorageClass, Requires: "ARCHIVE_AFTER_MONTHS"},
+	{Name: "BANDIT_EPSILON", Kind: settingFloat, Default: fmt.Sprint(defaultBanditEpsilon)},
+	{Name: "BUCKET", Kind: settingString},
+	{Name: "CHANGE_FEED", Kind: settingBool},
+	{Name: "CLICK_COUNTRY_HEADER", Kind: settingString, Default: defaultCountryHeader},
+	{Name: "CLICK_EXPORT_TABLE", Kind: settingString},
+	{Name: "CLOAKING_DISTANCE", Kind: settingInt, Default: strconv.Itoa(defaultCloakingDistance), Requires: "CLOAKING_INTERVAL"},
+	{Name: "CLOAKING_INTERVAL", Kind: settingDuration},
+	{Name: "CLOAKING_MIN_CLICKS", Kind: settingInt, Default: strconv.Itoa(defaultCloakingMinClicks), Requires: "CLOAKING_INTERVAL"},
+	{Name: "CLOUD_TASKS_QUEUE", Kind: settingString, Requires: "TASK_EXECUTOR=cloudtasks"},
+	{Name: "CODE_GENERATION", Kind: settingString, Choices: []string{"derived", "random"}},
+	{Name: "CODE_REUSE", Kind: settingString},
+	{Name: "CONTACT_LINKS", Kind: settingBool},
+	{Name: "CONTACT_LINK_OWNERS", Kind: settingString, Requires: "CONTACT_LINKS=true"},
+	{Name: "DOMAIN", Kind: settingString},
+	{Name: "DOMAIN_ALLOWLIST", Kind: settingString},
+	{Name: "DOMAIN_BLOCKLIST", Kind: settingString},
+	{Name: "DOMAIN_LIST_RELOAD", Kind: settingDuration, Default: defaultDomainListReload.String()},
+	{Name: "EVENTS_CLICK_SAMPLE", Kind: settingFloat},
+	{Name: "EVENTS_TOPIC", Kind: settingString},
+	{Name: "EVENTS_WEBHOOK", Kind: settingURLs, Secret: true},
+	{Name: "EXTEND_PERIOD", Kind: settingDuration, Default: defaultExtendPeriod.String()},
+	{Name: "FEED_POLL_INTERVAL", Kind: settingDuration, Default: defaultFeedPollInterval.String()},
+	{Name: "FEED_RETENTION", Kind: settingDuration, Default: defaultFeedRetention.String(), Requires: "CHANGE_FEED=true"},
+	{Name: "FIREBASE_PROJECT", Kind: settingString},
+	{Name: "FIRESTORE_COLLECTION", Kind: settingString, Default: defaultFirestoreCollection, Requires: "STORAGE=firestore"},
+	{Name: "FLOOD_COOLDOWN", Kind: settingDuration, Default: defaultFloodCooldown.String(), Requires: "FLOOD_THRESHOLD"},
+	{Name: "FLOOD_RESPONSE", Kind: settingString, Choices: []string{"captcha"}, Requires: "FLOOD_THRESHOLD"},
+	{Name: "FLOOD_THRESHOLD", Kind: settingInt},
+	{Name: "GCS_API", Kind: settingString, Choices: []string{gcsJSON, gcsGRPC}, Default: gcsJSON},
+	{Name: "GCS_DIAL_TIMEOUT", Kind: settingDuration, Default: defaultGCSDialTimeout.String()},
+	{Name: "GCS_HTTP2", Kind: settingBool, Default: "true"},
+	{Name: "GCS_IDLE_CONN_TIMEOUT", Kind: settingDuration, Default: defaultGCSIdleConnTimeout.String()},
+	{Name: "GCS_MAX_IDLE_CONNS", Kind: settingInt, Default: strconv.Itoa(defaultGCSMaxIdleConns)},
+	{Name: "GCS_MAX_IDLE_CONNS_PER_HOST", Kind: settingInt, Default: strconv.Itoa(defaultGCSMaxIdleConnsPerHost)},
+	{Name: "GCS_RESPONSE_HEADER_TIMEOUT", Kind: settingDuration, Default: defaultGCSResponseHeaderTimeout.String()},
+	{Name: "GCS_TLS_HANDSHAKE_TIMEOUT", Kind: settingDuration, Default: defaultGCSTLSHandshakeTimeout.String()},
+	{Name: "GOOGLE_CLOUD_PROJECT", Kind: settingString},
+	{Name: "HEAVY_CONCURRENCY", Kind: settingInt, Default: strconv.Itoa(defaultHeavyConcurrency)},
+	{Name: "HEAVY_QUEUE", Kind: settingInt, Default: strconv.Itoa(defaultHeavyQueue)},
+	{Name: "HEAVY_QUEUE_TIMEOUT", Kind: settingDuration, Default: defaultHeavyQueueWait.String()},
+	{Name: "HEAVY_RATE_LIMIT", Kind: settingInt},
+	{Name: "HONEYPOT_CODES", Kind: settingInt, Requires: "SIGNING_SECRET"},
+	{Name: "INSTANCE_CONCURRENCY", Kind: settingInt, Default: strconv.Itoa(defaultInstanceConcurrency)},
+	{Name: "LABEL_LOGO", Kind: settingString},
+	{Name: "LEGACY_API_DEPRECATED", Kind: settingTime},
+	{Name: "LEGACY_API_SUNSET", Kind: settingTime, Requires: "LEGACY_API_DEPRECATED"},
+	{Name: "LOG_FORMAT", Kind: settingString, Choices: []string{logJSON, logText}},
+	{Name: "LOG_LEVEL", Kind: settingString, Choices: []string{"debug", "info", "warning", "error"}, Default: "info"},
+	{Name: "MANAGEMENT_CONCURRENCY", Kind: settingInt, Default: strconv.Itoa(defaultManagementConcurrency)},
+	{Name: "MANAGEMENT_QUEUE_TIMEOUT", Kind: settingDuration, Default: defaultManagementWait.String()},
+	{Name: "OTEL_EXPORTER_OTLP_ENDPOINT", Kind: settingURL},
+	{Name: "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", Kind: settingURL},
+	{Name: "OTEL_TRACES_SAMPLER", Kind: settingString, Choices: traceSamplers, Default: defaultTraceSampler},
+	{Name: "OTEL_TRACES_SAMPLER_ARG", Kind: settingFloat, Default: "1", Requires: "OTEL_TRACES_SAMPLER"},
+	{Name: "POLICY_RELOAD", Kind: settingDuration, Default: defaultPolicyReload.String(), Requires: "POLICY_SOURCE"},
+	{Name: "POLICY_SOURCE", Kind: settingString},
+	{Name: "PORT", Kind: settingInt},
+	{Name: "RANDOM_CODE_BYTES", Kind: settingInt, Default: strconv.Itoa(defaultRandomCodeBytes), Requires: "CODE_GENERATION=random"},
+	{Name: "RECAPTCHA_SECRET", Kind: settingString, Secret: true, Requires: "RECAPTCHA_SITE_KEY"},
+	{Name: "RECAPTCHA_SITE_KEY", Kind: settingString},
+	{Name: "REDACT_PARAMS", Kind: settingString},
+	{Name: "REDACT_PATTERNS", Kind: settingString},
+	{Name: "REDIRECT_BURST", Kind: settingInt, Requires: "REDIRECT_RATE_LIMIT"},
+	{Name: "REDIRECT_CACHE_SIZE", Kind: settingInt},
+	{Name: "REDIRECT_CACHE_TTL", Kind: settingDuration},
+	{Name: "REDIRECT_ONLY", Kind: settingBool},
+	{Name: "REDIRECT_RATE_LIMIT", Kind: settingInt},
+	{Name: "REDIRECT_STATUS", Kind: settingString, Choices: []string{"301", "302", "307", "308"}, Default: "301"},
+	{Name: "REDIS_ADDR", Kind: settingString, Requires: "STORAGE=redis"},
+	{Name: "REDIS_PASSWORD", Kind: settingString, Secret: true, Requires: "REDIS_ADDR"},
+	{Name: "REDIS_PREFIX", Kind: settingString, Default: defaultRedisPrefix, Requires: "REDIS_ADDR"},
+	{Name: "REDIS_TLS", Kind: settingBool, Requires: "REDIS_ADDR"},
+	{Name: "REPLICA_SNAPSHOT_INTERVAL", Kind: settingDuration, Requires: "REDIRECT_ONLY=true"},
+	{Name: "REPLICA_SNAPSHOT_SOURCE", Kind: settingString, Choices: []string{"published"}, Requires: "REPLICA_SNAPSHOT_INTERVAL"},
+	{Name: "REPUTATION_CACHE_TTL", Kind: settingDuration, Default: defaultReputationCacheTTL.String()},
+	{Name: "ROLLUP_INTERVAL", Kind: settingDuration, Default: defaultRollupInterval.String()},
+	{Name: "SAFE_BROWSING_KEY", Kind: settingString, Secret: true},
+	{Name: "SAFE_BROWSING_ON_REDIRECT", Kind: settingBool, Requires: "SAFE_BROWSING_KEY"},
+	{Name: "SAFE_BROWSING_REDIRECT_TIMEOUT", Kind: settingDuration, Default: defaultSafeBrowsingRedirectTimeout.String(), Requires: "SAFE_BROWSING_ON_REDIRECT=true"},
+	{Name: "SCANNER_RATE_LIMIT", Kind: settingInt, Default: strconv.Itoa(defaultScannerLimit)},
+	{Name: "SCANNER_THRESHOLD", Kind: settingInt, Default: strconv.Itoa(defaultScannerThreshold)},
+	{Name: "SCREENSHOT_SERVICE", Kind: settingString, Secret: true, Requires: "SIGNING_SECRET"},
+	{Name: "SECURITY_CONTACT", Kind: settingString},
+	{Name: "SECURITY_EXPIRES", Kind: settingTime},
+	{Name: "SECURITY_LANGUAGES", Kind: settingString},
+	{Name: "SECURITY_POLICY", Kind: settingURL},
+	{Name: "SHUTDOWN_TIMEOUT", Kind: settingDuration, Default: defaultShutdownTimeout.String()},
+	{Name: "SIGNING_SECRET", Kind: settingString, Secret: true},
+	{Name: "SNAPSHOT_PUBLISH_INTERVAL", Kind: settingDuration},
+	{Name: "STORAGE", Kind: settingString, Choices: []string{"gcs", "firestore", "redis"}, Default: "gcs"},
+	{Name: "STORAGE_EMULATOR_HOST", Kind: settingString},
+	{Name: "TASK_EXECUTOR", Kind: settingString, Choices: []string{"cloudtasks"}},
+	{Name: "TASK_WORKERS", Kind: settingInt, Default: strconv.Itoa(defaultTaskWorkers)},
+	{Name: "TRACE_EXPORTER", Kind: settingString, Choices: []string{traceOTLP, traceCloudTrace, traceNone}},
+	{Name: "TRAFFIC_ANOMALY_THRESHOLD", Kind: settingFloat},
+	{Name: "TRAFFIC_MIN_CLICKS", Kind: settingFloat, Default: strconv.Itoa(defaultTrafficMinClicks), Requires: "TRAFFIC_ANOMALY_THRESHOLD"},
+	{Name: "TRAFFIC_WEBHOOK", Kind: settingURL, Secret: true},
+	{Name: "URL_NORMALIZATION", Kind: settingString, Choices: []string{"off", "scheme", "typos"}, Default: defaultURLNormalization},
+	{Name: "USAGE_SCAN_INTERVAL", Kind: settingDuration, Default: defaultUsageScanInterval.String()},
+}
+
+// Variables set by Cloud Run, the Go runtime and the container, which aren't settings of the server
+var platformVariables = map[string]bool{
+	"GOOGLE_APPLICATION_CREDENTIALS": true,
+	"GOOGLE_CLOUD_REGION":            true,
+}
+
+// struct configValue is the effective value of a setting.
+type configValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+	// default, file, env or flag
+	Source string `json:"source"`
+}
+
+// struct configIssue is something wrong with a setting.
+type configIssue struct {
+	Name    string `json:"name"`
+	Problem string `json:"problem"`
+	// Known setting the name is probably a typo of
+	Suggestion string `json:"suggestion,omitempty"`
+}
+
+// struct configReport is the configuration of an instance as reported to other instances.
+type configReport struct {
+	Instance string    `json:"instance"`
+	Digest   string    `json:"digest"`
+	Features []string  `json:"features"`
+	Started  time.Time `json:"started"`
+	// Last time the instance reported, instances which stopped reporting are gone
+	Seen time.Time `json:"seen"`
+}
+
+// struct configValidation is the checked configuration of this instance, and how it differs from others.
+type configValidation struct {
+	response
+	configReport
+	Settings   []configValue `json:"settings"`
+	Invalid    []configIssue `json:"invalid"`
+	Unknown    []configIssue `json:"unknown"`
+	Deprecated []configIssue `json:"deprecated"`
+	// Settings which have no effect without another one
+	Ineffective []configIssue `json:"ineffective"`
+	// Other live instances running with a different configuration
+	Drifted []configReport `json:"drifted"`
+}
+
+// Time this instance started, reported along with its configuration
+var instanceStarted = time.Now().UTC()
+
+// Value masked for secrets, with a fingerprint so differing secrets show in reports
+func maskSecret(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return "******** (sha256 " + hex.EncodeToString(sum[:4]) + ")"
+}
+
+// Check a value of a setting, empty if it's fine
+func checkSetting(s setting, value string) string {
+	var err error
+	switch s.Kind {
+	case settingBool:
+		if value != "true" && value != "false" {
+			return `should be "true" or "false"`
+		}
+	case settingInt:
+		_, err = strconv.Atoi(value)
+	case settingFloat:
+		_, err = strconv.ParseFloat(value, 64)
+	case settingDuration:
+		var d time.Duration
+		d, err = time.ParseDuration(value)
+		if err == nil && d <= 0 {
+			return "should be a positive duration"
+		}
+	case settingTime:
+		_, err = time.Parse(time.RFC3339, value)
+	case settingURL, settingURLs:
+		for _, raw := range strings.Split(value, ",") {
+			uri, parseErr := url.Parse(strings.TrimSpace(raw))
+			if parseErr != nil || (uri.Scheme != "https" && uri.Scheme != "http") || uri.Host == "" {
+				return "should be an http(s) URL"
+			}
+		}
+	}
+	if err != nil {
+		return "should be a valid " + s.Kind
+	}
+	if s.Choices != nil {
+		for _, choice := range s.Choices {
+			if value == choice {
+				return ""
+			}
+		}
+		return "should be one of " + strings.Join(s.Choices, ", ")
+	}
+	return ""
+}
+
+// Report whether the setting (NAME or NAME=value) another one requires is satisfied
+func requirementMet(requires string) bool {
+	name, value := requires, ""
+	if i := strings.Index(requires, "="); i >= 0 {
+		name, value = requires[:i], requires[i+1:]
+	}
+	if value == "" {
+		return settingValues[name] != ""
+	}
+	return settingValues[name] == value
+}
+
+// Known setting closest to an unknown name, if it's likely a typo of it
+func closestSetting(name string) string {
+	// One typo, and another one for every 10 characters
+	best, bestDistance := "", 2+len(name)/10
+	for _, s := range settings {
+		if d := editDistance(name, s.Name); d < bestDistance {
+			best, bestDistance = s.Name, d
+		}
+	}
+	return best
+}
+
+// Report whether an unknown variable looks like it was meant for the server:
+// it's close to a setting's name or shares its first word with one
+func looksLikeSetting(name string) bool {
+	if platformVariables[name] {
+		return false
+	}
+	if closestSetting(name) != "" {
+		return true
+	}
+	prefix := strings.SplitN(name, "_", 2)[0] + "_"
+	for _, s := range settings {
+		if strings.HasPrefix(s.Name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the configuration of this instance
+func validateConfig() configValidation {
+	known := map[string]bool{}
+	validation := configValidation{
+		configReport: configReport{Instance: instanceID, Features: enabledFeatures(), Started: instanceStarted},
+		Settings:     []configValue{},
+		Invalid:      []configIssue{},
+		Unknown:      []configIssue{},
+		Deprecated:   []configIssue{},
+		Ineffective:  []configIssue{},
+	}
+	digest := sha256.New()
+	for _, s := range settings {
+		known[s.Name] = true
+		value := settingValues[s.Name]
+		if value == "" {
+			if s.Default != "" {
+				validation.Settings = append(validation.Settings, configValue{s.Name, s.Default, sourceDefault})
+			}
+			continue
+		}
+		fmt.Fprintf(digest, "%s=%s\n", s.Name, value)
+		shown := value
+		if s.Secret {
+			shown = maskSecret(value)
+		}
+		validation.Settings = append(validation.Settings, configValue{s.Name, shown, settingSource(s.Name)})
+		if problem := checkSetting(s, value); problem != "" {
+			validation.Invalid = append(validation.Invalid, configIssue{Name: s.Name, Problem: problem})
+		}
+		if s.Deprecated != "" {
+			validation.Deprecated = append(validation.Deprecated, configIssue{Name: s.Name, Problem: s.Deprecated})
+		}
+		if s.Requires != "" && !requirementMet(s.Requires) {
+			validation.Ineffective = append(validation.Ineffective, configIssue{Name: s.Name, Problem: "has no effect without " + s.Requires})
+		}
+	}
+	for _, variable := range os.Environ() {
+		name := strings.SplitN(variable, "=", 2)[0]
+		if known[name] || !looksLikeSetting(name) {
+			continue
+		}
+		validation.Unknown = append(validation.Unknown, configIssue{Name: name, Problem: "isn't a setting", Suggestion: closestSetting(name)})
+	}
+	sort.Slice(validation.Unknown, func(i, j int) bool {
+		return validation.Unknown[i].Name < validation.Unknown[j].Name
+	})
+	validation.Digest = hex.EncodeToString(digest.Sum(nil))[:16]
+	return validation
+}
+
+// Name of the object holding the configuration report of an instance
+func configObject(instance string) string {
+	return configPrefix + instance + ".json"
+}
+
+// Report the configuration digest of this instance every hour, so admins can spot instances running with another one
+func startConfigReporter() {
+	go func() {
+		for {
+			report := validateConfig().configReport
+			report.Seen = clock().UTC()
+			marshalled, err := json.Marshal(report)
+			if err == nil {
+				err = gcsWriteBlob(context.Background(), configObject(instanceID), "application/json", marshalled)
+			}
+			if err != nil {
+				slog.Error("unable to report configuration", "err", err)
+			}
+			time.Sleep(configReportInterval)
+		}
+	}()
+}
+
+// Read the reports of other live instances with a different configuration, removing those of long gone instances
+func driftedInstances(ctx context.Context, digest string) ([]configReport, error) {
+	ctx, span := tracer.Start(ctx, "driftedInstances")
+	defer span.End()
+	drifted := []configReport{}
+	now := clock()
+	err := gcsListPrefix(ctx, configPrefix, func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			return err
+		}
+		report := configReport{}
+		if json.Unmarshal(data, &report) != nil || report.Instance == "" || report.Instance == instanceID {
+			return nil
+		}
+		if now.Sub(report.Seen) > configReportExpiry {
+			return gcsDelete(ctx, name)
+		}
+		if now.Sub(report.Seen) <= configReportStale && report.Digest != digest {
+			drifted = append(drifted, report)
+		}
+		return nil
+	})
+	return drifted, err
+}
+
+// GET handler checking the configuration of the instance answering, for admins: its effective settings with secrets masked,
+// invalid values, unknown and deprecated settings, settings without effect, and the features they turn on.
+// Other live instances running with a different configuration are listed as drifted.
+func configValidateHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "configValidateHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	validation := validateConfig()
+	drifted, err := driftedInstances(ctx, validation.Digest)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	validation.Drifted = drifted
+	validation.Seen = clock().UTC()
+	problems := len(validation.Invalid) + len(validation.Unknown) + len(validation.Deprecated) + len(validation.Ineffective)
+	validation.Message = fmt.Sprintf("%d configuration problems found!", problems)
+	if problems == 0 {
+		validation.Message = "configuration is valid!"
+	}
+	respond(ctx, validation, http.StatusOK, w)
+}
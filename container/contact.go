@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+)
+
+// Contact schemes allowed as destinations with CONTACT_LINKS=true and the action they stand for
+var contactSchemes = map[string]string{
+	"mailto": "Send an email to",
+	"tel":    "Call",
+}
+
+// Interstitial shown instead of handing a contact URL straight to the browser
+var contactTemplate = template.Must(template.New("contact").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex, nofollow">
+<title>{{.Action}} {{.Target}} - Urly Wurly</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<main class="error-page contact-page">
+<h1>{{.Action}} {{.Target}}</h1>
+<p>This link opens your {{if eq .Scheme "tel"}}phone{{else}}email{{end}} app.</p>
+<p><a class="btn btn-primary" href="{{.URL}}" rel="nofollow">{{.Action}} {{.Target}}</a></p>
+<p><a href="/">Take me back</a></p>
+</main>
+</body>
+</html>
+`))
+
+// struct contactResponse extends response with the contact URL of a link.
+type contactResponse struct {
+	response
+	// mailto: or tel: URL to open
+	URL string `json:"url"`
+}
+
+// Report whether an owner may create contact links.
+// CONTACT_LINKS=true enables them, CONTACT_LINK_OWNERS optionally restricts them to a comma separated
+// list of owner addresses and domains (each domain standing for the tenant of all addresses in it).
+func contactLinksAllowed(owner string) bool {
+	if !config.ContactLinks {
+		return false
+	}
+	policy := strings.TrimSpace(policySetting("CONTACT_LINK_OWNERS"))
+	if policy == "" {
+		return true
+	}
+	owner = strings.ToLower(strings.TrimSpace(owner))
+	if owner == "" {
+		return false
+	}
+	domain := owner[strings.LastIndex(owner, "@")+1:]
+	for _, entry := range strings.Split(policy, ",") {
+		entry = strings.TrimPrefix(strings.ToLower(strings.TrimSpace(entry)), "@")
+		if entry != "" && (entry == owner || entry == domain) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a mailto: or tel: destination and whether its owner may create it.
+// Returns the destination to store, with the spaces dropped from phone numbers.
+func checkContactURL(uri *url.URL, owner string) (string, error) {
+	if !contactLinksAllowed(owner) {
+		return "", errors.New(uri.Scheme + " links aren't enabled for this owner")
+	}
+	target, err := url.PathUnescape(uri.Opaque)
+	if err != nil || target == "" {
+		return "", errors.New(uri.Scheme + " link has no recipient")
+	}
+	switch uri.Scheme {
+	case "mailto":
+		_, err = mail.ParseAddressList(target)
+		if err != nil {
+			return "", errors.New("mailto link has an invalid address")
+		}
+	case "tel":
+		number := strings.ReplaceAll(target, " ", "")
+		if strings.Trim(number, "+0123456789-.()") != "" || strings.Trim(number, "+-.()") == "" {
+			return "", errors.New("tel link has an invalid number")
+		}
+		return "tel:" + number, nil
+	}
+	return uri.String(), nil
+}
+
+// Report whether a destination is a contact URL, by its scheme alone as every redirect asks
+func contactURL(destination string) bool {
+	colon := strings.IndexByte(destination, ':')
+	return colon > 0 && contactSchemes[strings.ToLower(destination[:colon])] != ""
+}
+
+// Report whether a link's destination is a contact URL
+func (l *link) contact() bool {
+	return contactURL(l.URL)
+}
+
+// Answer a visit of a contact link with an interstitial (or its JSON equivalent) instead of a redirect
+func serveContactInterstitial(ctx context.Context, w http.ResponseWriter, code string, l *link) {
+	ctx, span := tracer.Start(ctx, "serveContactInterstitial")
+	defer span.End()
+	uri, _ := url.Parse(l.URL)
+	target, _ := url.PathUnescape(uri.Opaque)
+	action := contactSchemes[uri.Scheme]
+	if nw, ok := w.(*negotiatedWriter); !ok || !nw.html {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, contactResponse{response{shortLink(code), action + " " + target}, l.URL}, http.StatusOK, w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	err := contactTemplate.Execute(w, struct {
+		Scheme string
+		Action string
+		Target string
+		// Validated on creation, tel: isn't among the schemes html/template lets through
+		URL template.URL
+	}{uri.Scheme, action, target, template.URL(l.URL)})
+	if err != nil {
+		slog.Error("unable to render contact page", "err", err)
+	}
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Query parameter carrying the click ID to destinations of conversion tracked links
+const clickIDParam = "uw_click"
+
+// How long after a click a conversion is still attributed to it
+const conversionWindow = 30 * 24 * time.Hour
+
+// Length of the signature part of click IDs
+const clickIDSignature = 16
+
+// Error returned for click IDs which weren't issued by us or are too old
+var errInvalidClickID = errors.New("invalid click id")
+
+// struct clickID identifies a single redirect of a conversion tracked link.
+type clickID struct {
+	Code    string
+	Variant int
+	Time    time.Time
+}
+
+// struct conversionRequest is the body of a conversion postback.
+type conversionRequest struct {
+	// Click ID received by the destination
+	ClickID string `json:"click_id"`
+	// Optional value of the conversion, e.g. order total
+	Value float64 `json:"value,omitempty"`
+}
+
+// Encode and sign a click ID as <code>.<variant>.<unix nanoseconds>.<signature>
+func (c clickID) String() string {
+	payload := fmt.Sprintf("%s.%d.%d", c.Code, c.Variant, c.Time.UnixNano())
+	return payload + "." + sign("click:" + payload)[:clickIDSignature]
+}
+
+// Decode a click ID and check its signature and age
+func parseClickID(id string, now time.Time) (clickID, error) {
+	parts := strings.Split(id, ".")
+	if len(parts) != 4 {
+		return clickID{}, errInvalidClickID
+	}
+	payload := strings.Join(parts[:3], ".")
+	expected := sign("click:" + payload)[:clickIDSignature]
+	if config.SigningSecret == "" || !hmac.Equal([]byte(expected), []byte(parts[3])) {
+		return clickID{}, errInvalidClickID
+	}
+	variant, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return clickID{}, errInvalidClickID
+	}
+	nanos, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return clickID{}, errInvalidClickID
+	}
+	c := clickID{Code: parts[0], Variant: variant, Time: time.Unix(0, nanos).UTC()}
+	if now.Sub(c.Time) > conversionWindow || c.Time.After(now.Add(time.Minute)) {
+		return clickID{}, errInvalidClickID
+	}
+	return c, nil
+}
+
+// Append a fresh click ID to a destination
+func withClickID(destination string, c clickID) string {
+	uri, err := url.Parse(destination)
+	if err != nil {
+		return destination
+	}
+	query := uri.Query()
+	query.Set(clickIDParam, c.String())
+	uri.RawQuery = query.Encode()
+	return uri.String()
+}
+
+// Name of the GCS object marking a click ID as converted
+func conversionObject(id string) string {
+	return "conversions/" + id
+}
+
+// Queue a conversion for the rollup of the day it was reported
+func recordConversion(code string, value float64, now time.Time) {
+	date := now.UTC().Format(rollupDate)
+	name := rollupObject(code, date)
+	pendingClicks.Lock()
+	defer pendingClicks.Unlock()
+	rollup, ok := pendingClicks.rollups[name]
+	if !ok {
+		rollup = &dailyRollup{Code: code, Date: date}
+		pendingClicks.rollups[name] = rollup
+	}
+	rollup.merge(&dailyRollup{Conversions: 1, ConversionValue: value})
+}
+
+// POST handler accepting conversion postbacks for a click ID, as query parameters (click_id, value) or JSON body.
+// Every click converts at most once, repeated postbacks answer with 409.
+func conversionsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "conversionsHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	req := conversionRequest{ClickID: r.URL.Query().Get("click_id")}
+	if value := r.URL.Query().Get("value"); value != "" {
+		parsed, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			respond(ctx, response{"", "value should be a number!"}, http.StatusBadRequest, w)
+			return
+		}
+		req.Value = parsed
+	}
+	if req.ClickID == "" {
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req)
+		if err != nil {
+			respond(ctx, response{"", "no click_id provided!"}, http.StatusBadRequest, w)
+			return
+		}
+	}
+	now := clock()
+	c, err := parseClickID(req.ClickID, now)
+	if err != nil {
+		respond(ctx, response{"", "unknown or expired click_id!"}, http.StatusBadRequest, w)
+		return
+	}
+
+	marshalled, err := json.Marshal(struct {
+		conversionRequest
+		Converted time.Time `json:"converted"`
+	}{req, now.UTC()})
+	if err != nil {
+		respond(ctx, response{"", "unable to encode conversion!"}, http.StatusInternalServerError, w)
+		return
+	}
+	err = gcsWriteIfGeneration(ctx, conversionObject(req.ClickID), "application/json", marshalled, 0)
+	if isPreconditionFailed(err) {
+		respond(ctx, response{"", "conversion already reported!"}, http.StatusConflict, w)
+		return
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	recordConversion(c.Code, req.Value, now)
+
+	// Conversions of bandit links also steer their traffic
+	if l, err := readLink(ctx, c.Code); err == nil && l.Bandit && c.Variant < len(l.Variants) {
+		delta := &banditStats{Conversions: make([]int64, c.Variant+1)}
+		delta.Conversions[c.Variant] = 1
+		err = mergeBanditStats(ctx, c.Code, delta)
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+	}
+	respond(ctx, response{shortLink(c.Code), "conversion recorded!"}, http.StatusOK, w)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// struct pendingCount holds clicks on a code which weren't added to its link record yet.
+type pendingCount struct {
+	Clicks    int64
+	LastClick time.Time
+}
+
+// Clicks waiting to be added to the counters of the link records, by code
+var pendingCounts = map[string]*pendingCount{}
+
+// Count a click towards the link's counter, guarded by pendingClicks like the rollups
+func countClick(c click) {
+	count, ok := pendingCounts[c.Code]
+	if !ok {
+		count = &pendingCount{}
+		pendingCounts[c.Code] = count
+	}
+	count.Clicks++
+	if c.Time.After(count.LastClick) {
+		count.LastClick = c.Time
+	}
+}
+
+// Add pending clicks to the counters of the link records, keeping those which fail for the next round.
+// Runs after the rollups were flushed, so a link counted for the first time starts from its rollups.
+func flushCounts(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "flushCounts")
+	defer span.End()
+	pendingClicks.Lock()
+	pending := pendingCounts
+	pendingCounts = map[string]*pendingCount{}
+	pendingClicks.Unlock()
+
+	for code, count := range pending {
+		err := addClicks(ctx, code, count)
+		if err == nil || err == storage.ErrObjectNotExist {
+			// Deleted links don't need counting
+			continue
+		}
+		slog.Error("unable to count clicks", "code", code, "err", err)
+		pendingClicks.Lock()
+		if newer, ok := pendingCounts[code]; ok {
+			count.Clicks += newer.Clicks
+			if newer.LastClick.After(count.LastClick) {
+				count.LastClick = newer.LastClick
+			}
+		}
+		pendingCounts[code] = count
+		pendingClicks.Unlock()
+	}
+}
+
+// Add clicks to the counter of a link record
+func addClicks(ctx context.Context, code string, count *pendingCount) error {
+	ctx, span := tracer.Start(ctx, "addClicks")
+	defer span.End()
+	// Counters don't change where links lead, edges needn't hear about them
+	l, err := updateLink(unrecorded(ctx), code, func(l *link) error {
+		if l.LastClick.IsZero() {
+			// Links clicked before they had a counter start from their rollups, which include these clicks
+			total, err := totalClicks(ctx, code)
+			if err != nil {
+				return err
+			}
+			l.Clicks = total
+			if total < count.Clicks {
+				// The rollups didn't make it
+				l.Clicks = count.Clicks
+			}
+		} else {
+			l.Clicks += count.Clicks
+		}
+		if count.LastClick.After(l.LastClick) {
+			l.LastClick = count.LastClick
+		}
+		return nil
+	})
+	if err == nil {
+		broadcast(liveClicksChanged, code, l)
+	}
+	return err
+}
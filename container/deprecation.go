@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// Wrap a handler of a superseded endpoint to announce its deprecation and successor.
+// Controlled by LEGACY_API_DEPRECATED (RFC 3339 time the endpoint was deprecated) and
+// optionally LEGACY_API_SUNSET (RFC 3339 time it will be removed); without them the handler is untouched.
+func deprecated(successor string, next http.HandlerFunc) http.HandlerFunc {
+	deprecation, sunset := deprecationSchedule()
+	if deprecation.IsZero() {
+		return next
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		// draft-ietf-httpapi-deprecation-header and RFC 8594
+		w.Header().Set("Deprecation", fmt.Sprintf("@%d", deprecation.Unix()))
+		if !sunset.IsZero() {
+			w.Header().Set("Sunset", sunset.UTC().Format(http.TimeFormat))
+		}
+		w.Header().Add("Link", fmt.Sprintf(`<https://%s%s>; rel="successor-version"`, config.Domain, successor))
+		w.Header().Add("Access-Control-Expose-Headers", "Deprecation, Sunset, Link")
+		next(w, r)
+	}
+}
+
+// Read the configured deprecation and sunset times of legacy endpoints
+func deprecationSchedule() (time.Time, time.Time) {
+	if config.LegacyAPIDeprecated.IsZero() {
+		return time.Time{}, time.Time{}
+	}
+	return config.LegacyAPIDeprecated, config.LegacyAPISunset
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Object holding the domain lists managed through /admin/domains
+const domainListObject = "config/domains.json"
+
+// How often instances reload the managed domain lists by default
+const defaultDomainListReload = time.Minute
+
+// Codes of destinations rejected by the domain lists, returned as "error" like the scheme* codes
+const (
+	domainBlocked    = "domain_blocked"
+	domainNotAllowed = "domain_not_allowed"
+	domainLoop       = "redirect_loop"
+)
+
+// struct domainLists holds patterns of destination domains, as stored and accepted by /admin/domains.
+type domainLists struct {
+	// Domains links may never point to
+	Blocklist []string `json:"blocklist"`
+	// Domains links may only point to, any domain if empty
+	Allowlist []string `json:"allowlist"`
+}
+
+// struct domainListsResponse shows the lists in effect and where they come from.
+type domainListsResponse struct {
+	// Lists managed through the API
+	Managed domainLists `json:"managed"`
+	// Lists from DOMAIN_BLOCKLIST and DOMAIN_ALLOWLIST, applied in addition
+	Configured domainLists `json:"configured"`
+	// Time this instance last loaded the managed lists
+	Loaded time.Time `json:"loaded,omitempty"`
+}
+
+// Managed domain lists, reloaded by startDomainLists
+var managedDomains = struct {
+	sync.RWMutex
+	lists  domainLists
+	loaded time.Time
+}{}
+
+// Split a comma-separated list of domain patterns, lower cased
+func parseDomainPatterns(raw string) []string {
+	patterns := []string{}
+	for _, pattern := range strings.Split(raw, ",") {
+		if pattern = strings.ToLower(strings.TrimSpace(pattern)); pattern != "" {
+			patterns = append(patterns, pattern)
+		}
+	}
+	return patterns
+}
+
+// Lists with their patterns trimmed and lower cased, as stored
+func (l domainLists) normalized() domainLists {
+	return domainLists{parseDomainPatterns(strings.Join(l.Blocklist, ",")), parseDomainPatterns(strings.Join(l.Allowlist, ","))}
+}
+
+// First pattern of the lists which isn't a valid pattern, empty if all are
+func (l domainLists) invalidPattern() string {
+	for _, pattern := range append(append([]string{}, l.Blocklist...), l.Allowlist...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return pattern
+		}
+	}
+	return ""
+}
+
+// Lists from DOMAIN_BLOCKLIST and DOMAIN_ALLOWLIST
+func configuredDomains() domainLists {
+	return domainLists{parseDomainPatterns(policySetting("DOMAIN_BLOCKLIST")), parseDomainPatterns(policySetting("DOMAIN_ALLOWLIST"))}
+}
+
+// Report whether a host matches a pattern: "example.com" matches the domain and its subdomains,
+// patterns with wildcards like "*.example.com" or "bit*.ly" match hosts as a whole
+func domainMatches(host string, pattern string) bool {
+	if strings.Contains(pattern, "*") {
+		matched, _ := path.Match(pattern, host)
+		return matched
+	}
+	return host == pattern || strings.HasSuffix(host, "."+pattern)
+}
+
+// Report whether a host matches any of the patterns
+func domainListed(host string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if domainMatches(host, pattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// Check the host of a web destination against the service's own domain and the domain lists.
+// Destinations without a host, like contact links, pass.
+func checkDomainLists(destination string) error {
+	uri, err := url.Parse(destination)
+	if err != nil || uri.Host == "" {
+		return nil
+	}
+	host := strings.TrimSuffix(strings.ToLower(uri.Hostname()), ".")
+	if own := ownHost(); own != "" && host == own {
+		return &schemeError{domainLoop, "links can't point to short links of this service", ""}
+	}
+	return checkHostAgainst(host, configuredDomains(), currentManagedDomains())
+}
+
+// Managed lists in effect on this instance
+func currentManagedDomains() domainLists {
+	managedDomains.RLock()
+	defer managedDomains.RUnlock()
+	return managedDomains.lists
+}
+
+// Check a host against domain lists applying together: blocked if any blocklist matches,
+// not allowed if there are allowlist entries and none of them matches
+func checkHostAgainst(host string, lists ...domainLists) error {
+	allowed, restricted := false, false
+	for _, l := range lists {
+		if domainListed(host, l.Blocklist) {
+			return &schemeError{domainBlocked, "links to " + host + " aren't allowed", ""}
+		}
+		restricted = restricted || len(l.Allowlist) > 0
+		allowed = allowed || domainListed(host, l.Allowlist)
+	}
+	if restricted && !allowed {
+		return &schemeError{domainNotAllowed, "links may only point to approved domains", ""}
+	}
+	return nil
+}
+
+// Host of DOMAIN without a port
+func ownHost() string {
+	domain := strings.ToLower(config.Domain)
+	if host, _, err := net.SplitHostPort(domain); err == nil {
+		return host
+	}
+	return domain
+}
+
+// Load the managed lists now and every DOMAIN_LIST_RELOAD, so changes through any instance reach all of them
+func startDomainLists() {
+	reload := config.DomainListReload
+	if reload <= 0 {
+		reload = defaultDomainListReload
+	}
+	startReloading("domains", domainListObject, reload, func(ctx context.Context, _ string) (string, error) {
+		generation, err := loadDomainLists(ctx)
+		return strconv.FormatInt(generation, 10), err
+	})
+}
+
+// Read the managed lists, keeping the previous ones if that fails. Returns the generation read, 0 if there are none.
+func loadDomainLists(ctx context.Context) (int64, error) {
+	ctx, span := tracer.Start(ctx, "loadDomainLists")
+	defer span.End()
+	lists := domainLists{}
+	data, generation, err := gcsReadGeneration(ctx, domainListObject)
+	if err != nil && err != storage.ErrObjectNotExist {
+		return 0, err
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(data), &lists)
+		if err != nil {
+			return 0, err
+		}
+	}
+	managedDomains.Lock()
+	managedDomains.lists = lists
+	managedDomains.loaded = clock().UTC()
+	managedDomains.Unlock()
+	return generation, nil
+}
+
+// Admin handler for the domain lists: GET shows them, PUT replaces the managed ones with {"blocklist", "allowlist"}.
+// Other instances pick up changes within DOMAIN_LIST_RELOAD.
+func domainListsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "domainListsHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	if r.Method == http.MethodPut {
+		req := domainLists{}
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req)
+		if err != nil {
+			respond(ctx, response{"", "unable to decode request body!"}, http.StatusBadRequest, w)
+			return
+		}
+		lists := req.normalized()
+		if pattern := lists.invalidPattern(); pattern != "" {
+			respond(ctx, response{"", "invalid pattern " + pattern + "!"}, http.StatusBadRequest, w)
+			return
+		}
+		marshalled, err := json.Marshal(lists)
+		if err == nil {
+			err = gcsWriteBlob(ctx, domainListObject, "application/json", marshalled)
+		}
+		if err == nil {
+			_, err = loadDomainLists(ctx)
+		}
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+	}
+	managedDomains.RLock()
+	resp := domainListsResponse{managedDomains.lists, configuredDomains(), managedDomains.loaded}
+	managedDomains.RUnlock()
+	if resp.Managed.Blocklist == nil {
+		resp.Managed.Blocklist = []string{}
+	}
+	if resp.Managed.Allowlist == nil {
+		resp.Managed.Allowlist = []string{}
+	}
+	respond(ctx, resp, http.StatusOK, w)
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// Default amount of time a one-click extension adds to a link
+const defaultExtendPeriod = 30 * 24 * time.Hour
+
+// How far ahead the calendar feed lists expirations
+const calendarHorizon = 365 * 24 * time.Hour
+
+// Returned when the expiry a reminder was signed for has already been extended
+var errAlreadyExtended = errors.New("link has already been extended")
+
+// Parse the expiry of a new link from either an absolute RFC 3339 time (expires=) or a duration (ttl=)
+func parseExpiry(expires string, ttl string, now time.Time) (time.Time, error) {
+	if expires != "" {
+		t, err := time.Parse(time.RFC3339, expires)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if !t.After(now) {
+			return time.Time{}, fmt.Errorf("expiry %s is in the past", expires)
+		}
+		return t.UTC(), nil
+	}
+	if ttl != "" {
+		d, err := time.ParseDuration(ttl)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if d <= 0 {
+			return time.Time{}, fmt.Errorf("ttl %s is not positive", ttl)
+		}
+		return now.Add(d).UTC(), nil
+	}
+	return time.Time{}, nil
+}
+
+// Report whether a link has passed its expiry
+func (l *link) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && !now.Before(l.Expires)
+}
+
+// Time a one-click extension adds, configurable via EXTEND_PERIOD (Go duration)
+func extendPeriod() time.Duration {
+	d := config.ExtendPeriod
+	if d <= 0 {
+		return defaultExtendPeriod
+	}
+	return d
+}
+
+// Value signed for the extension URL of a link.
+// It includes the current expiry, so a URL can only be used once per expiry.
+func extendSubject(code string, expires time.Time) string {
+	return fmt.Sprintf("extend:%s:%d", code, expires.Unix())
+}
+
+// Signed one-click URL extending the expiry of a link
+func extendURL(code string, expires time.Time) string {
+	return fmt.Sprintf("https://%s/api/v1/links/%s/extend?exp=%d&sig=%s",
+		config.Domain, code, expires.Unix(), sign(extendSubject(code, expires)))
+}
+
+// Value signed for a calendar feed, either per owner or per tag
+func calendarSubject(owner string, tag string) string {
+	return fmt.Sprintf("calendar:%s:%s", owner, tag)
+}
+
+// Signed URL of the calendar feed of an owner (or a tag shared by a team)
+func calendarURL(owner string, tag string) string {
+	query := url.Values{}
+	if owner != "" {
+		query.Set("owner", owner)
+	}
+	if tag != "" {
+		query.Set("tag", tag)
+	}
+	query.Set("sig", sign(calendarSubject(owner, tag)))
+	return fmt.Sprintf("https://%s/api/v1/expirations.ics?%s", config.Domain, query.Encode())
+}
+
+// GET handler extending the expiry of a link from a signed reminder URL
+func extendHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "extendHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	code := mux.Vars(r)["id"]
+	exp, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	if err != nil || !verifySignature(extendSubject(code, time.Unix(exp, 0)), r.URL.Query().Get("sig")) {
+		forbidden(ctx, w, "invalid signature!")
+		return
+	}
+	// Only the expiry changes, clicks and concurrent changes of the link are kept
+	l, err := updateLink(ctx, code, func(l *link) error {
+		if l.Expires.Unix() != exp {
+			return errAlreadyExtended
+		}
+		base := clock().UTC()
+		if l.Expires.After(base) {
+			base = l.Expires
+		}
+		l.Expires = base.Add(extendPeriod())
+		l.emit(eventLinkUpdated, code, l.eventData())
+		return nil
+	})
+	switch {
+	case err == storage.ErrObjectNotExist:
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return
+	case err == errAlreadyExtended:
+		respond(ctx, response{"", "link has already been extended!"}, http.StatusConflict, w)
+		return
+	case err != nil:
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	broadcast(eventLinkUpdated, code, l)
+	respond(ctx, response{shortLink(code), fmt.Sprintf("link extended until %s!", l.Expires.Format(time.RFC3339))}, http.StatusOK, w)
+}
+
+// GET handler serving an iCalendar feed of upcoming link expirations for an owner or tag
+func calendarHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "calendarHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	owner := r.URL.Query().Get("owner")
+	tag := strings.ToLower(r.URL.Query().Get("tag"))
+	if (owner == "" && tag == "") || !verifySignature(calendarSubject(owner, tag), r.URL.Query().Get("sig")) {
+		w.Header().Set("Content-Type", "application/json")
+		forbidden(ctx, w, "invalid signature!")
+		return
+	}
+
+	now := clock().UTC()
+	type expiring struct {
+		code string
+		link *link
+	}
+	links := []expiring{}
+	scope := linkScope{owner: owner}
+	err := scope.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil || l.Expires.IsZero() || l.expired(now) || l.Expires.Sub(now) > calendarHorizon {
+			return nil
+		}
+		if !scope.includes(l) || (tag != "" && !l.hasTag(tag)) {
+			return nil
+		}
+		links = append(links, expiring{code, l})
+		return nil
+	})
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].link.Expires.Before(links[j].link.Expires) })
+
+	cal := &calendar{}
+	cal.line("BEGIN", "VCALENDAR")
+	cal.line("VERSION", "2.0")
+	cal.line("PRODID", "-//Urly Wurly//Link Expirations//EN")
+	cal.line("X-WR-CALNAME", "Urly Wurly link expirations")
+	for _, e := range links {
+		extend := extendURL(e.code, e.link.Expires)
+		cal.line("BEGIN", "VEVENT")
+		cal.line("UID", fmt.Sprintf("%s-%d@%s", e.code, e.link.Expires.Unix(), config.Domain))
+		cal.line("DTSTAMP", now.Format("20060102T150405Z"))
+		cal.line("DTSTART", e.link.Expires.Format("20060102T150405Z"))
+		cal.line("DTEND", e.link.Expires.Add(30*time.Minute).Format("20060102T150405Z"))
+		cal.line("SUMMARY", icsEscape(fmt.Sprintf("Short link %s expires", e.code)))
+		cal.line("DESCRIPTION", icsEscape(fmt.Sprintf("%s points to %s and stops working at this time.\nExtend it by %s: %s",
+			shortLink(e.code), e.link.URL, extendPeriod(), extend)))
+		cal.line("URL", extend)
+		cal.line("BEGIN", "VALARM")
+		cal.line("ACTION", "DISPLAY")
+		cal.line("DESCRIPTION", icsEscape(fmt.Sprintf("Short link %s expires soon", e.code)))
+		cal.line("TRIGGER", "-P3D")
+		cal.line("END", "VALARM")
+		cal.line("END", "VEVENT")
+	}
+	cal.line("END", "VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Write([]byte(cal.String()))
+}
+
+// struct calendar builds iCalendar content with RFC 5545 line folding.
+type calendar struct {
+	strings.Builder
+}
+
+// Append a content line, folding it at 75 octets
+func (c *calendar) line(name string, value string) {
+	content := name + ":" + value
+	for len(content) > 75 {
+		cut := 75
+		for cut > 0 && !utf8Start(content[cut]) {
+			cut--
+		}
+		c.WriteString(content[:cut])
+		c.WriteString("\r\n ")
+		content = content[cut:]
+	}
+	c.WriteString(content)
+	c.WriteString("\r\n")
+}
+
+// Report whether a byte starts a UTF-8 sequence
+func utf8Start(b byte) bool {
+	return b&0xc0 != 0x80
+}
+
+// Escape a text value for iCalendar
+func icsEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\n", `\n`).Replace(value)
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+// Longest message a link may show once it's gone, in characters
+const maxFallbackMessage = 500
+
+// struct fallback is what a link shows instead of the generic error once it has expired, been consumed or deleted.
+// Printed QR codes outlive their campaigns, visitors should still land somewhere sensible.
+type fallback struct {
+	// Page to redirect to, e.g. the campaign's successor
+	URL string `json:"url,omitempty"`
+	// Message to show instead of a redirect
+	Message string `json:"message,omitempty"`
+}
+
+// Check the fallback requested for a new link, nil if there is none.
+// The URL is checked like a destination and has to be a web page.
+func newFallback(rawURL string, message string, owner string) (*fallback, error) {
+	rawURL, message = strings.TrimSpace(rawURL), strings.TrimSpace(message)
+	if rawURL == "" && message == "" {
+		return nil, nil
+	}
+	if rawURL != "" && message != "" {
+		return nil, errors.New("fallback_url and fallback_message can't be combined")
+	}
+	if utf8.RuneCountInString(message) > maxFallbackMessage {
+		return nil, errors.New("fallback_message is too long")
+	}
+	if rawURL == "" {
+		return &fallback{Message: message}, nil
+	}
+	destination, _, err := checkDestination(rawURL, owner)
+	if err != nil {
+		return nil, errors.New("fallback_url is invalid: " + err.Error())
+	}
+	if uri, err := url.Parse(destination); err != nil || (uri.Scheme != "http" && uri.Scheme != "https") {
+		return nil, errors.New("fallback_url should be a web page")
+	}
+	return &fallback{URL: destination}, nil
+}
+
+// Answer a visit of a link which is gone with its fallback.
+// Redirects are temporary, the code may be reissued later.
+func serveFallback(ctx context.Context, w http.ResponseWriter, f *fallback, status int) {
+	ctx, span := tracer.Start(ctx, "serveFallback")
+	defer span.End()
+	w.Header().Set("Cache-Control", "no-store")
+	if f.URL != "" {
+		w.Header().Set("Location", f.URL)
+		w.WriteHeader(temporaryStatus(status))
+		return
+	}
+	respond(ctx, response{"", f.Message}, http.StatusGone, w)
+}
+
+// Fallback of a code whose link was deleted, nil if it has none
+func deletedFallback(ctx context.Context, code string) *fallback {
+	ctx, span := tracer.Start(ctx, "deletedFallback")
+	defer span.End()
+	t, err := readTombstone(ctx, code)
+	if err != nil || t == nil {
+		return nil
+	}
+	return t.Fallback
+}
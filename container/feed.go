@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Objects of the change feed
+const (
+	feedHead   = "feed/head.json"
+	feedPrefix = "feed/"
+)
+
+// Timings of the change feed
+const (
+	// Changes collected into one entry
+	feedFlushInterval = time.Second
+	// Default time between two polls of an edge
+	defaultFeedPollInterval = 2 * time.Second
+	// How long an edge waits for an entry whose sequence number was taken before skipping it
+	feedGapTimeout = time.Minute
+	// Default age after which entries are removed
+	defaultFeedRetention = 24 * time.Hour
+)
+
+// Number of attempts at taking the next sequence number before keeping changes for the next flush
+const feedAttempts = 10
+
+// Stops pruning at the first entry to keep
+var errFeedPruned = errors.New("feed is pruned")
+
+// Key of the context marking writes which don't go into the change feed
+type unrecordedKey struct{}
+
+// struct feedChange is the new state of a link after a write, or its removal.
+type feedChange struct {
+	Code    string `json:"code"`
+	Deleted bool   `json:"deleted,omitempty"`
+	// Record as stored, possibly truncated like redirects read it
+	Data       []byte `json:"data,omitempty"`
+	Size       int64  `json:"size,omitempty"`
+	Generation int64  `json:"generation,omitempty"`
+}
+
+// struct feedEntry is a sequence-numbered batch of changes written by one instance.
+type feedEntry struct {
+	Seq      int64        `json:"seq"`
+	Time     time.Time    `json:"time"`
+	Instance string       `json:"instance"`
+	Changes  []feedChange `json:"changes"`
+}
+
+// struct feedPosition is the latest sequence number taken.
+type feedPosition struct {
+	Seq int64 `json:"seq"`
+}
+
+// Changes of this instance waiting for the next entry
+var pendingChanges = struct {
+	sync.Mutex
+	changes []feedChange
+}{}
+
+// Report whether link changes are published as a feed (CHANGE_FEED=true)
+func feedEnabled() bool {
+	return config.ChangeFeed
+}
+
+// Name of the object holding an entry, zero-padded so entries list in order
+func feedObject(seq int64) string {
+	return fmt.Sprintf("%s%020d.json", feedPrefix, seq)
+}
+
+// Mark a context for writes which don't matter to redirects, like counting clicks
+func unrecorded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, unrecordedKey{}, true)
+}
+
+// struct feedLinkStore records the changes written through it for the change feed.
+type feedLinkStore struct {
+	linkStore
+}
+
+// Record link changes in the change feed and flush them every second, pruning old entries on one instance
+func setupChangeFeed() {
+	if !feedEnabled() {
+		return
+	}
+	linkStorage = feedLinkStore{linkStorage}
+	go func() {
+		for range time.Tick(feedFlushInterval) {
+			flushChanges(context.Background())
+		}
+	}()
+	retention := config.FeedRetention
+	if retention <= 0 {
+		retention = defaultFeedRetention
+	}
+	startSingleton("prune-feed", time.Hour, func(ctx context.Context) error {
+		return pruneFeed(ctx, clock().Add(-retention))
+	})
+}
+
+func (s feedLinkStore) write(ctx context.Context, code string, data []byte, generation int64) error {
+	err := s.linkStore.write(ctx, code, data, generation)
+	if err != nil || ctx.Value(unrecordedKey{}) != nil {
+		return err
+	}
+	// Edges need the new generation for conditional writes of their own
+	rec, readErr := s.linkStore.read(ctx, code, maxLinkObjectSize+1)
+	if readErr != nil {
+		slog.Error("unable to record change", "code", code, "err", readErr)
+		return nil
+	}
+	recordChange(feedChange{Code: code, Data: rec.data, Size: rec.size, Generation: rec.generation})
+	return nil
+}
+
+func (s feedLinkStore) delete(ctx context.Context, code string) error {
+	err := s.linkStore.delete(ctx, code)
+	if err == nil {
+		recordChange(feedChange{Code: code, Deleted: true})
+	}
+	return err
+}
+
+// Queue a change for the next entry
+func recordChange(change feedChange) {
+	pendingChanges.Lock()
+	defer pendingChanges.Unlock()
+	pendingChanges.changes = append(pendingChanges.changes, change)
+}
+
+// Write pending changes as the next entry, keeping them for the next flush if that fails
+func flushChanges(ctx context.Context) {
+	pendingChanges.Lock()
+	changes := pendingChanges.changes
+	pendingChanges.changes = nil
+	pendingChanges.Unlock()
+	if len(changes) == 0 {
+		return
+	}
+	ctx, span := tracer.Start(ctx, "flushChanges")
+	defer span.End()
+	err := appendFeed(ctx, changes)
+	if err != nil {
+		slog.Error("unable to append changes to the feed", "changes", len(changes), "err", err)
+		pendingChanges.Lock()
+		pendingChanges.changes = append(changes, pendingChanges.changes...)
+		pendingChanges.Unlock()
+	}
+}
+
+// Take the next sequence number and write an entry under it
+func appendFeed(ctx context.Context, changes []feedChange) error {
+	var err error
+	for attempt := 0; attempt < feedAttempts; attempt++ {
+		position := feedPosition{}
+		content, generation, readErr := gcsReadGeneration(ctx, feedHead)
+		if readErr != nil && readErr != storage.ErrObjectNotExist {
+			return readErr
+		}
+		if readErr == nil {
+			err = json.Unmarshal([]byte(content), &position)
+			if err != nil {
+				return err
+			}
+		}
+		position.Seq++
+		var marshalled []byte
+		marshalled, err = json.Marshal(position)
+		if err != nil {
+			return err
+		}
+		err = gcsWriteIfGeneration(ctx, feedHead, "application/json", marshalled, generation)
+		if isPreconditionFailed(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := json.Marshal(feedEntry{position.Seq, clock().UTC(), instanceID, changes})
+		if err != nil {
+			return err
+		}
+		return gcsWriteBlob(ctx, feedObject(position.Seq), "application/json", entry)
+	}
+	return err
+}
+
+// Latest sequence number taken, 0 if the feed is empty
+func readFeedHead(ctx context.Context) (int64, error) {
+	data, _, err := gcsReadBlob(ctx, feedHead)
+	if err == storage.ErrObjectNotExist {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	position := feedPosition{}
+	err = json.Unmarshal(data, &position)
+	return position.Seq, err
+}
+
+// Read the entry with a sequence number
+func readFeedEntry(ctx context.Context, seq int64) (*feedEntry, error) {
+	data, _, err := gcsReadBlob(ctx, feedObject(seq))
+	if err != nil {
+		return nil, err
+	}
+	entry := &feedEntry{}
+	err = json.Unmarshal(data, entry)
+	return entry, err
+}
+
+// Remove entries written before a time
+func pruneFeed(ctx context.Context, before time.Time) error {
+	ctx, span := tracer.Start(ctx, "pruneFeed")
+	defer span.End()
+	err := gcsListPrefix(ctx, feedPrefix, func(name string) error {
+		seq, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, feedPrefix), ".json"), 10, 64)
+		if err != nil {
+			// The head
+			return nil
+		}
+		entry, err := readFeedEntry(ctx, seq)
+		if err != nil {
+			return nil
+		}
+		if !entry.Time.Before(before) {
+			// Entries are listed in order, the rest is younger
+			return errFeedPruned
+		}
+		return gcsDelete(ctx, name)
+	})
+	if err == errFeedPruned {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+)
+
+// Error returned when an outbound request would reach a non-public address
+var errUnsafeAddress = errors.New("refusing to connect to non-public address")
+
+// HTTP client for all outbound requests triggered by user supplied URLs.
+// Connections to loopback, private, link-local and metadata addresses are refused
+// at dial time, so DNS rebinding can't be used to reach internal services.
+var safeClient = &http.Client{
+	Timeout: 10 * time.Second,
+	Transport: &http.Transport{
+		Proxy: nil,
+		DialContext: (&net.Dialer{
+			Timeout: 5 * time.Second,
+			Control: safeControl,
+		}).DialContext,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: 10 * time.Second,
+		MaxIdleConns:          10,
+		IdleConnTimeout:       30 * time.Second,
+	},
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return errors.New("stopped after 5 redirects")
+		}
+		return checkFetchURL(req.URL)
+	},
+}
+
+// Dialer hook rejecting connections to addresses which aren't publicly routable
+func safeControl(network string, address string, conn syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !isPublicIP(ip) {
+		return errUnsafeAddress
+	}
+	return nil
+}
+
+// Report whether an IP address is publicly routable
+func isPublicIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsMulticast() || ip.IsUnspecified() || ip.IsInterfaceLocalMulticast() {
+		return false
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		switch {
+		case ip4[0] == 10,
+			ip4[0] == 172 && ip4[1]&0xf0 == 16,
+			ip4[0] == 192 && ip4[1] == 168,
+			ip4[0] == 100 && ip4[1]&0xc0 == 64,
+			ip4[0] == 0:
+			return false
+		}
+		return true
+	}
+	// Unique local addresses fc00::/7
+	return ip[0]&0xfe != 0xfc
+}
+
+// Validate a URL before it is handed to safeClient
+func checkFetchURL(uri *url.URL) error {
+	if uri.Scheme != "https" && uri.Scheme != "http" {
+		return fmt.Errorf("unsupported scheme %q", uri.Scheme)
+	}
+	if uri.Hostname() == "" {
+		return errors.New("missing host")
+	}
+	if uri.Port() != "" && uri.Port() != "80" && uri.Port() != "443" {
+		return fmt.Errorf("unsupported port %q", uri.Port())
+	}
+	return nil
+}
+
+// Resolve a host name and make sure every address it points to is public
+func checkPublicHost(ctx context.Context, host string) error {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if !isPublicIP(addr.IP) {
+			return errUnsafeAddress
+		}
+	}
+	return nil
+}
+
+// Fetch a user supplied URL with safeClient, reading at most limit bytes of the body
+func safeFetch(ctx context.Context, target string, limit int64) ([]byte, string, error) {
+	uri, err := url.Parse(target)
+	if err != nil {
+		return nil, "", err
+	}
+	err = checkFetchURL(uri)
+	if err != nil {
+		return nil, "", err
+	}
+	req, err := http.NewRequest(http.MethodGet, uri.String(), nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := safeClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+	body, err := ioutil.ReadAll(io.LimitReader(resp.Body, limit))
+	if err != nil {
+		return nil, "", err
+	}
+	return body, resp.Header.Get("Content-Type"), nil
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Certificates of the keys Firebase Auth signs ID tokens with, by key ID
+const firebaseCertsURL = "https://www.googleapis.com/robot/v1/metadata/x509/securetoken@system.gserviceaccount.com"
+
+// Clock skew tolerated when checking the times of ID tokens
+const idTokenLeeway = time.Minute
+
+// Errors of verifying ID tokens
+var (
+	errMalformedToken = errors.New("malformed ID token")
+	errTokenSignature = errors.New("ID token signature doesn't verify")
+	errTokenClaims    = errors.New("ID token isn't valid for this project")
+)
+
+// Client fetching the signing certificates
+var firebaseClient = &http.Client{Timeout: 10 * time.Second}
+
+// Signing keys of Firebase Auth, refreshed when Google's cache headers say so
+var firebaseKeys = struct {
+	sync.Mutex
+	keys    map[string]*rsa.PublicKey
+	expires time.Time
+	fetched time.Time
+}{}
+
+// struct idTokenClaims holds the claims of a Firebase ID token checked here.
+type idTokenClaims struct {
+	Issuer   string `json:"iss"`
+	Audience string `json:"aud"`
+	// UID of the user
+	Subject  string `json:"sub"`
+	Expires  int64  `json:"exp"`
+	IssuedAt int64  `json:"iat"`
+	AuthTime int64  `json:"auth_time"`
+}
+
+// Firebase project whose users may sign in, from FIREBASE_PROJECT. Sign-in is disabled without it.
+func firebaseProject() string {
+	return config.FirebaseProject
+}
+
+// Bearer token of a request if it is a Firebase ID token (a JWT), empty otherwise.
+// Admin, manage tokens and API keys never contain dots, so they can't be mistaken for one.
+func idToken(r *http.Request) string {
+	if firebaseProject() == "" {
+		return ""
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if strings.Count(token, ".") != 2 || !strings.HasPrefix(token, "eyJ") {
+		return ""
+	}
+	return token
+}
+
+// UID of the user signed in with a request, empty for anonymous requests.
+// Responds with 401 and returns false if the request carries an invalid ID token.
+func signedInUser(ctx context.Context, w http.ResponseWriter, r *http.Request) (string, bool) {
+	token := idToken(r)
+	if token == "" {
+		return "", true
+	}
+	uid, err := verifyIDToken(ctx, token)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		unauthorized(ctx, w, "user", authInvalidToken, "invalid ID token!")
+		return "", false
+	}
+	return uid, true
+}
+
+// Verify a Firebase ID token as documented for third party JWT libraries, returning the UID of its user
+func verifyIDToken(ctx context.Context, token string) (string, error) {
+	ctx, span := tracer.Start(ctx, "verifyIDToken")
+	defer span.End()
+	parts := strings.Split(token, ".")
+	header := struct {
+		Algorithm string `json:"alg"`
+		KeyID     string `json:"kid"`
+	}{}
+	claims := idTokenClaims{}
+	if decodeTokenPart(parts[0], &header) != nil || decodeTokenPart(parts[1], &claims) != nil {
+		return "", errMalformedToken
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || header.Algorithm != "RS256" {
+		return "", errMalformedToken
+	}
+	key, err := firebaseKey(ctx, header.KeyID)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if rsa.VerifyPKCS1v15(key, crypto.SHA256, hash[:], signature) != nil {
+		return "", errTokenSignature
+	}
+
+	project := firebaseProject()
+	now := time.Now()
+	switch {
+	case claims.Audience != project, claims.Issuer != "https://securetoken.google.com/"+project, claims.Subject == "":
+		return "", errTokenClaims
+	case now.After(time.Unix(claims.Expires, 0).Add(idTokenLeeway)):
+		return "", errTokenClaims
+	case now.Add(idTokenLeeway).Before(time.Unix(claims.IssuedAt, 0)), now.Add(idTokenLeeway).Before(time.Unix(claims.AuthTime, 0)):
+		return "", errTokenClaims
+	}
+	return claims.Subject, nil
+}
+
+// Decode a base64url encoded JSON part of a token
+func decodeTokenPart(part string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(part)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// Public key Firebase Auth signs with under a key ID, fetching the current keys if it isn't known (yet)
+func firebaseKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
+	firebaseKeys.Lock()
+	defer firebaseKeys.Unlock()
+	key, ok := firebaseKeys.keys[kid]
+	fresh := time.Now().Before(firebaseKeys.expires)
+	if ok && fresh {
+		return key, nil
+	}
+	// Unknown key IDs refetch at most once a minute, so made up tokens can't flood Google with requests
+	if fresh && time.Since(firebaseKeys.fetched) < time.Minute {
+		return nil, errTokenSignature
+	}
+	keys, expires, err := fetchFirebaseKeys(ctx)
+	if err != nil {
+		return nil, err
+	}
+	firebaseKeys.keys = keys
+	firebaseKeys.expires = expires
+	firebaseKeys.fetched = time.Now()
+	key, ok = keys[kid]
+	if !ok {
+		return nil, errTokenSignature
+	}
+	return key, nil
+}
+
+// Fetch the current signing keys along with the time until which they may be cached
+func fetchFirebaseKeys(ctx context.Context) (map[string]*rsa.PublicKey, time.Time, error) {
+	ctx, span := tracer.Start(ctx, "fetchFirebaseKeys")
+	defer span.End()
+	req, err := http.NewRequest(http.MethodGet, firebaseCertsURL, nil)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	resp, err := firebaseClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, time.Time{}, fmt.Errorf("fetching Firebase keys answered %d", resp.StatusCode)
+	}
+	certs := map[string]string{}
+	err = json.NewDecoder(resp.Body).Decode(&certs)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	keys := map[string]*rsa.PublicKey{}
+	for kid, cert := range certs {
+		block, _ := pem.Decode([]byte(cert))
+		if block == nil {
+			continue
+		}
+		parsed, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			continue
+		}
+		if key, ok := parsed.PublicKey.(*rsa.PublicKey); ok {
+			keys[kid] = key
+		}
+	}
+	// Keys rotate daily, the max-age tells how long the current ones stay valid
+	expires := time.Now().Add(time.Hour)
+	for _, directive := range strings.Split(resp.Header.Get("Cache-Control"), ",") {
+		directive = strings.TrimSpace(directive)
+		if strings.HasPrefix(directive, "max-age=") {
+			seconds, err := strconv.Atoi(strings.TrimPrefix(directive, "max-age="))
+			if err == nil {
+				expires = time.Now().Add(time.Duration(seconds) * time.Second)
+			}
+		}
+	}
+	return keys, expires, nil
+}
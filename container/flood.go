@@ -0,0 +1,220 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Defaults of the flood protection settings
+const (
+	defaultFloodCooldown = 10 * time.Minute
+	floodWindow          = time.Minute
+)
+
+// State of the redirect flood protection, set up by setupFloodProtection
+var flood struct {
+	sync.Mutex
+	// Redirects per code and client IP
+	redirects *limiter
+	// Number of rejected redirects needed within floodWindow to treat an IP as flooding
+	threshold int
+	// How long a flooding IP stays blocked
+	cooldown time.Duration
+	// Rejections per IP in the current window
+	rejections map[string]int
+	// Start of the current window
+	window time.Time
+	// Blocked IPs and when they are released
+	blocked map[string]time.Time
+}
+
+// Page served to flooding clients when FLOOD_RESPONSE=captcha
+var captchaTemplate = template.Must(template.New("captcha").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Are you human? - Urly Wurly</title>
+<link rel="stylesheet" href="/style.css">
+<script src="https://www.google.com/recaptcha/api.js" async defer></script>
+</head>
+<body>
+<main class="error-page">
+<h1>Too many requests</h1>
+<p>We have seen a lot of traffic from your network. Please confirm you are human to continue.</p>
+<form method="POST" action="/{{.Code}}/verify">
+<div class="g-recaptcha" data-sitekey="{{.SiteKey}}"></div>
+<p><button type="submit" class="btn btn-primary">Continue</button></p>
+</form>
+</main>
+</body>
+</html>
+`))
+
+// Configure flood protection from REDIRECT_RATE_LIMIT (redirects per minute per code and IP),
+// REDIRECT_BURST, FLOOD_THRESHOLD (rejections per minute before an IP is blocked) and FLOOD_COOLDOWN
+func setupFloodProtection() {
+	rate := config.RedirectRateLimit
+	if rate <= 0 {
+		return
+	}
+	burst := config.RedirectBurst
+	if burst <= 0 {
+		burst = rate
+	}
+	threshold := config.FloodThreshold
+	if threshold <= 0 {
+		threshold = 3 * rate
+	}
+	cooldown := config.FloodCooldown
+	if cooldown <= 0 {
+		cooldown = defaultFloodCooldown
+	}
+	flood.redirects = newLimiter(rate, burst)
+	flood.threshold = threshold
+	flood.cooldown = cooldown
+	flood.rejections = map[string]int{}
+	flood.blocked = map[string]time.Time{}
+}
+
+// Check whether a client may follow a short link and answer on its behalf if not
+func allowRedirect(ctx context.Context, w http.ResponseWriter, r *http.Request, code string) bool {
+	if flood.redirects == nil {
+		return true
+	}
+	ctx, span := tracer.Start(ctx, "allowRedirect")
+	defer span.End()
+	ip := clientIP(r)
+	now := time.Now()
+	retry := checkFlood(ip, code, now)
+	if retry == 0 {
+		return true
+	}
+
+	if config.FloodResponse == "captcha" && config.RecaptchaSiteKey != "" && isBlocked(ip, now) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusTooManyRequests)
+		err := captchaTemplate.Execute(w, struct {
+			Code    string
+			SiteKey string
+		}{code, config.RecaptchaSiteKey})
+		if err != nil {
+			slog.Error("unable to render captcha page", "code", code, "err", err)
+		}
+		return false
+	}
+	seconds := strconv.Itoa(int(math.Ceil(retry.Seconds())))
+	w.Header().Set("Retry-After", seconds)
+	// Let the browser cache the rejection instead of hammering us again
+	w.Header().Set("Cache-Control", "private, max-age="+seconds)
+	w.Header().Set("Content-Type", "application/json")
+	respond(ctx, response{"", "too many requests for this link, slow down!"}, http.StatusTooManyRequests, w)
+	return false
+}
+
+// Apply the per code and IP limit, tracking rejections to detect floods.
+// Returns how long the client has to wait, or zero if the redirect may proceed.
+func checkFlood(ip string, code string, now time.Time) time.Duration {
+	flood.Lock()
+	defer flood.Unlock()
+	if until, ok := flood.blocked[ip]; ok {
+		if now.Before(until) {
+			return until.Sub(now)
+		}
+		delete(flood.blocked, ip)
+	}
+	key := ip + "/" + code
+	if flood.redirects.allow(key, now) {
+		return 0
+	}
+
+	if now.Sub(flood.window) > floodWindow {
+		flood.window = now
+		flood.rejections = map[string]int{}
+	}
+	flood.rejections[ip]++
+	scoreClient(ip, floodPenalty, false)
+	if flood.rejections[ip] >= flood.threshold {
+		slog.Warn("click flood, blocking", "ip", ip, "code", code, "cooldown", flood.cooldown.String())
+		flood.blocked[ip] = now.Add(flood.cooldown)
+		delete(flood.rejections, ip)
+		return flood.cooldown
+	}
+	wait := flood.redirects.wait(key)
+	if wait < time.Second {
+		wait = time.Second
+	}
+	return wait
+}
+
+// Report whether an IP is blocked for flooding
+func isBlocked(ip string, now time.Time) bool {
+	flood.Lock()
+	defer flood.Unlock()
+	until, ok := flood.blocked[ip]
+	return ok && now.Before(until)
+}
+
+// POST handler verifying a reCAPTCHA answer and unblocking the client
+func captchaHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "captchaHandler")
+	defer span.End()
+	code := mux.Vars(r)["id"]
+	ip := clientIP(r)
+	ok, err := verifyCaptcha(ctx, r.PostFormValue("g-recaptcha-response"), ip)
+	if err != nil || !ok {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "captcha verification failed!"}, http.StatusForbidden, w)
+		return
+	}
+	if flood.redirects != nil {
+		flood.Lock()
+		delete(flood.blocked, ip)
+		flood.Unlock()
+	}
+	http.Redirect(w, r, "/"+code, http.StatusSeeOther)
+}
+
+// Ask reCAPTCHA whether a challenge response is valid
+func verifyCaptcha(ctx context.Context, token string, ip string) (bool, error) {
+	ctx, span := tracer.Start(ctx, "verifyCaptcha")
+	defer span.End()
+	if token == "" {
+		return false, nil
+	}
+	form := url.Values{"secret": {config.RecaptchaSecret}, "response": {token}, "remoteip": {ip}}
+	req, err := http.NewRequest(http.MethodPost, "https://www.google.com/recaptcha/api/siteverify", nil)
+	if err != nil {
+		return false, err
+	}
+	req.URL.RawQuery = form.Encode()
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("siteverify returned %d", resp.StatusCode)
+	}
+	result := struct {
+		Success bool `json:"success"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return false, err
+	}
+	return result.Success, nil
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Formats shorten requests can be answered in
+const (
+	formatJSON = "json"
+	// Just the short URL, e.g. for shell scripts
+	formatText = "text"
+	// Link to embed in a page
+	formatHTML = "html"
+	formatQR   = "qr"
+)
+
+// Media types of the formats negotiated by Accept, JSON first so it wins ties and */*
+var formatTypes = []struct {
+	format    string
+	mediaType string
+}{
+	{formatJSON, "application/json"},
+	{formatText, "text/plain"},
+	{formatHTML, "text/html"},
+}
+
+// Snippets answering shorten requests which asked for HTML
+var (
+	shortenedSnippet = template.Must(template.New("shortened").Parse(
+		`<a class="short-link" href="{{.}}" rel="noopener">{{.}}</a>` + "\n"))
+	failedSnippet = template.Must(template.New("failed").Parse(`<p class="text-danger">{{.}}</p>` + "\n"))
+)
+
+// struct shortenFormat is how a shorten request wants to be answered.
+type shortenFormat struct {
+	Kind string
+	// Rendering of the QR code, for qr
+	QR qrOptions
+}
+
+// Quality an Accept header gives a media type, taken from the most specific range matching it, -1 if none does
+func acceptQuality(accept string, mediaType string) float64 {
+	quality, specificity := -1.0, -1
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(fields[0]))
+		matched := -1
+		switch {
+		case mediaRange == mediaType:
+			matched = 2
+		case mediaRange == "*/*":
+			matched = 0
+		case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(mediaType, strings.TrimSuffix(mediaRange, "*")):
+			matched = 1
+		}
+		if matched <= specificity {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				parsed, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					q = parsed
+				}
+			}
+		}
+		quality, specificity = q, matched
+	}
+	return quality
+}
+
+// Pick the format of a shorten response from ?format= (json, text, html or qr), or else the Accept header.
+// Clients accepting anything get JSON as before.
+func shortenFormatOf(r *http.Request) (shortenFormat, error) {
+	format := shortenFormat{Kind: strings.ToLower(r.URL.Query().Get("format"))}
+	switch format.Kind {
+	case formatJSON, formatText, formatHTML:
+		return format, nil
+	case formatQR:
+		var err error
+		format.QR, err = parseQROptions(r.URL.Query())
+		return format, err
+	case "":
+	default:
+		return shortenFormat{Kind: formatJSON}, errors.New("format should be json, text, html or qr")
+	}
+	accept := r.Header.Get("Accept")
+	format.Kind = formatJSON
+	if accept == "" {
+		return format, nil
+	}
+	best := 0.0
+	for _, t := range formatTypes {
+		if q := acceptQuality(accept, t.mediaType); q > best {
+			format.Kind, best = t.format, q
+		}
+	}
+	return format, nil
+}
+
+// Answer a shorten request in the format it asked for.
+// QR codes come with the short URL in X-Shortened-URL, their failures are answered as JSON.
+func respondShortened(ctx context.Context, w http.ResponseWriter, resp shortenResponse, status int, format shortenFormat) {
+	switch format.Kind {
+	case formatText:
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			fmt.Fprintln(w, resp.ShortenedURL)
+		} else {
+			fmt.Fprintln(w, resp.Message)
+		}
+	case formatHTML:
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(status)
+		var err error
+		if status == http.StatusOK {
+			err = shortenedSnippet.Execute(w, resp.ShortenedURL)
+		} else {
+			err = failedSnippet.Execute(w, resp.Message)
+		}
+		if err != nil {
+			slog.Error("unable to render snippet", "err", err)
+		}
+	case formatQR:
+		if status != http.StatusOK {
+			respond(ctx, resp, status, w)
+			return
+		}
+		w.Header().Set("X-Shortened-URL", resp.ShortenedURL)
+		w.Header().Set("Access-Control-Expose-Headers", "X-Shortened-URL")
+		writeQR(ctx, w, strings.TrimPrefix(resp.ShortenedURL, shortLink("")), format.QR, status)
+	default:
+		respond(ctx, resp, status, w)
+	}
+}
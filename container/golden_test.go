@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"flag"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Rewrite the golden files from the current responses instead of comparing against them
+var update = flag.Bool("update", false, "rewrite testdata/golden from the current responses")
+
+// Time the clock stands still at, a day after the newest rollup of the fixtures
+var goldenTime = time.Date(2024, time.March, 1, 12, 0, 0, 0, time.UTC)
+
+// Admin token of the golden tests
+const goldenAdminToken = "golden-admin-token"
+
+// struct goldenRequest is one call of the API whose answer is kept in testdata/golden/<name>.json.
+type goldenRequest struct {
+	// Name of the golden file
+	name   string
+	method string
+	path   string
+	// Body sent, JSON unless contentType says otherwise
+	body string
+	// Send the admin token
+	admin bool
+	// Content-Type of the body if it isn't JSON
+	contentType string
+	// Fields holding values which vary between runs or machines, replaced at any depth before comparing
+	masked []string
+}
+
+// struct goldenResponse is what the golden files hold of a response.
+type goldenResponse struct {
+	Status      int    `json:"status"`
+	ContentType string `json:"content_type,omitempty"`
+	Location    string `json:"location,omitempty"`
+	// JSON bodies as they are, text as a string and anything else as its SHA-256
+	Body interface{} `json:"body,omitempty"`
+}
+
+// Build the router of a local server on an empty in-memory bucket. Settings are those of the environment,
+// then whatever configure changes before the features are set up.
+func newTestRouter(tb testing.TB, configure func(*serverConfig)) *mux.Router {
+	tb.Helper()
+	err := loadConfig("")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if configure != nil {
+		configure(&config)
+	}
+	setupLocal()
+	setupRedirectCache()
+	setupFloodProtection()
+	setupThrottling()
+	setupPriorities()
+	setupAliasProtection()
+	setupHoneypots()
+	return newRouter()
+}
+
+// Call every endpoint in turn on the fixtures with a frozen clock and compare the answers against the golden files.
+// Requests share the bucket, so later ones see what earlier ones created. Run with -update to record new answers.
+func TestGolden(t *testing.T) {
+	clock = func() time.Time { return goldenTime }
+	defer func() { clock = time.Now }()
+	// Clicks and domain lists kept in memory by an earlier run, with -count
+	pendingClicks.Lock()
+	pendingClicks.rollups = map[string]*dailyRollup{}
+	pendingCounts = map[string]*pendingCount{}
+	pendingClicks.Unlock()
+	managedDomains.Lock()
+	managedDomains.lists, managedDomains.loaded = domainLists{}, time.Time{}
+	managedDomains.Unlock()
+	router := newTestRouter(t, func(c *serverConfig) {
+		c.AdminToken = goldenAdminToken
+		c.Domain = "urly.test"
+		c.SigningSecret = "golden-signing-secret"
+	})
+	// The self-test resolves its probe over HTTP from the local port
+	server := httptest.NewServer(router)
+	defer server.Close()
+	config.Port = server.URL[strings.LastIndex(server.URL, ":")+1:]
+	err := seedLocal(filepath.Join("testdata", "fixtures.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, request := range goldenRequests {
+		got := serveGolden(t, router, request)
+		path := filepath.Join("testdata", "golden", request.name+".json")
+		if *update {
+			err := os.MkdirAll(filepath.Dir(path), 0755)
+			if err == nil {
+				err = ioutil.WriteFile(path, got, 0644)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		want, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Errorf("%s: %v, run with -update to record it", request.name, err)
+			continue
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s %s answered\n%s\nwant\n%s", request.method, request.path, got, want)
+		}
+	}
+	// The re-encoding started last has to finish before the clock is restored
+	for {
+		reencode.Lock()
+		running := reencode.running
+		reencode.Unlock()
+		if !running {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// Serve a request through the router and render what the golden file keeps of the response
+func serveGolden(t *testing.T, router http.Handler, request goldenRequest) []byte {
+	r := httptest.NewRequest(request.method, request.path, strings.NewReader(request.body))
+	r.RemoteAddr = "192.0.2.1:4711"
+	if request.body != "" {
+		r.Header.Set("Content-Type", "application/json")
+	}
+	if request.contentType != "" {
+		r.Header.Set("Content-Type", request.contentType)
+	}
+	if request.admin {
+		r.Header.Set("Authorization", "Bearer "+goldenAdminToken)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	got := goldenResponse{Status: w.Code, ContentType: w.Header().Get("Content-Type"), Location: w.Header().Get("Location")}
+	body := w.Body.Bytes()
+	var decoded interface{}
+	switch {
+	case len(body) == 0:
+	case json.Unmarshal(body, &decoded) == nil:
+		// Headers such as Location may repeat the masked values
+		for _, value := range mask(decoded, request.masked) {
+			got.Location = strings.Replace(got.Location, value, "<masked>", -1)
+		}
+		got.Body = decoded
+	case strings.Contains(got.ContentType, "text") || strings.Contains(got.ContentType, "xml") || strings.Contains(got.ContentType, "javascript"):
+		got.Body = string(body)
+	default:
+		hash := sha256.Sum256(body)
+		got.Body = "sha256:" + hex.EncodeToString(hash[:])
+	}
+	var rendered bytes.Buffer
+	encoder := json.NewEncoder(&rendered)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return rendered.Bytes()
+}
+
+// Replace the values of the named fields of JSON objects anywhere in a decoded body, returning the strings replaced
+func mask(decoded interface{}, names []string) []string {
+	var replaced []string
+	switch value := decoded.(type) {
+	case map[string]interface{}:
+		for key, field := range value {
+			masked := false
+			for _, name := range names {
+				if key == name {
+					if text, ok := field.(string); ok && text != "" {
+						replaced = append(replaced, text)
+					}
+					value[key] = "<masked>"
+					masked = true
+				}
+			}
+			if !masked {
+				replaced = append(replaced, mask(field, names)...)
+			}
+		}
+	case []interface{}:
+		for _, element := range value {
+			replaced = append(replaced, mask(element, names)...)
+		}
+	}
+	return replaced
+}
+
+// Calls of the golden test, in order
+var goldenRequests = []goldenRequest{
+	{name: "robots", method: http.MethodGet, path: "/robots.txt"},
+	{name: "security-txt", method: http.MethodGet, path: "/.well-known/security.txt"},
+	{name: "abuse", method: http.MethodGet, path: "/api/v1/abuse"},
+	{name: "version", method: http.MethodGet, path: "/api/v1/version", masked: []string{"go_version"}},
+	{name: "healthz", method: http.MethodGet, path: "/healthz"},
+	{name: "readyz", method: http.MethodGet, path: "/readyz"},
+	{name: "static", method: http.MethodGet, path: "/"},
+
+	{name: "create", method: http.MethodPost, path: "/api/v1/links", body: `{"url":"https://example.com/new","tags":["team"],"owner":"ops@example.com"}`},
+	{name: "create-custom", method: http.MethodPost, path: "/api/v1/links", body: `{"url":"https://example.com/release","customname":"release-notes","ttl":"48h"}`},
+	{name: "create-invalid", method: http.MethodPost, path: "/api/v1/links", body: `{"url":"not a url"}`},
+	{name: "shorten-legacy", method: http.MethodGet, path: "/s?url=https%3A%2F%2Fexample.com%2Fshortened"},
+	{name: "batch", method: http.MethodPost, path: "/api/v1/links/batch", body: `[{"url":"https://example.com/one"},{"url":"ftp://example.com/two"}]`},
+	{name: "import", method: http.MethodPost, path: "/api/v1/import", body: "url,code\nhttps://example.com/imported,imported-link\nnot a url,\n", contentType: "text/csv"},
+	{name: "links", method: http.MethodGet, path: "/api/v1/links?limit=3", admin: true},
+	{name: "links-next", method: http.MethodGet, path: "/api/v1/links?limit=3&after=expired", admin: true},
+	{name: "links-owner", method: http.MethodGet, path: "/api/v1/links?owner=ops%40example.com&sig=Gbi3sEpw4Du1DpfRy_lo_yjCmESLZ1ptfCrjqpTEKpU"},
+	{name: "links-unauthorized", method: http.MethodGet, path: "/api/v1/links"},
+	{name: "link", method: http.MethodGet, path: "/api/v1/links/docs", admin: true},
+	{name: "link-unauthorized", method: http.MethodGet, path: "/api/v1/links/docs"},
+	{name: "link-missing", method: http.MethodGet, path: "/api/v1/links/missing", admin: true},
+	{name: "lookup", method: http.MethodGet, path: "/api/v1/lookup?url=https%3A%2F%2Fexample.com%2Fdocs"},
+	{name: "resolve", method: http.MethodGet, path: "/api/v1/resolve/docs"},
+	{name: "stats", method: http.MethodGet, path: "/api/v1/links/docs/stats?from=2024-02-27&to=2024-02-29"},
+	{name: "share", method: http.MethodPost, path: "/api/v1/links/docs/share", admin: true},
+	{name: "extend", method: http.MethodGet, path: "/api/v1/links/release-notes/extend", admin: true},
+	{name: "update", method: http.MethodPut, path: "/s/legacy", body: `{"url":"https://example.org/new"}`, admin: true},
+	{name: "graphql", method: http.MethodPost, path: "/graphql", body: `{"query":"{ link(code: \"docs\") { code url tags clicks stats(from: \"2024-02-28\", to: \"2024-02-29\") { totalClicks } } }"}`, admin: true},
+	{name: "graphql-too-deep", method: http.MethodPost, path: "/graphql", body: `{"query":"{ ... { ... { ... { ... { ... { ... { ... { ... { ... { link(code: \"docs\") { code } } } } } } } } } } }"}`},
+	{name: "graphql-fragment-too-deep", method: http.MethodPost, path: "/graphql", body: `{"query":"{ ... { ... { ... { ... { ... { ... { link(code: \"docs\") { ...Daily } } } } } } } } fragment Daily on Link { stats { days { date } } }"}`},
+	{name: "graphql-schema", method: http.MethodGet, path: "/graphql"},
+	{name: "live", method: http.MethodGet, path: "/api/v1/live", admin: true},
+	{name: "jobs", method: http.MethodPost, path: "/api/v1/jobs", body: `{"kind":"retag","codes":["docs"],"add_tags":["archive"]}`, admin: true, masked: []string{"id"}},
+	{name: "job-missing", method: http.MethodGet, path: "/api/v1/jobs/0123456789abcdef", admin: true},
+	{name: "sheet", method: http.MethodGet, path: "/api/v1/sheet?tag=team", admin: true},
+	{name: "calendar", method: http.MethodGet, path: "/api/v1/expirations.ics", admin: true},
+	{name: "conversions", method: http.MethodPost, path: "/api/v1/conversions", body: `{"click_id":"forged","value":10}`},
+	{name: "insights-domains", method: http.MethodGet, path: "/api/v1/insights/domains", admin: true},
+	{name: "insights-compare", method: http.MethodGet, path: "/api/v1/insights/compare?a=docs&b=legacy&from=2024-02-27&to=2024-02-29", admin: true},
+	{name: "insights-anomalies", method: http.MethodGet, path: "/api/v1/insights/anomalies", admin: true},
+	{name: "postback", method: http.MethodPost, path: "/api/v1/links/docs/postback", body: `{}`},
+	{name: "abuse-report", method: http.MethodPost, path: "/api/v1/abuse", body: `{"link":"https://urly.test/docs","reason":"spam"}`},
+
+	{name: "claim", method: http.MethodPost, path: "/api/v1/claims", body: `{"domain":"example.com","contact":"ops@example.com"}`, masked: []string{"verification", "token", "dns_record", "file_url"}},
+	{name: "claim-get", method: http.MethodGet, path: "/api/v1/claims/example.com", admin: true, masked: []string{"verification", "dns_record", "file_url"}},
+	{name: "claim-verify-missing", method: http.MethodPost, path: "/api/v1/claims/unclaimed.example/verify", admin: true},
+	{name: "claim-policy", method: http.MethodPut, path: "/api/v1/claims/example.com/policy", body: `{"block_new_links":true}`, admin: true},
+	{name: "claim-links", method: http.MethodGet, path: "/api/v1/claims/example.com/links", admin: true},
+	{name: "claim-takedown", method: http.MethodDelete, path: "/api/v1/claims/example.com/links/docs", admin: true},
+	{name: "claim-delete", method: http.MethodDelete, path: "/api/v1/claims/example.com", admin: true},
+
+	{name: "admin-anomalies", method: http.MethodGet, path: "/admin/anomalies", admin: true},
+	{name: "admin-scanners", method: http.MethodGet, path: "/admin/scanners", admin: true},
+	{name: "admin-cloaking", method: http.MethodGet, path: "/admin/cloaking", admin: true},
+	{name: "admin-quarantine", method: http.MethodGet, path: "/admin/quarantine", admin: true},
+	{name: "admin-reputation", method: http.MethodGet, path: "/admin/reputation?domain=example.com", admin: true},
+	{name: "admin-leases", method: http.MethodGet, path: "/admin/leases", admin: true, masked: []string{"instance"}},
+	{name: "admin-deadletter", method: http.MethodGet, path: "/admin/deadletter", admin: true},
+	{name: "admin-reencode", method: http.MethodGet, path: "/admin/reencode", admin: true},
+	{name: "admin-keys", method: http.MethodGet, path: "/admin/keys", admin: true},
+	{name: "admin-keys-issue", method: http.MethodPost, path: "/admin/keys", body: `{"name":"ci","owner":"ops@example.com"}`, admin: true, masked: []string{"id", "key"}},
+	{name: "admin-domains", method: http.MethodGet, path: "/admin/domains", admin: true},
+	{name: "admin-squatting", method: http.MethodGet, path: "/admin/squatting", admin: true},
+	{name: "admin-claims", method: http.MethodGet, path: "/admin/claims", admin: true},
+	{name: "admin-redirects", method: http.MethodGet, path: "/admin/redirects?format=nginx", admin: true},
+	{name: "admin-simulate", method: http.MethodPost, path: "/admin/simulate", body: `{"domains":{"blocklist":["example.org"],"allowlist":[]}}`, admin: true},
+	{name: "admin-archive", method: http.MethodPost, path: "/admin/archive?months=1", admin: true},
+	{name: "admin-usage", method: http.MethodGet, path: "/admin/usage", admin: true},
+	{name: "admin-config", method: http.MethodGet, path: "/admin/config/validate", admin: true, masked: []string{"instance", "started"}},
+	{name: "admin-incident", method: http.MethodPost, path: "/admin/incidents", body: `{"title":"Slow redirects","status":"investigating","note":"Looking into it"}`, admin: true, masked: []string{"id"}},
+	{name: "admin-incidents", method: http.MethodGet, path: "/admin/incidents", admin: true, masked: []string{"id"}},
+	{name: "admin-selftest", method: http.MethodGet, path: "/admin/selftest", admin: true, masked: []string{"code", "duration_ms"}},
+	{name: "admin-reload", method: http.MethodPost, path: "/admin/reload", admin: true, masked: []string{"instance"}},
+	{name: "admin-cloaking-clear", method: http.MethodDelete, path: "/admin/cloaking?code=docs", admin: true},
+	{name: "admin-quarantine-add", method: http.MethodPost, path: "/admin/quarantine", body: `{"code":"docs","reason":"phishing report"}`, admin: true},
+	{name: "admin-quarantine-release", method: http.MethodDelete, path: "/admin/quarantine?code=docs", admin: true},
+	{name: "admin-reputation-clear", method: http.MethodDelete, path: "/admin/reputation?domain=example.com", admin: true},
+	{name: "admin-keys-revoke", method: http.MethodDelete, path: "/admin/keys?id=000000000000", admin: true},
+	{name: "admin-domains-update", method: http.MethodPut, path: "/admin/domains", body: `{"blocklist":["malware.example"],"allowlist":[]}`, admin: true, masked: []string{"instance"}},
+	{name: "admin-squatting-clear", method: http.MethodDelete, path: "/admin/squatting?registrant=192.0.2.1", admin: true},
+	{name: "admin-claims-clear", method: http.MethodDelete, path: "/admin/claims?domain=example.com", admin: true},
+	{name: "admin-incident-delete", method: http.MethodDelete, path: "/admin/incidents?id=missing", admin: true},
+	{name: "admin-unauthorized", method: http.MethodGet, path: "/admin/leases"},
+	{name: "task-unknown", method: http.MethodPost, path: "/internal/tasks/unknown", body: `{}`, admin: true},
+	{name: "status", method: http.MethodGet, path: "/status"},
+
+	{name: "widget", method: http.MethodGet, path: "/docs/widget"},
+	{name: "widget-script", method: http.MethodGet, path: "/docs/widget.js"},
+	{name: "badge", method: http.MethodGet, path: "/docs/badge.svg"},
+	{name: "ndef", method: http.MethodGet, path: "/docs/ndef"},
+	{name: "qr", method: http.MethodGet, path: "/docs/qr"},
+	{name: "label", method: http.MethodGet, path: "/docs/label"},
+	{name: "screenshot", method: http.MethodGet, path: "/docs/screenshot"},
+	{name: "preview", method: http.MethodGet, path: "/docs+"},
+	{name: "captcha", method: http.MethodPost, path: "/docs/verify", body: `{}`},
+	{name: "redirect", method: http.MethodGet, path: "/docs"},
+	{name: "redirect-head", method: http.MethodHead, path: "/docs"},
+	{name: "redirect-updated", method: http.MethodGet, path: "/legacy"},
+	{name: "redirect-expired", method: http.MethodGet, path: "/expired"},
+	{name: "redirect-missing", method: http.MethodGet, path: "/missing"},
+	{name: "delete", method: http.MethodDelete, path: "/s/legacy", admin: true},
+	{name: "redirect-deleted", method: http.MethodGet, path: "/legacy"},
+	{name: "metrics", method: http.MethodGet, path: "/metrics", admin: true},
+	// Last, the re-encoding goes on in the background
+	{name: "admin-reencode-start", method: http.MethodPost, path: "/admin/reencode?dry_run=true", admin: true},
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Deepest selection a query may make, so nested fields can't fan out without bounds
+const maxGraphQLDepth = 8
+
+// Errors of queries which can't be executed at all
+var (
+	errGraphQLSyntax   = errors.New("syntax error")
+	errGraphQLMutation = errors.New("only queries are supported")
+)
+
+// struct gqlSelection is a field, fragment spread or inline fragment of a selection set.
+type gqlSelection struct {
+	// Key of the field in the response, the field's name unless aliased
+	Alias string
+	Name  string
+	// Argument values, with variables still unresolved
+	Arguments map[string]interface{}
+	// @include and @skip conditions, unresolved
+	Include, Skip interface{}
+	Selections    []gqlSelection
+	// Name of the fragment spread, if this is one
+	Spread string
+	// Inline fragment, whose selections are merged into the enclosing ones
+	Inline bool
+}
+
+// struct gqlVariable is a reference to a variable in an argument value.
+type gqlVariable string
+
+// struct gqlOperation is a query of a document.
+type gqlOperation struct {
+	Name string
+	// Defaults of the variables it declares, and which of them are required
+	Defaults   map[string]interface{}
+	Required   map[string]bool
+	Selections []gqlSelection
+}
+
+// struct gqlDocument is a parsed GraphQL request.
+type gqlDocument struct {
+	Operations []gqlOperation
+	Fragments  map[string][]gqlSelection
+}
+
+// struct gqlParser reads a GraphQL document token by token.
+type gqlParser struct {
+	source string
+	pos    int
+	// Current token, and whether it's a string literal
+	token  string
+	quoted bool
+}
+
+// Parse a GraphQL document, supporting queries with variables, aliases, fragments and @include/@skip
+func parseGraphQL(source string) (*gqlDocument, error) {
+	p := &gqlParser{source: source}
+	doc := &gqlDocument{Fragments: map[string][]gqlSelection{}}
+	err := p.next()
+	for err == nil && !p.done() {
+		switch {
+		case p.at("{"):
+			var op gqlOperation
+			op.Selections, err = p.selectionSet(0)
+			doc.Operations = append(doc.Operations, op)
+		case p.at("query"):
+			var op gqlOperation
+			op, err = p.operation()
+			doc.Operations = append(doc.Operations, op)
+		case p.at("fragment"):
+			err = p.fragment(doc)
+		case p.at("mutation") || p.at("subscription"):
+			return nil, errGraphQLMutation
+		default:
+			err = p.unexpected()
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(doc.Operations) == 0 {
+		return nil, fmt.Errorf("%w: no query", errGraphQLSyntax)
+	}
+	for _, op := range doc.Operations {
+		if doc.depth(op.Selections, map[string]bool{}) > maxGraphQLDepth {
+			return nil, fmt.Errorf("%w: selections nested deeper than %d", errGraphQLSyntax, maxGraphQLDepth)
+		}
+	}
+	return doc, nil
+}
+
+// Nesting of selections with the fragments they spread expanded, each fragment counting as a level.
+// Fragments are parsed on their own, so only here spreads into deep selections are caught.
+func (doc *gqlDocument) depth(selections []gqlSelection, visited map[string]bool) int {
+	deepest := 0
+	for _, s := range selections {
+		d := 0
+		switch {
+		case s.Spread != "":
+			if !visited[s.Spread] {
+				visited[s.Spread] = true
+				d = 1 + doc.depth(doc.Fragments[s.Spread], visited)
+				delete(visited, s.Spread)
+			}
+		case s.Selections != nil:
+			d = 1 + doc.depth(s.Selections, visited)
+		}
+		if d > deepest {
+			deepest = d
+		}
+	}
+	return deepest
+}
+
+// Advance to the next token, skipping whitespace, commas and comments
+func (p *gqlParser) next() error {
+	p.quoted = false
+	for p.pos < len(p.source) {
+		c := p.source[p.pos]
+		if c == '#' {
+			for p.pos < len(p.source) && p.source[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if c != ' ' && c != '\t' && c != '\n' && c != '\r' && c != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos == len(p.source) {
+		p.token = ""
+		return nil
+	}
+	start := p.pos
+	c := p.source[p.pos]
+	switch {
+	case strings.HasPrefix(p.source[p.pos:], "..."):
+		p.pos += 3
+	case strings.IndexByte("!$():=@[]{}|", c) >= 0:
+		p.pos++
+	case c == '"':
+		return p.stringToken()
+	case c == '-' || c >= '0' && c <= '9':
+		p.pos++
+		for p.pos < len(p.source) && strings.IndexByte("0123456789.eE+-", p.source[p.pos]) >= 0 {
+			p.pos++
+		}
+	case isGraphQLNameChar(c):
+		for p.pos < len(p.source) && isGraphQLNameChar(p.source[p.pos]) {
+			p.pos++
+		}
+	default:
+		return fmt.Errorf("%w: unexpected character %q", errGraphQLSyntax, c)
+	}
+	p.token = p.source[start:p.pos]
+	return nil
+}
+
+func isGraphQLNameChar(c byte) bool {
+	return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+}
+
+// Read a string literal, with JSON escapes, or a block string between """
+func (p *gqlParser) stringToken() error {
+	p.quoted = true
+	if strings.HasPrefix(p.source[p.pos:], `"""`) {
+		end := strings.Index(p.source[p.pos+3:], `"""`)
+		if end < 0 {
+			return fmt.Errorf("%w: unterminated string", errGraphQLSyntax)
+		}
+		p.token = strings.TrimSpace(strings.ReplaceAll(p.source[p.pos+3:p.pos+3+end], `\"""`, `"""`))
+		p.pos += end + 6
+		return nil
+	}
+	end := p.pos + 1
+	for end < len(p.source) && p.source[end] != '"' && p.source[end] != '\n' {
+		if p.source[end] == '\\' {
+			end++
+		}
+		end++
+	}
+	if end >= len(p.source) || p.source[end] != '"' {
+		return fmt.Errorf("%w: unterminated string", errGraphQLSyntax)
+	}
+	err := json.Unmarshal([]byte(p.source[p.pos:end+1]), &p.token)
+	if err != nil {
+		return fmt.Errorf("%w: invalid string", errGraphQLSyntax)
+	}
+	p.pos = end + 1
+	return nil
+}
+
+// Report whether the whole document was read
+func (p *gqlParser) done() bool {
+	return p.token == "" && !p.quoted
+}
+
+func (p *gqlParser) unexpected() error {
+	if p.done() {
+		return fmt.Errorf("%w: unexpected end of document", errGraphQLSyntax)
+	}
+	return fmt.Errorf("%w: unexpected %q", errGraphQLSyntax, p.token)
+}
+
+// Report whether the current token is the given punctuator or keyword
+func (p *gqlParser) at(token string) bool {
+	return p.token == token && !p.quoted
+}
+
+// Consume a punctuator or keyword
+func (p *gqlParser) expect(token string) error {
+	if !p.at(token) {
+		return p.unexpected()
+	}
+	return p.next()
+}
+
+// Consume a name
+func (p *gqlParser) name() (string, error) {
+	if p.token == "" || p.quoted || !isGraphQLNameChar(p.token[0]) || p.token[0] >= '0' && p.token[0] <= '9' {
+		return "", p.unexpected()
+	}
+	name := p.token
+	return name, p.next()
+}
+
+// Parse query [name] [(variables)] [directives] { selections }
+func (p *gqlParser) operation() (gqlOperation, error) {
+	op := gqlOperation{Defaults: map[string]interface{}{}, Required: map[string]bool{}}
+	err := p.next()
+	if err != nil {
+		return op, err
+	}
+	if !p.at("{") && !p.at("(") && !p.at("@") {
+		op.Name, err = p.name()
+		if err != nil {
+			return op, err
+		}
+	}
+	if p.at("(") {
+		err = p.next()
+		for err == nil && !p.at(")") {
+			err = p.variableDefinition(&op)
+		}
+		if err == nil {
+			err = p.expect(")")
+		}
+		if err != nil {
+			return op, err
+		}
+	}
+	_, _, err = p.directives()
+	if err != nil {
+		return op, err
+	}
+	op.Selections, err = p.selectionSet(0)
+	return op, err
+}
+
+// Parse $name: Type [= default]
+func (p *gqlParser) variableDefinition(op *gqlOperation) error {
+	err := p.expect("$")
+	if err != nil {
+		return err
+	}
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	err = p.expect(":")
+	if err != nil {
+		return err
+	}
+	required, err := p.typeReference()
+	if err != nil {
+		return err
+	}
+	if p.at("=") {
+		err = p.next()
+		if err != nil {
+			return err
+		}
+		op.Defaults[name], err = p.value(true)
+		return err
+	}
+	op.Required[name] = required
+	return nil
+}
+
+// Parse a type like String, [String!] or Int!, returning whether it's non-null
+func (p *gqlParser) typeReference() (bool, error) {
+	var err error
+	if p.at("[") {
+		err = p.next()
+		if err == nil {
+			_, err = p.typeReference()
+		}
+		if err == nil {
+			err = p.expect("]")
+		}
+	} else {
+		_, err = p.name()
+	}
+	if err != nil || !p.at("!") {
+		return false, err
+	}
+	return true, p.next()
+}
+
+// Parse fragment Name on Type { selections }
+func (p *gqlParser) fragment(doc *gqlDocument) error {
+	err := p.next()
+	if err != nil {
+		return err
+	}
+	name, err := p.name()
+	if err != nil {
+		return err
+	}
+	err = p.expect("on")
+	if err == nil {
+		_, err = p.name()
+	}
+	if err != nil {
+		return err
+	}
+	doc.Fragments[name], err = p.selectionSet(0)
+	return err
+}
+
+// Parse { selections }
+func (p *gqlParser) selectionSet(depth int) ([]gqlSelection, error) {
+	if depth > maxGraphQLDepth {
+		return nil, fmt.Errorf("%w: selections nested deeper than %d", errGraphQLSyntax, maxGraphQLDepth)
+	}
+	err := p.expect("{")
+	if err != nil {
+		return nil, err
+	}
+	selections := []gqlSelection{}
+	for !p.at("}") {
+		if p.done() {
+			return nil, p.unexpected()
+		}
+		s, err := p.selection(depth)
+		if err != nil {
+			return nil, err
+		}
+		selections = append(selections, s)
+	}
+	return selections, p.next()
+}
+
+// Parse a field, ...Spread or inline fragment
+func (p *gqlParser) selection(depth int) (gqlSelection, error) {
+	var s gqlSelection
+	var err error
+	if p.at("...") {
+		err = p.next()
+		if err != nil {
+			return s, err
+		}
+		if !p.at("on") && !p.at("{") && !p.at("@") {
+			s.Spread, err = p.name()
+			if err == nil {
+				s.Include, s.Skip, err = p.directives()
+			}
+			return s, err
+		}
+		if p.at("on") {
+			err = p.next()
+			if err == nil {
+				_, err = p.name()
+			}
+		}
+		if err == nil {
+			s.Include, s.Skip, err = p.directives()
+		}
+		if err == nil {
+			s.Inline = true
+			s.Selections, err = p.selectionSet(depth + 1)
+		}
+		return s, err
+	}
+	s.Name, err = p.name()
+	if err != nil {
+		return s, err
+	}
+	s.Alias = s.Name
+	if p.at(":") {
+		err = p.next()
+		if err == nil {
+			s.Name, err = p.name()
+		}
+		if err != nil {
+			return s, err
+		}
+	}
+	if p.at("(") {
+		s.Arguments, err = p.arguments(false)
+		if err != nil {
+			return s, err
+		}
+	}
+	s.Include, s.Skip, err = p.directives()
+	if err == nil && p.at("{") {
+		s.Selections, err = p.selectionSet(depth + 1)
+	}
+	return s, err
+}
+
+// Parse (name: value, ...)
+func (p *gqlParser) arguments(constant bool) (map[string]interface{}, error) {
+	arguments := map[string]interface{}{}
+	err := p.expect("(")
+	for err == nil && !p.at(")") {
+		var name string
+		name, err = p.name()
+		if err == nil {
+			err = p.expect(":")
+		}
+		if err == nil {
+			arguments[name], err = p.value(constant)
+		}
+	}
+	if err == nil {
+		err = p.expect(")")
+	}
+	return arguments, err
+}
+
+// Parse @include(if: ...) and @skip(if: ...), rejecting other directives
+func (p *gqlParser) directives() (interface{}, interface{}, error) {
+	var include, skip interface{}
+	for p.at("@") {
+		err := p.next()
+		if err != nil {
+			return nil, nil, err
+		}
+		name, err := p.name()
+		if err != nil {
+			return nil, nil, err
+		}
+		if name != "include" && name != "skip" {
+			return nil, nil, fmt.Errorf("%w: unknown directive @%s", errGraphQLSyntax, name)
+		}
+		arguments, err := p.arguments(false)
+		if err != nil {
+			return nil, nil, err
+		}
+		if name == "include" {
+			include = arguments["if"]
+		} else {
+			skip = arguments["if"]
+		}
+	}
+	return include, skip, nil
+}
+
+// Parse a value: variable, number, string, boolean, null, enum, list or object
+func (p *gqlParser) value(constant bool) (interface{}, error) {
+	token, quoted := p.token, p.quoted
+	switch {
+	case quoted:
+		return token, p.next()
+	case token == "$" && !constant:
+		err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		name, err := p.name()
+		return gqlVariable(name), err
+	case token == "[":
+		list := []interface{}{}
+		err := p.next()
+		for err == nil && !p.at("]") {
+			var item interface{}
+			item, err = p.value(constant)
+			list = append(list, item)
+		}
+		if err == nil {
+			err = p.expect("]")
+		}
+		return list, err
+	case token == "{":
+		object := map[string]interface{}{}
+		err := p.next()
+		for err == nil && !p.at("}") {
+			var name string
+			name, err = p.name()
+			if err == nil {
+				err = p.expect(":")
+			}
+			if err == nil {
+				object[name], err = p.value(constant)
+			}
+		}
+		if err == nil {
+			err = p.expect("}")
+		}
+		return object, err
+	case token == "true" || token == "false":
+		return token == "true", p.next()
+	case token == "null":
+		return nil, p.next()
+	case token != "" && (token[0] == '-' || token[0] >= '0' && token[0] <= '9'):
+		if i, err := strconv.ParseInt(token, 10, 64); err == nil {
+			return i, p.next()
+		}
+		f, err := strconv.ParseFloat(token, 64)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid number %s", errGraphQLSyntax, token)
+		}
+		return f, p.next()
+	}
+	// Enum values are passed on as strings
+	return p.name()
+}
+
+// struct gqlError is an error of a GraphQL response, with the path of the field it happened at.
+type gqlError struct {
+	Message string        `json:"message"`
+	Path    []interface{} `json:"path,omitempty"`
+}
+
+// struct gqlResponse is the result of a GraphQL request.
+type gqlResponse struct {
+	Data   interface{} `json:"data,omitempty"`
+	Errors []gqlError  `json:"errors,omitempty"`
+}
+
+// struct gqlArgs holds the argument values of a field, with variables resolved.
+type gqlArgs map[string]interface{}
+
+// String argument, empty if it's missing
+func (a gqlArgs) string(name string) string {
+	s, _ := a[name].(string)
+	return s
+}
+
+// Integer argument, the given default if it's missing
+func (a gqlArgs) int(name string, fallback int) int {
+	switch n := a[name].(type) {
+	case int64:
+		return int(n)
+	case float64:
+		return int(n)
+	}
+	return fallback
+}
+
+// Object types of the schema resolve their fields by name
+type gqlObject interface {
+	typeName() string
+	resolve(x *gqlExecution, field string, args gqlArgs) (interface{}, error)
+}
+
+// struct gqlMap is a JSON object keeping the order of the selections it answers.
+type gqlMap struct {
+	keys   []string
+	values map[string]interface{}
+}
+
+func (m gqlMap) MarshalJSON() ([]byte, error) {
+	buffer := bytes.NewBufferString("{")
+	for i, key := range m.keys {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		marshalled, err := json.Marshal(key)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(marshalled)
+		buffer.WriteByte(':')
+		marshalled, err = json.Marshal(m.values[key])
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(marshalled)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// struct gqlExecution holds the state of executing a query.
+type gqlExecution struct {
+	ctx       context.Context
+	doc       *gqlDocument
+	variables map[string]interface{}
+	errors    []gqlError
+	// Resources answering queries may keep their own limits here
+	budget map[string]int
+}
+
+// Pick the operation to run and resolve its variables, failing like a malformed request if that's impossible
+func newGraphQLExecution(ctx context.Context, doc *gqlDocument, operationName string, variables map[string]interface{}) (*gqlExecution, *gqlOperation, error) {
+	var op *gqlOperation
+	for i := range doc.Operations {
+		if doc.Operations[i].Name == operationName || operationName == "" && len(doc.Operations) == 1 {
+			op = &doc.Operations[i]
+		}
+	}
+	if op == nil {
+		return nil, nil, errors.New("operationName should name one of the queries of the document")
+	}
+	resolved := map[string]interface{}{}
+	for name, value := range op.Defaults {
+		resolved[name] = value
+	}
+	for name, value := range variables {
+		resolved[name] = value
+	}
+	for name, required := range op.Required {
+		if _, ok := resolved[name]; !ok && required {
+			return nil, nil, fmt.Errorf("variable $%s is required", name)
+		}
+	}
+	return &gqlExecution{ctx: ctx, doc: doc, variables: resolved, budget: map[string]int{}}, op, nil
+}
+
+// Replace variables in a value by their values
+func (x *gqlExecution) resolveValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case gqlVariable:
+		return x.variables[string(v)]
+	case []interface{}:
+		list := make([]interface{}, len(v))
+		for i, item := range v {
+			list[i] = x.resolveValue(item)
+		}
+		return list
+	case map[string]interface{}:
+		object := map[string]interface{}{}
+		for name, item := range v {
+			object[name] = x.resolveValue(item)
+		}
+		return object
+	}
+	return value
+}
+
+// Report whether the directives of a selection keep it
+func (x *gqlExecution) included(s gqlSelection) bool {
+	if skip, _ := x.resolveValue(s.Skip).(bool); skip {
+		return false
+	}
+	include, ok := x.resolveValue(s.Include).(bool)
+	return s.Include == nil || ok && include
+}
+
+// Flatten fragments into the fields they select, merging the selections of fields selected twice.
+// Spreads of a fragment within itself are dropped.
+func (x *gqlExecution) collectFields(selections []gqlSelection, fields []gqlSelection, visited map[string]bool) []gqlSelection {
+	for _, s := range selections {
+		if !x.included(s) {
+			continue
+		}
+		switch {
+		case s.Spread != "":
+			fragment, ok := x.doc.Fragments[s.Spread]
+			if ok && !visited[s.Spread] {
+				visited[s.Spread] = true
+				fields = x.collectFields(fragment, fields, visited)
+				delete(visited, s.Spread)
+			}
+		case s.Inline:
+			fields = x.collectFields(s.Selections, fields, visited)
+		default:
+			merged := false
+			for i := range fields {
+				if fields[i].Alias == s.Alias {
+					fields[i].Selections = append(append([]gqlSelection{}, fields[i].Selections...), s.Selections...)
+					merged = true
+				}
+			}
+			if !merged {
+				fields = append(fields, s)
+			}
+		}
+	}
+	return fields
+}
+
+// Resolve the selected fields of an object.
+// Fields failing to resolve are null and reported in the errors, the others are still answered.
+func (x *gqlExecution) selectFields(object gqlObject, selections []gqlSelection, path []interface{}) gqlMap {
+	result := gqlMap{values: map[string]interface{}{}}
+	for _, field := range x.collectFields(selections, nil, map[string]bool{}) {
+		fieldPath := append(append([]interface{}{}, path...), field.Alias)
+		if _, ok := result.values[field.Alias]; !ok {
+			result.keys = append(result.keys, field.Alias)
+		}
+		if field.Name == "__typename" {
+			result.values[field.Alias] = object.typeName()
+			continue
+		}
+		if strings.HasPrefix(field.Name, "__") {
+			x.fail(fieldPath, errors.New("introspection isn't supported, GET /graphql for the schema"))
+			result.values[field.Alias] = nil
+			continue
+		}
+		args := gqlArgs{}
+		for name, value := range field.Arguments {
+			args[name] = x.resolveValue(value)
+		}
+		value, err := object.resolve(x, field.Name, args)
+		if err != nil {
+			x.fail(fieldPath, err)
+			result.values[field.Alias] = nil
+			continue
+		}
+		result.values[field.Alias] = x.complete(value, field, fieldPath)
+	}
+	return result
+}
+
+// Turn a resolved value into its JSON form, selecting the fields of objects
+func (x *gqlExecution) complete(value interface{}, field gqlSelection, path []interface{}) interface{} {
+	if value == nil {
+		return nil
+	}
+	if object, ok := value.(gqlObject); ok {
+		if field.Selections == nil {
+			x.fail(path, fmt.Errorf("field %s of type %s needs a selection of subfields", field.Name, object.typeName()))
+			return nil
+		}
+		return x.selectFields(object, field.Selections, path)
+	}
+	if t, ok := value.(time.Time); ok {
+		return t.Format(time.RFC3339Nano)
+	}
+	v := reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		return x.complete(v.Elem().Interface(), field, path)
+	case reflect.Slice:
+		list := make([]interface{}, v.Len())
+		for i := range list {
+			list[i] = x.complete(v.Index(i).Interface(), field, append(append([]interface{}{}, path...), i))
+		}
+		return list
+	}
+	if field.Selections != nil {
+		x.fail(path, fmt.Errorf("field %s has no subfields", field.Name))
+		return nil
+	}
+	return value
+}
+
+// Record the error of a field
+func (x *gqlExecution) fail(path []interface{}, err error) {
+	x.errors = append(x.errors, gqlError{err.Error(), path})
+}
@@ -0,0 +1,526 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Stats a single GraphQL request may ask for, each reads the rollups of its range
+const maxGraphQLStats = 10
+
+// Schema of the GraphQL API, served by GET /graphql.
+// Fields marked restricted are null with an error unless the request may manage the link.
+const graphqlSchema = `type Query {
+  # Any link, restricted fields need its manage token, the ID token of its user or the admin token
+  link(code: String!): Link
+  # Needs the owner's signature (owner and sig of links_url), an ID token or the admin token
+  links(owner: String, sig: String, tag: String, first: Int = 50, after: String): LinkPage
+  # Tags of the links listed like links, most used first
+  tags(owner: String, sig: String): [Tag]
+  # Like GET /api/v1/links/{code}/stats, days as YYYY-MM-DD
+  stats(code: String!, from: String, to: String, top: Int = 10): Stats
+}
+
+type Link {
+  code: String
+  shortUrl: String
+  # Restricted for burn-after-reading links
+  url: String
+  created: String
+  expires: String
+  redirectStatus: Int
+  burnAfterReading: Boolean
+  publicStats: Boolean
+  # Restricted
+  owner: String
+  uid: String
+  tags: [String]
+  # Restricted unless the link has public stats, null for links without analytics
+  clicks: Int
+  lastClick: String
+  stats(from: String, to: String, top: Int = 10): Stats
+}
+
+type LinkPage {
+  nodes: [Link]
+  # Pass as after for the next page, null on the last one
+  nextCursor: String
+}
+
+type Tag {
+  tag: String
+  links: Int
+  clicks: Int
+}
+
+type Stats {
+  code: String
+  totalClicks: Int
+  lastClick: String
+  from: String
+  to: String
+  clicks: Int
+  days: [Day]
+  topReferrers: [Referrer]
+}
+
+type Day {
+  date: String
+  clicks: Int
+  uniques: Int
+}
+
+type Referrer {
+  referrer: String
+  clicks: Int
+}
+`
+
+// Errors of GraphQL fields
+var (
+	errGraphQLStorage   = errors.New("unable to access GCS")
+	errGraphQLListing   = errors.New("owner and sig, an ID token or the admin token required")
+	errGraphQLTooMany   = fmt.Errorf("at most %d stats per request", maxGraphQLStats)
+	errGraphQLAnalytics = errors.New("link doesn't collect clicks")
+)
+
+// Error of a field the request may not read
+func notAuthorized(field string) error {
+	return fmt.Errorf("not authorized to read %s", field)
+}
+
+// Error of a field which doesn't exist
+func unknownField(object gqlObject, field string) error {
+	return fmt.Errorf("unknown field %s on %s", field, object.typeName())
+}
+
+// struct gqlViewer is whoever sends a GraphQL request.
+type gqlViewer struct {
+	admin bool
+	// Signed-in user
+	uid string
+	// Bearer token which is neither the admin token nor an ID token, i.e. a manage or claim token
+	token string
+}
+
+// Report whether the viewer may manage a link, like requireManager
+func (v *gqlViewer) manages(ctx context.Context, code string, l *link) bool {
+	switch {
+	case v.admin:
+		return true
+	case v.uid != "":
+		return l.UID != "" && l.UID == v.uid
+	case v.token == "":
+		return false
+	case verifySignature(manageSubject(code, l), v.token):
+		return true
+	}
+	c := claimOf(ctx, l.URL)
+	return c != nil && holdsClaim(c, v.token)
+}
+
+// Range and number of top referrers of stats arguments, defaulting like the stats endpoint
+func statsArgs(args gqlArgs) (time.Time, time.Time, int, error) {
+	from, to, err := parseRange(args.string("from"), args.string("to"), clock())
+	if err != nil {
+		return from, to, 0, err
+	}
+	top := args.int("top", defaultTopReferrers)
+	if top <= 0 {
+		top = defaultTopReferrers
+	}
+	if top > maxTopReferrers {
+		top = maxTopReferrers
+	}
+	return from, to, top, nil
+}
+
+// Stats of a link for the viewer, counted against the request's budget
+func (x *gqlExecution) stats(code string, l *link, readable bool, args gqlArgs) (interface{}, error) {
+	if !readable {
+		return nil, notAuthorized("stats")
+	}
+	if l.NoAnalytics {
+		return nil, errGraphQLAnalytics
+	}
+	from, to, top, err := statsArgs(args)
+	if err != nil {
+		return nil, err
+	}
+	x.budget["stats"]++
+	if x.budget["stats"] > maxGraphQLStats {
+		return nil, errGraphQLTooMany
+	}
+	stats, err := linkStats(x.ctx, code, l, from, to, top)
+	if err != nil {
+		return nil, errGraphQLStorage
+	}
+	return gqlStats(stats), nil
+}
+
+// struct gqlQuery is the root of queries.
+type gqlQuery struct {
+	viewer *gqlViewer
+}
+
+func (q gqlQuery) typeName() string {
+	return "Query"
+}
+
+func (q gqlQuery) resolve(x *gqlExecution, field string, args gqlArgs) (interface{}, error) {
+	switch field {
+	case "link", "stats":
+		code := args.string("code")
+		l, err := readLink(x.ctx, code)
+		if err == storage.ErrObjectNotExist {
+			return nil, nil
+		}
+		if err != nil {
+			return nil, errGraphQLStorage
+		}
+		manager := q.viewer.manages(x.ctx, code, l)
+		if field == "stats" {
+			return x.stats(code, l, manager || l.PublicStats, args)
+		}
+		return gqlLink{code, l, manager}, nil
+	case "links":
+		scope, match, err := q.listable(args)
+		if err != nil {
+			return nil, err
+		}
+		first := args.int("first", defaultPageSize)
+		if first <= 0 {
+			first = defaultPageSize
+		}
+		if first > maxPageSize {
+			first = maxPageSize
+		}
+		after, err := base64.RawURLEncoding.DecodeString(args.string("after"))
+		if err != nil {
+			return nil, errors.New("invalid cursor")
+		}
+		page := gqlLinkPage{Nodes: []gqlLink{}}
+		next, err := pageLinks(x.ctx, scope, string(after), first, match, func(code string, l *link) error {
+			// Listing links grants managing them, like the links endpoint
+			page.Nodes = append(page.Nodes, gqlLink{code, l, true})
+			return nil
+		})
+		if err != nil {
+			return nil, errGraphQLStorage
+		}
+		if next != "" {
+			page.NextCursor = &next
+		}
+		return page, nil
+	case "tags":
+		scope, match, err := q.listable(args)
+		if err != nil {
+			return nil, err
+		}
+		return tagCounts(x.ctx, scope, match)
+	}
+	return nil, unknownField(q, field)
+}
+
+// Scope and filter of the links the viewer may list with the arguments given, like the links endpoint
+func (q gqlQuery) listable(args gqlArgs) (linkScope, func(code string, l *link) bool, error) {
+	owner, tag := args.string("owner"), args.string("tag")
+	if !q.viewer.admin && q.viewer.uid == "" && (owner == "" || !verifySignature(linksSubject(owner), args.string("sig"))) {
+		return linkScope{}, nil, errGraphQLListing
+	}
+	return linkScope{owner, q.viewer.uid}, func(code string, l *link) bool {
+		return tag == "" || l.hasTag(tag)
+	}, nil
+}
+
+// struct gqlTag counts the links carrying a tag and their clicks.
+type gqlTag struct {
+	Tag    string
+	Links  int
+	Clicks int64
+}
+
+func (t gqlTag) typeName() string {
+	return "Tag"
+}
+
+func (t gqlTag) resolve(x *gqlExecution, field string, args gqlArgs) (interface{}, error) {
+	switch field {
+	case "tag":
+		return t.Tag, nil
+	case "links":
+		return t.Links, nil
+	case "clicks":
+		return t.Clicks, nil
+	}
+	return nil, unknownField(t, field)
+}
+
+// Count the tags of the scope's links matching a filter, most used first
+func tagCounts(ctx context.Context, scope linkScope, match func(code string, l *link) bool) ([]gqlTag, error) {
+	ctx, span := tracer.Start(ctx, "tagCounts")
+	defer span.End()
+	counts := map[string]*gqlTag{}
+	err := scope.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil || !scope.includes(l) || !match(code, l) || len(l.Tags) == 0 {
+			return nil
+		}
+		listed := describeLink(code, l)
+		for _, tag := range l.Tags {
+			if counts[tag] == nil {
+				counts[tag] = &gqlTag{Tag: tag}
+			}
+			counts[tag].Links++
+			if listed.Clicks != nil {
+				counts[tag].Clicks += *listed.Clicks
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, errGraphQLStorage
+	}
+	tags := []gqlTag{}
+	for _, t := range counts {
+		tags = append(tags, *t)
+	}
+	sort.Slice(tags, func(i, j int) bool {
+		if tags[i].Links != tags[j].Links {
+			return tags[i].Links > tags[j].Links
+		}
+		return tags[i].Tag < tags[j].Tag
+	})
+	return tags, nil
+}
+
+// struct gqlLink is a link, with whether the viewer may manage it.
+type gqlLink struct {
+	code    string
+	l       *link
+	manager bool
+}
+
+func (g gqlLink) typeName() string {
+	return "Link"
+}
+
+func (g gqlLink) resolve(x *gqlExecution, field string, args gqlArgs) (interface{}, error) {
+	l := g.l
+	switch field {
+	case "code":
+		return g.code, nil
+	case "shortUrl":
+		return shortLink(g.code), nil
+	case "url":
+		// Only the one visit may learn where a one-time link points
+		if l.BurnAfterReading && !g.manager {
+			return nil, notAuthorized(field)
+		}
+		return l.URL, nil
+	case "created":
+		if l.Created.IsZero() {
+			return nil, nil
+		}
+		return l.Created, nil
+	case "expires":
+		if l.Expires.IsZero() {
+			return nil, nil
+		}
+		return l.Expires, nil
+	case "redirectStatus":
+		return l.redirectStatus(), nil
+	case "burnAfterReading":
+		return l.BurnAfterReading, nil
+	case "publicStats":
+		return l.PublicStats, nil
+	case "owner", "uid", "tags":
+		if !g.manager {
+			return nil, notAuthorized(field)
+		}
+		switch field {
+		case "owner":
+			return l.Owner, nil
+		case "uid":
+			return l.UID, nil
+		}
+		return l.Tags, nil
+	case "clicks", "lastClick":
+		if !g.manager && !l.PublicStats {
+			return nil, notAuthorized(field)
+		}
+		if l.NoAnalytics {
+			return nil, nil
+		}
+		listed, err := listLink(x.ctx, g.code, l)
+		if err != nil {
+			return nil, errGraphQLStorage
+		}
+		if field == "clicks" {
+			return listed.Clicks, nil
+		}
+		return listed.LastClick, nil
+	case "stats":
+		return x.stats(g.code, l, g.manager || l.PublicStats, args)
+	}
+	return nil, unknownField(g, field)
+}
+
+// struct gqlLinkPage is a page of links.
+type gqlLinkPage struct {
+	Nodes      []gqlLink
+	NextCursor *string
+}
+
+func (p gqlLinkPage) typeName() string {
+	return "LinkPage"
+}
+
+func (p gqlLinkPage) resolve(x *gqlExecution, field string, args gqlArgs) (interface{}, error) {
+	switch field {
+	case "nodes":
+		return p.Nodes, nil
+	case "nextCursor":
+		return p.NextCursor, nil
+	}
+	return nil, unknownField(p, field)
+}
+
+// Stats of a link as GraphQL object
+type gqlStats statsResponse
+
+func (s gqlStats) typeName() string {
+	return "Stats"
+}
+
+func (s gqlStats) resolve(x *gqlExecution, field string, args gqlArgs) (interface{}, error) {
+	switch field {
+	case "code":
+		return s.Code, nil
+	case "totalClicks":
+		return s.TotalClicks, nil
+	case "lastClick":
+		return s.LastClick, nil
+	case "from":
+		return s.From, nil
+	case "to":
+		return s.To, nil
+	case "clicks":
+		return s.Clicks, nil
+	case "days":
+		days := make([]gqlDay, len(s.Days))
+		for i, day := range s.Days {
+			days[i] = gqlDay(day)
+		}
+		return days, nil
+	case "topReferrers":
+		referrers := make([]gqlReferrer, len(s.TopReferrers))
+		for i, referrer := range s.TopReferrers {
+			referrers[i] = gqlReferrer(referrer)
+		}
+		return referrers, nil
+	}
+	return nil, unknownField(s, field)
+}
+
+// Clicks of a day as GraphQL object
+type gqlDay dailyClicks
+
+func (d gqlDay) typeName() string {
+	return "Day"
+}
+
+func (d gqlDay) resolve(x *gqlExecution, field string, args gqlArgs) (interface{}, error) {
+	switch field {
+	case "date":
+		return d.Date, nil
+	case "clicks":
+		return d.Clicks, nil
+	case "uniques":
+		return d.Uniques, nil
+	}
+	return nil, unknownField(d, field)
+}
+
+// Clicks of a referrer as GraphQL object
+type gqlReferrer referrerClicks
+
+func (r gqlReferrer) typeName() string {
+	return "Referrer"
+}
+
+func (r gqlReferrer) resolve(x *gqlExecution, field string, args gqlArgs) (interface{}, error) {
+	switch field {
+	case "referrer":
+		return r.Referrer, nil
+	case "clicks":
+		return r.Clicks, nil
+	}
+	return nil, unknownField(r, field)
+}
+
+// struct graphqlRequest is a GraphQL request as POSTed by clients.
+type graphqlRequest struct {
+	Query         string                 `json:"query"`
+	OperationName string                 `json:"operationName"`
+	Variables     map[string]interface{} `json:"variables"`
+}
+
+// POST handler answering GraphQL queries about links, their stats and tags in one round trip, GET returns the schema.
+// Every field is authorized on its own: fields the request may not read are null and listed in the errors.
+func graphqlHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "graphqlHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		return
+	}
+	if r.Method == http.MethodGet {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		io.WriteString(w, graphqlSchema)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	uid, ok := signedInUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	failure := func(message string) {
+		respond(ctx, gqlResponse{Errors: []gqlError{{Message: message}}}, http.StatusBadRequest, w)
+	}
+	req := graphqlRequest{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&req)
+	if err != nil {
+		failure("unable to decode request body")
+		return
+	}
+	doc, err := parseGraphQL(req.Query)
+	if err != nil {
+		failure(err.Error())
+		return
+	}
+	x, op, err := newGraphQLExecution(ctx, doc, req.OperationName, req.Variables)
+	if err != nil {
+		failure(err.Error())
+		return
+	}
+	viewer := &gqlViewer{admin: isAdmin(r), uid: uid}
+	if !viewer.admin && idToken(r) == "" {
+		viewer.token = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	data := x.selectFields(gqlQuery{viewer}, op.Selections, nil)
+	w.Header().Set("Cache-Control", "private, no-cache")
+	respond(ctx, gqlResponse{Data: data, Errors: x.errors}, http.StatusOK, w)
+}
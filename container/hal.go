@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Media type of API responses with hypermedia links
+const halType = "application/hal+json"
+
+// struct halLink points at a related resource, as in HAL (https://tools.ietf.org/html/draft-kelly-json-hal).
+type halLink struct {
+	Href string `json:"href"`
+	// Media type of the resource, if it isn't JSON
+	Type string `json:"type,omitempty"`
+	// What to do with the resource, e.g. which methods it takes
+	Title string `json:"title,omitempty"`
+}
+
+// Links of a resource by relation, rendered as _links
+type halLinks map[string]halLink
+
+// Report whether an Accept header asks for HAL explicitly and ranks it at least as high as plain JSON.
+// Clients accepting anything keep getting plain JSON.
+func prefersHAL(accept string) bool {
+	if !strings.Contains(strings.ToLower(accept), halType) {
+		return false
+	}
+	hal := acceptQuality(accept, halType)
+	return hal > 0 && hal >= acceptQuality(accept, "application/json")
+}
+
+// Report whether the response goes to a client which asked for HAL
+func hypermedia(w http.ResponseWriter) bool {
+	negotiated, ok := w.(*negotiatedWriter)
+	return ok && negotiated.hal
+}
+
+// Absolute URL of an API path
+func apiURL(path string) string {
+	return fmt.Sprintf("https://%s%s", config.Domain, path)
+}
+
+// Resources related to a link. They need the same credentials as the link itself, except the public ones.
+func linkRelations(code string, l *link) halLinks {
+	links := halLinks{
+		"self":    {Href: apiURL("/api/v1/links/" + code)},
+		"short":   {Href: shortLink(code), Title: "redirects to the destination"},
+		"preview": {Href: shortLink(code) + "+", Type: "text/html", Title: "shows the destination without redirecting"},
+		"qr":      {Href: shortLink(code) + "/qr", Title: "QR code, PNG unless ?type= says otherwise"},
+		"edit":    {Href: apiURL("/s/" + code), Title: "PUT a new url to repoint, DELETE to remove"},
+		"resolve": {Href: apiURL("/api/v1/resolve/" + code), Title: "tells where the link pointed ?at= a time"},
+	}
+	if !l.NoAnalytics {
+		links["stats"] = halLink{Href: apiURL("/api/v1/links/" + code + "/stats")}
+	}
+	return links
+}
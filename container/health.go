@@ -0,0 +1,54 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// How long the readiness probe waits for the link store
+const readinessTimeout = 2 * time.Second
+
+// Single segment paths the router serves itself, they'd shadow links with these codes
+var reservedCodes = map[string]bool{
+	"healthz": true,
+	"readyz":  true,
+	"status":  true,
+	"metrics": true,
+	"graphql": true,
+}
+
+// Report whether a code is never issued, being a honeypot or a path of the service
+func isReserved(code string) bool {
+	return reservedCodes[code] || isHoneypot(code)
+}
+
+// GET handler for liveness probes, answering as long as the process serves requests
+func healthzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "healthzHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	respond(ctx, response{"", "ok!"}, http.StatusOK, w)
+}
+
+// GET handler for readiness probes, answering 503 while the link store can't be reached.
+// It reads a code which is never issued, so finding nothing is as good as finding something.
+func readyzHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "readyzHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+	defer cancel()
+	_, err := linkStorage.read(ctx, "readyz", 1)
+	if err != nil && err != storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to access link storage!"}, http.StatusServiceUnavailable, w)
+		return
+	}
+	respond(ctx, response{"", "ready!"}, http.StatusOK, w)
+}
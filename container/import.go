@@ -0,0 +1,168 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// Rows accepted per CSV import, larger lists should go through jobs
+const maxImportRows = maxBatchItems
+
+// struct importRow is a link to create from a row of an imported CSV file.
+type importRow struct {
+	// Record number in the file, counting from 1 including the header
+	Row  int    `json:"row"`
+	URL  string `json:"url"`
+	Code string `json:"code,omitempty"`
+}
+
+// struct importedLink is a row which became a link.
+type importedLink struct {
+	importRow
+	ShortURL string `json:"short_url"`
+	// How the URL was changed before shortening
+	Normalized *normalization `json:"normalized,omitempty"`
+}
+
+// struct importFailure is a row which didn't become a link.
+type importFailure struct {
+	importRow
+	// Machine readable reason, if there is one
+	Error   string `json:"error,omitempty"`
+	Message string `json:"message"`
+}
+
+// struct importReport sums up a CSV import.
+type importReport struct {
+	response
+	Created []importedLink `json:"created"`
+	// Rows whose custom code is taken, reserved, retired or repeated in the file
+	Collisions []importFailure `json:"collisions"`
+	// Rows which couldn't be read or whose URL was rejected
+	Invalid []importFailure `json:"invalid"`
+}
+
+// Read the rows of a CSV file of long_url,custom_code pairs, the code being optional.
+// A first line starting with long_url is taken as header. Malformed rows are returned as failures.
+func readImportRows(body io.Reader) ([]importRow, []importFailure, error) {
+	reader := csv.NewReader(body)
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	rows := []importRow{}
+	invalid := []importFailure{}
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		if line == 1 {
+			// Spreadsheets tend to start their exports with a byte order mark
+			record[0] = strings.TrimPrefix(record[0], "\ufeff")
+			if strings.EqualFold(strings.TrimSpace(record[0]), "long_url") {
+				continue
+			}
+		}
+		row := importRow{Row: line, URL: strings.TrimSpace(record[0])}
+		if len(record) > 1 {
+			row.Code = strings.TrimSpace(record[1])
+		}
+		switch {
+		case len(record) > 2:
+			invalid = append(invalid, importFailure{row, "", "rows should have a long_url and an optional custom_code!"})
+		case row.URL == "":
+			invalid = append(invalid, importFailure{row, "", "no url to shorten provided!"})
+		default:
+			rows = append(rows, row)
+		}
+		if len(rows)+len(invalid) > maxImportRows {
+			return nil, nil, fmt.Errorf("files may have at most %d rows, use a job for more", maxImportRows)
+		}
+	}
+	return rows, invalid, nil
+}
+
+// POST handler creating links from a CSV file of long_url,custom_code pairs, as request body or multipart "file".
+// ?tags= and ?owner= apply to all links. Answers with a report of created links, collisions and invalid rows.
+func importHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "importHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	uid, ok := signedInUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	var body io.Reader = io.LimitReader(r.Body, 16<<20)
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType == "multipart/form-data" {
+		r.Body = http.MaxBytesReader(w, r.Body, 16<<20)
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			respond(ctx, response{"", "multipart uploads need a file field!"}, http.StatusBadRequest, w)
+			return
+		}
+		defer file.Close()
+		body = file
+	}
+	rows, invalid, err := readImportRows(body)
+	if err != nil {
+		respond(ctx, response{"", "unable to read CSV: " + err.Error() + "!"}, http.StatusBadRequest, w)
+		return
+	}
+	if len(rows)+len(invalid) == 0 {
+		respond(ctx, response{"", "no rows to import!"}, http.StatusBadRequest, w)
+		return
+	}
+
+	report := importReport{Created: []importedLink{}, Collisions: []importFailure{}, Invalid: invalid}
+	// Rows repeating a custom code would overwrite each other, only the first one is created
+	seen := map[string]bool{}
+	unique := []importRow{}
+	for _, row := range rows {
+		if row.Code != "" && seen[row.Code] {
+			report.Collisions = append(report.Collisions, importFailure{row, "name_repeated", "custom code appears more than once in the file!"})
+			continue
+		}
+		seen[row.Code] = true
+		unique = append(unique, row)
+	}
+
+	tags := parseTags(r.URL.Query().Get("tags"))
+	owner := r.URL.Query().Get("owner")
+	registeredBy := registrant(r, uid)
+	results := make([]shortenResponse, len(unique))
+	statuses := make([]int, len(unique))
+	inParallel(len(unique), func(i int) {
+		req := shortenRequest{URL: unique[i].URL, CustomName: unique[i].Code, Tags: tags, Owner: owner, UID: uid, Registrant: registeredBy, ClaimToken: r.Header.Get("X-Claim-Token")}
+		results[i], statuses[i] = createLink(ctx, req)
+	})
+	for i, row := range unique {
+		resp := results[i]
+		switch {
+		case statuses[i] == http.StatusOK:
+			report.Created = append(report.Created, importedLink{row, resp.ShortenedURL, resp.Normalized})
+		case resp.Error == "name_taken" || resp.Error == "code_reserved" || resp.Error == "code_retired":
+			report.Collisions = append(report.Collisions, importFailure{row, resp.Error, resp.Message})
+		default:
+			report.Invalid = append(report.Invalid, importFailure{row, resp.Error, resp.Message})
+		}
+	}
+	for _, failures := range [][]importFailure{report.Collisions, report.Invalid} {
+		sort.Slice(failures, func(a, b int) bool { return failures[a].Row < failures[b].Row })
+	}
+	report.Message = fmt.Sprintf("%d links created, %d collisions, %d invalid rows", len(report.Created), len(report.Collisions), len(report.Invalid))
+	respond(ctx, report, http.StatusOK, w)
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// struct domainInsight aggregates the traffic of all links pointing to one destination domain.
+type domainInsight struct {
+	// Destination host, without a leading www.
+	Domain string `json:"domain"`
+	// Number of links pointing to the domain
+	Links int `json:"links"`
+	// Redirects to the domain within the range
+	Clicks int64 `json:"clicks"`
+	// Sum of the daily unique visitors of the links
+	Visitors int64 `json:"visitors"`
+	// Conversions reported for the domain's links and their share of clicks
+	Conversions    int64   `json:"conversions"`
+	ConversionRate float64 `json:"conversion_rate"`
+	// Share of all clicks within the range, between 0 and 1
+	Share float64 `json:"share"`
+	// Short code of the link with the most clicks
+	TopCode string `json:"top_code,omitempty"`
+}
+
+// struct domainInsightsResponse lists the destination domains by traffic.
+type domainInsightsResponse struct {
+	Owner   string          `json:"owner,omitempty"`
+	From    string          `json:"from"`
+	To      string          `json:"to"`
+	Clicks  int64           `json:"clicks"`
+	Domains []domainInsight `json:"domains"`
+}
+
+// Subject signed to grant access to the insights of an owner
+func insightsSubject(owner string) string {
+	return "insights:" + owner
+}
+
+// Signed link to the destination domain insights of an owner
+func insightsURL(owner string) string {
+	query := url.Values{"owner": {owner}, "sig": {sign(insightsSubject(owner))}}
+	return fmt.Sprintf("https://%s/api/v1/insights/domains?%s", config.Domain, query.Encode())
+}
+
+// Destination domain of a link, grouping www. with the bare domain
+func destinationDomain(destination string) string {
+	uri, err := url.Parse(destination)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimPrefix(strings.ToLower(uri.Hostname()), "www.")
+}
+
+// GET handler returning clicks of an owner's links grouped by destination domain, most visited first.
+// Requires the signature handed out on creation, or the admin token (which may omit the owner).
+func domainInsightsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "domainInsightsHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	owner := r.URL.Query().Get("owner")
+	if !isAdmin(r) && (owner == "" || !verifySignature(insightsSubject(owner), r.URL.Query().Get("sig"))) {
+		denyAccess(ctx, w, r, r.URL.Query().Get("sig"))
+		return
+	}
+	from, to, err := parseRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"), clock())
+	if err != nil {
+		respond(ctx, response{"", "from and to should be dates (YYYY-MM-DD) at most a year apart!"}, http.StatusBadRequest, w)
+		return
+	}
+
+	insights, err := domainInsights(ctx, owner, from, to)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	resp := domainInsightsResponse{Owner: owner, From: from.Format(rollupDate), To: to.Format(rollupDate), Domains: insights}
+	for _, d := range insights {
+		resp.Clicks += d.Clicks
+	}
+	for i := range resp.Domains {
+		if resp.Clicks > 0 {
+			resp.Domains[i].Share = float64(resp.Domains[i].Clicks) / float64(resp.Clicks)
+		}
+		if resp.Domains[i].Clicks > 0 {
+			resp.Domains[i].ConversionRate = float64(resp.Domains[i].Conversions) / float64(resp.Domains[i].Clicks)
+		}
+	}
+	respond(ctx, resp, http.StatusOK, w)
+}
+
+// Aggregate the rollups of an owner's links (all links for an empty owner) by destination domain
+func domainInsights(ctx context.Context, owner string, from time.Time, to time.Time) ([]domainInsight, error) {
+	ctx, span := tracer.Start(ctx, "domainInsights")
+	defer span.End()
+	domains := map[string]*domainInsight{}
+	top := map[string]int64{}
+	scope := linkScope{owner: owner}
+	err := scope.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil || !scope.includes(l) {
+			return nil
+		}
+		domain := destinationDomain(l.URL)
+		if domain == "" {
+			return nil
+		}
+		d, ok := domains[domain]
+		if !ok {
+			d = &domainInsight{Domain: domain}
+			domains[domain] = d
+		}
+		d.Links++
+		rollups, err := readRollups(ctx, code, from, to)
+		if err != nil {
+			return err
+		}
+		var clicks int64
+		for _, rollup := range rollups {
+			clicks += rollup.Clicks
+			d.Visitors += rollup.uniques()
+			d.Conversions += rollup.Conversions
+		}
+		d.Clicks += clicks
+		if clicks > top[domain] {
+			top[domain] = clicks
+			d.TopCode = code
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	insights := make([]domainInsight, 0, len(domains))
+	for _, d := range domains {
+		insights = append(insights, *d)
+	}
+	sort.Slice(insights, func(i, j int) bool {
+		if insights[i].Clicks != insights[j].Clicks {
+			return insights[i].Clicks > insights[j].Clicks
+		}
+		return insights[i].Domain < insights[j].Domain
+	})
+	return insights, nil
+}
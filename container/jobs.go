@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Kinds of bulk jobs
+const (
+	jobImport = "import"
+	jobDelete = "delete"
+	jobRetag  = "retag"
+	// Import from another shortener
+	jobMigrate = "migrate"
+)
+
+// States of bulk jobs
+const (
+	jobQueued  = "queued"
+	jobRunning = "running"
+	jobDone    = "done"
+)
+
+// Limits and timings of bulk jobs
+const (
+	maxJobItems  = 10000
+	maxJobErrors = 1000
+	// Items processed between two checkpoints
+	jobCheckpoint = 25
+	// How long a worker owns a job without checkpointing before others may take over
+	jobLease = 2 * time.Minute
+)
+
+// Errors of the job lifecycle
+var (
+	errJobBusy = errors.New("job is processed by another instance")
+	errJobLost = errors.New("job was taken over by another instance")
+)
+
+// struct jobRequest describes a bulk operation to run asynchronously.
+type jobRequest struct {
+	// Kind of job (import, delete, retag, migrate)
+	Kind string `json:"kind"`
+	// Links to create (import, migrate once resolved)
+	Links []shortenRequest `json:"links,omitempty"`
+	// Shortener to migrate from: bitly, tinyurl or rebrandly (migrate)
+	Source string `json:"source,omitempty"`
+	// Contents of a CSV export of the shortener (migrate)
+	Export string `json:"export,omitempty"`
+	// API token to list the links with instead of an export, and the Bitly group (migrate)
+	Token string `json:"token,omitempty"`
+	Group string `json:"group,omitempty"`
+	// Short codes to operate on (delete, retag)
+	Codes []string `json:"codes,omitempty"`
+	// Tags to add and remove (retag), add_tags also apply to migrated links
+	AddTags    []string `json:"add_tags,omitempty"`
+	RemoveTags []string `json:"remove_tags,omitempty"`
+}
+
+// struct jobError reports the failure of a single item.
+type jobError struct {
+	// Position of the item in the request
+	Index int `json:"index"`
+	// Short code or URL of the item
+	Item string `json:"item"`
+	// What went wrong
+	Error string `json:"error"`
+}
+
+// struct jobStatus is the progress of a bulk job as reported to clients.
+type jobStatus struct {
+	ID      string    `json:"id"`
+	Kind    string    `json:"kind"`
+	Status  string    `json:"status"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	// Number of items in the job
+	Total int `json:"total"`
+	// Number of items processed so far, successful or not
+	Processed int `json:"processed"`
+	// Number of items which failed
+	Failed int `json:"failed"`
+	// Failed items (at most maxJobErrors)
+	Errors []jobError `json:"errors"`
+	// Short links created by import and migrate jobs, by item index ("" for failures)
+	Results []string `json:"results,omitempty"`
+	// Migrated links which got a new code
+	Remapped []jobRemap `json:"remapped,omitempty"`
+}
+
+// struct job is the persisted state of a bulk job, including its input.
+type job struct {
+	jobStatus
+	Request jobRequest `json:"request"`
+	// Instance currently processing the job
+	Worker string `json:"worker,omitempty"`
+	// Time until which the worker owns the job
+	Lease time.Time `json:"lease,omitempty"`
+}
+
+// Name of the GCS object holding a job
+func jobObject(id string) string {
+	return "jobs/" + id + ".json"
+}
+
+// Number of items of a job request
+func (req *jobRequest) items() int {
+	if req.Kind == jobImport || req.Kind == jobMigrate {
+		return len(req.Links)
+	}
+	return len(req.Codes)
+}
+
+// Pick up unfinished jobs on one instance, also from instances which went away
+func startJobWorkers() {
+	startSingleton("resume-jobs", jobLease, resumeJobs)
+}
+
+// Queue unfinished jobs whose lease ran out
+func resumeJobs(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "resumeJobs")
+	defer span.End()
+	now := clock()
+	err := gcsListPrefix(ctx, "jobs/", func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			return nil
+		}
+		j := &job{}
+		if json.Unmarshal(data, j) != nil || j.Status == jobDone || now.Before(j.Lease) {
+			return nil
+		}
+		err = enqueue(ctx, "bulk-job", j.ID)
+		if err != nil {
+			slog.Error("unable to queue job", "job", j.ID, "err", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("unable to resume jobs: %v", err)
+	}
+	return nil
+}
+
+// Take the lease of a job for this instance, or refresh it at a checkpoint.
+// Fails if another instance holds the lease.
+func leaseJob(ctx context.Context, j *job) error {
+	ctx, span := tracer.Start(ctx, "leaseJob")
+	defer span.End()
+	content, generation, err := gcsReadGeneration(ctx, jobObject(j.ID))
+	if err != nil {
+		return err
+	}
+	stored := &job{}
+	err = json.Unmarshal([]byte(content), stored)
+	if err != nil {
+		return err
+	}
+	now := clock().UTC()
+	if stored.Worker != instanceID && now.Before(stored.Lease) {
+		if j.Worker == instanceID {
+			return errJobLost
+		}
+		return errJobBusy
+	}
+	j.Worker = instanceID
+	j.Lease = now.Add(jobLease)
+	j.Updated = now
+	marshalled, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	err = gcsWriteIfGeneration(ctx, jobObject(j.ID), "application/json", marshalled, generation)
+	if isPreconditionFailed(err) {
+		return errJobBusy
+	}
+	return err
+}
+
+// Process a job from where it was last checkpointed
+func runJob(ctx context.Context, id string) error {
+	ctx, span := tracer.Start(ctx, "runJob")
+	defer span.End()
+	data, _, err := gcsReadBlob(ctx, jobObject(id))
+	if err != nil {
+		return err
+	}
+	j := &job{}
+	err = json.Unmarshal(data, j)
+	if err != nil || j.Status == jobDone {
+		return err
+	}
+	j.Status = jobRunning
+	err = leaseJob(ctx, j)
+	if err != nil {
+		return err
+	}
+	if j.Request.Kind == jobMigrate && j.Results == nil {
+		err = resolveMigration(ctx, j)
+		if err != nil {
+			// Retrying won't fix a bad export or token, fail the job as a whole
+			j.Errors = append(j.Errors, jobError{0, j.Request.Source, redactError(err)})
+			j.Request.Export = ""
+			j.Request.Token = ""
+			j.Status = jobDone
+			j.Lease = time.Time{}
+			return leaseJob(ctx, j)
+		}
+		err = leaseJob(ctx, j)
+		if err != nil {
+			return err
+		}
+	}
+
+	total := j.Request.items()
+	for j.Processed < total {
+		i := j.Processed
+		item, err := processJobItem(ctx, j, i)
+		if err != nil {
+			j.Failed++
+			if len(j.Errors) < maxJobErrors {
+				j.Errors = append(j.Errors, jobError{i, item, redactError(err)})
+			}
+		}
+		j.Processed++
+		if j.Processed%jobCheckpoint == 0 && j.Processed < total {
+			err = leaseJob(ctx, j)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	j.Status = jobDone
+	j.Lease = time.Time{}
+	return leaseJob(ctx, j)
+}
+
+// Apply a job to its i-th item, returning a description of the item
+func processJobItem(ctx context.Context, j *job, i int) (string, error) {
+	ctx, span := tracer.Start(ctx, "processJobItem")
+	defer span.End()
+	switch j.Request.Kind {
+	case jobImport:
+		req := j.Request.Links[i]
+		resp, status := createLink(ctx, req)
+		if status != http.StatusOK {
+			return req.URL, errors.New(resp.Message)
+		}
+		j.Results[i] = resp.ShortenedURL
+		return req.URL, nil
+	case jobMigrate:
+		return migrateLink(ctx, j, i)
+	case jobDelete:
+		code := j.Request.Codes[i]
+		return code, deleteLink(ctx, code, false)
+	case jobRetag:
+		code := j.Request.Codes[i]
+		l, err := updateLink(ctx, code, func(l *link) error {
+			tags := []string{}
+			for _, tag := range l.Tags {
+				if !containsTag(j.Request.RemoveTags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+			for _, tag := range j.Request.AddTags {
+				if !containsTag(tags, tag) {
+					tags = append(tags, tag)
+				}
+			}
+			l.Tags = tags
+			l.emit(eventLinkUpdated, code, l.eventData())
+			return nil
+		})
+		if err == nil {
+			broadcast(eventLinkUpdated, code, l)
+		}
+		return code, err
+	}
+	return "", fmt.Errorf("unknown job kind %q", j.Request.Kind)
+}
+
+// Report whether a list of tags contains a tag
+func containsTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// POST handler submitting a bulk job, answering with 202 and the job's initial status
+func submitJobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "submitJobHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	req := jobRequest{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 16<<20)).Decode(&req)
+	if err != nil {
+		respond(ctx, response{"", "unable to decode request body!"}, http.StatusBadRequest, w)
+		return
+	}
+	if req.Kind != jobImport && req.Kind != jobDelete && req.Kind != jobRetag && req.Kind != jobMigrate {
+		respond(ctx, response{"", "kind should be import, delete, retag or migrate!"}, http.StatusBadRequest, w)
+		return
+	}
+	if req.Kind == jobMigrate {
+		req.Links = nil
+		req.AddTags = parseTags(strings.Join(req.AddTags, ","))
+		if !validSource(req.Source) {
+			respond(ctx, response{"", "source should be bitly, tinyurl or rebrandly!"}, http.StatusBadRequest, w)
+			return
+		}
+		if req.Export == "" && (req.Token == "" || req.Source == sourceTinyURL) {
+			respond(ctx, response{"", "migrations need an export, or a token for bitly and rebrandly!"}, http.StatusBadRequest, w)
+			return
+		}
+	} else if req.items() == 0 || req.items() > maxJobItems {
+		respond(ctx, response{"", fmt.Sprintf("a job needs between 1 and %d items!", maxJobItems)}, http.StatusBadRequest, w)
+		return
+	}
+	if req.Kind == jobRetag {
+		req.AddTags = parseTags(strings.Join(req.AddTags, ","))
+		req.RemoveTags = parseTags(strings.Join(req.RemoveTags, ","))
+		if len(req.AddTags) == 0 && len(req.RemoveTags) == 0 {
+			respond(ctx, response{"", "retag jobs need add_tags or remove_tags!"}, http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	random := make([]byte, 12)
+	rand.Read(random)
+	now := clock().UTC()
+	j := &job{jobStatus: jobStatus{ID: hex.EncodeToString(random), Kind: req.Kind, Status: jobQueued, Created: now, Updated: now, Total: req.items(), Errors: []jobError{}}, Request: req}
+	if req.Kind == jobImport {
+		j.Results = make([]string, len(req.Links))
+	}
+	marshalled, err := json.Marshal(j)
+	if err == nil {
+		err = gcsWriteIfGeneration(ctx, jobObject(j.ID), "application/json", marshalled, 0)
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	err = enqueue(ctx, "bulk-job", j.ID)
+	if err != nil {
+		// resumeJobs picks the job up later
+		slog.Error("unable to queue job", "job", j.ID, "err", err)
+	}
+	w.Header().Set("Location", "/api/v1/jobs/"+j.ID)
+	respond(ctx, j.jobStatus, http.StatusAccepted, w)
+}
+
+// GET handler reporting the progress and per-item errors of a bulk job
+func jobHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "jobHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	data, _, err := gcsReadBlob(ctx, jobObject(mux.Vars(r)["id"]))
+	if err != nil {
+		respond(ctx, response{"", "unable to find job!"}, http.StatusNotFound, w)
+		return
+	}
+	j := &job{}
+	err = json.Unmarshal(data, j)
+	if err != nil {
+		respond(ctx, response{"", "unable to decode job!"}, http.StatusInternalServerError, w)
+		return
+	}
+	respond(ctx, j.jobStatus, http.StatusOK, w)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/jung-kurt/gofpdf"
+)
+
+// Default label size
+const defaultLabelSize = "2x1"
+
+// struct labelSize is the size of a label in millimetres.
+type labelSize struct {
+	Width  float64
+	Height float64
+}
+
+// Common label sizes of thermal and sheet label printers
+var labelSizes = map[string]labelSize{
+	"1x1":             {25.4, 25.4},
+	"2x1":             {50.8, 25.4},
+	"3x2":             {76.2, 50.8},
+	"4x6":             {101.6, 152.4},
+	"dymo-11354":      {57, 32},
+	"dymo-99012":      {89, 36},
+	"brother-dk11201": {90, 29},
+	"brother-dk11204": {54, 17},
+	"avery-22805":     {38.1, 38.1},
+}
+
+// GET handler rendering a printable PDF label with the QR code and short URL of a link.
+// ?size= picks one of labelSizes, LABEL_LOGO adds a logo image unless ?logo=false.
+func labelHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "labelHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	name := strings.ToLower(r.URL.Query().Get("size"))
+	if name == "" {
+		name = defaultLabelSize
+	}
+	size, ok := labelSizes[name]
+	if !ok {
+		names := []string{}
+		for n := range labelSizes {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "size should be one of " + strings.Join(names, ", ") + "!"}, http.StatusBadRequest, w)
+		return
+	}
+	code := mux.Vars(r)["id"]
+	_, err := readLink(ctx, code)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return
+	}
+
+	logo := policySetting("LABEL_LOGO")
+	if r.URL.Query().Get("logo") == "false" {
+		logo = ""
+	}
+	label, err := renderLabel(ctx, code, size, logo)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "unable to render label!"}, http.StatusInternalServerError, w)
+		return
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", "inline; filename=\""+code+"-"+name+".pdf\"")
+	w.Write(label)
+}
+
+// Lay out a single label: QR code on the left (or top of tall labels), short URL and logo beside it
+func renderLabel(ctx context.Context, code string, size labelSize, logo string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "renderLabel")
+	defer span.End()
+	const margin = 2.0
+	orientation := "L"
+	if size.Height > size.Width {
+		orientation = "P"
+	}
+	pdf := gofpdf.NewCustom(&gofpdf.InitType{
+		OrientationStr: orientation,
+		UnitStr:        "mm",
+		Size:           gofpdf.SizeType{Wd: size.Width, Ht: size.Height},
+	})
+	// Dated by the clock rather than the PDF library, so a frozen clock renders the same label every time
+	now := clock()
+	pdf.SetCreationDate(now)
+	pdf.SetModificationDate(now)
+	pdf.SetMargins(0, 0, 0)
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.AddPage()
+
+	image, err := qrPNG(code, 512)
+	if err != nil {
+		return nil, err
+	}
+	options := gofpdf.ImageOptions{ImageType: "PNG"}
+	pdf.RegisterImageOptionsReader(code, options, bytes.NewReader(image))
+
+	// Area left for the text and logo next to the QR code
+	var textX, textY, textW, textH float64
+	if orientation == "P" {
+		qrSize := size.Width - 2*margin
+		pdf.ImageOptions(code, margin, margin, qrSize, qrSize, false, options, 0, "")
+		textX, textY, textW, textH = margin, 2*margin+qrSize, qrSize, size.Height-3*margin-qrSize
+	} else {
+		qrSize := size.Height - 2*margin
+		pdf.ImageOptions(code, margin, margin, qrSize, qrSize, false, options, 0, "")
+		textX, textY, textW, textH = 2*margin+qrSize, margin, size.Width-3*margin-qrSize, qrSize
+	}
+	if textW <= 0 || textH <= 0 {
+		return outputPDF(pdf)
+	}
+
+	if logo != "" {
+		logoH := textH / 2
+		pdf.ImageOptions(logo, textX, textY, 0, logoH, false, gofpdf.ImageOptions{ReadDpi: true}, 0, "")
+		textY += logoH
+		textH -= logoH
+	}
+
+	// Shrink the short URL until it fits the width
+	text := strings.TrimPrefix(shortLink(code), "https://")
+	fontSize := 14.0
+	pdf.SetFont("Helvetica", "B", fontSize)
+	for fontSize > 4 && pdf.GetStringWidth(text) > textW {
+		fontSize--
+		pdf.SetFontSize(fontSize)
+	}
+	pdf.SetXY(textX, textY)
+	pdf.CellFormat(textW, textH, text, "", 0, "C", false, 0, "")
+	return outputPDF(pdf)
+}
+
+// Render a finished PDF document
+func outputPDF(pdf *gofpdf.Fpdf) ([]byte, error) {
+	if pdf.Err() {
+		return nil, pdf.Error()
+	}
+	buffer := new(bytes.Buffer)
+	err := pdf.Output(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
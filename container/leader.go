@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Random identifier of this instance, used to own leases
+var instanceID = func() string {
+	random := make([]byte, 8)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}()
+
+// struct lease records which instance runs a singleton background job.
+type lease struct {
+	// Name of the singleton job
+	Name string `json:"name"`
+	// Instance holding the lease
+	Holder string `json:"holder"`
+	// Time the holder acquired the lease
+	Acquired time.Time `json:"acquired"`
+	// Time until which the lease is held unless renewed
+	Expires time.Time `json:"expires"`
+}
+
+// Name of the GCS object holding a lease
+func leaseObject(name string) string {
+	return "leases/" + name + ".json"
+}
+
+// Take or renew the lease of a singleton job for this instance.
+// Returns false if another instance holds an unexpired lease or acquired it concurrently.
+func acquireLease(ctx context.Context, name string, ttl time.Duration) (bool, error) {
+	ctx, span := tracer.Start(ctx, "acquireLease")
+	defer span.End()
+	now := clock().UTC()
+	current := lease{}
+	content, generation, err := gcsReadGeneration(ctx, leaseObject(name))
+	if err != nil && err != storage.ErrObjectNotExist {
+		return false, err
+	}
+	if err == nil {
+		err = json.Unmarshal([]byte(content), &current)
+		if err != nil {
+			return false, err
+		}
+		if current.Holder != instanceID && now.Before(current.Expires) {
+			return false, nil
+		}
+	}
+	next := lease{name, instanceID, current.Acquired, now.Add(ttl)}
+	if current.Holder != instanceID {
+		next.Acquired = now
+	}
+	marshalled, err := json.Marshal(next)
+	if err != nil {
+		return false, err
+	}
+	err = gcsWriteIfGeneration(ctx, leaseObject(name), "application/json", marshalled, generation)
+	if isPreconditionFailed(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if current.Holder != instanceID {
+		slog.Info("instance took over singleton task", "instance", instanceID, "task", name)
+	}
+	return true, nil
+}
+
+// Run a background job every interval on exactly one instance.
+// The leader renews its lease on every run and while a run takes, others take over once it stops doing so.
+func startSingleton(name string, interval time.Duration, run func(ctx context.Context) error) {
+	// Outlive the interval, so the leader renews before others may take over
+	ttl := interval + interval/2
+	go func() {
+		for range time.Tick(interval) {
+			leader, err := acquireLease(context.Background(), name, ttl)
+			if err != nil {
+				slog.Error("unable to acquire lease", "task", name, "err", err)
+				continue
+			}
+			if !leader {
+				continue
+			}
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go holdLease(ctx, name, ttl, cancel, done)
+			err = run(ctx)
+			close(done)
+			cancel()
+			if err != nil {
+				slog.Error("singleton task failed", "task", name, "err", err)
+			}
+		}
+	}()
+}
+
+// Renew the lease of a running singleton job until it's done.
+// Cancels the run if the lease can't be renewed, as another instance may take over once it expires.
+func holdLease(ctx context.Context, name string, ttl time.Duration, cancel context.CancelFunc, done <-chan struct{}) {
+	ticker := time.NewTicker(ttl / 3)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		leader, err := acquireLease(ctx, name, ttl)
+		if err != nil || !leader {
+			slog.Error("lost lease of running singleton task, cancelling it", "task", name, "err", err)
+			cancel()
+			return
+		}
+	}
+}
+
+// GET handler listing the leases of singleton background jobs
+func leasesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "leasesHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	leases := []lease{}
+	err := gcsListPrefix(ctx, "leases/", func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			return err
+		}
+		l := lease{}
+		if json.Unmarshal(data, &l) == nil {
+			leases = append(leases, l)
+		}
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(leases, func(i, j int) bool { return leases[i].Name < leases[j].Name })
+	respond(ctx, struct {
+		Instance string  `json:"instance"`
+		Leases   []lease `json:"leases"`
+	}{instanceID, leases}, http.StatusOK, w)
+}
@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Number of attempts at a conditional link update before giving up
+const updateAttempts = 5
+
+// struct link is the record stored for every short code.
+// Older deployments stored the bare long URL as object content, which is still understood when reading.
+type link struct {
+	// Destination of the short link
+	URL string `json:"url"`
+	// Time the link was created (zero for legacy objects)
+	Created time.Time `json:"created,omitempty"`
+	// Serve an inline viewer for direct media/file destinations instead of redirecting
+	MediaViewer bool `json:"media_viewer,omitempty"`
+	// Free-form labels used to group links into bundles
+	Tags []string `json:"tags,omitempty"`
+	// Contact of whoever created the link, used for expiry reminders
+	Owner string `json:"owner,omitempty"`
+	// Firebase UID of the signed-in user who created the link, empty for anonymous links
+	UID string `json:"uid,omitempty"`
+	// ID of whoever registered the custom name, to unwind squatting
+	Registrant string `json:"registrant,omitempty"`
+	// Time after which the link stops redirecting (zero means never)
+	Expires time.Time `json:"expires,omitempty"`
+	// Delete the destination after the first successful redirect
+	BurnAfterReading bool `json:"burn_after_reading,omitempty"`
+	// Time a burn-after-reading link was used (its URL is gone afterwards)
+	Consumed time.Time `json:"consumed,omitempty"`
+	// Never record or enrich clicks on this link
+	NoAnalytics bool `json:"no_analytics,omitempty"`
+	// Destinations of an A/B split link (URL holds the first one)
+	Variants []variant `json:"variants,omitempty"`
+	// Shift split traffic towards the best converting variant
+	Bandit bool `json:"bandit,omitempty"`
+	// Set while the link is quarantined, visitors get a warning instead of a redirect
+	Quarantine *quarantine `json:"quarantine,omitempty"`
+	// Append a signed click ID to the destination for conversion postbacks
+	TrackConversions bool `json:"track_conversions,omitempty"`
+	// Events about changes of the link which weren't delivered yet, written together with the change
+	Outbox []event `json:"outbox,omitempty"`
+	// Structured content served instead of redirecting (URL holds its URI form)
+	Payload *payload `json:"payload,omitempty"`
+	// Anyone may embed the stats widget, otherwise it needs the signed embed URL
+	PublicStats bool `json:"public_stats,omitempty"`
+	// Previous destinations of a repointed link, oldest first
+	History []revision `json:"history,omitempty"`
+	// Clicks so far, added to the record whenever pending clicks are flushed
+	Clicks int64 `json:"clicks,omitempty"`
+	// Time of the latest counted click, zero while the link has no counter yet
+	LastClick time.Time `json:"last_click,omitempty"`
+	// HTTP status of redirects (301, 302, 307 or 308), zero for the deployment's REDIRECT_STATUS
+	RedirectStatus int `json:"redirect_status,omitempty"`
+	// Shown instead of the generic error once the link has expired, been consumed or deleted
+	Fallback *fallback `json:"fallback,omitempty"`
+}
+
+// Report whether a new link is the same as an existing one, so the existing one can be handed out instead.
+// Burn-after-reading links are never shared, and neither are links whose state changed since creation.
+func (l *link) sameAs(existing *link) bool {
+	if l.BurnAfterReading || existing.BurnAfterReading || existing.Quarantine != nil || len(existing.History) > 0 {
+		return false
+	}
+	settings := func(l *link) []byte {
+		c := *l
+		c.Created, c.Outbox, c.Clicks, c.LastClick = time.Time{}, nil, 0, time.Time{}
+		marshalled, _ := json.Marshal(c)
+		return marshalled
+	}
+	return bytes.Equal(settings(l), settings(existing))
+}
+
+// Split a comma separated tag list, dropping empty entries
+func parseTags(raw string) []string {
+	var tags []string
+	for _, tag := range strings.Split(raw, ",") {
+		tag = strings.ToLower(strings.TrimSpace(tag))
+		if tag != "" {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
+
+// Report whether a link leads to a web page, which screenshots, fingerprints and reputations apply to
+func (l *link) webDestination() bool {
+	return l.Payload == nil && !l.contact()
+}
+
+// Report whether a link carries a tag
+func (l *link) hasTag(tag string) bool {
+	for _, t := range l.Tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// Decode the content of a stored object into a link, accepting the legacy plain URL format
+func decodeLink(data []byte) (*link, error) {
+	trimmed := bytes.TrimSpace(data)
+	if len(trimmed) == 0 || trimmed[0] != '{' {
+		return &link{URL: string(trimmed)}, nil
+	}
+	l := &link{}
+	err := json.Unmarshal(trimmed, l)
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// Read and decode the link stored for a short code
+func readLink(ctx context.Context, code string) (*link, error) {
+	ctx, span := tracer.Start(ctx, "readLink")
+	defer span.End()
+	rec, err := linkStorage.read(ctx, code, 0)
+	if err != nil {
+		return nil, err
+	}
+	return decodeLink(rec.data)
+}
+
+// Encode and store the link for a short code if the record is still at generation (0 means it doesn't exist),
+// dispatching the events in its outbox
+func writeLinkIfGeneration(ctx context.Context, code string, l *link, generation int64) error {
+	ctx, span := tracer.Start(ctx, "writeLink")
+	defer span.End()
+	marshalled, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	err = linkStorage.write(ctx, code, marshalled, generation)
+	if err == nil && len(l.Outbox) > 0 {
+		dispatchLater(ctx, code)
+	}
+	return err
+}
+
+// Apply a change to the stored link of a code, retrying when another request wrote it concurrently
+func updateLink(ctx context.Context, code string, change func(l *link) error) (*link, error) {
+	ctx, span := tracer.Start(ctx, "updateLink")
+	defer span.End()
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		rec, err := linkStorage.read(ctx, code, 0)
+		if err != nil {
+			return nil, err
+		}
+		l, err := decodeLink(rec.data)
+		if err != nil {
+			return nil, err
+		}
+		err = change(l)
+		if err != nil {
+			return nil, err
+		}
+		marshalled, err := json.Marshal(l)
+		if err != nil {
+			return nil, err
+		}
+		err = linkStorage.write(ctx, code, marshalled, rec.generation)
+		if err == nil {
+			if len(l.Outbox) > 0 {
+				dispatchLater(ctx, code)
+			}
+			return l, nil
+		}
+		if !isPreconditionFailed(err) {
+			return nil, err
+		}
+	}
+	return nil, errors.New("link kept changing, giving up")
+}
+
+// Delete a link, leaving a tombstone, and publish its deletion.
+// The tombstone keeps the link's fallback if asked to, i.e. when its creator deletes it.
+// The event is stored before the deletion and only delivered once the link is gone.
+func deleteLink(ctx context.Context, code string, keepFallback bool) error {
+	ctx, span := tracer.Start(ctx, "deleteLink")
+	defer span.End()
+	l, err := readLink(ctx, code)
+	if err != nil {
+		return err
+	}
+	err = writeTombstone(ctx, code, l, keepFallback)
+	if err != nil {
+		return err
+	}
+	var e event
+	if eventsEnabled() {
+		e = newEvent(eventLinkDeleted, code, nil)
+		err = storeEvent(ctx, e)
+		if err != nil {
+			return err
+		}
+	}
+	err = linkStorage.delete(ctx, code)
+	if err != nil {
+		return err
+	}
+	err = unindexOwner(ctx, code, l)
+	if err != nil {
+		slog.Error("unable to remove link from owner index", "code", code, "err", err)
+	}
+	if e.ID == "" {
+		return nil
+	}
+	err = enqueue(ctx, "dispatch-event", outboxObject(e.ID))
+	if err != nil {
+		slog.Error("unable to queue deletion event", "code", code, "err", err)
+	}
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Default and maximum number of links per page of the links API
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// Stops listing links once a page is full
+var errPageFull = errors.New("page is full")
+
+// struct listedLink is a link as returned by the links API.
+type listedLink struct {
+	Code     string     `json:"code"`
+	ShortURL string     `json:"short_url"`
+	URL      string     `json:"url"`
+	Created  time.Time  `json:"created,omitempty"`
+	Expires  *time.Time `json:"expires,omitempty"`
+	Tags     []string   `json:"tags,omitempty"`
+	// Signed-in user owning the link
+	UID string `json:"uid,omitempty"`
+	// Clicks so far, omitted for links opted out of analytics
+	Clicks *int64 `json:"clicks,omitempty"`
+	// Time of the latest counted click
+	LastClick *time.Time `json:"last_click,omitempty"`
+	// Related resources, for clients asking for HAL
+	Links halLinks `json:"_links,omitempty"`
+}
+
+// struct linksResponse is a page of the links API.
+type linksResponse struct {
+	response
+	Owner string `json:"owner,omitempty"`
+	// Signed-in user whose links are listed
+	UID   string       `json:"uid,omitempty"`
+	Links []listedLink `json:"links"`
+	// Cursor of the next page, empty on the last one
+	NextCursor string `json:"next_cursor,omitempty"`
+	// This page and the next one, for clients asking for HAL
+	Pages halLinks `json:"_links,omitempty"`
+}
+
+// Subject signed for listing the links of an owner
+func linksSubject(owner string) string {
+	return "links:" + owner
+}
+
+// Signed link to the list of an owner's links
+func linksURL(owner string) string {
+	query := url.Values{"owner": {owner}, "sig": {sign(linksSubject(owner))}}
+	return fmt.Sprintf("https://%s/api/v1/links?%s", config.Domain, query.Encode())
+}
+
+// Sum the clicks of all rollups of a code
+func totalClicks(ctx context.Context, code string) (int64, error) {
+	var clicks int64
+	err := gcsListPrefix(ctx, fmt.Sprintf("rollups/%s/", code), func(name string) error {
+		date := strings.TrimSuffix(name[strings.LastIndex(name, "/")+1:], ".json")
+		rollup, err := readRollup(ctx, code, date)
+		if err != nil {
+			return err
+		}
+		clicks += rollup.Clicks
+		return nil
+	})
+	return clicks, err
+}
+
+// Describe a link for lists of links, from its record alone.
+// Links which weren't clicked since they got a counter have no clicks to show.
+func describeLink(code string, l *link) listedLink {
+	listed := listedLink{Code: code, ShortURL: shortLink(code), URL: l.URL, Created: l.Created, Tags: l.Tags, UID: l.UID}
+	if !l.Expires.IsZero() {
+		listed.Expires = &l.Expires
+	}
+	if !l.NoAnalytics && !l.LastClick.IsZero() {
+		clicks := l.Clicks
+		listed.Clicks, listed.LastClick = &clicks, &l.LastClick
+	}
+	return listed
+}
+
+// Describe a single link for the links API, with the clicks of its counter.
+// Links which weren't clicked since they got a counter are summed up from their rollups.
+func listLink(ctx context.Context, code string, l *link) (listedLink, error) {
+	listed := describeLink(code, l)
+	if l.NoAnalytics || listed.Clicks != nil {
+		return listed, nil
+	}
+	clicks, err := totalClicks(ctx, code)
+	if err != nil {
+		return listed, err
+	}
+	listed.Clicks = &clicks
+	return listed, nil
+}
+
+// Visit up to limit links of a scope matching a filter (nil for all) in code order, starting after a code.
+// Listing starts at the cursor and stops with the page, and scoped listings only go through the owner index,
+// so only the scope's links up to the end of the page are read.
+// Returns the cursor of the next page, empty on the last one. With a filter the next page may turn out empty.
+func pageLinks(ctx context.Context, scope linkScope, after string, limit int, match func(code string, l *link) bool, visit func(code string, l *link) error) (string, error) {
+	ctx, span := tracer.Start(ctx, "pageLinks")
+	defer span.End()
+	visited, last, next := 0, "", ""
+	err := scope.list(ctx, after, func(code string) error {
+		if visited == limit {
+			// There is at least one more code
+			next = base64.RawURLEncoding.EncodeToString([]byte(last))
+			return errPageFull
+		}
+		l, err := readLink(ctx, code)
+		if err != nil || !scope.includes(l) || match != nil && !match(code, l) {
+			return nil
+		}
+		visited, last = visited+1, code
+		return visit(code, l)
+	})
+	if err == errPageFull {
+		err = nil
+	}
+	return next, err
+}
+
+// GET handler listing an owner's links in code order, ?limit= at a time.
+// Pass ?cursor= with the next_cursor of a page to get the following one.
+// Requires the signature handed out on creation, or the admin token (which may omit the owner to list all links).
+// Signed-in users get their own links with their ID token, narrowed down to an owner if one is given.
+func listLinksHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "listLinksHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	owner := query.Get("owner")
+	uid, ok := signedInUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	if !isAdmin(r) && uid == "" && (owner == "" || !verifySignature(linksSubject(owner), query.Get("sig"))) {
+		denyAccess(ctx, w, r, query.Get("sig"))
+		return
+	}
+	limit, err := strconv.Atoi(query.Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultPageSize
+	}
+	if limit > maxPageSize {
+		limit = maxPageSize
+	}
+	after := ""
+	if query.Get("cursor") != "" {
+		decoded, err := base64.RawURLEncoding.DecodeString(query.Get("cursor"))
+		if err != nil {
+			respond(ctx, response{"", "invalid cursor!"}, http.StatusBadRequest, w)
+			return
+		}
+		after = string(decoded)
+	}
+
+	resp := linksResponse{Owner: owner, UID: uid, Links: []listedLink{}}
+	resp.NextCursor, err = pageLinks(ctx, linkScope{owner, uid}, after, limit, nil, func(code string, l *link) error {
+		listed := describeLink(code, l)
+		if hypermedia(w) {
+			listed.Links = linkRelations(code, l)
+		}
+		resp.Links = append(resp.Links, listed)
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	resp.Message = fmt.Sprintf("%d links", len(resp.Links))
+	if hypermedia(w) {
+		resp.Pages = halLinks{"self": {Href: apiURL(r.URL.RequestURI())}}
+		if resp.NextCursor != "" {
+			query.Set("cursor", resp.NextCursor)
+			resp.Pages["next"] = halLink{Href: apiURL(r.URL.Path + "?" + query.Encode())}
+		}
+	}
+	respond(ctx, resp, http.StatusOK, w)
+}
+
+// GET handler describing a single link including its clicks, for its creator (manage token) or admins
+func linkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "linkHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		return
+	}
+	code := mux.Vars(r)["id"]
+	l, ok := readManagedLink(ctx, w, r, code)
+	if !ok {
+		return
+	}
+	listed, err := listLink(ctx, code, l)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if hypermedia(w) {
+		listed.Links = linkRelations(code, l)
+	}
+	w.Header().Set("Cache-Control", "private, no-cache")
+	respond(ctx, listed, http.StatusOK, w)
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Type of the live update sent after clicks were added to a link's counter
+const liveClicksChanged = "clicks.changed"
+
+// Limits and timings of live update sessions
+const (
+	// Sessions served by one instance at a time
+	maxLiveSessions = 1000
+	// Updates queued for a session before it counts as too slow and is closed
+	liveQueue = 64
+	// Size of a message from the dashboard, only subscriptions are sent
+	maxLiveMessage = 4096
+	// Time between two pings keeping idle connections and load balancers alive
+	livePing = 30 * time.Second
+	// Time without any frame from the dashboard after which it counts as gone
+	liveIdleTimeout = 75 * time.Second
+	// Links changed on other instances count as created if their record is younger than this
+	liveCreatedWindow = 10 * time.Second
+)
+
+// struct liveEvent is a change pushed to dashboards, shaped like outbox events.
+type liveEvent struct {
+	Type string      `json:"type"`
+	Code string      `json:"code"`
+	Time time.Time   `json:"time"`
+	Data interface{} `json:"data"`
+	// Who may see it
+	owner string
+	uid   string
+	tags  []string
+}
+
+// struct liveLinkData describes a link in created and updated live updates.
+type liveLinkData struct {
+	linkEventData
+	Clicks int64 `json:"clicks"`
+}
+
+// struct liveClickData holds a link's counter in clicks.changed live updates.
+type liveClickData struct {
+	Clicks    int64     `json:"clicks"`
+	LastClick time.Time `json:"last_click"`
+}
+
+// struct liveSubscription is a message from a dashboard replacing the tags it follows, none for all its links.
+type liveSubscription struct {
+	Type string   `json:"type"`
+	Tags []string `json:"tags"`
+}
+
+// struct liveSession is a dashboard connected to this instance and the links it sees.
+type liveSession struct {
+	ws *wsConn
+	// Viewer, one of them is set
+	admin bool
+	uid   string
+	owner string
+	// Followed tags, lower case, nil for all
+	tags  map[string]bool
+	queue chan []byte
+	done  chan struct{}
+	once  sync.Once
+}
+
+// Dashboards connected to this instance
+var live = struct {
+	sync.RWMutex
+	sessions map[*liveSession]bool
+}{sessions: map[*liveSession]bool{}}
+
+// Describe a change of a link for dashboards
+func newLiveEvent(eventType string, code string, l *link) liveEvent {
+	e := liveEvent{Type: eventType, Code: code, Time: clock().UTC(), owner: l.Owner, uid: l.UID, tags: l.Tags}
+	if eventType == liveClicksChanged {
+		e.Data = liveClickData{l.Clicks, l.LastClick}
+	} else {
+		e.Data = liveLinkData{l.eventData(), l.Clicks}
+	}
+	return e
+}
+
+// Push a change of a link to the dashboards which see it, without waiting for any of them
+func broadcast(eventType string, code string, l *link) {
+	live.RLock()
+	defer live.RUnlock()
+	if len(live.sessions) == 0 {
+		return
+	}
+	e := newLiveEvent(eventType, code, l)
+	marshalled, err := json.Marshal(e)
+	if err != nil {
+		slog.Error("unable to marshal live update", "code", code, "err", err)
+		return
+	}
+	for s := range live.sessions {
+		if !s.sees(e) {
+			continue
+		}
+		select {
+		case s.queue <- marshalled:
+		default:
+			go s.end(wsTryAgainLater, "too slow, reconnect")
+		}
+	}
+}
+
+// Report whether a session is allowed to see a change and follows it, called with live locked
+func (s *liveSession) sees(e liveEvent) bool {
+	switch {
+	case s.admin:
+	case s.uid != "":
+		if e.uid != s.uid {
+			return false
+		}
+	case e.owner != s.owner:
+		return false
+	}
+	if s.tags == nil {
+		return true
+	}
+	for _, tag := range e.tags {
+		if s.tags[strings.ToLower(tag)] {
+			return true
+		}
+	}
+	return false
+}
+
+// Follow only links with one of some tags, all links without any
+func (s *liveSession) follow(tags []string) {
+	var followed map[string]bool
+	if len(tags) > 0 {
+		followed = map[string]bool{}
+		for _, tag := range tags {
+			followed[strings.ToLower(tag)] = true
+		}
+	}
+	live.Lock()
+	s.tags = followed
+	live.Unlock()
+}
+
+// Close a session once, telling the dashboard why
+func (s *liveSession) end(status int, reason string) {
+	s.once.Do(func() {
+		live.Lock()
+		delete(live.sessions, s)
+		live.Unlock()
+		close(s.done)
+		s.ws.close(status, reason)
+	})
+}
+
+// Send queued updates and pings until the session ends
+func (s *liveSession) write() {
+	ping := time.NewTicker(livePing)
+	defer ping.Stop()
+	for {
+		var err error
+		select {
+		case <-s.done:
+			return
+		case message := <-s.queue:
+			err = s.ws.writeText(message)
+		case <-ping.C:
+			err = s.ws.writeFrame(wsPing, nil)
+		}
+		if err != nil {
+			s.end(wsGoingAway, "")
+			return
+		}
+	}
+}
+
+// Take subscriptions from the dashboard until it goes away
+func (s *liveSession) read() {
+	for {
+		opcode, message, err := s.ws.readMessage(maxLiveMessage, liveIdleTimeout)
+		switch {
+		case err == io.EOF:
+			s.end(wsNormalClosure, "")
+			return
+		case err == errFrameTooBig:
+			s.end(wsTooBig, "messages are limited to 4096 bytes")
+			return
+		case err != nil:
+			s.end(wsPolicyViolation, "")
+			return
+		case opcode != wsText:
+			s.end(wsUnsupportedData, "only text messages are understood")
+			return
+		}
+		subscription := liveSubscription{}
+		if json.Unmarshal(message, &subscription) != nil || subscription.Type != "subscribe" {
+			s.end(wsUnsupportedData, `expected {"type": "subscribe", "tags": [...]}`)
+			return
+		}
+		s.follow(subscription.Tags)
+		s.acknowledge(subscription.Tags)
+	}
+}
+
+// Confirm the tags a session follows
+func (s *liveSession) acknowledge(tags []string) {
+	if tags == nil {
+		tags = []string{}
+	}
+	marshalled, _ := json.Marshal(liveSubscription{"subscribed", tags})
+	select {
+	case s.queue <- marshalled:
+	default:
+	}
+}
+
+// GET handler upgrading to a WebSocket which pushes created and updated links and click counts.
+// Dashboards see the links they could list: all with the admin token, their own with an ID token,
+// or an owner's with its signature. Browsers can't set headers on WebSockets, so tokens may come as ?access_token=.
+func liveHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "liveHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	query := r.URL.Query()
+	if r.Header.Get("Authorization") == "" && query.Get("access_token") != "" {
+		r.Header.Set("Authorization", "Bearer "+query.Get("access_token"))
+	}
+	owner := query.Get("owner")
+	uid, ok := signedInUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	admin := isAdmin(r)
+	if !admin && uid == "" && (owner == "" || !verifySignature(linksSubject(owner), query.Get("sig"))) {
+		denyAccess(ctx, w, r, query.Get("sig"))
+		return
+	}
+	if !isWebSocketRequest(r) {
+		w.Header().Set("Upgrade", "websocket")
+		respond(ctx, response{"", "websocket upgrade required!"}, http.StatusUpgradeRequired, w)
+		return
+	}
+	live.RLock()
+	full := len(live.sessions) >= maxLiveSessions
+	live.RUnlock()
+	if full {
+		w.Header().Set("Retry-After", "30")
+		respond(ctx, response{"", "too many live sessions, try again later!"}, http.StatusServiceUnavailable, w)
+		return
+	}
+	ws, err := upgradeWebSocket(w, r)
+	if err == errNotWebSocket {
+		respond(ctx, response{"", "invalid websocket handshake!"}, http.StatusBadRequest, w)
+		return
+	}
+	if err != nil {
+		slog.Error("unable to upgrade to websocket", "err", err)
+		return
+	}
+
+	s := &liveSession{ws: ws, admin: admin, uid: uid, queue: make(chan []byte, liveQueue), done: make(chan struct{})}
+	if !admin && uid == "" {
+		s.owner = owner
+	}
+	s.follow(query["tag"])
+	live.Lock()
+	live.sessions[s] = true
+	live.Unlock()
+	s.acknowledge(query["tag"])
+	// The handler returns right away, so the session doesn't hold a request slot
+	go s.write()
+	go s.read()
+}
+
+// Tell all dashboards this instance goes away, so they reconnect to another one
+func closeLiveSessions() {
+	live.RLock()
+	sessions := make([]*liveSession, 0, len(live.sessions))
+	for s := range live.sessions {
+		sessions = append(sessions, s)
+	}
+	live.RUnlock()
+	for _, s := range sessions {
+		s.end(wsGoingAway, "shutting down")
+	}
+}
+
+// Pass links changed on other instances on to the dashboards of this one, with the change feed enabled.
+// The feed is only read while dashboards are connected. Click counters aren't part of it.
+func startLiveFeed() {
+	if !feedEnabled() {
+		return
+	}
+	poll := config.FeedPollInterval
+	if poll <= 0 {
+		poll = defaultFeedPollInterval
+	}
+	go func() {
+		var position int64
+		missing := map[int64]time.Time{}
+		announced := map[string]time.Time{}
+		for range time.Tick(poll) {
+			live.RLock()
+			idle := len(live.sessions) == 0
+			live.RUnlock()
+			if idle {
+				position = 0
+				continue
+			}
+			ctx := context.Background()
+			head, err := readFeedHead(ctx)
+			if err != nil {
+				slog.Error("unable to read change feed", "err", err)
+				continue
+			}
+			if position == 0 {
+				position = head
+				continue
+			}
+			for next := position + 1; next <= head; next++ {
+				entry, err := readFeedEntry(ctx, next)
+				if err == storage.ErrObjectNotExist {
+					if _, ok := missing[next]; !ok {
+						missing[next] = time.Now()
+					}
+					if time.Since(missing[next]) < feedGapTimeout {
+						break
+					}
+					entry = &feedEntry{Seq: next}
+				} else if err != nil {
+					slog.Error("unable to read change feed entry", "seq", next, "err", err)
+					break
+				}
+				delete(missing, next)
+				position = next
+				if entry.Instance != instanceID {
+					broadcastFeedEntry(entry, announced)
+				}
+			}
+			for code, at := range announced {
+				if time.Since(at) > liveCreatedWindow {
+					delete(announced, code)
+				}
+			}
+		}
+	}()
+}
+
+// Push the links of a feed entry written by another instance, which already pushed them to its own dashboards.
+// A young link counts as created the first time it shows up, the records don't tell creations apart otherwise.
+func broadcastFeedEntry(entry *feedEntry, announced map[string]time.Time) {
+	for _, change := range entry.Changes {
+		if change.Deleted {
+			continue
+		}
+		l, kind := inspectLink(change.Data, change.Size)
+		if kind != "" {
+			continue
+		}
+		eventType := eventLinkUpdated
+		if _, ok := announced[change.Code]; !ok && entry.Time.Sub(l.Created) < liveCreatedWindow {
+			eventType = eventLinkCreated
+			announced[change.Code] = time.Now()
+		}
+		broadcast(eventType, change.Code, l)
+	}
+}
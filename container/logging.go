@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Formats of log entries (LOG_FORMAT)
+const (
+	logJSON = "json"
+	logText = "text"
+)
+
+// Level of failures the server doesn't survive, above errors
+const levelCritical = slog.Level(12)
+
+// Levels of LOG_LEVEL, named like the severities of Cloud Logging
+var logLevels = map[string]slog.Level{
+	"debug":   slog.LevelDebug,
+	"info":    slog.LevelInfo,
+	"warning": slog.LevelWarn,
+	"error":   slog.LevelError,
+}
+
+// Log entries at LOG_LEVEL (default info) and above as JSON lines which Cloud Logging parses,
+// or as text with LOG_FORMAT=text, the default when running locally. Secrets are masked in both.
+func setupLogging(local bool) error {
+	level := slog.LevelInfo
+	if name := config.LogLevel; name != "" {
+		var ok bool
+		level, ok = logLevels[strings.ToLower(name)]
+		if !ok {
+			return fmt.Errorf("unknown LOG_LEVEL %q", name)
+		}
+	}
+	format := config.LogFormat
+	if format == "" {
+		format = logJSON
+		if local {
+			format = logText
+		}
+	}
+	options := &slog.HandlerOptions{Level: level, ReplaceAttr: cloudLoggingAttr}
+	out := redactingWriter{os.Stderr}
+	switch format {
+	case logJSON:
+		slog.SetDefault(slog.New(slog.NewJSONHandler(out, options)))
+	case logText:
+		slog.SetDefault(slog.New(slog.NewTextHandler(out, options)))
+	default:
+		return fmt.Errorf("unknown LOG_FORMAT %q", format)
+	}
+	return nil
+}
+
+// Rename the built-in fields to those of Cloud Logging's structured logs
+func cloudLoggingAttr(groups []string, a slog.Attr) slog.Attr {
+	if len(groups) > 0 {
+		return a
+	}
+	switch a.Key {
+	case slog.LevelKey:
+		return slog.String("severity", severity(a.Value.Any().(slog.Level)))
+	case slog.MessageKey:
+		return slog.Attr{Key: "message", Value: a.Value}
+	}
+	return a
+}
+
+// Cloud Logging severity of a level
+func severity(level slog.Level) string {
+	switch {
+	case level >= levelCritical:
+		return "CRITICAL"
+	case level >= slog.LevelError:
+		return "ERROR"
+	case level >= slog.LevelWarn:
+		return "WARNING"
+	case level >= slog.LevelInfo:
+		return "INFO"
+	}
+	return "DEBUG"
+}
+
+// Log why the server can't go on and exit
+func fatal(message string, args ...interface{}) {
+	slog.Log(context.Background(), levelCritical, message, args...)
+	os.Exit(1)
+}
+
+// ID of a request: the caller's X-Request-Id, the trace Cloud Run assigned, or a random one
+func requestID(r *http.Request) string {
+	if id := r.Header.Get("X-Request-Id"); id != "" && len(id) <= 128 {
+		return id
+	}
+	if trace := r.Header.Get("X-Cloud-Trace-Context"); trace != "" {
+		return strings.SplitN(trace, "/", 2)[0]
+	}
+	random := make([]byte, 8)
+	rand.Read(random)
+	return hex.EncodeToString(random)
+}
+
+// Middleware logging every request with its ID, code, status and latency, at debug level unless it failed.
+// The request is nested as httpRequest, so Cloud Logging shows it like those of the load balancer.
+// Registered before the status counter, so both see the same status.
+func logRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		id := requestID(r)
+		w.Header().Set("X-Request-Id", id)
+		recorder := &statusWriter{w, http.StatusOK}
+		next.ServeHTTP(recorder, r)
+
+		level := slog.LevelDebug
+		if recorder.code >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+		ctx := context.Background()
+		if !slog.Default().Enabled(ctx, level) {
+			return
+		}
+		args := []interface{}{
+			slog.String("request_id", id),
+			slog.Group("httpRequest",
+				slog.String("requestMethod", r.Method),
+				slog.String("requestUrl", r.URL.RequestURI()),
+				slog.Int("status", recorder.code),
+				slog.String("latency", fmt.Sprintf("%.6fs", time.Since(start).Seconds())),
+				slog.String("userAgent", r.UserAgent()),
+				slog.String("remoteIp", clientIP(r)),
+				slog.String("referer", r.Referer())),
+		}
+		if code := mux.Vars(r)["id"]; code != "" {
+			args = append(args, slog.String("code", code))
+		}
+		if trace := r.Header.Get("X-Cloud-Trace-Context"); trace != "" && config.Project != "" {
+			traceID := strings.SplitN(trace, "/", 2)[0]
+			args = append(args, slog.String("logging.googleapis.com/trace", "projects/"+config.Project+"/traces/"+traceID))
+		}
+		slog.Log(ctx, level, fmt.Sprintf("%s %s %d", r.Method, r.URL.Path, recorder.code), args...)
+	})
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Prefix of the reverse index from destinations to their codes
+const reversePrefix = "reverse/"
+
+// struct reverseEntry points a destination at the code of a link to it.
+type reverseEntry struct {
+	Code string `json:"code"`
+	URL  string `json:"url"`
+}
+
+// Name of the object indexing a destination
+func reverseObject(destination string) string {
+	return reversePrefix + destinationHash(destination) + ".json"
+}
+
+// Report whether a link to a destination may be handed out for it again
+func reusableFor(l *link, destination string, now time.Time) bool {
+	return l.URL == destination && l.retired(now).IsZero() && !l.BurnAfterReading && l.Quarantine == nil
+}
+
+// Find the code of an active link to a destination in the reverse index, empty if there is none
+func indexedCode(ctx context.Context, destination string) (string, *link, error) {
+	ctx, span := tracer.Start(ctx, "indexedCode")
+	defer span.End()
+	data, _, err := gcsReadBlob(ctx, reverseObject(destination))
+	if err == storage.ErrObjectNotExist {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	entry := reverseEntry{}
+	if json.Unmarshal(data, &entry) != nil || entry.URL != destination {
+		return "", nil, nil
+	}
+	l, err := readLink(ctx, entry.Code)
+	if err == storage.ErrObjectNotExist || err == nil && !reusableFor(l, destination, clock()) {
+		return "", nil, nil
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	return entry.Code, l, nil
+}
+
+// Find the code of an active link to a destination, empty if there is none.
+// Links shortened before the reverse index existed are found under the codes derived from the destination.
+func lookupCode(ctx context.Context, destination string) (string, error) {
+	ctx, span := tracer.Start(ctx, "lookupCode")
+	defer span.End()
+	code, _, err := indexedCode(ctx, destination)
+	if err != nil || code != "" {
+		return code, err
+	}
+	now := clock()
+	for salt := uint32(0); salt < derivedCodes; salt++ {
+		code := generateShortCode(ctx, destination, salt)
+		l, err := readLink(ctx, code)
+		if err == storage.ErrObjectNotExist {
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		if reusableFor(l, destination, now) {
+			return code, nil
+		}
+	}
+	return "", nil
+}
+
+// Point the reverse index at a new link, unless it leads to another active link to the destination already.
+// Burn-after-reading links are never indexed, and nothing is with random codes, which mustn't be found from a URL.
+func indexLink(ctx context.Context, code string, l *link) error {
+	ctx, span := tracer.Start(ctx, "indexLink")
+	defer span.End()
+	if randomCodes() || !reusableFor(l, l.URL, clock()) {
+		return nil
+	}
+	existing, _, err := indexedCode(ctx, l.URL)
+	if err != nil || existing != "" {
+		return err
+	}
+	marshalled, err := json.Marshal(reverseEntry{code, l.URL})
+	if err != nil {
+		return err
+	}
+	return gcsWriteBlob(ctx, reverseObject(l.URL), "application/json", marshalled)
+}
+
+// GET handler finding the short link of a URL, GET /api/v1/lookup?url=.
+// The URL is normalized like when shortening it. Not available with random codes.
+func lookupHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "lookupHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	if randomCodes() {
+		respond(ctx, response{"", "lookups aren't available with random codes!"}, http.StatusNotImplemented, w)
+		return
+	}
+	destination, _, err := checkDestination(r.URL.Query().Get("url"), "")
+	if err != nil {
+		respond(ctx, destinationFailure(err), http.StatusBadRequest, w)
+		return
+	}
+	code, err := lookupCode(ctx, destination)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if code == "" {
+		respond(ctx, response{"", "no short link for this url!"}, http.StatusNotFound, w)
+		return
+	}
+	respond(ctx, response{shortLink(code), "url found!"}, http.StatusOK, w)
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// Number of previous destinations kept in a link's history
+const maxHistory = 20
+
+// Errors of repointing a link which can't change its destination
+var (
+	errNotRepointable = errors.New("link can't be repointed")
+	errLinkGone       = errors.New("link has expired or been consumed")
+)
+
+// struct revision is a previous destination of a link, kept for auditing.
+type revision struct {
+	URL string `json:"url"`
+	// Time the link was repointed away from URL
+	Replaced time.Time `json:"replaced"`
+	// Whoever repointed it, "admin" or "owner"
+	By string `json:"by"`
+}
+
+// struct updateRequest holds the new destination of a link.
+type updateRequest struct {
+	URL string `json:"url"`
+}
+
+// Subject signed for the creator of a link to manage it.
+// It includes the creation time, so a token doesn't carry over to a later link reusing the code.
+func manageSubject(code string, l *link) string {
+	return fmt.Sprintf("manage:%s:%d", code, l.Created.UnixNano())
+}
+
+// Token handed to the creator of a link for managing it later
+func manageToken(code string, l *link) string {
+	return sign(manageSubject(code, l))
+}
+
+// Check that a request carries the manage token of a link (or the admin token) as bearer token,
+// or the ID token of the signed-in user who owns it.
+// Responds with 401 without a token and 403 with a wrong one, returning false.
+// Pass a nil link for codes which don't exist, so only admins learn about that.
+func requireManager(ctx context.Context, w http.ResponseWriter, r *http.Request, code string, l *link) bool {
+	if isAdmin(r) {
+		return true
+	}
+	if idToken(r) != "" {
+		uid, ok := signedInUser(ctx, w, r)
+		if !ok {
+			return false
+		}
+		if l == nil || l.UID == "" || l.UID != uid {
+			forbidden(ctx, w, "link isn't owned by the signed-in user!")
+			return false
+		}
+		return true
+	}
+	supplied := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if supplied == "" {
+		unauthorized(ctx, w, "link", authRequired, "manage token of the link required!")
+		return false
+	}
+	if l == nil || !verifySignature(manageSubject(code, l), supplied) {
+		// Owners of the destination domain may manage links to it with their claim token
+		if managedByClaim(ctx, r, code, l) {
+			return true
+		}
+		forbidden(ctx, w, "token doesn't grant access to this link!")
+		return false
+	}
+	return true
+}
+
+// Report whether a request may manage a link only through the claim token of its destination domain,
+// not as admin, signed-in owner or with the link's manage token
+func managedByClaim(ctx context.Context, r *http.Request, code string, l *link) bool {
+	supplied := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if l == nil || supplied == "" || isAdmin(r) || idToken(r) != "" || verifySignature(manageSubject(code, l), supplied) {
+		return false
+	}
+	c := claimOf(ctx, l.URL)
+	return c != nil && holdsClaim(c, supplied)
+}
+
+// Read a link for a manager, responding and returning false unless the request may manage it
+func readManagedLink(ctx context.Context, w http.ResponseWriter, r *http.Request, code string) (*link, bool) {
+	l, err := readLink(ctx, code)
+	if err != nil && err != storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return nil, false
+	}
+	if !requireManager(ctx, w, r, code, l) {
+		return nil, false
+	}
+	if l == nil {
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return nil, false
+	}
+	return l, true
+}
+
+// DELETE handler removing a link, for its creator (manage token) or admins
+func deleteLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "deleteLinkHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		// Methods are added by mux.CORSMethodMiddleware
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		return
+	}
+	code := mux.Vars(r)["id"]
+	if _, ok := readManagedLink(ctx, w, r, code); !ok {
+		return
+	}
+	// Links removed by admins are often abusive, their fallback goes with them
+	err := deleteLink(ctx, code, !isAdmin(r))
+	if err == storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to delete link!"}, http.StatusInternalServerError, w)
+		return
+	}
+	respond(ctx, response{shortLink(code), "link deleted!"}, http.StatusOK, w)
+}
+
+// PUT handler repointing a link at a new destination, for its creator (manage token) or admins.
+// The new URL is checked like on creation and the previous one is added to the link's history.
+func updateLinkHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "updateLinkHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	code := mux.Vars(r)["id"]
+	req := updateRequest{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		respond(ctx, response{"", "unable to decode request body!"}, http.StatusBadRequest, w)
+		return
+	}
+	l, ok := readManagedLink(ctx, w, r, code)
+	if !ok {
+		return
+	}
+	by := "owner"
+	if isAdmin(r) {
+		by = "admin"
+	}
+	byClaim := managedByClaim(ctx, r, code, l)
+
+	destination, normalized, err := checkDestination(req.URL, l.Owner)
+	if err != nil {
+		respond(ctx, destinationFailure(err), http.StatusBadRequest, w)
+		return
+	}
+	if harmfulDestination(ctx, destination) {
+		respond(ctx, response{"", "destination domain has a bad reputation!"}, http.StatusBadRequest, w)
+		return
+	}
+	if threat := unsafeDestination(ctx, destination); threat != "" {
+		respond(ctx, unsafeDestinationFailure(threat), http.StatusBadRequest, w)
+		return
+	}
+	claimToken := r.Header.Get("X-Claim-Token")
+	if claimToken == "" {
+		claimToken = strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	}
+	// Owners of a domain manage the links to it, they can't send its visitors elsewhere
+	if byClaim {
+		if c := claimOf(ctx, destination); c == nil || !holdsClaim(c, claimToken) {
+			forbidden(ctx, w, "claim tokens only repoint links within the claimed domain!")
+			return
+		}
+	}
+	if domain := blockedByClaim(ctx, claimToken, destination); domain != "" && !isAdmin(r) {
+		respond(ctx, domainClaimedFailure(domain), http.StatusForbidden, w)
+		return
+	}
+	l, err = updateLink(ctx, code, func(l *link) error {
+		if l.Payload != nil || len(l.Variants) > 0 {
+			return errNotRepointable
+		}
+		if !l.Consumed.IsZero() || l.expired(clock()) {
+			return errLinkGone
+		}
+		if contactURL(destination) && (l.TrackConversions || l.MediaViewer) {
+			return errNotRepointable
+		}
+		if l.URL == destination {
+			return nil
+		}
+		l.History = append(l.History, revision{l.URL, clock().UTC(), by})
+		if len(l.History) > maxHistory {
+			l.History = l.History[len(l.History)-maxHistory:]
+		}
+		l.URL = destination
+		l.emit(eventLinkUpdated, code, l.eventData())
+		return nil
+	})
+	switch {
+	case err == errNotRepointable:
+		respond(ctx, response{"", "split, payload and tracked links can't be repointed!"}, http.StatusConflict, w)
+		return
+	case err == errLinkGone:
+		respond(ctx, response{"", "link has expired or been consumed!"}, http.StatusGone, w)
+		return
+	case err != nil:
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	broadcast(eventLinkUpdated, code, l)
+	if l.webDestination() {
+		// The new destination needs its own thumbnail and cloaking baseline
+		if screenshotsEnabled() {
+			err = enqueue(ctx, "screenshot", destinationTask{code, l.URL})
+			if err != nil {
+				slog.Error("unable to queue screenshot", "code", code, "err", err)
+			}
+		}
+		if cloakingEnabled() {
+			err = enqueue(ctx, "fingerprint", destinationTask{code, l.URL})
+			if err != nil {
+				slog.Error("unable to queue fingerprint", "code", code, "err", err)
+			}
+		}
+	}
+	resp := shortenResponse{response: response{shortLink(code), "link updated!"}, Normalized: normalized}
+	if hypermedia(w) {
+		resp.Links = linkRelations(code, l)
+	}
+	respond(ctx, resp, http.StatusOK, w)
+}
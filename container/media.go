@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Known direct media/file extensions and the viewer used to display them
+var mediaKinds = map[string]string{
+	".mp4":  "video",
+	".webm": "video",
+	".mov":  "video",
+	".ogv":  "video",
+	".mp3":  "audio",
+	".ogg":  "audio",
+	".oga":  "audio",
+	".wav":  "audio",
+	".flac": "audio",
+	".m4a":  "audio",
+	".png":  "image",
+	".jpg":  "image",
+	".jpeg": "image",
+	".gif":  "image",
+	".webp": "image",
+	".svg":  "image",
+	".pdf":  "document",
+}
+
+// HTML wrapper shown instead of a redirect for media links
+var mediaTemplate = template.Must(template.New("media").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Name}} - Urly Wurly</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<main class="media">
+{{if eq .Kind "video"}}<video src="{{.URL}}" controls preload="metadata"></video>
+{{else if eq .Kind "audio"}}<audio src="{{.URL}}" controls preload="metadata"></audio>
+{{else if eq .Kind "image"}}<img src="{{.URL}}" alt="{{.Name}}">
+{{else}}<iframe src="{{.URL}}" title="{{.Name}}"></iframe>
+{{end}}
+<p><a href="{{.URL}}" download>Download {{.Name}}</a> &middot; <a href="{{.URL}}">Open original</a></p>
+</main>
+</body>
+</html>
+`))
+
+// Determine the viewer for a destination from the file extension of its path
+func mediaKind(long string) string {
+	uri, err := url.Parse(long)
+	if err != nil {
+		return ""
+	}
+	return mediaKinds[strings.ToLower(path.Ext(uri.Path))]
+}
+
+// Render the inline viewer page for a media link
+func serveMediaViewer(ctx context.Context, w http.ResponseWriter, l *link, kind string) {
+	ctx, span := tracer.Start(ctx, "serveMediaViewer")
+	defer span.End()
+	uri, _ := url.Parse(l.URL)
+	name := path.Base(uri.Path)
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	err := mediaTemplate.Execute(w, struct {
+		URL  string
+		Name string
+		Kind string
+	}{l.URL, name, kind})
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
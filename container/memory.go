@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"sort"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// struct memoryObject is an object of the in-memory bucket.
+type memoryObject struct {
+	data        []byte
+	contentType string
+	generation  int64
+}
+
+// struct memoryBucket stands in for the GCS bucket in local mode, losing everything on exit.
+type memoryBucket struct {
+	sync.Mutex
+	objects map[string]*memoryObject
+	// Last generation handed out, so generations are unique like in GCS
+	generation int64
+}
+
+// In-memory bucket used by the GCS primitives instead of BUCKET when running with --local
+var localBucket *memoryBucket
+
+// Prepare running on a laptop: all storage in process memory and defaults for PORT and DOMAIN
+func setupLocal() {
+	localBucket = &memoryBucket{objects: map[string]*memoryObject{}}
+	linkStorage = memoryLinkStore{localBucket}
+	if config.Port == "" {
+		config.Port = "8080"
+	}
+	if config.Domain == "" {
+		config.Domain = "localhost:" + config.Port
+	}
+	slog.Info("running locally, nothing is persisted", "port", config.Port)
+}
+
+// Fill the in-memory bucket from a JSON object mapping object names to their contents, e.g. link records
+// under their codes and rollups under rollups/, so every local run starts from the same state.
+// Strings are stored as they are, like links holding a bare URL, everything else as JSON.
+func seedLocal(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	objects := map[string]json.RawMessage{}
+	err = json.Unmarshal(data, &objects)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	names := make([]string, 0, len(objects))
+	for name := range objects {
+		names = append(names, name)
+	}
+	// Generations follow the names, whatever order the file has
+	sort.Strings(names)
+	for _, name := range names {
+		content, contentType := []byte(objects[name]), "application/json"
+		text := ""
+		if json.Unmarshal(content, &text) == nil {
+			content, contentType = []byte(text), "text/plain"
+		}
+		err = localBucket.write(name, contentType, content, anyGeneration)
+		if err != nil {
+			return err
+		}
+	}
+	slog.Info("seeded objects", "objects", len(names), "path", path)
+	return nil
+}
+
+// Read an object, storage.ErrObjectNotExist if there is none
+func (b *memoryBucket) read(name string) ([]byte, string, int64, error) {
+	b.Lock()
+	defer b.Unlock()
+	object, ok := b.objects[name]
+	if !ok {
+		return nil, "", 0, storage.ErrObjectNotExist
+	}
+	return append([]byte{}, object.data...), object.contentType, object.generation, nil
+}
+
+// Write an object if it is still at generation (0 means it doesn't exist, anyGeneration skips the check)
+func (b *memoryBucket) write(name string, contentType string, data []byte, generation int64) error {
+	b.Lock()
+	defer b.Unlock()
+	if generation != anyGeneration {
+		var current int64
+		if object, ok := b.objects[name]; ok {
+			current = object.generation
+		}
+		if current != generation {
+			return errWriteConflict
+		}
+	}
+	b.generation++
+	b.objects[name] = &memoryObject{append([]byte{}, data...), contentType, b.generation}
+	return nil
+}
+
+// Remove an object, storage.ErrObjectNotExist if there is none
+func (b *memoryBucket) delete(name string) error {
+	b.Lock()
+	defer b.Unlock()
+	if _, ok := b.objects[name]; !ok {
+		return storage.ErrObjectNotExist
+	}
+	delete(b.objects, name)
+	return nil
+}
+
+// Visit the names of objects below a prefix in lexical order, only top level ones for a "/" delimiter
+func (b *memoryBucket) list(prefix string, delimiter string, visit func(name string) error) error {
+	b.Lock()
+	names := []string{}
+	for name := range b.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" && strings.Contains(strings.TrimPrefix(name, prefix), delimiter) {
+			continue
+		}
+		names = append(names, name)
+	}
+	b.Unlock()
+	sort.Strings(names)
+	for _, name := range names {
+		err := visit(name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// struct memoryLinkStore keeps links in the in-memory bucket, named after their codes like in GCS.
+type memoryLinkStore struct {
+	bucket *memoryBucket
+}
+
+func (s memoryLinkStore) read(ctx context.Context, code string, limit int64) (*storedLink, error) {
+	data, _, generation, err := s.bucket.read(code)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(data))
+	if limit > 0 && size > limit {
+		data = data[:limit]
+	}
+	return &storedLink{data, size, generation}, nil
+}
+
+func (s memoryLinkStore) write(ctx context.Context, code string, data []byte, generation int64) error {
+	return s.bucket.write(code, "application/json", data, generation)
+}
+
+func (s memoryLinkStore) delete(ctx context.Context, code string) error {
+	return s.bucket.delete(code)
+}
+
+func (s memoryLinkStore) list(ctx context.Context, after string, visit func(code string) error) error {
+	return s.bucket.list("", "/", func(code string) error {
+		if code <= after {
+			return nil
+		}
+		return visit(code)
+	})
+}
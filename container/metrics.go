@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/stats"
+	"go.opencensus.io/stats/view"
+	"go.opencensus.io/tag"
+)
+
+// Measures recorded by the server, exported to Stackdriver alongside traces
+var (
+	// Size of link objects read on the redirect path
+	linkObjectSize = stats.Int64("urly-wurly/link_object_size", "Size of link objects read from storage", stats.UnitBytes)
+	// Stored values found unfit for redirecting
+	linkAnomalies = stats.Int64("urly-wurly/link_anomalies", "Number of anomalous link objects detected at read time", stats.UnitDimensionless)
+	// Requests to expensive endpoints turned away by the throttling
+	throttledRequests = stats.Int64("urly-wurly/throttled_requests", "Number of requests to expensive endpoints rejected on overload", stats.UnitDimensionless)
+	// Management requests held back or turned away in favour of redirects
+	delayedRequests = stats.Float64("urly-wurly/management_delay", "Time management requests waited for redirects to leave room", stats.UnitMilliseconds)
+	shedRequests    = stats.Int64("urly-wurly/management_shed", "Number of management requests rejected while redirects kept the instance busy", stats.UnitDimensionless)
+	// Connections taken for GCS requests, fresh ones cost a TCP and TLS handshake
+	gcsConnections    = stats.Int64("urly-wurly/gcs_connections", "Number of connections taken for GCS requests", stats.UnitDimensionless)
+	gcsConnectionWait = stats.Float64("urly-wurly/gcs_connection_wait", "Time GCS requests waited for a connection", stats.UnitMilliseconds)
+	// Time operations on link objects take, by API
+	gcsLatency = stats.Float64("urly-wurly/gcs_latency", "Time operations on link objects in GCS took", stats.UnitMilliseconds)
+	// Time redirects took from the request to the response
+	redirectLatency = stats.Float64("urly-wurly/redirect_latency", "Time redirect requests took to be answered", stats.UnitMilliseconds)
+)
+
+// Tag keys used by the views below
+var (
+	keyAnomaly   = tag.MustNewKey("anomaly")
+	keyEndpoint  = tag.MustNewKey("endpoint")
+	keyClass     = tag.MustNewKey("class")
+	keyReused    = tag.MustNewKey("reused")
+	keyAPI       = tag.MustNewKey("api")
+	keyOperation = tag.MustNewKey("operation")
+)
+
+// Views aggregating the measures above
+var views = []*view.View{
+	{
+		Name:        "urly-wurly/link_object_size",
+		Description: "Distribution of link object sizes read from storage",
+		Measure:     linkObjectSize,
+		Aggregation: view.Distribution(0, 64, 128, 256, 512, 1024, 2048, 4096, 16384, 65536),
+	},
+	{
+		Name:        "urly-wurly/link_anomalies",
+		Description: "Number of anomalous link objects by kind of anomaly",
+		Measure:     linkAnomalies,
+		TagKeys:     []tag.Key{keyAnomaly},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "urly-wurly/throttled_requests",
+		Description: "Number of requests to expensive endpoints rejected on overload by endpoint",
+		Measure:     throttledRequests,
+		TagKeys:     []tag.Key{keyEndpoint},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "urly-wurly/management_delay",
+		Description: "Distribution of the time management requests waited for redirects by class",
+		Measure:     delayedRequests,
+		TagKeys:     []tag.Key{keyClass},
+		Aggregation: view.Distribution(1, 10, 50, 100, 250, 500, 1000, 2500, 5000),
+	},
+	{
+		Name:        "urly-wurly/management_shed",
+		Description: "Number of management requests rejected in favour of redirects by class",
+		Measure:     shedRequests,
+		TagKeys:     []tag.Key{keyClass},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "urly-wurly/gcs_connections",
+		Description: "Number of connections taken for GCS requests by whether they were reused",
+		Measure:     gcsConnections,
+		TagKeys:     []tag.Key{keyReused},
+		Aggregation: view.Count(),
+	},
+	{
+		Name:        "urly-wurly/gcs_connection_wait",
+		Description: "Distribution of the time GCS requests waited for a connection by whether it was reused",
+		Measure:     gcsConnectionWait,
+		TagKeys:     []tag.Key{keyReused},
+		Aggregation: view.Distribution(0.1, 0.5, 1, 5, 10, 25, 50, 100, 250, 500, 1000),
+	},
+	{
+		Name:        "urly-wurly/gcs_latency",
+		Description: "Distribution of the time operations on link objects in GCS took by API and operation",
+		Measure:     gcsLatency,
+		TagKeys:     []tag.Key{keyAPI, keyOperation},
+		Aggregation: view.Distribution(1, 2, 5, 10, 15, 20, 30, 50, 75, 100, 250, 500, 1000),
+	},
+	{
+		Name:        "urly-wurly/redirect_latency",
+		Description: "Distribution of the time redirect requests took to be answered",
+		Measure:     redirectLatency,
+		Aggregation: view.Distribution(1, 2, 5, 10, 20, 50, 100, 250, 500, 1000, 2500, 5000),
+	},
+}
+
+// Register all views with OpenCensus
+func registerViews() {
+	err := view.Register(views...)
+	if err != nil {
+		fatal("unable to register views", "err", err)
+	}
+}
+
+// Record a measurement with additional tags, logging instead of failing.
+// Measurements taken in a sampled span keep it as exemplar, so histogram buckets link to a trace.
+func record(ctx context.Context, mutators []tag.Mutator, measurement stats.Measurement) {
+	options := []stats.Options{stats.WithTags(mutators...), stats.WithMeasurements(measurement)}
+	if spanContext, ok := exemplarSpanContext(ctx); ok {
+		attachments := metricdata.Attachments{metricdata.AttachmentKeySpanContext: spanContext}
+		options = append(options, stats.WithAttachments(attachments))
+	}
+	err := stats.RecordWithOptions(ctx, options...)
+	if err != nil {
+		slog.Error("unable to record measurements", "err", err)
+	}
+}
+
+// Record how long a redirect took since start, with its span as exemplar
+func recordRedirectLatency(ctx context.Context, start time.Time) {
+	record(ctx, nil, redirectLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
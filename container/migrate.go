@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Shorteners links can be migrated from
+const (
+	sourceBitly     = "bitly"
+	sourceTinyURL   = "tinyurl"
+	sourceRebrandly = "rebrandly"
+)
+
+// APIs of the shorteners which have one fit for listing all links
+const (
+	bitlyAPI     = "https://api-ssl.bitly.com/v4"
+	rebrandlyAPI = "https://api.rebrandly.com/v1"
+)
+
+// Client calling the APIs of other shorteners
+var migrationClient = &http.Client{Timeout: 30 * time.Second}
+
+// Column names of the export files, lower cased, in order of preference
+var (
+	exportURLColumns  = []string{"long_url", "long url", "destination", "original url", "original_url", "url"}
+	exportCodeColumns = []string{"custom link", "custom_bitlink", "bitlink", "link", "short url", "short_url", "shorturl", "tinyurl", "tiny url", "alias", "slashtag"}
+	exportTagColumns  = []string{"tags", "tag"}
+)
+
+// struct jobRemap is a migrated link which didn't keep its code.
+type jobRemap struct {
+	// Position of the link in the migration
+	Index int `json:"index"`
+	// Code at the other shortener
+	Code     string `json:"code"`
+	ShortURL string `json:"short_url"`
+	// Why the code wasn't kept: name_taken, code_reserved, code_retired or invalid_code
+	Reason string `json:"reason"`
+}
+
+// Report whether a migration source is supported
+func validSource(source string) bool {
+	return source == sourceBitly || source == sourceTinyURL || source == sourceRebrandly
+}
+
+// Code of a short link as found in exports and APIs ("bit.ly/abc", "https://tinyurl.com/abc" or just "abc")
+func shortCode(short string) string {
+	short = strings.TrimSpace(short)
+	if !strings.Contains(short, "://") && strings.Contains(short, "/") {
+		short = "https://" + short
+	}
+	if uri, err := url.Parse(short); err == nil && uri.Host != "" {
+		short = uri.Path
+	}
+	return strings.Trim(short, "/")
+}
+
+// Split the tags of an export, which are separated by commas, semicolons or pipes
+func exportTags(raw string) []string {
+	return parseTags(strings.NewReplacer(";", ",", "|", ",").Replace(raw))
+}
+
+// Read the links of a CSV export of any supported shortener, guessing the columns from the header.
+// Rows without a long URL become links without one, so that they fail like any invalid item.
+func parseExport(export string) ([]shortenRequest, error) {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(export, "\ufeff")))
+	reader.FieldsPerRecord = -1
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read header: %v", err)
+	}
+	column := func(names []string) int {
+		for _, name := range names {
+			for i, h := range header {
+				if strings.EqualFold(strings.TrimSpace(h), name) {
+					return i
+				}
+			}
+		}
+		return -1
+	}
+	urlColumn, codeColumn, tagColumn := column(exportURLColumns), column(exportCodeColumns), column(exportTagColumns)
+	if urlColumn < 0 {
+		return nil, errors.New("header has no long URL column")
+	}
+	field := func(record []string, i int) string {
+		if i < 0 || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+	links := []shortenRequest{}
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return links, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		links = append(links, shortenRequest{URL: field(record, urlColumn), CustomName: shortCode(field(record, codeColumn)), Tags: exportTags(field(record, tagColumn))})
+		if len(links) > maxJobItems {
+			return nil, fmt.Errorf("exports may have at most %d links", maxJobItems)
+		}
+	}
+}
+
+// GET a JSON document from a shortener's API
+func getMigrationAPI(ctx context.Context, endpoint string, header string, token string, v interface{}) error {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set(header, token)
+	req.Header.Set("Accept", "application/json")
+	resp, err := migrationClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %d", redact(endpoint), resp.StatusCode)
+	}
+	return json.NewDecoder(io.LimitReader(resp.Body, 16<<20)).Decode(v)
+}
+
+// List the links of a Bitly group, the user's default group if none is given
+func fetchBitly(ctx context.Context, token string, group string) ([]shortenRequest, error) {
+	ctx, span := tracer.Start(ctx, "fetchBitly")
+	defer span.End()
+	if group == "" {
+		user := struct {
+			DefaultGroup string `json:"default_group_guid"`
+		}{}
+		err := getMigrationAPI(ctx, bitlyAPI+"/user", "Authorization", "Bearer "+token, &user)
+		if err != nil {
+			return nil, err
+		}
+		group = user.DefaultGroup
+	}
+	links := []shortenRequest{}
+	next := bitlyAPI + "/groups/" + url.PathEscape(group) + "/bitlinks?size=100"
+	for next != "" {
+		page := struct {
+			Links []struct {
+				ID      string   `json:"id"`
+				LongURL string   `json:"long_url"`
+				Tags    []string `json:"tags"`
+			} `json:"links"`
+			Pagination struct {
+				Next string `json:"next"`
+			} `json:"pagination"`
+		}{}
+		err := getMigrationAPI(ctx, next, "Authorization", "Bearer "+token, &page)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range page.Links {
+			links = append(links, shortenRequest{URL: l.LongURL, CustomName: shortCode(l.ID), Tags: parseTags(strings.Join(l.Tags, ","))})
+		}
+		if len(links) > maxJobItems {
+			return nil, fmt.Errorf("migrations may have at most %d links", maxJobItems)
+		}
+		next = page.Pagination.Next
+	}
+	return links, nil
+}
+
+// List the links of a Rebrandly account
+func fetchRebrandly(ctx context.Context, token string) ([]shortenRequest, error) {
+	ctx, span := tracer.Start(ctx, "fetchRebrandly")
+	defer span.End()
+	links := []shortenRequest{}
+	last := ""
+	for {
+		query := url.Values{"limit": {"25"}, "orderBy": {"createdAt"}, "orderDir": {"asc"}}
+		if last != "" {
+			query.Set("last", last)
+		}
+		page := []struct {
+			ID          string `json:"id"`
+			Slashtag    string `json:"slashtag"`
+			Destination string `json:"destination"`
+		}{}
+		err := getMigrationAPI(ctx, rebrandlyAPI+"/links?"+query.Encode(), "apikey", token, &page)
+		if err != nil {
+			return nil, err
+		}
+		if len(page) == 0 {
+			return links, nil
+		}
+		for _, l := range page {
+			links = append(links, shortenRequest{URL: l.Destination, CustomName: l.Slashtag})
+		}
+		if len(links) > maxJobItems {
+			return nil, fmt.Errorf("migrations may have at most %d links", maxJobItems)
+		}
+		last = page[len(page)-1].ID
+	}
+}
+
+// Turn the export or API token of a migration job into the links to create.
+// Both are dropped from the job afterwards, so the token isn't kept.
+func resolveMigration(ctx context.Context, j *job) error {
+	ctx, span := tracer.Start(ctx, "resolveMigration")
+	defer span.End()
+	var links []shortenRequest
+	var err error
+	switch {
+	case j.Request.Export != "":
+		links, err = parseExport(j.Request.Export)
+	case j.Request.Source == sourceBitly:
+		links, err = fetchBitly(ctx, j.Request.Token, j.Request.Group)
+	case j.Request.Source == sourceRebrandly:
+		links, err = fetchRebrandly(ctx, j.Request.Token)
+	default:
+		err = fmt.Errorf("%s links can only be migrated from an export", j.Request.Source)
+	}
+	if err != nil {
+		return err
+	}
+	for i := range links {
+		for _, tag := range j.Request.AddTags {
+			if !containsTag(links[i].Tags, tag) {
+				links[i].Tags = append(links[i].Tags, tag)
+			}
+		}
+	}
+	j.Request.Links = links
+	j.Request.Export = ""
+	j.Request.Token = ""
+	j.Total = len(links)
+	j.Results = make([]string, len(links))
+	j.Remapped = []jobRemap{}
+	return nil
+}
+
+// Create the i-th link of a migration, keeping its code if possible and issuing a new one otherwise
+func migrateLink(ctx context.Context, j *job, i int) (string, error) {
+	req := j.Request.Links[i]
+	code := req.CustomName
+	reason := ""
+	if code != "" && !customNamePattern.MatchString(code) {
+		reason = "invalid_code"
+		req.CustomName = ""
+	}
+	resp, status := createLink(ctx, req)
+	if status != http.StatusOK && (resp.Error == "name_taken" || resp.Error == "code_reserved" || resp.Error == "code_retired") {
+		destination, _, err := checkDestination(req.URL, req.Owner)
+		if l, readErr := readLink(ctx, code); err == nil && readErr == nil && l.URL == destination {
+			// Created before the job was interrupted, or the same link exists already
+			j.Results[i] = shortLink(code)
+			return req.URL, nil
+		}
+		reason = resp.Error
+		req.CustomName = ""
+		resp, status = createLink(ctx, req)
+	}
+	if status != http.StatusOK {
+		return req.URL, errors.New(resp.Message)
+	}
+	j.Results[i] = resp.ShortenedURL
+	if reason != "" {
+		j.Remapped = append(j.Remapped, jobRemap{i, code, resp.ShortenedURL, reason})
+	}
+	return req.URL, nil
+}
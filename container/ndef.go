@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// URI identifier codes of the NFC Forum URI record type, longest prefixes first
+var ndefURIPrefixes = []struct {
+	code   byte
+	prefix string
+}{
+	{0x02, "https://www."},
+	{0x01, "http://www."},
+	{0x04, "https://"},
+	{0x03, "http://"},
+}
+
+// Encode a URL as an NDEF message holding a single well-known URI record
+func ndefMessage(uri string) []byte {
+	payload := []byte{0x00}
+	for _, p := range ndefURIPrefixes {
+		if strings.HasPrefix(uri, p.prefix) {
+			payload[0] = p.code
+			uri = strings.TrimPrefix(uri, p.prefix)
+			break
+		}
+	}
+	payload = append(payload, uri...)
+
+	// MB and ME (only record), TNF well-known
+	header := byte(0x80 | 0x40 | 0x01)
+	message := []byte{}
+	if len(payload) < 256 {
+		// Short record with a one byte payload length
+		message = append(message, header|0x10, 1, byte(len(payload)))
+	} else {
+		length := make([]byte, 4)
+		binary.BigEndian.PutUint32(length, uint32(len(payload)))
+		message = append(message, header, 1)
+		message = append(message, length...)
+	}
+	message = append(message, 'U')
+	return append(message, payload...)
+}
+
+// Wrap an NDEF message in the TLV block expected in the memory of NFC Forum type 2 tags
+func ndefTLV(message []byte) []byte {
+	tlv := []byte{0x03}
+	if len(message) < 255 {
+		tlv = append(tlv, byte(len(message)))
+	} else {
+		tlv = append(tlv, 0xFF, byte(len(message)>>8), byte(len(message)))
+	}
+	tlv = append(tlv, message...)
+	return append(tlv, 0xFE)
+}
+
+// GET handler returning the NDEF payload programming an NFC tag with a short link.
+// ?format= is raw (default, binary), hex or base64, ?tlv=true wraps the message for type 2 tags.
+func ndefHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "ndefHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	code := mux.Vars(r)["id"]
+	_, err := readLink(ctx, code)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return
+	}
+
+	payload := ndefMessage(shortLink(code))
+	if r.URL.Query().Get("tlv") == "true" {
+		payload = ndefTLV(payload)
+	}
+	switch r.URL.Query().Get("format") {
+	case "", "raw":
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Header().Set("Content-Disposition", "attachment; filename=\""+code+".ndef\"")
+		w.Write(payload)
+	case "hex":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(strings.ToUpper(hex.EncodeToString(payload))))
+	case "base64":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte(base64.StdEncoding.EncodeToString(payload)))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "format should be raw, hex or base64!"}, http.StatusBadRequest, w)
+	}
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"html/template"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// struct negotiatedWriter remembers whether the client prefers HTML over JSON,
+// so respond can render error pages for browsers.
+type negotiatedWriter struct {
+	http.ResponseWriter
+	html bool
+	// Client asked for HAL, API responses carry links to related resources
+	hal bool
+}
+
+// Middleware recording the client's preferred error format and whether it wants hypermedia
+func negotiate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept")
+		accept := r.Header.Get("Accept")
+		next.ServeHTTP(&negotiatedWriter{w, prefersHTML(accept), prefersHAL(accept)}, r)
+	})
+}
+
+// Report whether an Accept header ranks text/html above application/json
+func prefersHTML(accept string) bool {
+	html, json := -1.0, -1.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		mediaType := strings.ToLower(strings.TrimSpace(fields[0]))
+		quality := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				q, err := strconv.ParseFloat(param[2:], 64)
+				if err == nil {
+					quality = q
+				}
+			}
+		}
+		switch mediaType {
+		case "text/html", "application/xhtml+xml":
+			if quality > html {
+				html = quality
+			}
+		case "application/json":
+			if quality > json {
+				json = quality
+			}
+		}
+	}
+	return html > 0 && html > json
+}
+
+// Human-friendly page shown to browsers for failed requests
+var errorTemplate = template.Must(template.New("error").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.Status}} - Urly Wurly</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<main class="error-page">
+<img src="/logo-square.png" alt="Urly Wurly" width="96" height="96">
+<h1>{{.Status}}</h1>
+<p>{{.Message}}</p>
+<p><a href="/">Shorten a link</a></p>
+</main>
+</body>
+</html>
+`))
+
+// Render the HTML error page
+func writeErrorPage(w http.ResponseWriter, message string, code int) error {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(code)
+	return errorTemplate.Execute(w, struct {
+		Status  string
+		Message string
+	}{strconv.Itoa(code) + " " + http.StatusText(code), message})
+}
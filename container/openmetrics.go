@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.opencensus.io/metric/metricdata"
+	"go.opencensus.io/metric/metricproducer"
+	"go.opencensus.io/trace"
+)
+
+// Content type of the exposition served by /metrics
+const openMetricsType = "application/openmetrics-text; version=1.0.0; charset=utf-8"
+
+// Characters not allowed in metric and label names
+var openMetricsInvalid = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
+
+// Escaping of label values
+var openMetricsEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// Name of a view in the exposition, e.g. urly_wurly_gcs_latency
+func openMetricsName(name string) string {
+	return openMetricsInvalid.ReplaceAllString(name, "_")
+}
+
+func formatOpenMetricsFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+// Label set of a time series, with the upper bound of a histogram bucket unless le is empty
+func openMetricsLabels(keys []metricdata.LabelKey, values []metricdata.LabelValue, le string) string {
+	labels := []string{}
+	for i, key := range keys {
+		if i < len(values) && values[i].Present {
+			labels = append(labels, fmt.Sprintf(`%s="%s"`, openMetricsName(key.Key), openMetricsEscaper.Replace(values[i].Value)))
+		}
+	}
+	if le != "" {
+		labels = append(labels, fmt.Sprintf(`le="%s"`, le))
+	}
+	if len(labels) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(labels, ",") + "}"
+}
+
+// Exemplar of a histogram bucket pointing at the trace of its measurement, empty if it has none
+func openMetricsExemplar(exemplar *metricdata.Exemplar) string {
+	if exemplar == nil {
+		return ""
+	}
+	spanContext, ok := exemplar.Attachments[metricdata.AttachmentKeySpanContext].(trace.SpanContext)
+	if !ok {
+		return ""
+	}
+	timestamp := float64(exemplar.Timestamp.UnixNano()) / float64(time.Second)
+	return fmt.Sprintf(` # {trace_id="%s",span_id="%s"} %s %s`, spanContext.TraceID, spanContext.SpanID,
+		formatOpenMetricsFloat(exemplar.Value), strconv.FormatFloat(timestamp, 'f', 3, 64))
+}
+
+// Write the latest point of each time series of a metric.
+// Distributions other than cumulative ones and summaries aren't produced by any view and are skipped.
+func writeOpenMetric(out io.Writer, m *metricdata.Metric) {
+	name := openMetricsName(m.Descriptor.Name)
+	kind := "gauge"
+	switch m.Descriptor.Type {
+	case metricdata.TypeCumulativeInt64, metricdata.TypeCumulativeFloat64:
+		kind = "counter"
+	case metricdata.TypeCumulativeDistribution:
+		kind = "histogram"
+	case metricdata.TypeGaugeDistribution, metricdata.TypeSummary:
+		return
+	}
+	fmt.Fprintf(out, "# TYPE %s %s\n", name, kind)
+	fmt.Fprintf(out, "# HELP %s %s\n", name, strings.ReplaceAll(m.Descriptor.Description, "\n", " "))
+	for _, series := range m.TimeSeries {
+		if len(series.Points) == 0 {
+			continue
+		}
+		labels := openMetricsLabels(m.Descriptor.LabelKeys, series.LabelValues, "")
+		switch value := series.Points[len(series.Points)-1].Value.(type) {
+		case int64:
+			if kind == "counter" {
+				fmt.Fprintf(out, "%s_total%s %d\n", name, labels, value)
+			} else {
+				fmt.Fprintf(out, "%s%s %d\n", name, labels, value)
+			}
+		case float64:
+			if kind == "counter" {
+				fmt.Fprintf(out, "%s_total%s %s\n", name, labels, formatOpenMetricsFloat(value))
+			} else {
+				fmt.Fprintf(out, "%s%s %s\n", name, labels, formatOpenMetricsFloat(value))
+			}
+		case *metricdata.Distribution:
+			bounds := []float64{}
+			if value.BucketOptions != nil {
+				bounds = value.BucketOptions.Bounds
+			}
+			cumulative := int64(0)
+			for i, bucket := range value.Buckets {
+				cumulative += bucket.Count
+				le := "+Inf"
+				if i < len(bounds) {
+					le = formatOpenMetricsFloat(bounds[i])
+				}
+				fmt.Fprintf(out, "%s_bucket%s %d%s\n", name, openMetricsLabels(m.Descriptor.LabelKeys, series.LabelValues, le),
+					cumulative, openMetricsExemplar(bucket.Exemplar))
+			}
+			fmt.Fprintf(out, "%s_count%s %d\n", name, labels, value.Count)
+			fmt.Fprintf(out, "%s_sum%s %s\n", name, labels, formatOpenMetricsFloat(value.Sum))
+		}
+	}
+}
+
+// GET handler exposing the metrics of this instance in the OpenMetrics text format, for admins.
+// Meant to be scraped by Prometheus with the admin token, histogram buckets carry a recent trace as exemplar.
+func openMetricsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "openMetricsHandler")
+	defer span.End()
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	metrics := []*metricdata.Metric{}
+	for _, producer := range metricproducer.GlobalManager().GetAll() {
+		metrics = append(metrics, producer.Read()...)
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].Descriptor.Name < metrics[j].Descriptor.Name
+	})
+
+	w.Header().Set("Content-Type", openMetricsType)
+	w.Header().Set("Cache-Control", "no-store")
+	for _, m := range metrics {
+		writeOpenMetric(w, m)
+	}
+	fmt.Fprint(w, "# EOF\n")
+}
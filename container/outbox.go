@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Types of events published through the outbox
+const (
+	eventLinkCreated     = "link.created"
+	eventLinkUpdated     = "link.updated"
+	eventLinkConsumed    = "link.consumed"
+	eventLinkQuarantined = "link.quarantined"
+	eventLinkReleased    = "link.released"
+	eventLinkDeleted     = "link.deleted"
+	eventTrafficAnomaly  = "traffic.anomaly"
+)
+
+// Timings of the outbox dispatcher
+const (
+	// Interval of the sweep delivering events left behind by crashed instances
+	outboxSweep = 10 * time.Minute
+	// Age after which a deletion event is dropped if its link still exists, as the deletion failed
+	outboxDeleteGrace = time.Hour
+)
+
+// struct event is a change published to subscribers at least once.
+// Subscribers use ID to recognise events delivered more than once.
+type event struct {
+	ID   string    `json:"id"`
+	Type string    `json:"type"`
+	Code string    `json:"code,omitempty"`
+	Time time.Time `json:"time"`
+	// Details depending on the type of event
+	Data json.RawMessage `json:"data,omitempty"`
+	// Receivers which got the event in an earlier attempt, left out of what they are sent
+	Delivered []string `json:"delivered,omitempty"`
+}
+
+// Create an event with a fresh ID
+func newEvent(eventType string, code string, data interface{}) event {
+	random := make([]byte, 12)
+	rand.Read(random)
+	e := event{ID: hex.EncodeToString(random), Type: eventType, Code: code, Time: clock().UTC()}
+	if data != nil {
+		e.Data, _ = json.Marshal(data)
+	}
+	return e
+}
+
+// struct linkEventData describes a link in created and updated events.
+type linkEventData struct {
+	// Destination, left out for burn-after-reading links
+	URL     string    `json:"url,omitempty"`
+	Owner   string    `json:"owner,omitempty"`
+	Tags    []string  `json:"tags,omitempty"`
+	Expires time.Time `json:"expires,omitempty"`
+}
+
+// Describe a link for created and updated events
+func (l *link) eventData() linkEventData {
+	data := linkEventData{Owner: l.Owner, Tags: l.Tags, Expires: l.Expires}
+	if !l.BurnAfterReading {
+		data.URL = l.URL
+	}
+	return data
+}
+
+// Whether link events are published, enabled by EVENTS_WEBHOOK or EVENTS_TOPIC
+func eventsEnabled() bool {
+	return config.EventsWebhook != "" || config.EventsTopic != ""
+}
+
+// Add an event to the outbox of a link, which is written together with the change it describes
+func (l *link) emit(eventType string, code string, data interface{}) {
+	if eventsEnabled() {
+		l.Outbox = append(l.Outbox, newEvent(eventType, code, data))
+	}
+}
+
+// Name of the GCS object holding an event which isn't part of a link
+func outboxObject(id string) string {
+	return "outbox/" + id + ".json"
+}
+
+// Persist an event on its own, for changes which don't write a link.
+// Fails with a precondition error if an event with the same ID was stored before.
+func storeEvent(ctx context.Context, e event) error {
+	ctx, span := tracer.Start(ctx, "storeEvent")
+	defer span.End()
+	marshalled, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return gcsWriteIfGeneration(ctx, outboxObject(e.ID), "application/json", marshalled, 0)
+}
+
+// Deliver an event to its subscribers, the topic first and then the webhooks.
+// Receivers which got it are added to its delivered list, so retries skip them.
+func deliverEvent(ctx context.Context, e *event) error {
+	ctx, span := tracer.Start(ctx, "deliverEvent")
+	defer span.End()
+	if strings.HasPrefix(e.Type, "traffic.") {
+		if config.TrafficWebhook == "" {
+			return nil
+		}
+		return notifyTrafficWebhook(ctx, e.Data)
+	}
+	if !eventsEnabled() {
+		return nil
+	}
+	if eventsTopic != nil && !e.deliveredTo(topicReceiver) {
+		err := publishEvent(ctx, *e)
+		if err != nil {
+			return err
+		}
+		e.Delivered = append(e.Delivered, topicReceiver)
+	}
+	body, err := e.payload()
+	if err != nil {
+		return err
+	}
+	// A failing webhook doesn't hold up the others
+	var failed error
+	for _, webhook := range eventWebhooks() {
+		receiver := webhookReceiver(webhook)
+		if e.deliveredTo(receiver) {
+			continue
+		}
+		err = postEvent(ctx, webhook, e, body)
+		if err != nil {
+			failed = err
+			continue
+		}
+		e.Delivered = append(e.Delivered, receiver)
+	}
+	return failed
+}
+
+// Deliver the pending events of a link in order and remove them from its outbox
+func dispatchLinkEvents(ctx context.Context, code string) error {
+	ctx, span := tracer.Start(ctx, "dispatchLinkEvents")
+	defer span.End()
+	l, err := readLink(ctx, code)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	delivered := map[string]bool{}
+	// Receivers which got the event that failed, so the next attempt skips them
+	var partial *event
+	for i := range l.Outbox {
+		e := &l.Outbox[i]
+		received := len(e.Delivered)
+		err = deliverEvent(ctx, e)
+		if err != nil {
+			if len(e.Delivered) > received {
+				partial = e
+			}
+			break
+		}
+		delivered[e.ID] = true
+	}
+	if len(delivered) > 0 || partial != nil {
+		_, updateErr := updateLink(ctx, code, func(l *link) error {
+			pending := []event{}
+			for _, e := range l.Outbox {
+				if partial != nil && e.ID == partial.ID {
+					e.Delivered = partial.Delivered
+				}
+				if !delivered[e.ID] {
+					pending = append(pending, e)
+				}
+			}
+			l.Outbox = pending
+			return nil
+		})
+		if updateErr != nil {
+			return updateErr
+		}
+	}
+	return err
+}
+
+// Deliver an event stored on its own and remove it
+func dispatchStoredEvent(ctx context.Context, name string) error {
+	ctx, span := tracer.Start(ctx, "dispatchStoredEvent")
+	defer span.End()
+	data, _, err := gcsReadBlob(ctx, name)
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	e := event{}
+	err = json.Unmarshal(data, &e)
+	if err != nil {
+		return err
+	}
+	if e.Type == eventLinkDeleted {
+		_, err = linkStorage.read(ctx, e.Code, 1)
+		if err == nil {
+			if clock().Sub(e.Time) < outboxDeleteGrace {
+				return fmt.Errorf("link %s not deleted yet", e.Code)
+			}
+			return gcsDelete(ctx, name)
+		}
+		if err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+	received := len(e.Delivered)
+	err = deliverEvent(ctx, &e)
+	if err != nil {
+		if len(e.Delivered) > received {
+			// Keep track of the receivers which got it
+			marshalled, marshalErr := json.Marshal(e)
+			if marshalErr == nil {
+				gcsWriteBlob(ctx, name, "application/json", marshalled)
+			}
+		}
+		return err
+	}
+	return gcsDelete(ctx, name)
+}
+
+// Hand the pending events of a link to the task runner, the sweep catches up if this fails
+func dispatchLater(ctx context.Context, code string) {
+	err := enqueue(ctx, "dispatch-link-events", code)
+	if err != nil {
+		slog.Error("unable to queue events", "code", code, "err", err)
+	}
+}
+
+// Periodically deliver events which weren't dispatched right after being written, on one instance
+func startOutboxDispatcher() {
+	if !eventsEnabled() && config.TrafficWebhook == "" {
+		return
+	}
+	startSingleton("outbox-sweep", outboxSweep, sweepOutbox)
+}
+
+// Queue all pending events, stored on their own or in links
+func sweepOutbox(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "sweepOutbox")
+	defer span.End()
+	err := gcsListPrefix(ctx, "outbox/", func(name string) error {
+		return enqueue(ctx, "dispatch-event", name)
+	})
+	if err != nil || !eventsEnabled() {
+		return err
+	}
+	return linkStorage.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err == nil && len(l.Outbox) > 0 {
+			return enqueue(ctx, "dispatch-link-events", code)
+		}
+		return nil
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// Prefix of the index from owners and users to the codes of their links
+const ownersPrefix = "owners/"
+
+// struct linkScope narrows a listing down to an owner's and a signed-in user's links, empty fields match anyone.
+type linkScope struct {
+	owner string
+	uid   string
+}
+
+// Report whether a link is in the scope
+func (s linkScope) includes(l *link) bool {
+	return (s.owner == "" || l.Owner == s.owner) && (s.uid == "" || l.UID == s.uid)
+}
+
+// Prefix of the index objects of an owner ("o") or user ("u"), hashed as names may contain anything
+func ownerIndexPrefix(kind string, name string) string {
+	sum := sha256.Sum256([]byte(name))
+	return ownersPrefix + kind + "/" + hex.EncodeToString(sum[:]) + "/"
+}
+
+// Names of the index objects listing a link under its owner and user
+func ownerIndexObjects(code string, l *link) []string {
+	names := []string{}
+	if l.Owner != "" {
+		names = append(names, ownerIndexPrefix("o", l.Owner)+code)
+	}
+	if l.UID != "" {
+		names = append(names, ownerIndexPrefix("u", l.UID)+code)
+	}
+	return names
+}
+
+// Add a link to the index of its owner and user.
+// Written before the link itself, entries of links that weren't written are skipped when listing.
+func indexOwner(ctx context.Context, code string, l *link) error {
+	ctx, span := tracer.Start(ctx, "indexOwner")
+	defer span.End()
+	for _, name := range ownerIndexObjects(code, l) {
+		err := gcsWriteBlob(ctx, name, "text/plain", nil)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Remove a deleted link from the index of its owner and user
+func unindexOwner(ctx context.Context, code string, l *link) error {
+	ctx, span := tracer.Start(ctx, "unindexOwner")
+	defer span.End()
+	for _, name := range ownerIndexObjects(code, l) {
+		err := gcsDelete(ctx, name)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+	}
+	return nil
+}
+
+// Visit the codes of the links that may be in the scope after a code in lexical order.
+// Scoped listings only go through the index of the user or owner, everything else lists all links.
+// Callers check includes on the links, the index may hold entries of links that weren't written.
+func (s linkScope) list(ctx context.Context, after string, visit func(code string) error) error {
+	prefix := ""
+	switch {
+	case s.uid != "":
+		prefix = ownerIndexPrefix("u", s.uid)
+	case s.owner != "":
+		prefix = ownerIndexPrefix("o", s.owner)
+	default:
+		return linkStorage.list(ctx, after, visit)
+	}
+	return gcsListPrefixAfter(ctx, prefix, prefix+after, func(name string) error {
+		return visit(strings.TrimPrefix(name, prefix))
+	})
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Payload types which can be stored behind a short code instead of a URL
+const (
+	payloadVCard = "vcard"
+	payloadWiFi  = "wifi"
+	payloadGeo   = "geo"
+)
+
+// struct payload is structured content served directly instead of redirecting.
+// Only the fields of its type may be set.
+type payload struct {
+	// One of vcard, wifi or geo
+	Type string `json:"type"`
+
+	// Contact (vcard), Name is required
+	Name         string `json:"name,omitempty"`
+	Organization string `json:"organization,omitempty"`
+	Title        string `json:"title,omitempty"`
+	Phone        string `json:"phone,omitempty"`
+	Email        string `json:"email,omitempty"`
+	Website      string `json:"website,omitempty"`
+	Address      string `json:"address,omitempty"`
+
+	// Network credentials (wifi), SSID is required
+	SSID string `json:"ssid,omitempty"`
+	// WPA (default), WEP or nopass
+	Security string `json:"security,omitempty"`
+	Password string `json:"password,omitempty"`
+	Hidden   bool   `json:"hidden,omitempty"`
+
+	// Coordinates (geo) in decimal degrees, both required
+	Latitude  *float64 `json:"latitude,omitempty"`
+	Longitude *float64 `json:"longitude,omitempty"`
+	// Name of the place
+	Label string `json:"label,omitempty"`
+}
+
+// Check that a payload is complete and only sets fields of its type, normalising the Wi-Fi security
+func (p *payload) validate() error {
+	vcard := p.Name != "" || p.Organization != "" || p.Title != "" || p.Phone != "" || p.Email != "" || p.Website != "" || p.Address != ""
+	wifi := p.SSID != "" || p.Security != "" || p.Password != "" || p.Hidden
+	geo := p.Latitude != nil || p.Longitude != nil || p.Label != ""
+
+	switch p.Type {
+	case payloadVCard:
+		if wifi || geo {
+			return errors.New("vcard payloads only take contact fields")
+		}
+		if strings.TrimSpace(p.Name) == "" {
+			return errors.New("vcard payloads need a name")
+		}
+		if p.Email != "" && !strings.Contains(p.Email, "@") {
+			return errors.New("email of the vcard is invalid")
+		}
+		if p.Phone != "" && strings.Trim(p.Phone, "+0123456789 ()-/.") != "" {
+			return errors.New("phone of the vcard is invalid")
+		}
+		if p.Website != "" {
+			uri, err := url.Parse(p.Website)
+			if err != nil || (uri.Scheme != "https" && uri.Scheme != "http") || uri.Host == "" {
+				return errors.New("website of the vcard is not a HTTP/HTTPS URL")
+			}
+		}
+	case payloadWiFi:
+		if vcard || geo {
+			return errors.New("wifi payloads only take network fields")
+		}
+		if p.SSID == "" || len(p.SSID) > 32 {
+			return errors.New("wifi payloads need an ssid of at most 32 bytes")
+		}
+		p.Security = strings.ToUpper(p.Security)
+		switch p.Security {
+		case "", "WPA":
+			p.Security = "WPA"
+			if len(p.Password) < 8 || len(p.Password) > 63 {
+				return errors.New("WPA passwords have 8 to 63 characters")
+			}
+		case "WEP":
+			if p.Password == "" {
+				return errors.New("WEP networks need a password")
+			}
+		case "NOPASS":
+			p.Security = "nopass"
+			if p.Password != "" {
+				return errors.New("open networks have no password")
+			}
+		default:
+			return errors.New("wifi security should be WPA, WEP or nopass")
+		}
+	case payloadGeo:
+		if vcard || wifi {
+			return errors.New("geo payloads only take coordinates and a label")
+		}
+		if p.Latitude == nil || p.Longitude == nil {
+			return errors.New("geo payloads need a latitude and longitude")
+		}
+		if *p.Latitude < -90 || *p.Latitude > 90 {
+			return errors.New("latitude should be between -90 and 90")
+		}
+		if *p.Longitude < -180 || *p.Longitude > 180 {
+			return errors.New("longitude should be between -180 and 180")
+		}
+	default:
+		return errors.New("payload type should be vcard, wifi or geo")
+	}
+	return nil
+}
+
+// Escape a vCard 3.0 text value
+func vcardEscape(value string) string {
+	return strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+}
+
+// Render a vcard payload as a vCard 3.0 document
+func (p *payload) vcard() string {
+	lines := []string{"BEGIN:VCARD", "VERSION:3.0", "FN:" + vcardEscape(p.Name), "N:" + vcardEscape(p.Name) + ";;;;"}
+	if p.Organization != "" {
+		lines = append(lines, "ORG:"+vcardEscape(p.Organization))
+	}
+	if p.Title != "" {
+		lines = append(lines, "TITLE:"+vcardEscape(p.Title))
+	}
+	if p.Phone != "" {
+		lines = append(lines, "TEL;TYPE=CELL:"+vcardEscape(p.Phone))
+	}
+	if p.Email != "" {
+		lines = append(lines, "EMAIL:"+vcardEscape(p.Email))
+	}
+	if p.Website != "" {
+		lines = append(lines, "URL:"+vcardEscape(p.Website))
+	}
+	if p.Address != "" {
+		lines = append(lines, "ADR:;;"+vcardEscape(p.Address)+";;;;")
+	}
+	lines = append(lines, "END:VCARD")
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// Render a wifi payload in the WIFI: format understood by phone cameras
+func (p *payload) wifi() string {
+	escape := strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, ":", `\:`, `"`, `\"`).Replace
+	s := "WIFI:T:" + p.Security + ";S:" + escape(p.SSID) + ";"
+	if p.Password != "" {
+		s += "P:" + escape(p.Password) + ";"
+	}
+	if p.Hidden {
+		s += "H:true;"
+	}
+	return s + ";"
+}
+
+// Render a geo payload as a geo: URI (RFC 5870)
+func (p *payload) geo() string {
+	s := "geo:" + strconv.FormatFloat(*p.Latitude, 'f', -1, 64) + "," + strconv.FormatFloat(*p.Longitude, 'f', -1, 64)
+	if p.Label != "" {
+		s += "?q=" + url.QueryEscape(p.Label)
+	}
+	return s
+}
+
+// Single line URI standing in for the destination of a payload link,
+// so short codes, tombstones and listings treat it like any other link
+func (p *payload) uri() string {
+	switch p.Type {
+	case payloadVCard:
+		return "data:text/vcard;base64," + base64.StdEncoding.EncodeToString([]byte(p.vcard()))
+	case payloadWiFi:
+		return p.wifi()
+	case payloadGeo:
+		return p.geo()
+	}
+	return ""
+}
+
+// Page shown to browsers opening a Wi-Fi link
+var wifiTemplate = template.Must(template.New("wifi").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>{{.SSID}} - Urly Wurly</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<main class="payload">
+<h1>Wi-Fi network</h1>
+<dl>
+<dt>Network</dt><dd>{{.SSID}}{{if .Hidden}} (hidden){{end}}</dd>
+<dt>Security</dt><dd>{{.Security}}</dd>
+{{if .Password}}<dt>Password</dt><dd><code>{{.Password}}</code></dd>{{end}}
+</dl>
+</main>
+</body>
+</html>
+`))
+
+// Serve the content of a payload link with the content type of its kind.
+// Browsers get a page for Wi-Fi credentials and a map for coordinates.
+func servePayload(ctx context.Context, w http.ResponseWriter, code string, p *payload) {
+	ctx, span := tracer.Start(ctx, "servePayload")
+	defer span.End()
+	html := false
+	if nw, ok := w.(*negotiatedWriter); ok {
+		html = nw.html
+	}
+	var err error
+	switch p.Type {
+	case payloadVCard:
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Header().Set("Content-Disposition", "inline; filename=\""+code+".vcf\"")
+		_, err = w.Write([]byte(p.vcard()))
+	case payloadWiFi:
+		if html {
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			err = wifiTemplate.Execute(w, p)
+			break
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, err = w.Write([]byte(p.wifi()))
+	case payloadGeo:
+		if html {
+			lat := strconv.FormatFloat(*p.Latitude, 'f', -1, 64)
+			lng := strconv.FormatFloat(*p.Longitude, 'f', -1, 64)
+			w.Header().Set("Location", "https://www.openstreetmap.org/?mlat="+lat+"&mlon="+lng+"#map=16/"+lat+"/"+lng)
+			w.WriteHeader(http.StatusFound)
+			return
+		}
+		// GeoJSON positions are longitude first
+		feature := map[string]interface{}{
+			"type":       "Feature",
+			"geometry":   map[string]interface{}{"type": "Point", "coordinates": []float64{*p.Longitude, *p.Latitude}},
+			"properties": map[string]string{"name": p.Label, "uri": p.geo()},
+		}
+		w.Header().Set("Content-Type", "application/geo+json")
+		err = json.NewEncoder(w).Encode(feature)
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Page shown to browsers previewing a short link with a "+" suffix
+var previewTemplate = template.Must(template.New("preview").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex, nofollow">
+<title>Preview of {{.ShortenedURL}} - Urly Wurly</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<main class="error-page preview-page">
+<img src="/logo-square.png" alt="Urly Wurly" width="96" height="96">
+<h1>{{.ShortenedURL}}</h1>
+{{if .URL}}<p>This short link leads to <code>{{.URL}}</code></p>
+{{range .Variants}}<p>or <code>{{.}}</code></p>
+{{end}}{{else}}<p>{{.Message}}</p>
+{{end}}<p>Created {{if .Created.IsZero}}a long time ago{{else}}on {{.Created.Format "January 2, 2006"}}{{end}}{{if .Clicks}}, clicked {{.Clicks}} times{{end}}{{if .Expires}}, expires on {{.Expires.Format "January 2, 2006"}}{{end}}.</p>
+{{if .Warning}}<p class="text-danger">{{.Warning}}</p>
+{{end}}<p><a href="/">Take me back</a></p>
+<p><a class="btn btn-primary" href="{{.ShortenedURL}}" rel="noopener noreferrer nofollow">Continue</a></p>
+</main>
+</body>
+</html>
+`))
+
+// struct previewResponse is where a short link leads, shown instead of redirecting.
+type previewResponse struct {
+	response
+	// Destination, empty for burn-after-reading links, which reveal it only when opened
+	URL string `json:"url,omitempty"`
+	// Other destinations of a split link
+	Variants []string  `json:"variants,omitempty"`
+	Created  time.Time `json:"created,omitempty"`
+	// Clicks so far, only for links with public stats
+	Clicks  *int64     `json:"clicks,omitempty"`
+	Expires *time.Time `json:"expires,omitempty"`
+	// Why the link was quarantined
+	Warning string `json:"warning,omitempty"`
+}
+
+// Describe a link for its preview
+func previewLink(ctx context.Context, code string, l *link) (previewResponse, error) {
+	ctx, span := tracer.Start(ctx, "previewLink")
+	defer span.End()
+	preview := previewResponse{response: response{shortLink(code), "link previewed!"}, URL: l.URL, Created: l.Created}
+	for i, v := range l.Variants {
+		// The first variant is URL
+		if i > 0 {
+			preview.Variants = append(preview.Variants, v.URL)
+		}
+	}
+	if l.BurnAfterReading {
+		// Showing it would read the one-time link without consuming it
+		preview.URL = ""
+		preview.Message = "This is a one-time link, its destination is only shown when it's opened."
+	}
+	if !l.Expires.IsZero() {
+		preview.Expires = &l.Expires
+	}
+	if l.Quarantine != nil {
+		preview.Warning = l.Quarantine.Reason
+		if preview.Warning == "" {
+			preview.Warning = "This link has been flagged and is under review."
+		}
+	}
+	if l.PublicStats && !l.NoAnalytics {
+		listed, err := listLink(ctx, code, l)
+		if err != nil {
+			return preview, err
+		}
+		preview.Clicks = listed.Clicks
+	}
+	return preview, nil
+}
+
+// GET handler previewing a short link (/<code>+) instead of following it: where it leads, when it was created,
+// and how often it was clicked if its stats are public. Browsers get a page, everybody else JSON.
+// Previews aren't counted as clicks.
+func previewHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "previewHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	code := mux.Vars(r)["id"]
+	if isHoneypot(code) {
+		trapScanner(ctx, w, r, code)
+		return
+	}
+	if !allowScanner(ctx, w, r) || !allowRedirect(ctx, w, r, code) {
+		return
+	}
+	l, err := lengthenURL(ctx, code)
+	if err == errAnomalousLink {
+		respond(ctx, response{"", "link is unavailable!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return
+	}
+	if l.expired(clock()) {
+		respond(ctx, response{"", "link has expired!"}, http.StatusGone, w)
+		return
+	}
+	if !l.Consumed.IsZero() {
+		respond(ctx, response{"", "this link has been consumed!"}, http.StatusGone, w)
+		return
+	}
+	preview, err := previewLink(ctx, code, l)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+
+	// The destination may be repointed, so the preview mustn't stick
+	w.Header().Set("Cache-Control", "no-cache")
+	if nw, ok := w.(*negotiatedWriter); !ok || !nw.html {
+		respond(ctx, preview, http.StatusOK, w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	err = previewTemplate.Execute(w, preview)
+	if err != nil {
+		slog.Error("unable to render preview", "err", err)
+	}
+}
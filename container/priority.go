@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"go.opencensus.io/tag"
+)
+
+// Defaults of the request prioritization
+const (
+	// Cloud Run's default of concurrent requests per instance
+	defaultInstanceConcurrency   = 80
+	defaultManagementConcurrency = 20
+	defaultManagementWait        = 5 * time.Second
+)
+
+// Classes of requests competing for an instance
+const (
+	// Short links and everything else visitors follow, never held back
+	classRedirect = "redirect"
+	// The JSON and GraphQL APIs and the status page
+	classAPI = "api"
+	// Admin endpoints and queued tasks
+	classAdmin = "admin"
+	// QR codes and printable labels of links, rendered anew on every request
+	classRender = "render"
+)
+
+// Companions of short links which are rendered rather than read, held back like management requests
+var renderedCompanions = map[string]bool{"qr": true, "label": true}
+
+// Requests in flight by class, set up by setupPriorities.
+// Management requests only start while redirects leave room for them, so they can't crowd redirects out.
+var priority struct {
+	sync.Mutex
+	// Requests the instance serves at once, as configured on Cloud Run
+	capacity int
+	// Management requests served at once
+	limit int
+	// How long a management request waits for room
+	wait time.Duration
+	// Requests in flight
+	redirects  int
+	management int
+	// Management requests waiting for room
+	waiting int
+	// Closed when a request finishes while management requests are waiting
+	released chan struct{}
+}
+
+// Configure the prioritization from INSTANCE_CONCURRENCY (the instance's concurrency on Cloud Run),
+// MANAGEMENT_CONCURRENCY (API and admin requests served at once) and MANAGEMENT_QUEUE_TIMEOUT
+func setupPriorities() {
+	capacity := config.InstanceConcurrency
+	if capacity <= 0 {
+		capacity = defaultInstanceConcurrency
+	}
+	limit := config.ManagementConcurrency
+	if limit <= 0 {
+		limit = defaultManagementConcurrency
+	}
+	if limit > capacity {
+		limit = capacity
+	}
+	wait := config.ManagementQueueTimeout
+	if wait <= 0 {
+		wait = defaultManagementWait
+	}
+	priority.capacity = capacity
+	priority.limit = limit
+	priority.wait = wait
+	priority.released = make(chan struct{})
+}
+
+// Class of a request by its path
+func requestClass(r *http.Request) string {
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/admin/"), strings.HasPrefix(r.URL.Path, "/internal/tasks/"):
+		return classAdmin
+	case strings.HasPrefix(r.URL.Path, "/api/"), r.URL.Path == "/s", strings.HasPrefix(r.URL.Path, "/s/"),
+		r.URL.Path == "/graphql", r.URL.Path == "/status":
+		return classAPI
+	}
+	// /{id}/qr and /{id}/label
+	if parts := strings.Split(r.URL.Path, "/"); len(parts) == 3 && renderedCompanions[parts[2]] {
+		return classRender
+	}
+	return classRedirect
+}
+
+// Middleware letting redirects through right away and holding management requests back
+// while the instance is busy, rejecting them with 503 if no room frees up in time
+func prioritize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if priority.released == nil || r.Method == http.MethodOptions {
+			next.ServeHTTP(w, r)
+			return
+		}
+		class := requestClass(r)
+		if class == classRedirect {
+			priority.Lock()
+			priority.redirects++
+			priority.Unlock()
+			defer finishRequest(class)
+			next.ServeHTTP(w, r)
+			return
+		}
+		ctx := context.Background()
+		mutators := []tag.Mutator{tag.Upsert(keyClass, class)}
+		delay, ok := admitManagement(r)
+		if !ok {
+			record(ctx, mutators, shedRequests.M(1))
+			rejectOverload(ctx, w, http.StatusServiceUnavailable, priority.wait, "server is busy serving redirects, try again later!")
+			return
+		}
+		defer finishRequest(class)
+		if delay > 0 {
+			record(ctx, mutators, delayedRequests.M(float64(delay)/float64(time.Millisecond)))
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Wait until a management request may start, returning how long it waited.
+// Returns false if the wait times out or the client goes away.
+func admitManagement(r *http.Request) (time.Duration, bool) {
+	start := time.Now()
+	var timeout <-chan time.Time
+	for {
+		priority.Lock()
+		if priority.management < priority.limit && priority.redirects+priority.management < priority.capacity {
+			priority.management++
+			priority.Unlock()
+			if timeout == nil {
+				return 0, true
+			}
+			return time.Since(start), true
+		}
+		priority.waiting++
+		released := priority.released
+		priority.Unlock()
+		if timeout == nil {
+			timer := time.NewTimer(priority.wait)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+		var ok bool
+		select {
+		case <-released:
+			ok = true
+		case <-timeout:
+		case <-r.Context().Done():
+		}
+		priority.Lock()
+		priority.waiting--
+		priority.Unlock()
+		if !ok {
+			return 0, false
+		}
+	}
+}
+
+// Count a request as done, waking waiting management requests
+func finishRequest(class string) {
+	priority.Lock()
+	defer priority.Unlock()
+	if class == classRedirect {
+		priority.redirects--
+	} else {
+		priority.management--
+	}
+	if priority.waiting > 0 {
+		close(priority.released)
+		priority.released = make(chan struct{})
+	}
+}
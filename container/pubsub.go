@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"math/rand"
+
+	"cloud.google.com/go/pubsub"
+)
+
+// Type of the sampled redirect events, which don't go through the outbox
+const eventLinkClicked = "link.clicked"
+
+// Topic link events are published to, nil unless EVENTS_TOPIC is set
+var eventsTopic *pubsub.Topic
+
+// Share of redirects published as events, from EVENTS_CLICK_SAMPLE
+var clickSample float64
+
+// struct clickEventData describes a redirect in clicked events.
+type clickEventData struct {
+	// Host of the referring page, empty for direct traffic
+	Referrer string `json:"referrer,omitempty"`
+	// Share of redirects published, to scale counts back up
+	Sample float64 `json:"sample"`
+}
+
+// Publish link events to the Pub/Sub topic EVENTS_TOPIC of GOOGLE_CLOUD_PROJECT,
+// and EVENTS_CLICK_SAMPLE (0 to 1) of the redirects
+func setupEventsTopic(ctx context.Context) error {
+	topic := config.EventsTopic
+	if topic == "" {
+		return nil
+	}
+	client, err := pubsub.NewClient(ctx, config.Project)
+	if err != nil {
+		return err
+	}
+	eventsTopic = client.Topic(topic)
+	clickSample = config.EventsClickSample
+	if clickSample > 1 {
+		clickSample = 1
+	}
+	return nil
+}
+
+// Publish an event and wait until Pub/Sub took it.
+// The type and code are also set as attributes, so subscriptions can filter on them.
+func publishEvent(ctx context.Context, e event) error {
+	ctx, span := tracer.Start(ctx, "publishEvent")
+	defer span.End()
+	body, err := e.payload()
+	if err != nil {
+		return err
+	}
+	result := eventsTopic.Publish(ctx, &pubsub.Message{Data: body, Attributes: map[string]string{"type": e.Type, "code": e.Code}})
+	_, err = result.Get(ctx)
+	return err
+}
+
+// Publish a sample of the redirects without waiting, losing those which fail
+func publishClick(c click) {
+	if eventsTopic == nil || clickSample <= 0 || rand.Float64() >= clickSample {
+		return
+	}
+	e := newEvent(eventLinkClicked, c.Code, clickEventData{c.Referrer, clickSample})
+	e.Time = c.Time
+	go func() {
+		err := publishEvent(context.Background(), e)
+		if err != nil {
+			slog.Error("unable to publish click", "code", c.Code, "err", err)
+		}
+	}()
+}
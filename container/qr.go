@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	qrcode "github.com/skip2/go-qrcode"
+)
+
+// Size of QR codes served by /<code>/qr by default, and the range accepted by ?size=
+const (
+	defaultQRSize = 256
+	minQRSize     = 64
+	maxQRSize     = 2048
+)
+
+// Error correction levels accepted by ?ecc=, recovering 7%, 15%, 25% and 30% of the code
+var qrLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// struct qrOptions is how a QR code is rendered.
+type qrOptions struct {
+	// png or svg
+	Type  string
+	Size  int
+	Level qrcode.RecoveryLevel
+}
+
+// Render the QR code for a short code's public URL as an image of size x size pixels
+func qrImage(code string, size int) (image.Image, error) {
+	qr, err := qrcode.New(shortLink(code), qrcode.Medium)
+	if err != nil {
+		return nil, err
+	}
+	return qr.Image(size), nil
+}
+
+// Render the QR code for a short code's public URL as PNG
+func qrPNG(code string, size int) ([]byte, error) {
+	return qrcode.Encode(shortLink(code), qrcode.Medium, size)
+}
+
+// Render the QR code for a short code's public URL as SVG, one path of square modules on white
+func qrSVG(code string, size int, level qrcode.RecoveryLevel) ([]byte, error) {
+	qr, err := qrcode.New(shortLink(code), level)
+	if err != nil {
+		return nil, err
+	}
+	// The bitmap includes the quiet zone
+	bitmap := qr.Bitmap()
+	modules := len(bitmap)
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(out, `<rect width="%d" height="%d" fill="#fff"/><path fill="#000" d="`, modules, modules)
+	for y, row := range bitmap {
+		for x, dark := range row {
+			if dark {
+				fmt.Fprintf(out, "M%d %dh1v1h-1z", x, y)
+			}
+		}
+	}
+	out.WriteString(`"/></svg>`)
+	return out.Bytes(), nil
+}
+
+// Read ?type= (png or svg), ?size= in pixels and ?ecc= (L, M, Q or H)
+func parseQROptions(query url.Values) (qrOptions, error) {
+	options := qrOptions{Type: strings.ToLower(query.Get("type")), Size: defaultQRSize, Level: qrcode.Medium}
+	if options.Type == "" {
+		options.Type = "png"
+	}
+	if options.Type != "png" && options.Type != "svg" {
+		return options, errors.New("type should be png or svg")
+	}
+	if raw := query.Get("size"); raw != "" {
+		size, err := strconv.Atoi(raw)
+		if err != nil || size < minQRSize || size > maxQRSize {
+			return options, fmt.Errorf("size should be between %d and %d", minQRSize, maxQRSize)
+		}
+		options.Size = size
+	}
+	if raw := query.Get("ecc"); raw != "" {
+		level, ok := qrLevels[strings.ToUpper(raw)]
+		if !ok {
+			return options, errors.New("ecc should be L, M, Q or H")
+		}
+		options.Level = level
+	}
+	return options, nil
+}
+
+// Write the QR code of a short code as the response
+func writeQR(ctx context.Context, w http.ResponseWriter, code string, options qrOptions, status int) {
+	ctx, span := tracer.Start(ctx, "writeQR")
+	defer span.End()
+	var image []byte
+	var err error
+	contentType := "image/png"
+	if options.Type == "svg" {
+		image, err = qrSVG(code, options.Size, options.Level)
+		contentType = "image/svg+xml"
+	} else {
+		image, err = qrcode.Encode(shortLink(code), options.Level, options.Size)
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "unable to render QR code!"}, http.StatusInternalServerError, w)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "inline; filename=\""+code+"."+options.Type+"\"")
+	w.WriteHeader(status)
+	w.Write(image)
+}
+
+// GET handler rendering the QR code of a link's short URL as PNG or SVG.
+// ?type= is png (default) or svg, ?size= the width in pixels and ?ecc= the error correction level (L, M, Q or H).
+func qrHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "qrHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	options, err := parseQROptions(r.URL.Query())
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", err.Error() + "!"}, http.StatusBadRequest, w)
+		return
+	}
+	code := mux.Vars(r)["id"]
+	_, err = readLink(ctx, code)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return
+	}
+	// The short URL of a code never changes
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	writeQR(ctx, w, code, options, http.StatusOK)
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"html/template"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Who put a link into quarantine
+const (
+	quarantineAdmin        = "admin"
+	quarantineAbuseReports = "abuse_reports"
+	quarantineSafeBrowsing = "safe_browsing"
+)
+
+// struct quarantine holds why and since when a link is quarantined.
+type quarantine struct {
+	// Who quarantined the link (admin, abuse_reports, safe_browsing)
+	Source string `json:"source"`
+	// Explanation shown to visitors
+	Reason string `json:"reason"`
+	// Time the link was quarantined
+	Since time.Time `json:"since"`
+}
+
+// struct quarantineResponse tells API clients where a quarantined link leads and how to proceed anyway.
+type quarantineResponse struct {
+	response
+	Quarantine *quarantine `json:"quarantine"`
+	// Destination of the link
+	URL string `json:"url"`
+	// Signed URL following the link despite the warning
+	ConfirmURL string `json:"confirm_url"`
+}
+
+// Full-page warning shown instead of redirecting to quarantined links
+var warningTemplate = template.Must(template.New("warning").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<meta name="robots" content="noindex, nofollow">
+<title>Warning - Urly Wurly</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<main class="error-page warning-page">
+<h1>This link may be unsafe</h1>
+<p>{{.Reason}}</p>
+<p>It leads to <code>{{.URL}}</code></p>
+<p><a href="/">Take me back</a></p>
+<p><a class="btn btn-outline-danger" href="{{.ConfirmURL}}" rel="noopener noreferrer nofollow">I understand the risk, continue</a></p>
+</main>
+</body>
+</html>
+`))
+
+// Subject signed to skip the warning of a quarantined link, changes whenever it is quarantined anew
+func quarantineSubject(code string, q *quarantine) string {
+	return fmt.Sprintf("quarantine:%s:%d", code, q.Since.UnixNano())
+}
+
+// Short link following a quarantined link despite the warning
+func confirmURL(code string, q *quarantine) string {
+	return shortLink(code) + "?" + url.Values{"confirm": {sign(quarantineSubject(code, q))}}.Encode()
+}
+
+// Put a link into quarantine, keeping an existing quarantine as it is.
+// Returns the quarantine the link is in afterwards.
+func quarantineLink(ctx context.Context, code string, source string, reason string) (*quarantine, error) {
+	ctx, span := tracer.Start(ctx, "quarantineLink")
+	defer span.End()
+	l, err := updateLink(ctx, code, func(l *link) error {
+		if l.Quarantine == nil {
+			l.Quarantine = &quarantine{source, reason, clock().UTC()}
+			l.emit(eventLinkQuarantined, code, l.Quarantine)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	slog.Warn("quarantined link", "code", code, "source", source, "reason", reason)
+	return l.Quarantine, nil
+}
+
+// Lift the quarantine of a link
+func releaseLink(ctx context.Context, code string) error {
+	ctx, span := tracer.Start(ctx, "releaseLink")
+	defer span.End()
+	_, err := updateLink(ctx, code, func(l *link) error {
+		if l.Quarantine != nil {
+			l.emit(eventLinkReleased, code, nil)
+		}
+		l.Quarantine = nil
+		return nil
+	})
+	return err
+}
+
+// Report whether a request confirmed following a quarantined link
+func quarantineConfirmed(r *http.Request, code string, l *link) bool {
+	return verifySignature(quarantineSubject(code, l.Quarantine), r.URL.Query().Get("confirm"))
+}
+
+// Answer a visit of a quarantined link with a warning page (or its JSON equivalent)
+func serveQuarantineWarning(ctx context.Context, w http.ResponseWriter, code string, l *link) {
+	ctx, span := tracer.Start(ctx, "serveQuarantineWarning")
+	defer span.End()
+	w.Header().Set("Cache-Control", "no-store")
+	reason := l.Quarantine.Reason
+	if reason == "" {
+		reason = "This link has been flagged and is under review."
+	}
+	resp := quarantineResponse{response{shortLink(code), reason}, l.Quarantine, l.URL, confirmURL(code, l.Quarantine)}
+	if nw, ok := w.(*negotiatedWriter); !ok || !nw.html {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, resp, http.StatusForbidden, w)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusForbidden)
+	err := warningTemplate.Execute(w, struct {
+		Reason     string
+		URL        string
+		ConfirmURL string
+	}{reason, l.URL, resp.ConfirmURL})
+	if err != nil {
+		slog.Error("unable to render quarantine page", "err", err)
+	}
+}
+
+// Admin handler for quarantines: GET lists quarantined links, POST ?code=&reason= quarantines a link, DELETE ?code= releases it
+func quarantineHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "quarantineHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	code := r.URL.Query().Get("code")
+	switch r.Method {
+	case http.MethodPost:
+		reason := strings.TrimSpace(r.URL.Query().Get("reason"))
+		_, err := quarantineLink(ctx, code, quarantineAdmin, reason)
+		if err != nil {
+			respond(ctx, response{"", "unable to quarantine link!"}, http.StatusNotFound, w)
+			return
+		}
+		respond(ctx, response{shortLink(code), "link quarantined!"}, http.StatusOK, w)
+		return
+	case http.MethodDelete:
+		err := releaseLink(ctx, code)
+		if err != nil {
+			respond(ctx, response{"", "unable to release link!"}, http.StatusNotFound, w)
+			return
+		}
+		respond(ctx, response{shortLink(code), "link released!"}, http.StatusOK, w)
+		return
+	}
+
+	type quarantined struct {
+		Code string `json:"code"`
+		URL  string `json:"url"`
+		*quarantine
+	}
+	links := []quarantined{}
+	err := linkStorage.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err == nil && l.Quarantine != nil {
+			links = append(links, quarantined{code, l.URL, l.Quarantine})
+		}
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(links, func(i, j int) bool { return links[i].Since.After(links[j].Since) })
+	respond(ctx, links, http.StatusOK, w)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// struct tokenBucket holds the tokens available to a single key.
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// struct limiter hands out tokens per key at a fixed rate with a burst allowance.
+// Buckets which have refilled completely are forgotten to bound memory.
+type limiter struct {
+	sync.Mutex
+	// Tokens added per second
+	rate float64
+	// Maximum number of tokens a bucket holds
+	burst float64
+	// Buckets by key
+	buckets map[string]*tokenBucket
+}
+
+// Create a limiter allowing perMinute requests per key with the given burst
+func newLimiter(perMinute int, burst int) *limiter {
+	if burst < 1 {
+		burst = 1
+	}
+	l := &limiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		buckets: map[string]*tokenBucket{},
+	}
+	go func() {
+		for now := range time.Tick(time.Minute) {
+			l.sweep(now)
+		}
+	}()
+	return l
+}
+
+// Take a token for a key, reporting whether one was available
+func (l *limiter) allow(key string, now time.Time) bool {
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// Time until a key gets its next token
+func (l *limiter) wait(key string) time.Duration {
+	l.Lock()
+	defer l.Unlock()
+	b, ok := l.buckets[key]
+	if !ok || b.tokens >= 1 || l.rate == 0 {
+		return 0
+	}
+	return time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+}
+
+// Drop buckets which would be full by now
+func (l *limiter) sweep(now time.Time) {
+	l.Lock()
+	defer l.Unlock()
+	for key, b := range l.buckets {
+		if b.tokens+now.Sub(b.last).Seconds()*l.rate >= l.burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+// Address of the client, as appended to X-Forwarded-For by the Google front end
+func clientIP(r *http.Request) string {
+	if forwarded := r.Header.Get("X-Forwarded-For"); forwarded != "" {
+		hops := strings.Split(forwarded, ",")
+		return strings.TrimSpace(hops[len(hops)-1])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"io"
+	"regexp"
+	"strings"
+	"sync"
+
+	"go.opentelemetry.io/otel/attribute"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// Replacement of masked secrets
+const redacted = "REDACTED"
+
+// Query parameters masked by default, matched against the words of a parameter's name
+// so that e.g. access_token and X-Goog-Signature are covered too
+var defaultRedactedParams = []string{"token", "accesstoken", "key", "apikey", "secret", "password", "passwd", "pwd", "sig", "signature", "auth", "authorization", "session", "sessionid", "sid", "credential", "credentials", "code", "jwt"}
+
+var (
+	// Query parameters in URLs within free text
+	queryParamPattern = regexp.MustCompile(`([?&;])([^=&?;\s#"'<>]+)=([^&;\s#"'<>]*)`)
+	// Passwords in the user info of URLs
+	userinfoPattern = regexp.MustCompile(`(://[^/\s:@"'<>]+:)[^@\s/"'<>]+@`)
+)
+
+// Redaction rules, set up by setupRedaction
+var redaction struct {
+	sync.RWMutex
+	// Lower case names of masked query parameters
+	params map[string]bool
+	// Further patterns masked wherever they match
+	patterns []*regexp.Regexp
+}
+
+// Configure which secrets are masked in logs, traces and stored error messages:
+// REDACT_PARAMS adds comma-separated query parameters to the default ones,
+// REDACT_PATTERNS a space-separated list of regular expressions. Invalid expressions are fatal.
+func setupRedaction() {
+	err := applyRedaction(policySetting("REDACT_PARAMS"), policySetting("REDACT_PATTERNS"))
+	if err != nil {
+		fatal("invalid REDACT_PATTERNS", "err", err)
+	}
+}
+
+// Replace the redaction rules, keeping the current ones if an expression is invalid
+func applyRedaction(rawParams string, rawPatterns string) error {
+	params := map[string]bool{}
+	for _, param := range defaultRedactedParams {
+		params[param] = true
+	}
+	for _, param := range strings.Split(rawParams, ",") {
+		if param = strings.ToLower(strings.TrimSpace(param)); param != "" {
+			params[param] = true
+		}
+	}
+	patterns := []*regexp.Regexp{}
+	for _, expression := range strings.Fields(rawPatterns) {
+		pattern, err := regexp.Compile(expression)
+		if err != nil {
+			return err
+		}
+		patterns = append(patterns, pattern)
+	}
+	redaction.Lock()
+	redaction.params, redaction.patterns = params, patterns
+	redaction.Unlock()
+	return nil
+}
+
+// Report whether a query parameter is masked, by its full name or any of its words
+func redactedParam(name string) bool {
+	redaction.RLock()
+	defer redaction.RUnlock()
+	name = strings.ToLower(name)
+	if redaction.params[name] {
+		return true
+	}
+	for _, word := range strings.FieldsFunc(name, func(r rune) bool { return r == '-' || r == '_' || r == '.' }) {
+		if redaction.params[word] {
+			return true
+		}
+	}
+	return false
+}
+
+// Mask secrets in text which may contain URLs: values of sensitive query parameters,
+// passwords in URLs and whatever matches REDACT_PATTERNS
+func redact(text string) string {
+	if strings.ContainsAny(text, "=@") {
+		text = queryParamPattern.ReplaceAllStringFunc(text, func(match string) string {
+			parts := queryParamPattern.FindStringSubmatch(match)
+			if parts[3] == "" || !redactedParam(parts[2]) {
+				return match
+			}
+			return parts[1] + parts[2] + "=" + redacted
+		})
+		text = userinfoPattern.ReplaceAllString(text, "${1}"+redacted+"@")
+	}
+	redaction.RLock()
+	patterns := redaction.patterns
+	redaction.RUnlock()
+	for _, pattern := range patterns {
+		text = pattern.ReplaceAllString(text, redacted)
+	}
+	return text
+}
+
+// Mask secrets in an error message, for errors stored or returned rather than logged
+func redactError(err error) string {
+	return redact(err.Error())
+}
+
+// struct redactingWriter masks secrets in log lines before they are written.
+type redactingWriter struct {
+	out io.Writer
+}
+
+func (w redactingWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(w.out, redact(string(p)))
+	// The logger only cares whether everything it passed was taken
+	return len(p), err
+}
+
+// struct redactingExporter masks secrets in span names, attributes, events and statuses before exporting.
+type redactingExporter struct {
+	sdktrace.SpanExporter
+}
+
+func (e redactingExporter) ExportSpans(ctx context.Context, spans []sdktrace.ReadOnlySpan) error {
+	masked := make([]sdktrace.ReadOnlySpan, len(spans))
+	for i, s := range spans {
+		masked[i] = redactedSpan{s}
+	}
+	return e.SpanExporter.ExportSpans(ctx, masked)
+}
+
+// struct redactedSpan is an ended span whose texts are masked as the exporter reads them.
+type redactedSpan struct {
+	sdktrace.ReadOnlySpan
+}
+
+func (s redactedSpan) Name() string {
+	return redact(s.ReadOnlySpan.Name())
+}
+
+func (s redactedSpan) Attributes() []attribute.KeyValue {
+	return redactAttributes(s.ReadOnlySpan.Attributes())
+}
+
+func (s redactedSpan) Events() []sdktrace.Event {
+	events := s.ReadOnlySpan.Events()
+	masked := make([]sdktrace.Event, len(events))
+	for i, event := range events {
+		event.Name = redact(event.Name)
+		event.Attributes = redactAttributes(event.Attributes)
+		masked[i] = event
+	}
+	return masked
+}
+
+func (s redactedSpan) Status() sdktrace.Status {
+	status := s.ReadOnlySpan.Status()
+	status.Description = redact(status.Description)
+	return status
+}
+
+// Copy of span attributes with secrets masked in string values
+func redactAttributes(attributes []attribute.KeyValue) []attribute.KeyValue {
+	if len(attributes) == 0 {
+		return attributes
+	}
+	masked := make([]attribute.KeyValue, len(attributes))
+	for i, kv := range attributes {
+		if kv.Value.Type() == attribute.STRING {
+			kv = kv.Key.String(redact(kv.Value.AsString()))
+		}
+		masked[i] = kv
+	}
+	return masked
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// Visitors a day of a busy link, each with an IP of their own
+const benchmarkVisitors = 1000
+
+// Serve redirects of one link through the router, from the in-memory store and the redirect cache.
+// Requests take turns among the given number of visitors, so the rollup of the day lists them all.
+func benchmarkRedirect(b *testing.B, visitors int) {
+	router := newTestRouter(b, func(c *serverConfig) {
+		c.RedirectCacheSize = 100
+	})
+	err := writeLinkIfGeneration(context.Background(), "bench", &link{URL: "https://example.com/", Created: time.Now().UTC()}, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	requests := make([]*http.Request, visitors)
+	for i := range requests {
+		requests[i] = httptest.NewRequest(http.MethodGet, "/bench", nil)
+		requests[i].RemoteAddr = fmt.Sprintf("10.0.%d.%d:4711", i/256, i%256)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, requests[i%visitors])
+		if w.Code != http.StatusMovedPermanently && w.Code != http.StatusFound {
+			b.Fatalf("redirect answered %d: %s", w.Code, w.Body)
+		}
+	}
+}
+
+func BenchmarkRedirectSingleVisitor(b *testing.B) {
+	benchmarkRedirect(b, 1)
+}
+
+func BenchmarkRedirectBusyLink(b *testing.B) {
+	benchmarkRedirect(b, benchmarkVisitors)
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Formats of redirect maps and their file names
+var redirectMapFiles = map[string]string{
+	"nginx":      "urly-wurly.map",
+	"cloudflare": "urly-wurly-redirects.csv",
+	"netlify":    "_redirects",
+}
+
+// Characters escaped in destinations written to redirect maps, which would end a value or start a variable
+var redirectMapEscaper = strings.NewReplacer(`"`, "%22", `\`, "%5C", "$", "%24", " ", "%20", "\t", "%09", "\n", "%0A", "\r", "%0D")
+
+// struct redirectMapping is a short code redirecting to a destination.
+type redirectMapping struct {
+	code        string
+	destination string
+	// HTTP status of the redirect, a temporary one for links which may change or go away
+	status int
+}
+
+// Links which can be served as plain redirects by other infrastructure, in code order.
+// Burn-after-reading, quarantined, expired and non-web links need this service and are left out.
+func redirectMappings(ctx context.Context, tag string) ([]redirectMapping, error) {
+	ctx, span := tracer.Start(ctx, "redirectMappings")
+	defer span.End()
+	now := clock()
+	mappings := []redirectMapping{}
+	err := linkStorage.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil || (tag != "" && !l.hasTag(tag)) {
+			return nil
+		}
+		if l.BurnAfterReading || l.Quarantine != nil || !l.retired(now).IsZero() || !l.webDestination() {
+			return nil
+		}
+		status := l.redirectStatus()
+		if len(l.Variants) > 0 || l.TrackConversions || !l.Expires.IsZero() {
+			status = temporaryStatus(status)
+		}
+		mappings = append(mappings, redirectMapping{code, redirectMapEscaper.Replace(l.URL), status})
+		return nil
+	})
+	return mappings, err
+}
+
+// Render mappings as an nginx map from $uri to the destination, to be used like
+// if ($urly_wurly_redirect) { return 301 $urly_wurly_redirect; }
+func renderNginxMap(mappings []redirectMapping, generated time.Time) []byte {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "# %d redirects exported from %s at %s\n", len(mappings), config.Domain, generated.Format(time.RFC3339))
+	out.WriteString("map $uri $urly_wurly_redirect {\n    default \"\";\n")
+	for _, m := range mappings {
+		fmt.Fprintf(out, "    \"/%s\" \"%s\";\n", m.code, m.destination)
+	}
+	out.WriteString("}\n")
+	return out.Bytes()
+}
+
+// Render mappings as a Cloudflare bulk redirect list: source URL, target URL and status code
+func renderCloudflareCSV(mappings []redirectMapping) []byte {
+	out := &bytes.Buffer{}
+	writer := csv.NewWriter(out)
+	for _, m := range mappings {
+		writer.Write([]string{config.Domain + "/" + m.code, m.destination, fmt.Sprint(m.status)})
+	}
+	writer.Flush()
+	return out.Bytes()
+}
+
+// Render mappings as a _redirects file as read by Netlify and Cloudflare Pages
+func renderRedirectsFile(mappings []redirectMapping, generated time.Time) []byte {
+	out := &bytes.Buffer{}
+	fmt.Fprintf(out, "# %d redirects exported from %s at %s\n", len(mappings), config.Domain, generated.Format(time.RFC3339))
+	for _, m := range mappings {
+		fmt.Fprintf(out, "/%s %s %d\n", m.code, m.destination, m.status)
+	}
+	return out.Bytes()
+}
+
+// Admin handler exporting all links as a redirect map for other infrastructure, e.g. a cold standby.
+// ?format= is nginx (a map file), cloudflare (bulk redirect CSV) or netlify (_redirects), ?tag= narrows it down.
+func redirectMapHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "redirectMapHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	format := r.URL.Query().Get("format")
+	filename, ok := redirectMapFiles[format]
+	if !ok {
+		respond(ctx, response{"", "format should be nginx, cloudflare or netlify!"}, http.StatusBadRequest, w)
+		return
+	}
+	mappings, err := redirectMappings(ctx, strings.ToLower(r.URL.Query().Get("tag")))
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+
+	now := clock().UTC()
+	var body []byte
+	contentType := "text/plain; charset=utf-8"
+	switch format {
+	case "nginx":
+		body = renderNginxMap(mappings, now)
+	case "cloudflare":
+		body = renderCloudflareCSV(mappings)
+		contentType = "text/csv; charset=utf-8"
+	case "netlify":
+		body = renderRedirectsFile(mappings, now)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", "attachment; filename=\""+filename+"\"")
+	w.Write(body)
+}
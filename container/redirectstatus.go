@@ -0,0 +1,39 @@
+package main
+
+import (
+	"net/http"
+)
+
+// Statuses links may redirect with: permanent 301 and 308, temporary 302 and 307.
+// 307 and 308 keep the request method.
+var redirectStatuses = map[int]bool{
+	http.StatusMovedPermanently:  true,
+	http.StatusFound:             true,
+	http.StatusTemporaryRedirect: true,
+	http.StatusPermanentRedirect: true,
+}
+
+// Status of redirects of links which don't pick one, REDIRECT_STATUS or 301
+func defaultRedirectStatus() int {
+	status := config.RedirectStatus
+	if !redirectStatuses[status] {
+		return http.StatusMovedPermanently
+	}
+	return status
+}
+
+// Status the link redirects with
+func (l *link) redirectStatus() int {
+	if redirectStatuses[l.RedirectStatus] {
+		return l.RedirectStatus
+	}
+	return defaultRedirectStatus()
+}
+
+// Temporary counterpart of a redirect status, for redirects browsers mustn't remember
+func temporaryStatus(status int) int {
+	if status == http.StatusTemporaryRedirect || status == http.StatusPermanentRedirect {
+		return http.StatusTemporaryRedirect
+	}
+	return http.StatusFound
+}
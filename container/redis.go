@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gomodule/redigo/redis"
+)
+
+// Default prefix of the keys holding links in Redis
+const defaultRedisPrefix = "link:"
+
+// Suffix of the prefix making up the key of the sorted set of all codes.
+// Codes never contain ":", so it can't clash with the key of a link.
+const redisCodesSuffix = ":codes"
+
+// Number of codes fetched from the sorted set at once when listing
+const redisListBatch = 1000
+
+// Write a link's hash if it is still at the expected generation (-1 skips the check), then set its expiry
+// and add the code to the sorted set of codes.
+// KEYS[1] is the link's key and KEYS[2] the sorted set, ARGV the record, the expected generation,
+// the expiry in Unix milliseconds (0 for none) and the code.
+var redisWriteScript = redis.NewScript(2, `
+local current = tonumber(redis.call('HGET', KEYS[1], 'generation') or '0')
+local expected = tonumber(ARGV[2])
+if expected ~= -1 and current ~= expected then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'record', ARGV[1], 'generation', current + 1)
+redis.call('ZADD', KEYS[2], 0, ARGV[4])
+if tonumber(ARGV[3]) > 0 then
+	redis.call('PEXPIREAT', KEYS[1], ARGV[3])
+else
+	redis.call('PERSIST', KEYS[1])
+end
+return 1
+`)
+
+// struct redisLinkStore keeps each link as a hash of its record and a generation counter.
+// Expiring links carry a Redis TTL, so they vanish without a sweep.
+// A sorted set with equal scores holds all codes in lexical order for listing them.
+type redisLinkStore struct {
+	pool   *redis.Pool
+	prefix string
+}
+
+// Connect to REDIS_ADDR, optionally with REDIS_PASSWORD (AUTH) and REDIS_TLS=true (in-transit encryption)
+func newRedisLinkStore() *redisLinkStore {
+	options := []redis.DialOption{redis.DialConnectTimeout(5 * time.Second)}
+	if config.RedisPassword != "" {
+		options = append(options, redis.DialPassword(config.RedisPassword))
+	}
+	if config.RedisTLS {
+		options = append(options, redis.DialUseTLS(true))
+	}
+	prefix := config.RedisPrefix
+	if prefix == "" {
+		prefix = defaultRedisPrefix
+	}
+	pool := &redis.Pool{
+		MaxIdle:     10,
+		IdleTimeout: 4 * time.Minute,
+		Dial: func() (redis.Conn, error) {
+			return redis.Dial("tcp", config.RedisAddr, options...)
+		},
+	}
+	return &redisLinkStore{pool, prefix}
+}
+
+// Time at which the key of a link may vanish, zero if it has to be kept.
+// Expired links are kept as long as the code reuse policy needs them as tombstones.
+func redisExpiry(data []byte) time.Time {
+	l, err := decodeLink(data)
+	if err != nil || l.Expires.IsZero() {
+		return time.Time{}
+	}
+	never, rest := codeReusePolicy()
+	if never {
+		return time.Time{}
+	}
+	return l.Expires.Add(rest)
+}
+
+func (s *redisLinkStore) read(ctx context.Context, code string, limit int64) (*storedLink, error) {
+	ctx, span := tracer.Start(ctx, "redisLinkStore.read")
+	defer span.End()
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	values, err := redis.Values(conn.Do("HMGET", s.prefix+code, "record", "generation"))
+	if err != nil {
+		return nil, err
+	}
+	if values[0] == nil {
+		return nil, storage.ErrObjectNotExist
+	}
+	data, err := redis.Bytes(values[0], nil)
+	if err != nil {
+		return nil, err
+	}
+	generation, err := redis.Int64(values[1], nil)
+	if err != nil {
+		return nil, err
+	}
+	size := int64(len(data))
+	if limit > 0 && size > limit {
+		data = data[:limit]
+	}
+	return &storedLink{data, size, generation}, nil
+}
+
+func (s *redisLinkStore) write(ctx context.Context, code string, data []byte, generation int64) error {
+	ctx, span := tracer.Start(ctx, "redisLinkStore.write")
+	defer span.End()
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	var expireAt int64
+	if expiry := redisExpiry(data); !expiry.IsZero() {
+		expireAt = expiry.UnixNano() / int64(time.Millisecond)
+	}
+	written, err := redis.Int(redisWriteScript.Do(conn, s.prefix+code, s.codesKey(), data, generation, expireAt, code))
+	if err != nil {
+		return err
+	}
+	if written == 0 {
+		return errWriteConflict
+	}
+	return nil
+}
+
+func (s *redisLinkStore) delete(ctx context.Context, code string) error {
+	ctx, span := tracer.Start(ctx, "redisLinkStore.delete")
+	defer span.End()
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.Send("MULTI")
+	conn.Send("DEL", s.prefix+code)
+	conn.Send("ZREM", s.codesKey(), code)
+	replies, err := redis.Ints(conn.Do("EXEC"))
+	if err != nil {
+		return err
+	}
+	if replies[0] == 0 {
+		return storage.ErrObjectNotExist
+	}
+	return nil
+}
+
+// Key of the sorted set of all codes
+func (s *redisLinkStore) codesKey() string {
+	return s.prefix + redisCodesSuffix
+}
+
+// Visit the codes after a code in lexical order, a batch at a time from the sorted set of codes.
+// Codes of links which expired in the meantime are dropped from the set on the way.
+func (s *redisLinkStore) list(ctx context.Context, after string, visit func(code string) error) error {
+	ctx, span := tracer.Start(ctx, "redisLinkStore.list")
+	defer span.End()
+	conn, err := s.pool.GetContext(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	err = s.buildCodes(conn)
+	if err != nil {
+		return err
+	}
+	start := "-"
+	if after != "" {
+		start = "(" + after
+	}
+	for {
+		codes, err := redis.Strings(conn.Do("ZRANGEBYLEX", s.codesKey(), start, "+", "LIMIT", 0, redisListBatch))
+		if err != nil {
+			return err
+		}
+		for _, code := range codes {
+			conn.Send("EXISTS", s.prefix+code)
+		}
+		conn.Flush()
+		live := []string{}
+		for _, code := range codes {
+			exists, err := redis.Bool(conn.Receive())
+			if err != nil {
+				return err
+			}
+			if exists {
+				live = append(live, code)
+			} else {
+				conn.Send("ZREM", s.codesKey(), code)
+			}
+		}
+		_, err = conn.Do("")
+		if err != nil {
+			return err
+		}
+		for _, code := range live {
+			err = visit(code)
+			if err != nil {
+				return err
+			}
+		}
+		if len(codes) < redisListBatch {
+			return nil
+		}
+		start = "(" + codes[len(codes)-1]
+	}
+}
+
+// Fill the sorted set of codes from the keys of the links, once for stores from before it existed
+func (s *redisLinkStore) buildCodes(conn redis.Conn) error {
+	exists, err := redis.Bool(conn.Do("EXISTS", s.codesKey()))
+	if err != nil || exists {
+		return err
+	}
+	cursor := "0"
+	for {
+		values, err := redis.Values(conn.Do("SCAN", cursor, "MATCH", s.prefix+"*", "COUNT", 1000))
+		if err != nil {
+			return err
+		}
+		cursor, _ = redis.String(values[0], nil)
+		keys, _ := redis.Strings(values[1], nil)
+		args := redis.Args{s.codesKey()}
+		for _, key := range keys {
+			if key != s.codesKey() {
+				args = args.Add(0, strings.TrimPrefix(key, s.prefix))
+			}
+		}
+		if len(args) > 1 {
+			_, err = conn.Do("ZADD", args...)
+			if err != nil {
+				return err
+			}
+		}
+		if cursor == "0" {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// GCS object holding the checkpoint of the re-encoding job
+const reencodeCheckpoint = "admin/reencode.json"
+
+// Default number of objects processed between checkpoints
+const defaultReencodeBatch = 100
+
+// struct reencodeProgress is the persisted state of the job rewriting legacy objects.
+type reencodeProgress struct {
+	// Whether the job only counts legacy objects without rewriting them
+	DryRun bool `json:"dry_run"`
+	// Whether a worker is currently processing batches on this instance
+	Running bool `json:"running"`
+	// Whether the whole bucket has been processed
+	Done bool `json:"done"`
+	// Last object processed, the job resumes after it
+	Cursor string `json:"cursor"`
+	// Number of objects visited
+	Scanned int `json:"scanned"`
+	// Number of visited objects still in the legacy format
+	Legacy int `json:"legacy"`
+	// Number of legacy objects rewritten as JSON
+	Rewritten int `json:"rewritten"`
+	// Number of links added to the owner index
+	Indexed int `json:"indexed"`
+	// Number of objects that couldn't be read or written
+	Failed int `json:"failed"`
+	// Last error encountered
+	LastError string `json:"last_error,omitempty"`
+	// Time of the last checkpoint
+	Updated time.Time `json:"updated"`
+}
+
+// State of the re-encoding job on this instance
+var reencode = struct {
+	sync.Mutex
+	running bool
+}{}
+
+// GET returns the job's progress, POST starts or resumes it (dry_run=, batch=, restart=)
+func reencodeHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "reencodeHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+
+	progress, err := loadReencodeProgress(ctx)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	reencode.Lock()
+	progress.Running = reencode.running
+	reencode.Unlock()
+	if r.Method == http.MethodGet {
+		respond(ctx, progress, http.StatusOK, w)
+		return
+	}
+
+	batch, err := strconv.Atoi(r.URL.Query().Get("batch"))
+	if err != nil || batch <= 0 {
+		batch = defaultReencodeBatch
+	}
+	dryRun := r.URL.Query().Get("dry_run") == "true"
+	if r.URL.Query().Get("restart") == "true" || progress.Done || progress.DryRun != dryRun {
+		progress = &reencodeProgress{DryRun: dryRun}
+	}
+
+	reencode.Lock()
+	defer reencode.Unlock()
+	if reencode.running {
+		respond(ctx, response{"", "re-encoding is already running!"}, http.StatusConflict, w)
+		return
+	}
+	reencode.running = true
+	progress.Running = true
+	started := *progress
+	go runReencode(context.Background(), progress, batch)
+	respond(ctx, started, http.StatusAccepted, w)
+}
+
+// Process the bucket in batches, checkpointing after every batch
+func runReencode(ctx context.Context, progress *reencodeProgress, batch int) {
+	ctx, span := tracer.Start(ctx, "runReencode")
+	defer span.End()
+	defer func() {
+		reencode.Lock()
+		reencode.running = false
+		reencode.Unlock()
+	}()
+
+	pending := 0
+	err := linkStorage.list(ctx, "", func(name string) error {
+		if name <= progress.Cursor {
+			return nil
+		}
+		reencodeObject(ctx, name, progress)
+		progress.Cursor = name
+		pending++
+		if pending < batch {
+			return nil
+		}
+		pending = 0
+		return saveReencodeProgress(ctx, progress)
+	})
+	if err != nil {
+		progress.LastError = redactError(err)
+	} else {
+		progress.Done = true
+	}
+	progress.Running = false
+	err = saveReencodeProgress(ctx, progress)
+	if err != nil {
+		slog.Error("unable to save reencode checkpoint", "err", err)
+	}
+}
+
+// Rewrite a single object as JSON if it's still in the legacy format.
+// Links in JSON with an owner or user are added to the owner index, which links created before it lack.
+func reencodeObject(ctx context.Context, name string, progress *reencodeProgress) {
+	progress.Scanned++
+	rec, err := linkStorage.read(ctx, name, 0)
+	if err != nil {
+		progress.Failed++
+		progress.LastError = redactError(err)
+		return
+	}
+	content := string(rec.data)
+	if strings.HasPrefix(strings.TrimSpace(content), "{") {
+		l, err := decodeLink(rec.data)
+		if err != nil || progress.DryRun || l.Owner == "" && l.UID == "" {
+			return
+		}
+		err = indexOwner(ctx, name, l)
+		if err != nil {
+			progress.Failed++
+			progress.LastError = redactError(err)
+			return
+		}
+		progress.Indexed++
+		return
+	}
+	progress.Legacy++
+	if progress.DryRun {
+		return
+	}
+	l, _ := decodeLink(rec.data)
+	marshalled, err := json.Marshal(l)
+	if err != nil {
+		progress.Failed++
+		progress.LastError = redactError(err)
+		return
+	}
+	// The generation precondition keeps concurrent updates from being overwritten
+	err = linkStorage.write(ctx, name, marshalled, rec.generation)
+	if err != nil {
+		progress.Failed++
+		progress.LastError = redactError(err)
+		return
+	}
+	progress.Rewritten++
+}
+
+// Read the job's checkpoint, starting fresh if there is none
+func loadReencodeProgress(ctx context.Context) (*reencodeProgress, error) {
+	progress := &reencodeProgress{}
+	data, _, err := gcsReadBlob(ctx, reencodeCheckpoint)
+	if err == storage.ErrObjectNotExist {
+		return progress, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, progress)
+	if err != nil {
+		return nil, err
+	}
+	return progress, nil
+}
+
+// Persist the job's checkpoint
+func saveReencodeProgress(ctx context.Context, progress *reencodeProgress) error {
+	progress.Updated = clock().UTC()
+	marshalled, err := json.Marshal(progress)
+	if err != nil {
+		return err
+	}
+	return gcsWriteBlob(ctx, reencodeCheckpoint, "application/json", marshalled)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How often instances check the policy source for changes by default
+const defaultPolicyReload = time.Minute
+
+// Settings which the policy source can override without a restart
+var reloadableSettings = map[string]bool{
+	"DOMAIN_BLOCKLIST":    true,
+	"DOMAIN_ALLOWLIST":    true,
+	"ALLOWED_SCHEMES":     true,
+	"CONTACT_LINK_OWNERS": true,
+	"REDACT_PARAMS":       true,
+	"REDACT_PATTERNS":     true,
+	"LABEL_LOGO":          true,
+}
+
+// struct reloadStatus tells how loading a source of configuration went last time.
+type reloadStatus struct {
+	Source string `json:"source"`
+	// Where the source is read from
+	Location string `json:"location"`
+	// Last successful load, its content stays in effect while later ones fail
+	Loaded *time.Time `json:"loaded,omitempty"`
+	// Version of the content loaded, e.g. the modification time of a file or the generation of an object
+	Version   string    `json:"version,omitempty"`
+	Attempted time.Time `json:"attempted"`
+	// Why the last attempt failed
+	Error string `json:"error,omitempty"`
+}
+
+// struct reloader loads a source of configuration now and then.
+type reloader struct {
+	// Load the source unless its version is the one given, returning the version in effect
+	load   func(ctx context.Context, version string) (string, error)
+	status reloadStatus
+}
+
+// struct reloadResponse reports the sources of configuration of the instance answering.
+type reloadResponse struct {
+	response
+	Instance string         `json:"instance"`
+	Sources  []reloadStatus `json:"sources"`
+}
+
+// Sources of configuration registered by startReloading, in registration order
+var reloaders = struct {
+	sync.Mutex
+	list []*reloader
+}{}
+
+// Settings loaded from the policy source
+var policy = struct {
+	sync.RWMutex
+	settings map[string]string
+}{}
+
+// Value of a setting which can be reloaded: taken from the policy source, or the configuration if it doesn't set it
+func policySetting(name string) string {
+	policy.RLock()
+	value, ok := policy.settings[name]
+	policy.RUnlock()
+	if ok {
+		return value
+	}
+	return settingValues[name]
+}
+
+// Load a source of configuration now and every interval, keeping the previous content if loading fails
+func startReloading(source string, location string, interval time.Duration, load func(ctx context.Context, version string) (string, error)) {
+	rl := &reloader{load: load, status: reloadStatus{Source: source, Location: location}}
+	reloaders.Lock()
+	reloaders.list = append(reloaders.list, rl)
+	reloaders.Unlock()
+	reload(context.Background(), rl, false)
+	go func() {
+		for range time.Tick(interval) {
+			reload(context.Background(), rl, false)
+		}
+	}()
+}
+
+// Load a source of configuration, even if it didn't change if forced, and record how it went
+func reload(ctx context.Context, rl *reloader, force bool) reloadStatus {
+	ctx, span := tracer.Start(ctx, "reload")
+	defer span.End()
+	reloaders.Lock()
+	current := rl.status.Version
+	reloaders.Unlock()
+	if force {
+		current = ""
+	}
+	version, err := rl.load(ctx, current)
+	now := clock().UTC()
+	reloaders.Lock()
+	defer reloaders.Unlock()
+	rl.status.Attempted, rl.status.Error = now, ""
+	if err != nil {
+		slog.Error("unable to load policy", "source", rl.status.Source, "err", err)
+		rl.status.Error = redactError(err)
+		return rl.status
+	}
+	if version != rl.status.Version || rl.status.Loaded == nil || force {
+		rl.status.Loaded = &now
+	}
+	rl.status.Version = version
+	return rl.status
+}
+
+// Where the policy is read from: POLICY_SOURCE, a file (e.g. a mounted Secret Manager secret) or gs://<bucket>/<object>
+func policySource() string {
+	return config.PolicySource
+}
+
+// Read the policy source unless its version is the given one, returning its content (nil if unchanged) and version
+func readPolicySource(ctx context.Context, source string, version string) ([]byte, string, error) {
+	if !strings.HasPrefix(source, "gs://") {
+		info, err := os.Stat(source)
+		if err != nil {
+			return nil, "", err
+		}
+		current := info.ModTime().UTC().Format(time.RFC3339Nano) + "/" + strconv.FormatInt(info.Size(), 10)
+		if current == version {
+			return nil, current, nil
+		}
+		data, err := ioutil.ReadFile(source)
+		return data, current, err
+	}
+	bucket, object := "", ""
+	if parts := strings.SplitN(strings.TrimPrefix(source, "gs://"), "/", 2); len(parts) == 2 {
+		bucket, object = parts[0], parts[1]
+	}
+	if bucket == "" || object == "" {
+		return nil, "", errors.New("POLICY_SOURCE should be a file or gs://<bucket>/<object>")
+	}
+	countOperation(opRead, 1)
+	if localBucket != nil {
+		data, _, generation, err := localBucket.read(object)
+		return data, strconv.FormatInt(generation, 10), err
+	}
+
+	client, err := gcsClient()
+	if err != nil {
+		return nil, "", err
+	}
+	handle := client.Bucket(bucket).Object(object)
+	attrs, err := handle.Attrs(ctx)
+	if err != nil {
+		return nil, "", gcsCheck(client, err)
+	}
+	current := strconv.FormatInt(attrs.Generation, 10)
+	if current == version {
+		return nil, current, nil
+	}
+	reader, err := handle.Generation(attrs.Generation).NewReader(ctx)
+	if err != nil {
+		return nil, "", gcsCheck(client, err)
+	}
+	defer reader.Close()
+	buffer := new(bytes.Buffer)
+	_, err = buffer.ReadFrom(reader)
+	if err != nil {
+		return nil, "", gcsCheck(client, err)
+	}
+	return buffer.Bytes(), current, nil
+}
+
+// Load the policy, a JSON object of reloadable settings and their values, unless it's still at the given version.
+// A policy with unknown or invalid settings is rejected as a whole.
+func loadPolicy(ctx context.Context, version string) (string, error) {
+	ctx, span := tracer.Start(ctx, "loadPolicy")
+	defer span.End()
+	data, current, err := readPolicySource(ctx, policySource(), version)
+	if err != nil || data == nil {
+		return current, err
+	}
+	settings := map[string]string{}
+	err = json.Unmarshal(data, &settings)
+	if err != nil {
+		return "", fmt.Errorf("policy isn't a JSON object of settings: %v", err)
+	}
+	for name := range settings {
+		if !reloadableSettings[name] {
+			return "", fmt.Errorf("policy sets %s, which can't be reloaded", name)
+		}
+	}
+	redactParams, ok := settings["REDACT_PARAMS"]
+	if !ok {
+		redactParams = config.RedactParams
+	}
+	redactPatterns, ok := settings["REDACT_PATTERNS"]
+	if !ok {
+		redactPatterns = config.RedactPatterns
+	}
+	err = applyRedaction(redactParams, redactPatterns)
+	if err != nil {
+		return "", fmt.Errorf("invalid REDACT_PATTERNS: %v", err)
+	}
+	policy.Lock()
+	policy.settings = settings
+	policy.Unlock()
+	slog.Info("loaded policy", "version", current, "source", policySource())
+	return current, nil
+}
+
+// Load the policy now and every POLICY_RELOAD if there is a POLICY_SOURCE
+func startPolicyReloader() {
+	if policySource() == "" {
+		return
+	}
+	interval := config.PolicyReload
+	if interval <= 0 {
+		interval = defaultPolicyReload
+	}
+	startReloading("policy", policySource(), interval, loadPolicy)
+}
+
+// Admin handler for the sources of configuration of the instance answering:
+// GET reports how loading them went last time, POST reloads them right away.
+// Other instances pick up changes on their own schedule.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "reloadHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	reloaders.Lock()
+	list := append([]*reloader{}, reloaders.list...)
+	reloaders.Unlock()
+	resp := reloadResponse{response: response{"", "configuration sources listed!"}, Instance: instanceID, Sources: []reloadStatus{}}
+	failed := 0
+	for _, rl := range list {
+		var status reloadStatus
+		if r.Method == http.MethodPost {
+			status = reload(ctx, rl, true)
+		} else {
+			reloaders.Lock()
+			status = rl.status
+			reloaders.Unlock()
+		}
+		if status.Error != "" {
+			failed++
+		}
+		resp.Sources = append(resp.Sources, status)
+	}
+	code := http.StatusOK
+	if r.Method == http.MethodPost {
+		resp.Message = "configuration reloaded!"
+		if failed > 0 {
+			resp.Message = fmt.Sprintf("%d configuration sources failed to load!", failed)
+			code = http.StatusBadGateway
+		}
+	}
+	respond(ctx, resp, code, w)
+}
@@ -0,0 +1,287 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Redirect cache of redirect-only instances, unless REDIRECT_CACHE_SIZE and REDIRECT_CACHE_TTL say otherwise
+const (
+	replicaCacheSize = 100000
+	replicaCacheTTL  = 5 * time.Minute
+)
+
+// Report whether this instance only serves redirects (REDIRECT_ONLY=true).
+// Such instances don't register endpoints creating, changing or managing links and skip the singleton jobs.
+func redirectOnly() bool {
+	return config.RedirectOnly
+}
+
+// interface linkSnapshot is a read-only copy of all links.
+type linkSnapshot interface {
+	// Record of a code, false if it isn't part of the snapshot
+	lookup(code string) (*storedLink, bool)
+	// Release the snapshot once it has been replaced
+	close() error
+}
+
+// mapSnapshot is a snapshot read from the link store by the instance itself.
+type mapSnapshot map[string]*storedLink
+
+func (s mapSnapshot) lookup(code string) (*storedLink, bool) {
+	rec, ok := s[code]
+	return rec, ok
+}
+
+func (s mapSnapshot) close() error {
+	return nil
+}
+
+// struct snapshotLinkStore serves reads from a periodically synced copy of all links.
+// Codes missing from the snapshot, e.g. created since it was taken, are read from the wrapped store.
+type snapshotLinkStore struct {
+	linkStore
+	sync.RWMutex
+	snapshot linkSnapshot
+	// Codes written through this instance since the snapshot was taken
+	changed map[string]bool
+	// Published snapshot in use, if it was downloaded
+	object string
+	// Changes from the change feed since the snapshot was taken, nil records for removed links
+	fed map[string]fedChange
+	// Sequence number of the latest feed entry applied or covered by the snapshot
+	position int64
+}
+
+// struct fedChange is the state of a link according to the change feed.
+type fedChange struct {
+	rec *storedLink
+	seq int64
+}
+
+// Keep a local snapshot of all links on redirect-only instances if REPLICA_SNAPSHOT_INTERVAL is set (e.g. 10m).
+// With REPLICA_SNAPSHOT_SOURCE=published it's downloaded from the main deployment instead of read link by link.
+func setupReplicaSnapshot() {
+	if !redirectOnly() {
+		return
+	}
+	interval := config.ReplicaSnapshotInterval
+	if interval <= 0 {
+		return
+	}
+	snapshot := &snapshotLinkStore{linkStore: linkStorage, snapshot: mapSnapshot{}, changed: map[string]bool{}, fed: map[string]fedChange{}}
+	linkStorage = snapshot
+	refresh := snapshot.syncStore
+	if config.ReplicaSnapshotSource == "published" {
+		refresh = snapshot.syncPublished
+	}
+	poll := config.FeedPollInterval
+	if poll <= 0 {
+		poll = defaultFeedPollInterval
+	}
+	go func() {
+		ctx := context.Background()
+		refresh(ctx)
+		// The first snapshot tells where to start reading the feed
+		if feedEnabled() {
+			go snapshot.tailFeed(poll)
+		}
+		for range time.Tick(interval) {
+			refresh(ctx)
+		}
+	}()
+}
+
+// Read all links from the wrapped store and replace the snapshot with them
+func (s *snapshotLinkStore) syncStore(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "syncSnapshot")
+	defer span.End()
+	// Changes after this entry may be missing from the snapshot
+	seq, err := readFeedHead(ctx)
+	if err != nil {
+		slog.Error("unable to read change feed", "err", err)
+		return
+	}
+	links := mapSnapshot{}
+	err = s.linkStore.list(ctx, "", func(code string) error {
+		rec, err := s.linkStore.read(ctx, code, maxLinkObjectSize+1)
+		if err != nil {
+			// Removed while listing
+			return nil
+		}
+		links[code] = rec
+		return nil
+	})
+	if err != nil {
+		slog.Error("unable to sync link snapshot", "err", err)
+		return
+	}
+	s.replace(links, "", seq)
+	span.SetAttributes(attribute.Int64("links", int64(len(links))))
+}
+
+// Download the latest published snapshot if it's newer than the one in use
+func (s *snapshotLinkStore) syncPublished(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "syncPublishedSnapshot")
+	defer span.End()
+	data, _, err := gcsReadBlob(ctx, snapshotManifest)
+	info := snapshotInfo{}
+	if err == nil {
+		err = json.Unmarshal(data, &info)
+	}
+	if err != nil {
+		slog.Error("unable to read snapshot manifest", "err", err)
+		return
+	}
+	s.RLock()
+	current := s.object
+	s.RUnlock()
+	if info.Object == current {
+		return
+	}
+	mapped, err := downloadSnapshot(ctx, info.Object)
+	if err != nil {
+		slog.Error("unable to download snapshot", "object", info.Object, "err", err)
+		return
+	}
+	s.replace(mapped, info.Object, info.Sequence)
+	span.SetAttributes(attribute.Int64("links", int64(info.Links)))
+}
+
+// Switch to a new snapshot taken at a feed position and release the previous one.
+// Changes from the feed which the snapshot covers are dropped.
+func (s *snapshotLinkStore) replace(snapshot linkSnapshot, object string, seq int64) {
+	s.Lock()
+	previous := s.snapshot
+	s.snapshot = snapshot
+	s.object = object
+	s.changed = map[string]bool{}
+	for code, change := range s.fed {
+		if change.seq <= seq {
+			delete(s.fed, code)
+		}
+	}
+	if seq > s.position {
+		s.position = seq
+	}
+	s.Unlock()
+	err := previous.close()
+	if err != nil {
+		slog.Error("unable to release link snapshot", "err", err)
+	}
+}
+
+// Serve reads for redirects (with a limit) from the feed and the snapshot.
+// Full reads precede conditional updates, so they always go to the wrapped store for the current generation.
+func (s *snapshotLinkStore) read(ctx context.Context, code string, limit int64) (*storedLink, error) {
+	if limit <= 0 {
+		return s.linkStore.read(ctx, code, limit)
+	}
+	s.RLock()
+	change, ok := s.fed[code]
+	rec := change.rec
+	if !ok {
+		rec, ok = s.snapshot.lookup(code)
+	}
+	ok = ok && !s.changed[code]
+	s.RUnlock()
+	if ok && rec == nil {
+		return nil, storage.ErrObjectNotExist
+	}
+	if ok && (int64(len(rec.data)) == rec.size || limit <= int64(len(rec.data))) {
+		if int64(len(rec.data)) > limit {
+			return &storedLink{rec.data[:limit], rec.size, rec.generation}, nil
+		}
+		return rec, nil
+	}
+	return s.linkStore.read(ctx, code, limit)
+}
+
+func (s *snapshotLinkStore) write(ctx context.Context, code string, data []byte, generation int64) error {
+	err := s.linkStore.write(ctx, code, data, generation)
+	s.forget(code)
+	return err
+}
+
+func (s *snapshotLinkStore) delete(ctx context.Context, code string) error {
+	err := s.linkStore.delete(ctx, code)
+	s.forget(code)
+	return err
+}
+
+// Stop serving a code from the snapshot, so it is read from the wrapped store until the next sync
+func (s *snapshotLinkStore) forget(code string) {
+	s.Lock()
+	s.changed[code] = true
+	s.Unlock()
+}
+
+// Apply new entries of the change feed every poll interval.
+// Entries whose sequence number was taken but which don't show up are skipped after a while.
+func (s *snapshotLinkStore) tailFeed(poll time.Duration) {
+	missing := map[int64]time.Time{}
+	s.Lock()
+	if s.position == 0 {
+		// Without a snapshot, links not in the feed are read from the store anyway
+		s.position, _ = readFeedHead(context.Background())
+	}
+	s.Unlock()
+	for range time.Tick(poll) {
+		ctx := context.Background()
+		head, err := readFeedHead(ctx)
+		if err != nil {
+			slog.Error("unable to read change feed", "err", err)
+			continue
+		}
+		s.RLock()
+		next := s.position + 1
+		s.RUnlock()
+		for ; next <= head; next++ {
+			entry, err := readFeedEntry(ctx, next)
+			if err == storage.ErrObjectNotExist {
+				if _, ok := missing[next]; !ok {
+					missing[next] = time.Now()
+				}
+				if time.Since(missing[next]) < feedGapTimeout {
+					break
+				}
+				slog.Warn("skipping missing change feed entry", "seq", next)
+				entry = &feedEntry{Seq: next}
+			} else if err != nil {
+				slog.Error("unable to read change feed entry", "seq", next, "err", err)
+				break
+			}
+			delete(missing, next)
+			s.apply(entry)
+		}
+	}
+}
+
+// Take over the changes of a feed entry, unless a newer generation of a link is known
+func (s *snapshotLinkStore) apply(entry *feedEntry) {
+	s.Lock()
+	defer s.Unlock()
+	if entry.Seq <= s.position {
+		// Covered by a snapshot in the meantime
+		return
+	}
+	s.position = entry.Seq
+	for _, change := range entry.Changes {
+		if change.Deleted {
+			s.fed[change.Code] = fedChange{nil, entry.Seq}
+			continue
+		}
+		if known, ok := s.fed[change.Code]; ok && known.rec != nil && known.rec.generation > change.Generation {
+			// Entries of different instances may arrive out of order
+			continue
+		}
+		s.fed[change.Code] = fedChange{&storedLink{change.Data, change.Size, change.Generation}, entry.Seq}
+		delete(s.changed, change.Code)
+	}
+}
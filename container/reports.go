@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Default number of distinct reporters after which a link is quarantined
+const defaultQuarantineReports = 3
+
+// struct abuseReport is a visitor's complaint about a short link.
+type abuseReport struct {
+	// Short code or full short link being reported
+	Link string `json:"link"`
+	// What is wrong with the link
+	Reason string `json:"reason"`
+	// Optional way to reach the reporter
+	Contact string `json:"contact,omitempty"`
+	// Time the report was received
+	Received time.Time `json:"received"`
+}
+
+// Short code of a reported link, accepting bare codes and full short links
+func reportedCode(reported string) string {
+	reported = strings.TrimSpace(reported)
+	if uri, err := url.Parse(reported); err == nil && uri.Host != "" {
+		reported = uri.Path
+	}
+	return strings.Trim(reported, "/")
+}
+
+// Name of the GCS object holding a report, one per reporter and link
+func reportObject(code string, r *http.Request) string {
+	hash := sha256.Sum256([]byte(config.SigningSecret + "|" + clientIP(r)))
+	return "reports/" + code + "/" + hex.EncodeToString(hash[:8]) + ".json"
+}
+
+// POST handler accepting abuse reports as JSON ({"link", "reason", "contact"}).
+// Links reported by ABUSE_QUARANTINE_REPORTS distinct clients are quarantined.
+func abuseReportHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "abuseReportHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	report := abuseReport{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<16)).Decode(&report)
+	if err != nil {
+		respond(ctx, response{"", "unable to decode request body!"}, http.StatusBadRequest, w)
+		return
+	}
+	code := reportedCode(report.Link)
+	if code == "" || strings.TrimSpace(report.Reason) == "" {
+		respond(ctx, response{"", "link and reason are required!"}, http.StatusBadRequest, w)
+		return
+	}
+	l, err := readLink(ctx, code)
+	if err != nil {
+		respond(ctx, response{"", "unable to find URL!"}, http.StatusNotFound, w)
+		return
+	}
+	report.Link = code
+	report.Received = clock().UTC()
+	marshalled, err := json.Marshal(report)
+	if err != nil {
+		respond(ctx, response{"", "unable to encode report!"}, http.StatusInternalServerError, w)
+		return
+	}
+	err = gcsWriteIfGeneration(ctx, reportObject(code, r), "application/json", marshalled, 0)
+	if isPreconditionFailed(err) {
+		respond(ctx, response{shortLink(code), "you already reported this link, thank you!"}, http.StatusOK, w)
+		return
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+
+	threshold := config.AbuseQuarantineReports
+	if threshold > 0 && l.Quarantine == nil {
+		reports := 0
+		err = gcsListPrefix(ctx, "reports/"+code+"/", func(name string) error {
+			reports++
+			return nil
+		})
+		if err == nil && reports >= threshold {
+			_, err = quarantineLink(ctx, code, quarantineAbuseReports, "This link has been reported as abusive and is under review.")
+			if err == nil {
+				reportAbusiveDomain(ctx, destinationDomain(l.URL), code)
+			}
+		}
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+	}
+	respond(ctx, response{shortLink(code), "report received, thank you!"}, http.StatusOK, w)
+}
@@ -0,0 +1,297 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Signals contributing to the reputation of a destination domain
+const (
+	signalSafeBrowsing = "safe_browsing"
+	signalAbuseReports = "abuse_reports"
+	signalDeadLinks    = "dead_links"
+)
+
+// Defaults of the reputation subsystem
+const (
+	// How long a domain's reputation is kept in memory before reading it again
+	defaultReputationCacheTTL = 10 * time.Minute
+	// Lifetime of verdicts derived from abuse reports and fetch outcomes
+	abuseVerdictTTL    = 7 * 24 * time.Hour
+	deadLinkVerdictTTL = 7 * 24 * time.Hour
+	// Fetches needed before a dead link rate counts
+	deadLinkSamples = 5
+)
+
+// struct verdict is the outcome of one kind of check on a domain.
+type verdict struct {
+	// Whether the domain is considered harmful by this check
+	Bad bool `json:"bad"`
+	// Degree of badness between 0 and 1
+	Score float64 `json:"score"`
+	// Explanation, e.g. threat type or failure count
+	Detail string `json:"detail,omitempty"`
+	// Number of observations the verdict is based on
+	Samples int `json:"samples,omitempty"`
+	// Failed observations, for rate based signals
+	Failures int `json:"failures,omitempty"`
+	// Time of the check
+	Checked time.Time `json:"checked"`
+	// Time after which the check has to be repeated
+	Expires time.Time `json:"expires"`
+}
+
+// Report whether a verdict can still be relied on
+func (v *verdict) fresh(now time.Time) bool {
+	return v != nil && now.Before(v.Expires)
+}
+
+// struct reputation collects the verdicts on a destination domain.
+type reputation struct {
+	Domain   string              `json:"domain"`
+	Verdicts map[string]*verdict `json:"verdicts"`
+}
+
+// Return the first fresh verdict marking the domain harmful for visitors, if any
+func (r *reputation) harmful(now time.Time) (string, *verdict) {
+	for _, signal := range []string{signalSafeBrowsing, signalAbuseReports} {
+		if v := r.Verdicts[signal]; v.fresh(now) && v.Bad {
+			return signal, v
+		}
+	}
+	return "", nil
+}
+
+// In-memory copy of domain reputations, including domains without any verdicts
+var reputations = struct {
+	sync.Mutex
+	entries map[string]*reputation
+	fetched map[string]time.Time
+}{entries: map[string]*reputation{}, fetched: map[string]time.Time{}}
+
+// Name of the GCS object holding the reputation of a domain
+func reputationObject(domain string) string {
+	return "reputation/" + domain + ".json"
+}
+
+// REPUTATION_CACHE_TTL, parsed once as every redirect checks it
+var reputationTTL struct {
+	sync.Once
+	ttl time.Duration
+}
+
+// How long reputations are cached in memory, REPUTATION_CACHE_TTL
+func reputationCacheTTL() time.Duration {
+	reputationTTL.Do(func() {
+		ttl := config.ReputationCacheTTL
+		if ttl <= 0 {
+			ttl = defaultReputationCacheTTL
+		}
+		reputationTTL.ttl = ttl
+	})
+	return reputationTTL.ttl
+}
+
+// Reputation of a domain, from memory if fresh enough and from GCS otherwise
+func domainReputation(ctx context.Context, domain string) (*reputation, error) {
+	reputations.Lock()
+	cached, ok := reputations.entries[domain]
+	fresh := ok && time.Since(reputations.fetched[domain]) < reputationCacheTTL()
+	reputations.Unlock()
+	if fresh {
+		return cached, nil
+	}
+	ctx, span := tracer.Start(ctx, "domainReputation")
+	defer span.End()
+	stored := &reputation{Domain: domain, Verdicts: map[string]*verdict{}}
+	data, _, err := gcsReadBlob(ctx, reputationObject(domain))
+	if err != nil && err != storage.ErrObjectNotExist {
+		return nil, err
+	}
+	if err == nil {
+		err = json.Unmarshal(data, stored)
+		if err != nil {
+			return nil, err
+		}
+	}
+	rememberReputation(stored)
+	return stored, nil
+}
+
+// Put a reputation into the in-memory cache
+func rememberReputation(r *reputation) {
+	reputations.Lock()
+	defer reputations.Unlock()
+	reputations.entries[r.Domain] = r
+	reputations.fetched[r.Domain] = time.Now()
+}
+
+// Change the verdict of one signal on a domain, retrying when another instance wrote concurrently
+func updateVerdict(ctx context.Context, domain string, signal string, change func(v *verdict, now time.Time) *verdict) error {
+	ctx, span := tracer.Start(ctx, "updateVerdict")
+	defer span.End()
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		stored := &reputation{Domain: domain, Verdicts: map[string]*verdict{}}
+		content, generation, err := gcsReadGeneration(ctx, reputationObject(domain))
+		if err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(content), stored)
+			if err != nil {
+				return err
+			}
+			if stored.Verdicts == nil {
+				stored.Verdicts = map[string]*verdict{}
+			}
+		}
+		now := clock().UTC()
+		current := stored.Verdicts[signal]
+		if !current.fresh(now) {
+			current = nil
+		}
+		stored.Verdicts[signal] = change(current, now)
+		marshalled, err := json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		err = gcsWriteIfGeneration(ctx, reputationObject(domain), "application/json", marshalled, generation)
+		if err == nil {
+			rememberReputation(stored)
+			return nil
+		}
+		if !isPreconditionFailed(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("reputation of %s kept changing, giving up", domain)
+}
+
+// Return the fresh verdict of a signal on a domain, or run the check and remember its outcome for ttl
+func checkVerdict(ctx context.Context, domain string, signal string, ttl time.Duration, check func(ctx context.Context) (*verdict, error)) (*verdict, error) {
+	ctx, span := tracer.Start(ctx, "checkVerdict")
+	defer span.End()
+	r, err := domainReputation(ctx, domain)
+	if err == nil {
+		if v := r.Verdicts[signal]; v.fresh(clock()) {
+			return v, nil
+		}
+	}
+	v, err := check(ctx)
+	if err != nil {
+		return nil, err
+	}
+	err = updateVerdict(ctx, domain, signal, func(_ *verdict, now time.Time) *verdict {
+		v.Checked = now
+		v.Expires = now.Add(ttl)
+		return v
+	})
+	if err != nil {
+		slog.Error("unable to store verdict", "signal", signal, "domain", domain, "err", err)
+	}
+	return v, nil
+}
+
+// Mark a domain as harmful because one of its links was quarantined after abuse reports
+func reportAbusiveDomain(ctx context.Context, domain string, code string) {
+	err := updateVerdict(ctx, domain, signalAbuseReports, func(v *verdict, now time.Time) *verdict {
+		if v == nil {
+			v = &verdict{}
+		}
+		v.Samples++
+		v.Bad = true
+		v.Score = 1
+		v.Detail = fmt.Sprintf("%d link(s) quarantined after abuse reports, last %s", v.Samples, code)
+		v.Checked = now
+		v.Expires = now.Add(abuseVerdictTTL)
+		return v
+	})
+	if err != nil {
+		slog.Error("unable to record abuse reports", "domain", domain, "err", err)
+	}
+}
+
+// Count the outcome of fetching a destination towards its domain's dead link rate
+func recordFetchOutcome(ctx context.Context, domain string, ok bool) {
+	err := updateVerdict(ctx, domain, signalDeadLinks, func(v *verdict, now time.Time) *verdict {
+		if v == nil {
+			v = &verdict{Expires: now.Add(deadLinkVerdictTTL)}
+		}
+		v.Samples++
+		if !ok {
+			v.Failures++
+		}
+		v.Score = float64(v.Failures) / float64(v.Samples)
+		v.Bad = v.Samples >= deadLinkSamples && v.Score >= 0.5
+		v.Detail = fmt.Sprintf("%d of %d fetches failed", v.Failures, v.Samples)
+		v.Checked = now
+		return v
+	})
+	if err != nil {
+		slog.Error("unable to record fetch outcome", "domain", domain, "err", err)
+	}
+}
+
+// Admin handler showing (GET) or forgetting (DELETE) the reputation of ?domain=
+func reputationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "reputationHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	domain := strings.TrimPrefix(strings.ToLower(r.URL.Query().Get("domain")), "www.")
+	if domain == "" {
+		respond(ctx, response{"", "domain is required!"}, http.StatusBadRequest, w)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		err := gcsDelete(ctx, reputationObject(domain))
+		if err != nil && err != storage.ErrObjectNotExist {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		rememberReputation(&reputation{Domain: domain, Verdicts: map[string]*verdict{}})
+		respond(ctx, response{"", "reputation reset!"}, http.StatusOK, w)
+		return
+	}
+	rep, err := domainReputation(ctx, domain)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	respond(ctx, rep, http.StatusOK, w)
+}
+
+// Warning to show before redirecting to a destination whose domain is considered harmful, nil if there is none
+func reputationWarning(ctx context.Context, destination string) *quarantine {
+	rep, err := domainReputation(ctx, destinationDomain(destination))
+	if err != nil {
+		slog.Error("unable to read reputation", "destination", destination, "err", err)
+		return nil
+	}
+	signal, v := rep.harmful(clock())
+	if signal == "" {
+		return nil
+	}
+	return &quarantine{signal, "The destination of this link has been flagged as harmful: " + v.Detail, v.Checked}
+}
+
+// Report whether any destination has a domain considered harmful
+func harmfulDestination(ctx context.Context, destinations ...string) bool {
+	for _, destination := range destinations {
+		if reputationWarning(ctx, destination) != nil {
+			return true
+		}
+	}
+	return false
+}
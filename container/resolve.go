@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// States of a code at a point in time
+const (
+	resolvedActive      = "active"
+	resolvedExpired     = "expired"
+	resolvedConsumed    = "consumed"
+	resolvedQuarantined = "quarantined"
+	resolvedDeleted     = "deleted"
+	resolvedUnused      = "unused"
+	// A link existed, but where it pointed isn't known anymore
+	resolvedUnknown = "unknown"
+)
+
+// struct resolution is where a code pointed at a point in time.
+type resolution struct {
+	response
+	Code  string    `json:"code"`
+	At    time.Time `json:"at"`
+	State string    `json:"state"`
+	URL   string    `json:"url,omitempty"`
+	// Time span the code pointed to URL, no end while it still does
+	From  *time.Time `json:"from,omitempty"`
+	Until *time.Time `json:"until,omitempty"`
+	// Whoever repointed it away from URL
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// Read the tombstone of a code, nil if it has none
+func readTombstone(ctx context.Context, code string) (*tombstone, error) {
+	data, _, err := gcsReadBlob(ctx, tombstoneObject(code))
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	t := &tombstone{}
+	return t, json.Unmarshal(data, t)
+}
+
+// Work out where a link pointed at a point in time from its history.
+// History beyond maxHistory revisions is dropped, times before the oldest one kept are unknown.
+func resolveAt(l *link, at time.Time) resolution {
+	res := resolution{At: at, State: resolvedActive, URL: l.URL}
+	if !l.Created.IsZero() {
+		created := l.Created
+		res.From = &created
+	}
+	for i, rev := range l.History {
+		if at.Before(rev.Replaced) {
+			if i == 0 && len(l.History) >= maxHistory {
+				return resolution{At: at, State: resolvedUnknown}
+			}
+			replaced := rev.Replaced
+			res.URL, res.Until, res.ReplacedBy = rev.URL, &replaced, rev.By
+			break
+		}
+		replaced := rev.Replaced
+		res.From = &replaced
+	}
+	switch {
+	case !l.Consumed.IsZero() && !at.Before(l.Consumed):
+		res.State, res.URL = resolvedConsumed, ""
+	case !l.Expires.IsZero() && !at.Before(l.Expires):
+		res.State = resolvedExpired
+	case l.Quarantine != nil && !at.Before(l.Quarantine.Since):
+		res.State = resolvedQuarantined
+	}
+	return res
+}
+
+// GET handler telling where a code pointed at ?at= (RFC 3339, now by default), e.g. to look into complaints.
+// Uses the repointing history of the link, and its tombstone before it was created or after it was deleted.
+// For the link's managers, and for admins once there is no link anymore.
+func resolveHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "resolveHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		return
+	}
+	code := mux.Vars(r)["id"]
+	now := clock().UTC()
+	at := now
+	if raw := r.URL.Query().Get("at"); raw != "" {
+		parsed, err := time.Parse(time.RFC3339, raw)
+		if err != nil || parsed.After(now) {
+			respond(ctx, response{"", "at should be a past RFC 3339 timestamp!"}, http.StatusBadRequest, w)
+			return
+		}
+		at = parsed.UTC()
+	}
+	l, err := readLink(ctx, code)
+	if err != nil && err != storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if l != nil && !requireManager(ctx, w, r, code, l) || l == nil && !requireAdmin(ctx, w, r) {
+		return
+	}
+	t, err := readTombstone(ctx, code)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+
+	res := resolution{At: at, State: resolvedUnused}
+	switch {
+	case l != nil && (l.Created.IsZero() || !at.Before(l.Created)):
+		res = resolveAt(l, at)
+	case t != nil && !at.Before(t.Deleted):
+		// Deleted and not reissued by then
+		deleted := t.Deleted
+		res.State, res.From = resolvedDeleted, &deleted
+	case t != nil:
+		// Tombstones only keep a hash of the destination
+		res.State = resolvedUnknown
+	}
+	res.Code = code
+	res.Message = "code resolved!"
+	respond(ctx, res, http.StatusOK, w)
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Lookup endpoint of the Safe Browsing API v4
+const safeBrowsingURL = "https://safebrowsing.googleapis.com/v4/threatMatches:find"
+
+// Caching of Safe Browsing lookups
+const (
+	// How long a URL without matches is trusted, matches are cached as long as the API says
+	safeBrowsingCleanTTL = 30 * time.Minute
+	// URLs remembered, the cache starts over beyond that
+	maxSafeBrowsingEntries = 10000
+	// How long a redirect waits for a lookup before redirecting unchecked
+	defaultSafeBrowsingRedirectTimeout = time.Second
+)
+
+// Machine readable reason of destinations rejected as unsafe
+const errUnsafeDestination = "unsafe_destination"
+
+// Threats looked up, as documented for the Lookup API
+var safeBrowsingThreatTypes = []string{"MALWARE", "SOCIAL_ENGINEERING", "UNWANTED_SOFTWARE", "POTENTIALLY_HARMFUL_APPLICATION"}
+
+// Client querying Safe Browsing
+var safeBrowsingClient = &http.Client{Timeout: 5 * time.Second}
+
+// struct safeBrowsingEntry is the cached outcome of looking up a URL.
+type safeBrowsingEntry struct {
+	// Threat type of a match, empty for clean URLs
+	threat  string
+	checked time.Time
+	expires time.Time
+}
+
+// URLs looked up recently
+var safeBrowsingCache = struct {
+	sync.Mutex
+	entries map[string]safeBrowsingEntry
+}{entries: map[string]safeBrowsingEntry{}}
+
+// struct threatEntry is a URL in requests and matches of the Lookup API.
+type threatEntry struct {
+	URL string `json:"url"`
+}
+
+// struct threatMatch is a match of the Lookup API.
+type threatMatch struct {
+	ThreatType string      `json:"threatType"`
+	Threat     threatEntry `json:"threat"`
+	// Duration like "300s"
+	CacheDuration string `json:"cacheDuration"`
+}
+
+// Report whether destinations are checked against Safe Browsing, which needs an API key in SAFE_BROWSING_KEY
+func safeBrowsingEnabled() bool {
+	return config.SafeBrowsingKey != ""
+}
+
+// Report whether redirects check their destination again, SAFE_BROWSING_ON_REDIRECT=true
+func safeBrowsingOnRedirect() bool {
+	return safeBrowsingEnabled() && config.SafeBrowsingOnRedirect
+}
+
+// Look up URLs with Safe Browsing, returning the cached or fresh outcome of each
+func lookupSafeBrowsing(ctx context.Context, urls ...string) (map[string]safeBrowsingEntry, error) {
+	now := clock()
+	found := map[string]safeBrowsingEntry{}
+	unknown := []threatEntry{}
+	safeBrowsingCache.Lock()
+	for _, u := range urls {
+		if entry, ok := safeBrowsingCache.entries[u]; ok && now.Before(entry.expires) {
+			found[u] = entry
+		} else if _, ok := found[u]; !ok {
+			unknown = append(unknown, threatEntry{u})
+		}
+	}
+	safeBrowsingCache.Unlock()
+	if len(unknown) == 0 {
+		return found, nil
+	}
+
+	ctx, span := tracer.Start(ctx, "lookupSafeBrowsing")
+	defer span.End()
+	body, err := json.Marshal(map[string]interface{}{
+		"client": map[string]string{"clientId": "urly-wurly", "clientVersion": version},
+		"threatInfo": map[string]interface{}{
+			"threatTypes":      safeBrowsingThreatTypes,
+			"platformTypes":    []string{"ANY_PLATFORM"},
+			"threatEntryTypes": []string{"URL"},
+			"threatEntries":    unknown,
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	endpoint := safeBrowsingURL + "?" + url.Values{"key": {config.SafeBrowsingKey}}.Encode()
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := safeBrowsingClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Safe Browsing answered %d", resp.StatusCode)
+	}
+	result := struct {
+		Matches []threatMatch `json:"matches"`
+	}{}
+	err = json.NewDecoder(resp.Body).Decode(&result)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, u := range unknown {
+		found[u.URL] = safeBrowsingEntry{"", now, now.Add(safeBrowsingCleanTTL)}
+	}
+	for _, match := range result.Matches {
+		ttl, err := time.ParseDuration(match.CacheDuration)
+		if err != nil || ttl <= 0 {
+			ttl = safeBrowsingCleanTTL
+		}
+		found[match.Threat.URL] = safeBrowsingEntry{match.ThreatType, now, now.Add(ttl)}
+	}
+	safeBrowsingCache.Lock()
+	if len(safeBrowsingCache.entries) >= maxSafeBrowsingEntries {
+		safeBrowsingCache.entries = map[string]safeBrowsingEntry{}
+	}
+	for _, u := range unknown {
+		safeBrowsingCache.entries[u.URL] = found[u.URL]
+	}
+	safeBrowsingCache.Unlock()
+	return found, nil
+}
+
+// Threat type of the first destination Safe Browsing flags, empty if none is flagged.
+// Destinations pass if Safe Browsing can't be reached, so an outage doesn't stop shortening.
+func unsafeDestination(ctx context.Context, destinations ...string) string {
+	if !safeBrowsingEnabled() {
+		return ""
+	}
+	found, err := lookupSafeBrowsing(ctx, destinations...)
+	if err != nil {
+		slog.Error("unable to look up destinations with Safe Browsing", "err", err)
+		return ""
+	}
+	for _, destination := range destinations {
+		if threat := found[destination].threat; threat != "" {
+			return threat
+		}
+	}
+	return ""
+}
+
+// Response rejecting a destination flagged by Safe Browsing
+func unsafeDestinationFailure(threat string) shortenResponse {
+	message := fmt.Sprintf("destination is flagged by Google Safe Browsing (%s)!", threatDescription(threat))
+	return shortenResponse{response: response{"", message}, Error: errUnsafeDestination}
+}
+
+// Human readable form of a threat type, e.g. "social engineering"
+func threatDescription(threat string) string {
+	return strings.ToLower(strings.Replace(threat, "_", " ", -1))
+}
+
+// Check the destination of a link on redirect with SAFE_BROWSING_ON_REDIRECT, quarantining it if flagged.
+// Returns the link's quarantine, or nil if the destination isn't flagged or the lookup took longer
+// than SAFE_BROWSING_REDIRECT_TIMEOUT.
+func safeBrowsingWarning(ctx context.Context, code string, destination string) *quarantine {
+	if !safeBrowsingOnRedirect() {
+		return nil
+	}
+	timeout := config.SafeBrowsingRedirectTimeout
+	if timeout <= 0 {
+		timeout = defaultSafeBrowsingRedirectTimeout
+	}
+	lookupCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	threat := unsafeDestination(lookupCtx, destination)
+	if threat == "" {
+		return nil
+	}
+	reason := fmt.Sprintf("The destination of this link has been flagged by Google Safe Browsing (%s).", threatDescription(threat))
+	q, err := quarantineLink(ctx, code, quarantineSafeBrowsing, reason)
+	if err != nil {
+		slog.Error("unable to quarantine", "code", code, "err", err)
+		// Warn this visitor anyway, the next one tries again
+		return &quarantine{quarantineSafeBrowsing, reason, clock().UTC()}
+	}
+	return q
+}
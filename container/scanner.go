@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mr-tron/base58"
+)
+
+// Points added to a client's abuse score
+const (
+	honeypotPenalty = 10
+	floodPenalty    = 1
+)
+
+// Defaults for scanner handling
+const (
+	defaultScannerThreshold = 10
+	defaultScannerLimit     = 10
+	abuseScoreDecay         = time.Hour
+	robotsHoneypots         = 3
+)
+
+// Error returned when a honeypot code would be issued to a user
+var errReservedCode = errors.New("short code is reserved")
+
+// Honeypot codes and per-IP abuse scores, set up by setupHoneypots
+var scanners struct {
+	sync.Mutex
+	// Honeypot codes, never issued to users
+	honeypots map[string]bool
+	// Honeypots published as disallowed paths in robots.txt
+	published []string
+	// Abuse score per client IP
+	scores map[string]*abuseScore
+	// Score from which a client is treated as a scanner
+	threshold int
+	// Redirects per minute allowed to scanners, across all codes
+	limit *limiter
+}
+
+// struct abuseScore tracks the misbehaviour of a single client.
+type abuseScore struct {
+	Score    int       `json:"score"`
+	Honeypot int       `json:"honeypot_hits"`
+	Updated  time.Time `json:"updated"`
+}
+
+// Derive HONEYPOT_CODES honeypot codes from SIGNING_SECRET, so all instances agree on them.
+// SCANNER_THRESHOLD and SCANNER_RATE_LIMIT tune how flagged clients are throttled.
+func setupHoneypots() {
+	scanners.scores = map[string]*abuseScore{}
+	threshold := config.ScannerThreshold
+	if threshold <= 0 {
+		threshold = defaultScannerThreshold
+	}
+	limit := config.ScannerRateLimit
+	if limit <= 0 {
+		limit = defaultScannerLimit
+	}
+	scanners.threshold = threshold
+	scanners.limit = newLimiter(limit, limit)
+	go func() {
+		for range time.Tick(abuseScoreDecay) {
+			forgetScores()
+		}
+	}()
+
+	count := config.HoneypotCodes
+	if count <= 0 || config.SigningSecret == "" {
+		return
+	}
+	scanners.honeypots = map[string]bool{}
+	mac := hmac.New(sha256.New, []byte(config.SigningSecret))
+	for i := 0; len(scanners.honeypots) < count; i++ {
+		mac.Reset()
+		fmt.Fprintf(mac, "honeypot:%d", i)
+		// Same shape as generated codes: base58 of four bytes
+		code := base58.Encode(mac.Sum(nil)[:4])
+		if !scanners.honeypots[code] && len(scanners.published) < robotsHoneypots {
+			scanners.published = append(scanners.published, code)
+		}
+		scanners.honeypots[code] = true
+	}
+}
+
+// Report whether a code is a honeypot
+func isHoneypot(code string) bool {
+	return scanners.honeypots[code]
+}
+
+// Add points to the abuse score of a client
+func scoreClient(ip string, points int, honeypot bool) {
+	scanners.Lock()
+	defer scanners.Unlock()
+	now := time.Now()
+	s, ok := scanners.scores[ip]
+	if !ok || now.Sub(s.Updated) > abuseScoreDecay {
+		s = &abuseScore{}
+		scanners.scores[ip] = s
+	}
+	s.Score += points
+	if honeypot {
+		s.Honeypot++
+	}
+	s.Updated = now
+}
+
+// Drop abuse scores which have decayed
+func forgetScores() {
+	scanners.Lock()
+	defer scanners.Unlock()
+	for ip, s := range scanners.scores {
+		if time.Since(s.Updated) > abuseScoreDecay {
+			delete(scanners.scores, ip)
+		}
+	}
+}
+
+// Report whether a client's abuse score marks it as a scanner
+func isScanner(ip string) bool {
+	scanners.Lock()
+	defer scanners.Unlock()
+	s, ok := scanners.scores[ip]
+	return ok && s.Score >= scanners.threshold && time.Since(s.Updated) <= abuseScoreDecay
+}
+
+// Record a honeypot hit and answer exactly like an unknown code would
+func trapScanner(ctx context.Context, w http.ResponseWriter, r *http.Request, code string) {
+	ctx, span := tracer.Start(ctx, "trapScanner")
+	defer span.End()
+	ip := clientIP(r)
+	slog.Warn("honeypot requested", "code", code, "ip", ip, "user_agent", r.UserAgent())
+	scoreClient(ip, honeypotPenalty, true)
+	w.Header().Set("Content-Type", "application/json")
+	respond(ctx, response{"", "unable to find URL!"}, http.StatusBadRequest, w)
+}
+
+// Throttle clients flagged as scanners across all codes
+func allowScanner(ctx context.Context, w http.ResponseWriter, r *http.Request) bool {
+	ip := clientIP(r)
+	if !isScanner(ip) || scanners.limit.allow(ip, time.Now()) {
+		return true
+	}
+	w.Header().Set("Retry-After", strconv.Itoa(int(scanners.limit.wait(ip).Seconds())+1))
+	w.Header().Set("Content-Type", "application/json")
+	respond(ctx, response{"", "too many requests, slow down!"}, http.StatusTooManyRequests, w)
+	return false
+}
+
+// GET handler serving robots.txt, listing a few honeypots as disallowed paths.
+// Well-behaved crawlers never request them, enumeration tools reading robots.txt do.
+func robotsHandler(w http.ResponseWriter, r *http.Request) {
+	body := new(strings.Builder)
+	body.WriteString("User-agent: *\n")
+	body.WriteString("Disallow: /api/\n")
+	body.WriteString("Disallow: /admin/\n")
+	for _, code := range scanners.published {
+		fmt.Fprintf(body, "Disallow: /%s\n", code)
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Write([]byte(body.String()))
+}
+
+// GET handler listing clients with an abuse score, highest first
+func scannersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "scannersHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	type client struct {
+		IP string `json:"ip"`
+		abuseScore
+		Scanner bool `json:"scanner"`
+	}
+	clients := []client{}
+	scanners.Lock()
+	for ip, s := range scanners.scores {
+		if time.Since(s.Updated) > abuseScoreDecay {
+			continue
+		}
+		clients = append(clients, client{ip, *s, s.Score >= scanners.threshold})
+	}
+	scanners.Unlock()
+	sort.Slice(clients, func(i, j int) bool { return clients[i].Score > clients[j].Score })
+	respond(ctx, clients, http.StatusOK, w)
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Codes identifying why a destination was rejected, returned as "error" next to the message
+const (
+	schemeUnparsable  = "unparsable_url"
+	schemeMissing     = "missing_scheme"
+	schemeMissingHost = "missing_host"
+	schemeTypo        = "scheme_typo"
+	schemeNotAllowed  = "scheme_not_allowed"
+)
+
+// Reason of a normalization which prepended a missing scheme, corrected typos are reported as scheme_typo
+const schemeAdded = "scheme_added"
+
+// Default web schemes links may point to
+const defaultAllowedSchemes = "https,http"
+
+// Normalizations applied by default, see urlNormalization
+const defaultURLNormalization = "scheme"
+
+// struct normalization reports how a submitted URL was changed before shortening.
+type normalization struct {
+	// URL as submitted
+	Input string `json:"input"`
+	// URL which was shortened
+	URL string `json:"url"`
+	// scheme_added or scheme_typo
+	Reason string `json:"reason"`
+}
+
+// Well-known schemes which are rejected as such rather than taken for a misspelt http(s)
+var knownSchemes = map[string]bool{
+	"ftp": true, "ftps": true, "sftp": true, "tftp": true, "file": true, "data": true, "blob": true,
+	"javascript": true, "vbscript": true, "about": true, "chrome": true, "ws": true, "wss": true,
+	"ssh": true, "git": true, "svn": true, "smb": true, "nfs": true, "ldap": true, "irc": true,
+	"mailto": true, "tel": true, "sms": true, "geo": true, "news": true, "telnet": true,
+}
+
+// struct schemeError explains why a destination was rejected and how it might be fixed.
+type schemeError struct {
+	// One of the scheme* codes
+	Code string
+	// Human readable explanation
+	Message string
+	// Corrected destination, if the input looks like a typo
+	Suggestion string
+}
+
+func (e *schemeError) Error() string {
+	return e.Message
+}
+
+// Web schemes allowed by ALLOWED_SCHEMES (comma separated, only http and https are supported).
+// The first one is prepended to inputs without a scheme.
+func allowedSchemes() []string {
+	raw := policySetting("ALLOWED_SCHEMES")
+	if raw == "" {
+		raw = defaultAllowedSchemes
+	}
+	schemes := []string{}
+	for _, scheme := range strings.Split(raw, ",") {
+		scheme = strings.ToLower(strings.TrimSpace(scheme))
+		if scheme == "https" || scheme == "http" {
+			schemes = append(schemes, scheme)
+		}
+	}
+	if len(schemes) == 0 {
+		return strings.Split(defaultAllowedSchemes, ",")
+	}
+	return schemes
+}
+
+// Normalizations enabled by URL_NORMALIZATION: "off" rejects anything but complete URLs,
+// "scheme" (default) prepends missing schemes and "typos" additionally corrects misspelt ones
+func urlNormalization() (prefix bool, typos bool) {
+	switch config.URLNormalization {
+	case "off":
+		return false, false
+	case "typos":
+		return true, true
+	}
+	return true, false
+}
+
+// Report whether a web scheme is allowed
+func schemeAllowed(scheme string) bool {
+	for _, allowed := range allowedSchemes() {
+		if scheme == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// Check a destination against the scheme policy, normalizing it as far as URL_NORMALIZATION allows.
+// Returns the destination to store and the reason it differs from the input, if it does.
+// Contact URLs pass, checkContactURL has the final word on them.
+func checkScheme(raw string) (string, string, error) {
+	raw = strings.TrimSpace(raw)
+	uri, err := url.Parse(raw)
+	if err == nil && contactSchemes[uri.Scheme] != "" {
+		return raw, "", nil
+	}
+	if err == nil && schemeAllowed(uri.Scheme) && uri.Host != "" {
+		return raw, "", nil
+	}
+
+	prefix, typos := urlNormalization()
+	preferred := allowedSchemes()[0]
+	scheme, rest := splitScheme(raw)
+	lower := strings.ToLower(scheme)
+	switch {
+	case prefix && scheme == "" && strings.HasPrefix(raw, "//"):
+		return corrected(preferred+":"+raw, schemeAdded)
+	case prefix && (scheme == "" || strings.Contains(scheme, ".")) && looksLikeHost(raw):
+		return corrected(preferred+"://"+raw, schemeAdded)
+	case scheme == "" && err != nil:
+		return "", "", &schemeError{schemeUnparsable, "unable to parse URI. was it encoded?", ""}
+	case scheme == "":
+		return "", "", &schemeError{schemeMissing, "provided input has no scheme like " + preferred, ""}
+	case schemeAllowed(lower) && rest == "":
+		return "", "", &schemeError{schemeMissingHost, "provided URL has no host", ""}
+	case schemeAllowed(lower) && typos:
+		return corrected(lower+"://"+rest, schemeTypo)
+	case schemeAllowed(lower):
+		// Right scheme, wrong separator like https:/ or https//
+		return "", "", &schemeError{schemeTypo, "provided URL is malformed after its scheme " + lower, lower + "://" + rest}
+	case !knownSchemes[lower]:
+		if nearest := nearestScheme(lower); nearest != "" && typos {
+			return corrected(nearest+"://"+rest, schemeTypo)
+		} else if nearest != "" {
+			return "", "", &schemeError{schemeTypo, "unknown scheme " + scheme + ", probably a typo of " + nearest, nearest + "://" + rest}
+		}
+	}
+	return "", "", &schemeError{schemeNotAllowed, scheme + " URLs aren't allowed, use " + strings.Join(allowedSchemes(), " or "), ""}
+}
+
+// Check a destination like link creation does: the scheme policy, then the contact policy for mailto: and tel:.
+// Returns the destination to store and how it was normalized, if it was.
+func checkDestination(raw string, owner string) (string, *normalization, error) {
+	destination, reason, err := checkScheme(raw)
+	if err != nil {
+		return "", nil, err
+	}
+	var normalized *normalization
+	if reason != "" {
+		normalized = &normalization{strings.TrimSpace(raw), destination, reason}
+	}
+	uri, _ := url.Parse(destination)
+	if contactSchemes[uri.Scheme] != "" {
+		destination, err = checkContactURL(uri, owner)
+	} else {
+		err = checkDomainLists(destination)
+	}
+	return destination, normalized, err
+}
+
+// Response rejecting a destination, with the code and suggestion of scheme errors
+func destinationFailure(err error) shortenResponse {
+	var rejected *schemeError
+	if errors.As(err, &rejected) {
+		return shortenResponse{response: response{"", rejected.Message + "!"}, Error: rejected.Code, Suggestion: rejected.Suggestion}
+	}
+	return shortenResponse{response: response{"", err.Error() + "!"}}
+}
+
+// Check a corrected destination, which has to pass without further corrections
+func corrected(destination string, reason string) (string, string, error) {
+	uri, err := url.Parse(destination)
+	if err != nil || !schemeAllowed(uri.Scheme) || uri.Host == "" {
+		return "", "", &schemeError{schemeUnparsable, "unable to parse URI. was it encoded?", ""}
+	}
+	return destination, reason, nil
+}
+
+// Split the scheme off an input, tolerating a missing colon (https//) and any number of slashes.
+// Returns an empty scheme if there is none.
+func splitScheme(raw string) (string, string) {
+	end := strings.IndexAny(raw, ":/")
+	if end <= 0 {
+		return "", raw
+	}
+	scheme := raw[:end]
+	for i, c := range scheme {
+		letter := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+		if !letter && (i == 0 || !(c >= '0' && c <= '9' || c == '+' || c == '-' || c == '.')) {
+			return "", raw
+		}
+	}
+	if raw[end] == '/' && !strings.HasPrefix(raw[end:], "//") {
+		// A plain path like example.com/page
+		return "", raw
+	}
+	if raw[end] == '/' && strings.Contains(scheme, ".") {
+		// A host like example.com//page
+		return "", raw
+	}
+	return scheme, strings.TrimLeft(raw[end:], ":/\\")
+}
+
+// Report whether an input without a scheme starts with something like a host name
+func looksLikeHost(raw string) bool {
+	if strings.ContainsAny(raw, " \t\r\n") {
+		return false
+	}
+	uri, err := url.Parse("https://" + raw)
+	return err == nil && strings.Contains(uri.Hostname(), ".") && !strings.HasPrefix(uri.Hostname(), ".") && !strings.HasSuffix(uri.Hostname(), ".")
+}
+
+// Allowed scheme closest to a misspelt one (at most two edits away), empty if there is none
+func nearestScheme(scheme string) string {
+	nearest, best := "", 3
+	for _, allowed := range allowedSchemes() {
+		if d := editDistance(scheme, allowed); d < best {
+			nearest, best = allowed, d
+		}
+	}
+	return nearest
+}
+
+// Levenshtein distance of two short strings
+func editDistance(a string, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			current[j] = min3(previous[j]+1, current[j-1]+1, previous[j-1]+cost)
+		}
+		previous = current
+	}
+	return previous[len(b)]
+}
+
+// Smallest of three integers
+func min3(a int, b int, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
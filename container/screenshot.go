@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Largest thumbnail accepted from the rendering service
+const maxScreenshotSize = 2 << 20
+
+// Screenshots are captured when an external rendering service is configured.
+// SCREENSHOT_SERVICE is a URL template containing a single %s for the escaped destination,
+// e.g. https://render.example.com/shot?width=640&url=%s
+func screenshotsEnabled() bool {
+	return config.ScreenshotService != "" && config.SigningSecret != ""
+}
+
+// Name of the GCS object holding the thumbnail for a short code
+func screenshotObject(code string) string {
+	return "screenshots/" + code
+}
+
+// Signed URL under which the thumbnail of a short code is served
+func screenshotURL(code string) string {
+	return fmt.Sprintf("https://%s/%s/screenshot?sig=%s", config.Domain, code, sign(screenshotObject(code)))
+}
+
+// Render a thumbnail of the destination and store it in GCS.
+// Runs as a background task, rejected destinations are only logged as retrying won't help.
+func captureScreenshot(ctx context.Context, code string, long string) error {
+	ctx, span := tracer.Start(ctx, "captureScreenshot")
+	defer span.End()
+	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
+	defer cancel()
+
+	uri, err := url.Parse(long)
+	if err != nil {
+		slog.Error("unable to take screenshot", "code", code, "err", err)
+		return nil
+	}
+	err = checkFetchURL(uri)
+	if err == nil {
+		err = checkPublicHost(ctx, uri.Hostname())
+	}
+	if err != nil {
+		slog.Warn("screenshot destination rejected", "code", code, "err", err)
+		return nil
+	}
+
+	renderer := fmt.Sprintf(config.ScreenshotService, url.QueryEscape(uri.String()))
+	image, contentType, err := fetchScreenshot(ctx, renderer)
+	if err != nil {
+		return fmt.Errorf("screenshot %s: %v", code, err)
+	}
+	return gcsWriteBlob(ctx, screenshotObject(code), contentType, image)
+}
+
+// Call the rendering service and validate what it returns
+func fetchScreenshot(ctx context.Context, renderer string) ([]byte, string, error) {
+	ctx, span := tracer.Start(ctx, "fetchScreenshot")
+	defer span.End()
+	req, err := http.NewRequest(http.MethodGet, renderer, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	resp, err := http.DefaultClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("rendering service returned %d", resp.StatusCode)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if !strings.HasPrefix(contentType, "image/") {
+		return nil, "", fmt.Errorf("rendering service returned %q", contentType)
+	}
+	image, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxScreenshotSize+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(image) > maxScreenshotSize {
+		return nil, "", fmt.Errorf("screenshot exceeds %d bytes", maxScreenshotSize)
+	}
+	return image, contentType, nil
+}
+
+// GET handler serving a stored thumbnail, guarded by a signature
+func screenshotHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "screenshotHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	object := screenshotObject(mux.Vars(r)["id"])
+	if !verifySignature(object, r.URL.Query().Get("sig")) {
+		w.Header().Set("Content-Type", "application/json")
+		forbidden(ctx, w, "invalid signature!")
+		return
+	}
+	image, contentType, err := gcsReadBlob(ctx, object)
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "no screenshot available!"}, http.StatusNotFound, w)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write(image)
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// struct selftestStep reports the outcome of a single probe step.
+type selftestStep struct {
+	// Name of the step
+	Name string `json:"name"`
+	// Whether the step succeeded (skipped steps count as successful)
+	OK bool `json:"ok"`
+	// Whether the step was skipped because the feature isn't available
+	Skipped bool `json:"skipped,omitempty"`
+	// Time the step took in milliseconds
+	DurationMS int64 `json:"duration_ms"`
+	// Failure or skip reason
+	Detail string `json:"detail,omitempty"`
+}
+
+// struct selftestResponse is the report of an end-to-end probe.
+type selftestResponse struct {
+	// Whether all steps succeeded
+	OK bool `json:"ok"`
+	// Throwaway short code used by the probe
+	Code string `json:"code"`
+	// Individual steps in execution order
+	Steps []selftestStep `json:"steps"`
+}
+
+// Client used to resolve the probe link through this instance without following the redirect
+var selftestClient = &http.Client{
+	Timeout: 10 * time.Second,
+	CheckRedirect: func(req *http.Request, via []*http.Request) error {
+		return http.ErrUseLastResponse
+	},
+}
+
+// GET handler creating, resolving and deleting a throwaway link, which never shows up in events or the index.
+// Responds 200 if every step passed and 503 otherwise, so it can back an uptime check.
+func selftestHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "selftestHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+
+	random := make([]byte, 6)
+	rand.Read(random)
+	code := "selftest-" + hex.EncodeToString(random)
+	target := fmt.Sprintf("https://%s/selftest/%s", config.Domain, code)
+	report := selftestResponse{OK: true, Code: code}
+
+	// Each probe returns a reason if it had to be skipped
+	step := func(name string, probe func() (string, error)) {
+		start := time.Now()
+		skipped, err := probe()
+		result := selftestStep{Name: name, OK: err == nil, Skipped: skipped != "", Detail: skipped, DurationMS: time.Since(start).Milliseconds()}
+		if err != nil {
+			result.Detail = redactError(err)
+			report.OK = false
+		}
+		report.Steps = append(report.Steps, result)
+	}
+
+	step("create", func() (string, error) {
+		// Written straight to the store: the probe isn't indexed, announced or broadcast like links users create
+		return "", writeLinkIfGeneration(ctx, code, &link{URL: target, Created: clock().UTC(), Tags: []string{"selftest"}}, 0)
+	})
+	step("resolve", func() (string, error) {
+		return "", selftestResolve(ctx, code, target)
+	})
+	step("analytics", func() (string, error) {
+		flushClicks(ctx)
+		rollup, err := readRollup(ctx, code, clock().UTC().Format(rollupDate))
+		if err != nil {
+			return "", err
+		}
+		if rollup.Clicks == 0 {
+			return "", fmt.Errorf("redirect was not counted")
+		}
+		return "", nil
+	})
+	step("delete", func() (string, error) {
+		err := gcsDelete(ctx, rollupObject(code, clock().UTC().Format(rollupDate)))
+		if err != nil && err != storage.ErrObjectNotExist {
+			return "", err
+		}
+		return "", linkStorage.delete(ctx, code)
+	})
+
+	status := http.StatusOK
+	if !report.OK {
+		status = http.StatusServiceUnavailable
+	}
+	respond(ctx, report, status, w)
+}
+
+// Request the probe link from this instance and check where it redirects to
+func selftestResolve(ctx context.Context, code string, target string) error {
+	ctx, span := tracer.Start(ctx, "selftestResolve")
+	defer span.End()
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("http://127.0.0.1:%s/%s", config.Port, code), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := selftestClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 300 || resp.StatusCode >= 400 {
+		return fmt.Errorf("expected a redirect, got status %d", resp.StatusCode)
+	}
+	if location := resp.Header.Get("Location"); location != target {
+		return fmt.Errorf("redirected to %q instead of %q", location, target)
+	}
+	return nil
+}
@@ -4,25 +4,33 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"hash/crc32"
-	"log"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"net/url"
-	"os"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"cloud.google.com/go/profiler"
 	"cloud.google.com/go/storage"
 
 	"github.com/gorilla/mux"
 	"github.com/mr-tron/base58"
+	"google.golang.org/api/googleapi"
+	"google.golang.org/api/iterator"
 
 	"contrib.go.opencensus.io/exporter/stackdriver"
-	"go.opencensus.io/trace"
 )
 
 // struct response forms a JSON response for the servers API.
@@ -33,230 +41,1123 @@ type response struct {
 	Message string `json:"message"`
 }
 
+// Message of a response, implemented by response and everything embedding it
+func (r response) message() string {
+	return r.Message
+}
+
+// interface messenger is implemented by responses carrying a human readable message.
+type messenger interface {
+	message() string
+}
+
+// struct shortenRequest holds the parameters for creating a short link.
+type shortenRequest struct {
+	// URL to shorten
+	URL string `json:"url"`
+	// Requested short code instead of a generated one
+	CustomName string `json:"customname,omitempty"`
+	// Labels used to group links into bundles
+	Tags []string `json:"tags,omitempty"`
+	// Contact of whoever creates the link
+	Owner string `json:"owner,omitempty"`
+	// Signed-in user creating the link, taken from the ID token only
+	UID string `json:"-"`
+	// API key, user or IP registering a custom name, for the squatting protection
+	Registrant string `json:"-"`
+	// Token of a domain claim from X-Claim-Token, lifting the claim's policy
+	ClaimToken string `json:"-"`
+	// Answer with links to the new link's related resources, for clients asking for HAL
+	Hypermedia bool `json:"-"`
+	// Absolute expiry as RFC 3339 time
+	Expires string `json:"expires,omitempty"`
+	// Relative expiry as Go duration
+	TTL string `json:"ttl,omitempty"`
+	// Serve an inline viewer for media destinations
+	Media bool `json:"media,omitempty"`
+	// Delete the destination after the first redirect
+	BurnAfterReading bool `json:"burn_after_reading,omitempty"`
+	// Opt the link out of click analytics
+	NoAnalytics bool `json:"no_analytics,omitempty"`
+	// Destinations of an A/B split link, replacing URL
+	Variants []variant `json:"variants,omitempty"`
+	// Optimise the split for conversions reported through the postback URL
+	Bandit bool `json:"bandit,omitempty"`
+	// Append a click ID to the destination, to be reported back to /api/v1/conversions
+	TrackConversions bool `json:"track_conversions,omitempty"`
+	// Structured content (vCard, Wi-Fi, geo) to serve instead of a URL
+	Payload *payload `json:"payload,omitempty"`
+	// Let anyone embed the stats widget of the link
+	PublicStats bool `json:"public_stats,omitempty"`
+	// HTTP status of redirects, 301 or 308 for permanent and 302 or 307 for temporary ones
+	RedirectStatus int `json:"redirect_status,omitempty"`
+	// Page to redirect to once the link has expired, been consumed or deleted
+	FallbackURL string `json:"fallback_url,omitempty"`
+	// Message to show instead once the link is gone, can't be combined with fallback_url
+	FallbackMessage string `json:"fallback_message,omitempty"`
+}
+
+// struct shortenResponse extends response with details about a newly created link.
+type shortenResponse struct {
+	response
+	// Signed URL of the destination thumbnail (if screenshots are enabled)
+	ScreenshotURL string `json:"screenshot_url,omitempty"`
+	// Expiry of the link (if one was requested)
+	Expires *time.Time `json:"expires,omitempty"`
+	// Signed iCalendar feed listing upcoming expirations of the owner (or the first tag)
+	CalendarURL string `json:"calendar_url,omitempty"`
+	// Signed link to the aggregate traffic insights of the owner
+	InsightsURL string `json:"insights_url,omitempty"`
+	// Signed URL for reporting conversions of a split link, append &variant=<index>
+	PostbackURL string `json:"postback_url,omitempty"`
+	// Machine readable reason the URL was rejected, e.g. scheme_typo or name_taken
+	Error string `json:"error,omitempty"`
+	// Corrected URL to retry with, if the rejected one looks misspelt
+	Suggestion string `json:"suggestion,omitempty"`
+	// How the submitted URL was changed before shortening, for the UI to confirm with the user
+	Normalized *normalization `json:"normalized,omitempty"`
+	// Bearer token for managing the link later, e.g. DELETE /s/<code> (if a signing secret is set)
+	ManageToken string `json:"manage_token,omitempty"`
+	// URL of the stats widget for embedding as iframe, signed for private stats
+	EmbedURL string `json:"embed_url,omitempty"`
+	// Signed link to the list of the owner's links
+	LinksURL string `json:"links_url,omitempty"`
+	// Related resources of the link, for clients asking for HAL
+	Links halLinks `json:"_links,omitempty"`
+}
+
+// Current time of everything handlers store or answer, frozen by the golden tests.
+// Latencies, timeouts and caches of remote data keep going by the wall clock.
+var clock = time.Now
+
+// Custom names must be at least 6 word characters or dashes
+var customNamePattern = regexp.MustCompile(`^[\w-]{6,}$`)
+
+// Codes tried for a URL whose code belongs to another link: the first ones are derived with
+// a counter as salt, so the same link is found again, later ones with random salts
+const (
+	derivedCodes    = 4
+	maxCodeAttempts = 16
+)
+
+// Random bytes of randomly drawn codes by default (8 or 9 characters) and at least (5 or 6 characters)
+const (
+	defaultRandomCodeBytes = 6
+	minRandomCodeBytes     = 4
+)
+
+// Errors of issuing a short code
+var (
+	errCodeTaken  = errors.New("short code is taken")
+	errNoFreeCode = errors.New("no free short code found")
+)
+
 // Launch HTTP server, register routes & handlers and server static files
 func main() {
-	err := profiler.Start(profiler.Config{
-		Service:              "urly-wurly",
-		NoHeapProfiling:      true,
-		NoAllocProfiling:     true,
-		NoGoroutineProfiling: true,
-		DebugLogging:         true,
-		ServiceVersion:       "1.0.0",
-	})
+	local := flag.Bool("local", false, "keep everything in memory and skip Cloud Profiler and Stackdriver, for local development")
+	seed := flag.String("seed", "", "with --local, JSON file of the objects to start with, by name")
+	configFile := flag.String("config", "", "YAML file of settings, overridden by the environment and by flags")
+	registerSettingFlags()
+	flag.Parse()
+	configErr := loadConfig(*configFile)
+	err := setupLogging(*local)
 	if err != nil {
-		log.Fatal(err)
+		fatal("invalid logging configuration", "err", err)
 	}
-	exporter, err := stackdriver.NewExporter(stackdriver.Options{})
+	if configErr != nil {
+		fatal("invalid configuration", "err", configErr)
+	}
+	setupRedaction()
+	var exporter *stackdriver.Exporter
+	if *local {
+		setupLocal()
+		if *seed != "" {
+			err := seedLocal(*seed)
+			if err != nil {
+				fatal("unable to seed local bucket", "path", *seed, "err", err)
+			}
+		}
+	} else {
+		err := profiler.Start(profiler.Config{
+			Service:              "urly-wurly",
+			NoHeapProfiling:      true,
+			NoAllocProfiling:     true,
+			NoGoroutineProfiling: true,
+			DebugLogging:         true,
+			ServiceVersion:       version,
+		})
+		if err != nil {
+			fatal("unable to start profiler", "err", err)
+		}
+		// Only metrics are exported through OpenCensus, traces go through OpenTelemetry
+		exporter, err = stackdriver.NewExporter(stackdriver.Options{})
+		if err != nil {
+			fatal("unable to create metrics exporter", "err", err)
+		}
+	}
+	tracing, err := setupTracing(context.Background(), *local)
 	if err != nil {
-		log.Fatal(err)
+		fatal("unable to set up tracing", "err", err)
+	}
+	registerViews()
+	if !*local {
+		err := setupLinkStore(context.Background())
+		if err != nil {
+			fatal("unable to set up link store", "err", err)
+		}
+		err = setupClickExport(context.Background())
+		if err != nil {
+			fatal("unable to set up click export", "err", err)
+		}
+		err = setupEventsTopic(context.Background())
+		if err != nil {
+			fatal("unable to set up events topic", "err", err)
+		}
+	}
+	setupChangeFeed()
+	setupReplicaSnapshot()
+	setupRedirectCache()
+	setupArchive()
+	setupFloodProtection()
+	setupThrottling()
+	setupPriorities()
+	setupAliasProtection()
+	setupHoneypots()
+	startPolicyReloader()
+	startTaskRunner()
+	startRollups()
+	if !redirectOnly() {
+		startDomainLists()
+		startTrafficDetector()
+		startCloakingDetector()
+		startJobWorkers()
+		startOutboxDispatcher()
+		startSnapshotPublisher()
+		startArchiver()
+		startLiveFeed()
+	}
+	startStatusRecorder()
+	startUsageRecorder()
+	startConfigReporter()
+	if exporter != nil {
+		exporter.StartMetricsExporter()
 	}
-	trace.RegisterExporter(exporter)
-	exporter.StartMetricsExporter()
-	defer exporter.StopMetricsExporter()
-	trace.ApplyConfig(trace.Config{DefaultSampler: trace.AlwaysSample()})
 
 	ctx := context.Background()
-	ctx, span := trace.StartSpan(ctx, "main")
+	ctx, span := tracer.Start(ctx, "main")
 	defer span.End()
 
+	http.Handle("/", newRouter())
+	serve(exporter, tracing)
+}
+
+// Register routes & handlers, static files and the middleware wrapping all of them
+func newRouter() *mux.Router {
 	router := mux.NewRouter()
-	router.HandleFunc("/s", shortenHandler).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
-	router.HandleFunc("/{id:[\\w-]+}", lengthenHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/robots.txt", robotsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/.well-known/security.txt", securityTxtHandler).Methods(http.MethodGet)
+	router.HandleFunc("/api/v1/abuse", abuseHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/api/v1/version", versionHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/internal/tasks/{kind}", taskHandler).Methods(http.MethodPost)
+	router.HandleFunc("/healthz", healthzHandler).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/readyz", readyzHandler).Methods(http.MethodGet, http.MethodHead)
+	router.HandleFunc("/status", statusHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/metrics", openMetricsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/admin/reload", reloadHandler).Methods(http.MethodGet, http.MethodPost)
+	if !redirectOnly() {
+		router.HandleFunc("/s", withAPIKey(deprecated("/api/v1/links", shortenHandler))).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+		router.HandleFunc("/s/{id:[\\w-]+}", deleteLinkHandler).Methods(http.MethodDelete, http.MethodOptions)
+		router.HandleFunc("/s/{id:[\\w-]+}", updateLinkHandler).Methods(http.MethodPut)
+		router.HandleFunc("/api/v1/abuse", abuseReportHandler).Methods(http.MethodPost)
+		router.HandleFunc("/api/v1/links", withAPIKey(createHandler)).Methods(http.MethodPost, http.MethodOptions)
+		router.HandleFunc("/api/v1/links", throttled("list", listLinksHandler)).Methods(http.MethodGet)
+		router.HandleFunc("/graphql", throttled("graphql", graphqlHandler)).Methods(http.MethodGet, http.MethodPost, http.MethodOptions)
+		router.HandleFunc("/api/v1/live", liveHandler).Methods(http.MethodGet)
+		router.HandleFunc("/api/v1/lookup", lookupHandler).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/resolve/{id:[\\w-]+}", resolveHandler).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/links/batch", withAPIKey(throttled("batch", batchHandler))).Methods(http.MethodPost, http.MethodOptions)
+		router.HandleFunc("/api/v1/import", withAPIKey(throttled("import", importHandler))).Methods(http.MethodPost, http.MethodOptions)
+		router.HandleFunc("/api/v1/links/{id:[\\w-]+}", linkHandler).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/links/{id:[\\w-]+}/stats", throttledWhen("stats", largeStatsRange, statsHandler)).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/links/{id:[\\w-]+}/share", shareStatsHandler).Methods(http.MethodPost, http.MethodOptions)
+		router.HandleFunc("/api/v1/jobs", submitJobHandler).Methods(http.MethodPost)
+		router.HandleFunc("/api/v1/jobs/{id:[0-9a-f]+}", jobHandler).Methods(http.MethodGet)
+		router.HandleFunc("/api/v1/sheet", throttled("sheet", sheetHandler)).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/expirations.ics", throttled("calendar", calendarHandler)).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/conversions", conversionsHandler).Methods(http.MethodPost, http.MethodOptions)
+		router.HandleFunc("/api/v1/insights/domains", throttled("domains", domainInsightsHandler)).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/insights/compare", throttled("compare", compareHandler)).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/insights/anomalies", throttled("anomalies", trafficAnomaliesHandler)).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/links/{id:[\\w-]+}/postback", postbackHandler).Methods(http.MethodPost, http.MethodOptions)
+		router.HandleFunc("/api/v1/links/{id:[\\w-]+}/extend", extendHandler).Methods(http.MethodGet, http.MethodOptions)
+		router.HandleFunc("/api/v1/claims", createClaimHandler).Methods(http.MethodPost)
+		router.HandleFunc("/api/v1/claims/{domain:[\\w.-]+}", claimHandler).Methods(http.MethodGet, http.MethodDelete)
+		router.HandleFunc("/api/v1/claims/{domain:[\\w.-]+}/verify", verifyClaimHandler).Methods(http.MethodPost)
+		router.HandleFunc("/api/v1/claims/{domain:[\\w.-]+}/policy", claimPolicyHandler).Methods(http.MethodPut)
+		router.HandleFunc("/api/v1/claims/{domain:[\\w.-]+}/links", throttled("claims", claimLinksHandler)).Methods(http.MethodGet)
+		router.HandleFunc("/api/v1/claims/{domain:[\\w.-]+}/links/{id:[\\w-]+}", claimTakedownHandler).Methods(http.MethodDelete)
+		router.HandleFunc("/admin/anomalies", anomaliesHandler).Methods(http.MethodGet)
+		router.HandleFunc("/admin/scanners", scannersHandler).Methods(http.MethodGet)
+		router.HandleFunc("/admin/cloaking", cloakingHandler).Methods(http.MethodGet, http.MethodDelete)
+		router.HandleFunc("/admin/quarantine", quarantineHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+		router.HandleFunc("/admin/reputation", reputationHandler).Methods(http.MethodGet, http.MethodDelete)
+		router.HandleFunc("/admin/leases", leasesHandler).Methods(http.MethodGet)
+		router.HandleFunc("/admin/deadletter", deadLettersHandler).Methods(http.MethodGet)
+		router.HandleFunc("/admin/selftest", selftestHandler).Methods(http.MethodGet)
+		router.HandleFunc("/admin/reencode", reencodeHandler).Methods(http.MethodGet, http.MethodPost)
+		router.HandleFunc("/admin/keys", apiKeysHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+		router.HandleFunc("/admin/domains", domainListsHandler).Methods(http.MethodGet, http.MethodPut)
+		router.HandleFunc("/admin/squatting", squattingHandler).Methods(http.MethodGet, http.MethodDelete)
+		router.HandleFunc("/admin/claims", claimsAdminHandler).Methods(http.MethodGet, http.MethodDelete)
+		router.HandleFunc("/admin/redirects", throttled("redirects", redirectMapHandler)).Methods(http.MethodGet)
+		router.HandleFunc("/admin/simulate", throttled("simulate", simulationHandler)).Methods(http.MethodPost)
+		router.HandleFunc("/admin/archive", throttled("archive", archiveHandler)).Methods(http.MethodPost)
+		router.HandleFunc("/admin/usage", throttled("usage", usageHandler)).Methods(http.MethodGet)
+		router.HandleFunc("/admin/config/validate", throttled("config", configValidateHandler)).Methods(http.MethodGet)
+		router.HandleFunc("/admin/incidents", incidentsHandler).Methods(http.MethodGet, http.MethodPost, http.MethodDelete)
+	}
+	router.HandleFunc("/{id:[\\w-]+}/verify", captchaHandler).Methods(http.MethodPost)
+	router.HandleFunc("/{id:[\\w-]+}/widget", widgetHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/{id:[\\w-]+}/widget.js", widgetScriptHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/{id:[\\w-]+}/badge.svg", badgeHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/{id:[\\w-]+}/ndef", ndefHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/{id:[\\w-]+}/qr", qrHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/{id:[\\w-]+}/label", labelHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/{id:[\\w-]+}/screenshot", screenshotHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/{id:[\\w-]+}+", previewHandler).Methods(http.MethodGet, http.MethodOptions)
+	router.HandleFunc("/{id:[\\w-]+}", lengthenHandler).Methods(http.MethodGet, http.MethodHead, http.MethodOptions)
 	router.PathPrefix("/").Handler(http.FileServer(http.Dir("./public/")))
 	router.Use(mux.CORSMethodMiddleware(router))
-	http.Handle("/", router)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%s", os.Getenv("PORT")), nil))
+	router.Use(logRequests)
+	router.Use(countRequests)
+	router.Use(prioritize)
+	router.Use(authHeaders)
+	router.Use(negotiate)
+	return router
 }
 
 // GET & POST handler to shorten URLs
 func shortenHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	ctx, span := trace.StartSpan(ctx, "shortenHandler")
+	ctx, span := tracer.Start(ctx, "shortenHandler")
 	defer span.End()
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.Header().Set("Content-Type", "application/json")
 	if r.Method == http.MethodOptions {
 		return
 	}
+	format, err := shortenFormatOf(r)
+	if err != nil {
+		respond(ctx, response{"", err.Error() + "!"}, http.StatusBadRequest, w)
+		return
+	}
+	uid, ok := signedInUser(ctx, w, r)
+	if !ok {
+		return
+	}
 	parameters, ok := r.URL.Query()["url"]
 	if !ok || len(parameters[0]) < 1 {
 		parameters, ok = r.URL.Query()["text"]
 		if !ok || len(parameters[0]) < 1 {
-			respond(ctx, response{"", "no url to shorten provided!"}, http.StatusBadRequest, w)
+			respondShortened(ctx, w, shortenResponse{response: response{"", "no url to shorten provided!"}}, http.StatusBadRequest, format)
 			return
 		}
 	}
 	encodedLongURL := strings.TrimSpace(parameters[0])
 	longURL, err := url.QueryUnescape(encodedLongURL)
 	if err != nil {
-		respond(ctx, response{"", "unable to decode URL. was it encoded?"}, http.StatusBadRequest, w)
+		respondShortened(ctx, w, shortenResponse{response: response{"", "unable to decode URL. was it encoded?"}}, http.StatusBadRequest, format)
 		return
 	}
-	uri, err := url.Parse(longURL)
+
+	req := shortenRequest{
+		URL:     longURL,
+		Tags:    parseTags(r.URL.Query().Get("tags")),
+		Owner:   r.URL.Query().Get("owner"),
+		Expires: r.URL.Query().Get("expires"),
+		TTL:     r.URL.Query().Get("ttl"),
+		Media:   r.URL.Query().Get("media") == "true",
+		UID:     uid,
+
+		Registrant:       registrant(r, uid),
+		ClaimToken:       r.Header.Get("X-Claim-Token"),
+		Hypermedia:       hypermedia(w),
+		BurnAfterReading: r.URL.Query().Get("burn") == "true",
+		NoAnalytics:      r.URL.Query().Get("noanalytics") == "true",
+		FallbackURL:      r.URL.Query().Get("fallback_url"),
+		FallbackMessage:  r.URL.Query().Get("fallback_message"),
+	}
+	if status := r.URL.Query().Get("redirect_status"); status != "" {
+		req.RedirectStatus, err = strconv.Atoi(status)
+		if err != nil {
+			respondShortened(ctx, w, shortenResponse{response: response{"", "redirect_status should be 301, 302, 307 or 308!"}}, http.StatusBadRequest, format)
+			return
+		}
+	}
+	parameters, ok = r.URL.Query()["customname"]
+	if ok {
+		req.CustomName = parameters[0]
+	}
+	resp, code := createLink(ctx, req)
+	respondShortened(ctx, w, resp, code, format)
+}
+
+// POST handler creating a link from a JSON shortenRequest
+func createHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "createHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		// Signed-in users send their ID token
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type, X-Claim-Token")
+		return
+	}
+	format, err := shortenFormatOf(r)
+	if err != nil {
+		respond(ctx, response{"", err.Error() + "!"}, http.StatusBadRequest, w)
+		return
+	}
+	uid, ok := signedInUser(ctx, w, r)
+	if !ok {
+		return
+	}
+	req := shortenRequest{}
+	err = json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req)
 	if err != nil {
-		respond(ctx, response{"", "unable to parse URI. was it encoded?"}, http.StatusBadRequest, w)
+		respondShortened(ctx, w, shortenResponse{response: response{"", "unable to decode request body!"}}, http.StatusBadRequest, format)
 		return
 	}
-	if uri.Scheme != "https" && uri.Scheme != "http" {
-		respond(ctx, response{"", "provided input is not a HTTP/HTTPS URL!"}, http.StatusBadRequest, w)
+	req.URL = strings.TrimSpace(req.URL)
+	if req.URL == "" && len(req.Variants) > 0 {
+		req.URL = req.Variants[0].URL
+	}
+	if req.URL == "" && req.Payload == nil {
+		respondShortened(ctx, w, shortenResponse{response: response{"", "no url to shorten provided!"}}, http.StatusBadRequest, format)
 		return
 	}
+	req.UID = uid
+	req.Registrant = registrant(r, uid)
+	req.ClaimToken = r.Header.Get("X-Claim-Token")
+	req.Hypermedia = hypermedia(w)
+	resp, code := createLink(ctx, req)
+	respondShortened(ctx, w, resp, code, format)
+}
 
-	custom := ""
-	parameters, ok = r.URL.Query()["customname"]
-	if ok {
-		custom = parameters[0]
-		reg, err := regexp.Compile(`^[\w-]{6,}$`)
+// Validate a shorten request and store the new link.
+// Returns the response to send along with its HTTP status code.
+func createLink(ctx context.Context, req shortenRequest) (shortenResponse, int) {
+	ctx, span := tracer.Start(ctx, "createLink")
+	defer span.End()
+	failure := func(message string, code int) (shortenResponse, int) {
+		return shortenResponse{response: response{"", message}}, code
+	}
+	// Failures because the short code is unavailable, distinguished for imports
+	collision := func(reason string, message string, code int) (shortenResponse, int) {
+		return shortenResponse{response: response{"", message}, Error: reason}, code
+	}
+
+	var err error
+	var normalized *normalization
+	if req.Payload != nil {
+		if req.URL != "" || len(req.Variants) > 0 || req.Bandit || req.TrackConversions || req.Media {
+			return failure("payloads can't be combined with a url, variants, conversion tracking or the media viewer!", http.StatusBadRequest)
+		}
+		err = req.Payload.validate()
+		if err != nil {
+			return failure(err.Error()+"!", http.StatusBadRequest)
+		}
+		req.URL = req.Payload.uri()
+	} else {
+		req.URL, normalized, err = checkDestination(req.URL, req.Owner)
 		if err != nil {
-			respond(ctx, response{"", "unable to compile regex"}, http.StatusInternalServerError, w)
+			return destinationFailure(err), http.StatusBadRequest
 		}
+		if contactURL(req.URL) && (len(req.Variants) > 0 || req.TrackConversions || req.Media) {
+			return failure("contact links can't have variants, conversion tracking or the media viewer!", http.StatusBadRequest)
+		}
+	}
 
-		longURL, err := gcsRead(ctx, custom)
-		if longURL != "" {
-			respond(ctx, response{"", "Custom name already registered to another URL!"}, http.StatusBadRequest, w)
-			return
+	if req.CustomName != "" {
+		taken := false
+		if rec, err := linkStorage.read(ctx, req.CustomName, 0); err == nil && len(rec.data) > 0 {
+			existing, err := decodeLink(rec.data)
+			// Expired and consumed links give up their name as far as the reuse policy allows
+			taken = err != nil || existing.retired(clock()).IsZero()
+		}
+		if taken || isReserved(req.CustomName) {
+			return collision("name_taken", "Custom name already registered to another URL!", http.StatusConflict)
 		}
+		if !customNamePattern.MatchString(req.CustomName) {
+			return failure("custom name should be at least 6 alphanumeric characters incl. underscores and dashes!", http.StatusBadRequest)
+		}
+		if !allowAlias(ctx, req.Registrant) {
+			return shortenResponse{response: response{"", "too many custom names registered, try again later!"}, Error: "alias_rate_limited"}, http.StatusTooManyRequests
+		}
+	}
 
-		if !reg.MatchString(custom) {
-			respond(ctx, response{"", "custom name should be at least 6 alphanumeric characters incl. underscores and dashes!"}, http.StatusBadRequest, w)
-			return
+	if len(req.Variants) > 0 || req.Bandit {
+		err = validateVariants(req.Variants)
+		if err != nil {
+			return failure(err.Error()+"!", http.StatusBadRequest)
+		}
+		if req.Bandit && req.NoAnalytics {
+			return failure("bandit mode needs click counts and can't be combined with no_analytics!", http.StatusBadRequest)
+		}
+		req.URL = req.Variants[0].URL
+	}
+	destinations := []string{req.URL}
+	for _, v := range req.Variants {
+		destinations = append(destinations, v.URL)
+	}
+	if req.Payload == nil && harmfulDestination(ctx, destinations...) {
+		return failure("destination domain has a bad reputation!", http.StatusBadRequest)
+	}
+	if req.Payload == nil {
+		if threat := unsafeDestination(ctx, destinations...); threat != "" {
+			return unsafeDestinationFailure(threat), http.StatusBadRequest
+		}
+		if domain := blockedByClaim(ctx, req.ClaimToken, destinations...); domain != "" {
+			return domainClaimedFailure(domain), http.StatusForbidden
+		}
+	}
+	if req.TrackConversions && (req.NoAnalytics || config.SigningSecret == "") {
+		return failure("conversion tracking needs click analytics and a signing secret!", http.StatusBadRequest)
+	}
+	if req.RedirectStatus != 0 && !redirectStatuses[req.RedirectStatus] {
+		return failure("redirect_status should be 301, 302, 307 or 308!", http.StatusBadRequest)
+	}
+	gone, err := newFallback(req.FallbackURL, req.FallbackMessage, req.Owner)
+	if err != nil {
+		return failure(err.Error()+"!", http.StatusBadRequest)
+	}
+	if gone != nil && gone.URL != "" {
+		if harmfulDestination(ctx, gone.URL) {
+			return failure("fallback domain has a bad reputation!", http.StatusBadRequest)
+		}
+		if threat := unsafeDestination(ctx, gone.URL); threat != "" {
+			return unsafeDestinationFailure(threat), http.StatusBadRequest
 		}
 	}
 
-	shortURL, err := shortenURL(ctx, longURL, custom)
+	l := &link{URL: req.URL, MediaViewer: req.Media, Tags: req.Tags, Owner: strings.TrimSpace(req.Owner), UID: req.UID, BurnAfterReading: req.BurnAfterReading, NoAnalytics: req.NoAnalytics, Variants: req.Variants, Bandit: req.Bandit, TrackConversions: req.TrackConversions, Payload: req.Payload, PublicStats: req.PublicStats, RedirectStatus: req.RedirectStatus, Fallback: gone}
+	if req.CustomName != "" && req.Registrant != "" {
+		l.Registrant = registrantID(req.Registrant)
+	}
+	l.Expires, err = parseExpiry(req.Expires, req.TTL, clock())
 	if err != nil {
-		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
-		return
+		return failure("expiry should be a future RFC 3339 time or a positive duration!", http.StatusBadRequest)
 	}
-	respond(ctx, response{shortURL, "url shortened!"}, http.StatusOK, w)
+
+	code, err := shortenURL(ctx, l, req.CustomName)
+	if err == errReservedCode {
+		return collision("code_reserved", "unable to issue a short code for this URL!", http.StatusConflict)
+	}
+	if err == errCodeRetired {
+		return collision("code_retired", "short code was used before and can't be reissued for another URL!", http.StatusConflict)
+	}
+	if err == errCodeTaken {
+		return collision("name_taken", "Custom name already registered to another URL!", http.StatusConflict)
+	}
+	if err == errNoFreeCode {
+		return failure("unable to find a free short code for this URL!", http.StatusServiceUnavailable)
+	}
+	if err != nil {
+		return failure("unable to access GCS!", http.StatusInternalServerError)
+	}
+	if req.CustomName != "" {
+		rememberAlias(req.Registrant, code)
+	}
+	resp := shortenResponse{response: response{shortLink(code), "url shortened!"}, Normalized: normalized}
+	if screenshotsEnabled() && l.webDestination() {
+		err = enqueue(ctx, "screenshot", destinationTask{code, l.URL})
+		if err != nil {
+			slog.Error("unable to queue screenshot", "code", code, "err", err)
+		}
+		resp.ScreenshotURL = screenshotURL(code)
+	}
+	if cloakingEnabled() && l.webDestination() {
+		err = enqueue(ctx, "fingerprint", destinationTask{code, l.URL})
+		if err != nil {
+			slog.Error("unable to queue fingerprint", "code", code, "err", err)
+		}
+	}
+	if config.SigningSecret != "" {
+		resp.ManageToken = manageToken(code, l)
+	}
+	if !l.NoAnalytics {
+		resp.EmbedURL = embedURL(code, l)
+	}
+	if l.Owner != "" && config.SigningSecret != "" {
+		resp.InsightsURL = insightsURL(l.Owner)
+		resp.LinksURL = linksURL(l.Owner)
+	}
+	if len(l.Variants) > 0 && config.SigningSecret != "" {
+		resp.PostbackURL = postbackURL(code)
+	}
+	if !l.Expires.IsZero() {
+		resp.Expires = &l.Expires
+		if config.SigningSecret != "" {
+			if l.Owner != "" {
+				resp.CalendarURL = calendarURL(l.Owner, "")
+			} else if len(l.Tags) > 0 {
+				resp.CalendarURL = calendarURL("", l.Tags[0])
+			}
+		}
+	}
+	if req.Hypermedia {
+		resp.Links = linkRelations(code, l)
+	}
+	return resp, http.StatusOK
 }
 
 // GET handler to lengthen a previously shortened URLS.
-// Upon success, HTTP 302 will be returned to redirect to long URL
+// Upon success, the link's redirect status (REDIRECT_STATUS, 301 by default) will be returned to redirect to long URL.
+// Links which may change with every visit or go away are redirected temporarily.
+// Links which are gone show their fallback, if they have one, instead of the generic error.
+// HEAD answers the same without a body for link checkers and unfurlers, it counts no click and consumes no link.
 func lengthenHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := context.Background()
-	ctx, span := trace.StartSpan(ctx, "lengthenHandler")
+	ctx, span := tracer.Start(ctx, "lengthenHandler")
 	defer span.End()
+	defer recordRedirectLatency(ctx, time.Now())
 	w.Header().Set("Access-Control-Allow-Origin", "*")
 	if r.Method == http.MethodOptions {
 		return
 	}
+	// A HEAD request only resolves the link, it isn't a visit
+	visit := r.Method != http.MethodHead
 	short := mux.Vars(r)["id"]
-	longURL, err := lengthenURL(ctx, short)
+	if isHoneypot(short) {
+		trapScanner(ctx, w, r, short)
+		return
+	}
+	if !allowScanner(ctx, w, r) || !allowRedirect(ctx, w, r, short) {
+		return
+	}
+	l, err := lengthenURL(ctx, short)
+	if err == errAnomalousLink {
+		respond(ctx, response{"", "link is unavailable!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if err == storage.ErrObjectNotExist {
+		if gone := deletedFallback(ctx, short); gone != nil {
+			serveFallback(ctx, w, gone, defaultRedirectStatus())
+			return
+		}
+	}
 	if err != nil {
 		respond(ctx, response{"", "unable to find URL!"}, http.StatusBadRequest, w)
 		return
 	}
-	w.Header().Set("Location", longURL)
-	w.WriteHeader(http.StatusMovedPermanently)
+	if (l.expired(clock()) || !l.Consumed.IsZero()) && l.Fallback != nil {
+		serveFallback(ctx, w, l.Fallback, l.redirectStatus())
+		return
+	}
+	if l.expired(clock()) {
+		respond(ctx, response{"", "link has expired!"}, http.StatusGone, w)
+		return
+	}
+	if !l.Consumed.IsZero() {
+		respond(ctx, response{"", "this link has been consumed!"}, http.StatusGone, w)
+		return
+	}
+	if l.Quarantine == nil && l.webDestination() {
+		l.Quarantine = reputationWarning(ctx, l.URL)
+	}
+	if l.Quarantine == nil && l.webDestination() {
+		l.Quarantine = safeBrowsingWarning(ctx, short, l.URL)
+	}
+	if l.Quarantine != nil && !quarantineConfirmed(r, short, l) {
+		serveQuarantineWarning(ctx, w, short, l)
+		return
+	}
+	status := l.redirectStatus()
+	if l.Quarantine != nil {
+		// The link may be released or removed later, browsers must ask again
+		w.Header().Set("Cache-Control", "no-store")
+		status = temporaryStatus(status)
+	}
+	if l.BurnAfterReading && !visit {
+		// Only the one visit may learn where a one-time link points
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if l.BurnAfterReading {
+		l, err = consumeLink(ctx, short)
+		if err == errLinkConsumed {
+			respond(ctx, response{"", "this link has been consumed!"}, http.StatusGone, w)
+			return
+		}
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		// Browsers must not remember where a one-time link pointed
+		w.Header().Set("Cache-Control", "no-store")
+		status = temporaryStatus(status)
+	}
+	now := clock()
+	if l.Payload != nil {
+		if visit && !l.NoAnalytics {
+			recordClick(newClick(short, r, now))
+		}
+		servePayload(ctx, w, short, l.Payload)
+		return
+	}
+	if l.contact() {
+		if visit && !l.NoAnalytics {
+			recordClick(newClick(short, r, now))
+		}
+		serveContactInterstitial(ctx, w, short, l)
+		return
+	}
+	picked := 0
+	if len(l.Variants) > 0 {
+		picked = pickVariant(ctx, short, l)
+		l.URL = l.Variants[picked].URL
+		// Every visit must be able to land on another variant
+		w.Header().Set("Cache-Control", "no-store")
+		status = temporaryStatus(status)
+	}
+	if l.TrackConversions {
+		if visit {
+			l.URL = withClickID(l.URL, clickID{short, picked, now})
+		}
+		// Each visit carries its own click ID
+		w.Header().Set("Cache-Control", "no-store")
+		status = temporaryStatus(status)
+	}
+	if visit && !l.NoAnalytics {
+		recordClick(newClick(short, r, now))
+	}
+	if l.MediaViewer {
+		if kind := mediaKind(l.URL); kind != "" {
+			serveMediaViewer(ctx, w, l, kind)
+			return
+		}
+	}
+	w.Header().Set("Location", l.URL)
+	w.WriteHeader(status)
 }
 
-// Create a short URL and store the long one in GCS
-func shortenURL(ctx context.Context, long string, code string) (string, error) {
-	ctx, span := trace.StartSpan(ctx, "shortenURL")
+// Create a short code and store the long URL in GCS
+func shortenURL(ctx context.Context, l *link, code string) (string, error) {
+	ctx, span := tracer.Start(ctx, "shortenURL")
 	defer span.End()
-	if code == "" {
-		code = generateShortCode(ctx, long)
+	custom := code
+	now := clock()
+	l.Created = now.UTC()
+	outbox := l.Outbox
+	var salt uint32
+	nextSalt := func() {
+		if salt+1 < derivedCodes {
+			salt++
+			return
+		}
+		random := make([]byte, 4)
+		rand.Read(random)
+		salt = binary.LittleEndian.Uint32(random)
+	}
+	// The same link shortened before is handed out again, even if its code had to be salted
+	if custom == "" && !randomCodes() {
+		if indexed, existing, err := indexedCode(ctx, l.URL); err == nil && indexed != "" && l.sameAs(existing) {
+			return indexed, nil
+		}
 	}
+	for attempt := 0; attempt < maxCodeAttempts; attempt++ {
+		if custom == "" && randomCodes() {
+			code = randomShortCode(ctx)
+		} else if custom == "" {
+			code = generateShortCode(ctx, l.URL, salt)
+		}
+		if isReserved(code) {
+			if custom != "" {
+				return "", errReservedCode
+			}
+			nextSalt()
+			continue
+		}
+		rec, err := linkStorage.read(ctx, code, 0)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return "", err
+		}
+		var generation int64
+		if err == nil {
+			existing, err := decodeLink(rec.data)
+			if err != nil || existing.retired(now).IsZero() {
+				if custom != "" {
+					return "", errCodeTaken
+				}
+				// Random codes are never shared, even for the same link
+				if err == nil && !randomCodes() && l.sameAs(existing) {
+					return code, nil
+				}
+				if err != nil {
+					slog.Warn("short code taken by an unreadable record, deriving a new one", "code", code, "err", err)
+				} else if existing.URL != l.URL {
+					slog.Info("short code collision, deriving a new one", "code", code, "url", l.URL, "existing", existing.URL)
+				}
+				nextSalt()
+				continue
+			}
+			generation = rec.generation
+		}
+		err = checkCodeReuse(ctx, code, l.URL, now)
+		if err == errCodeRetired && custom == "" {
+			nextSalt()
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
 
-	err := gcsWrite(ctx, code, long)
-	if err != nil {
-		return "", err
+		l.Outbox = outbox
+		l.emit(eventLinkCreated, code, l.eventData())
+		err = indexOwner(ctx, code, l)
+		if err != nil {
+			return "", err
+		}
+		err = writeLinkIfGeneration(ctx, code, l, generation)
+		if isPreconditionFailed(err) {
+			if custom != "" {
+				return "", errCodeTaken
+			}
+			// Written concurrently, look at the same code again
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		err = indexLink(ctx, code, l)
+		if err != nil {
+			slog.Error("unable to index link", "code", code, "err", err)
+		}
+		broadcast(eventLinkCreated, code, l)
+		return code, nil
 	}
+	return "", errNoFreeCode
+}
 
-	return fmt.Sprintf("https://%s/%s", os.Getenv("DOMAIN"), code), nil
+// Public short URL for a short code
+func shortLink(code string) string {
+	return fmt.Sprintf("https://%s/%s", config.Domain, code)
 }
 
-// Recreate the full URL from the short code by reading from GCS
-func lengthenURL(ctx context.Context, short string) (string, error) {
-	ctx, span := trace.StartSpan(ctx, "lengthenURL")
+// Recreate the full URL from the short code by reading from the link store.
+// Objects which don't hold a sane HTTP(S) link are flagged and never redirected to.
+func lengthenURL(ctx context.Context, short string) (*link, error) {
+	ctx, span := tracer.Start(ctx, "lengthenURL")
 	defer span.End()
-	return gcsRead(ctx, short)
+	rec, err := readForRedirect(ctx, short, maxLinkObjectSize+1)
+	if err != nil {
+		return nil, err
+	}
+	record(ctx, nil, linkObjectSize.M(rec.size))
+	l, kind := inspectLink(rec.data, rec.size)
+	if kind != "" {
+		flagAnomaly(ctx, short, kind, rec.size)
+		return nil, errAnomalousLink
+	}
+	return l, nil
+}
+
+// Shared GCS client, connected on first use and replaced after connection errors
+var (
+	gcsMutex  sync.Mutex
+	gcsShared *storage.Client
+)
+
+// Primitive returning the shared GCS client, connecting if there is none (yet).
+// It outlives requests, so it doesn't take their context. A failed connection isn't remembered.
+func gcsClient() (*storage.Client, error) {
+	gcsMutex.Lock()
+	defer gcsMutex.Unlock()
+	if gcsShared == nil {
+		client, err := newGCSClient(context.Background())
+		if err != nil {
+			return nil, err
+		}
+		gcsShared = client
+	}
+	return gcsShared, nil
+}
+
+// Primitive passing through the result of a GCS call, dropping the shared client on connection errors
+// so the next call reconnects. The dropped client is closed once in-flight calls had time to finish.
+func gcsCheck(client *storage.Client, err error) error {
+	var netErr net.Error
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) || !errors.As(err, &netErr) {
+		return err
+	}
+	gcsMutex.Lock()
+	defer gcsMutex.Unlock()
+	if gcsShared == client {
+		slog.Warn("dropping GCS client after connection error", "err", err)
+		gcsShared = nil
+		time.AfterFunc(time.Minute, func() { client.Close() })
+	}
+	return err
 }
 
-// Primitive to write an arbitrary string to a GCS object
-func gcsWrite(ctx context.Context, short string, url string) error {
-	ctx, span := trace.StartSpan(ctx, "gcsWrite")
+// Primitive to delete a GCS object
+func gcsDelete(ctx context.Context, name string) error {
+	ctx, span := tracer.Start(ctx, "gcsDelete")
 	defer span.End()
+	countOperation(opDelete, 1)
+	if localBucket != nil {
+		return localBucket.delete(name)
+	}
 
-	client, err := storage.NewClient(ctx)
+	client, err := gcsClient()
 	if err != nil {
 		return err
 	}
 
-	bucket := client.Bucket(os.Getenv("BUCKET"))
-	object := bucket.Object(short)
-	writer := object.NewWriter(ctx)
+	return gcsCheck(client, client.Bucket(config.Bucket).Object(name).Delete(ctx))
+}
 
-	_, err = fmt.Fprintf(writer, url)
+// Primitive to write binary content with a content type to a GCS object
+func gcsWriteBlob(ctx context.Context, name string, contentType string, data []byte) error {
+	ctx, span := tracer.Start(ctx, "gcsWriteBlob")
+	defer span.End()
+	countOperation(opWrite, 1)
+	if localBucket != nil {
+		return localBucket.write(name, contentType, data, anyGeneration)
+	}
+
+	client, err := gcsClient()
 	if err != nil {
 		return err
 	}
 
-	err = writer.Close()
+	writer := client.Bucket(config.Bucket).Object(name).NewWriter(ctx)
+	writer.ContentType = contentType
+	_, err = writer.Write(data)
 	if err != nil {
-		return err
+		writer.Close()
+		return gcsCheck(client, err)
+	}
+	return gcsCheck(client, writer.Close())
+}
+
+// Primitive to read binary content and its content type from a GCS object
+func gcsReadBlob(ctx context.Context, name string) ([]byte, string, error) {
+	ctx, span := tracer.Start(ctx, "gcsReadBlob")
+	defer span.End()
+	countOperation(opRead, 1)
+	if localBucket != nil {
+		data, contentType, _, err := localBucket.read(name)
+		return data, contentType, err
 	}
 
-	err = client.Close()
+	client, err := gcsClient()
 	if err != nil {
-		return err
+		return nil, "", err
+	}
+
+	reader, err := client.Bucket(config.Bucket).Object(name).NewReader(ctx)
+	if err != nil {
+		return nil, "", gcsCheck(client, err)
 	}
+	defer reader.Close()
 
-	return nil
+	buffer := new(bytes.Buffer)
+	_, err = buffer.ReadFrom(reader)
+	if err != nil {
+		return nil, "", gcsCheck(client, err)
+	}
+	return buffer.Bytes(), reader.Attrs.ContentType, nil
 }
 
-// Primitive to read an arbitrary string from a GCS object
-func gcsRead(ctx context.Context, short string) (string, error) {
-	ctx, span := trace.StartSpan(ctx, "gcsRead")
+// Primitive to read a GCS object together with its generation
+func gcsReadGeneration(ctx context.Context, name string) (string, int64, error) {
+	ctx, span := tracer.Start(ctx, "gcsReadGeneration")
 	defer span.End()
-	client, err := storage.NewClient(ctx)
-	if err != nil {
-		return "", err
+	countOperation(opRead, 1)
+	if localBucket != nil {
+		data, _, generation, err := localBucket.read(name)
+		return string(data), generation, err
 	}
 
-	bucket := client.Bucket(os.Getenv("BUCKET"))
-	object := bucket.Object(short)
+	client, err := gcsClient()
+	if err != nil {
+		return "", 0, err
+	}
 
-	reader, err := object.NewReader(ctx)
+	reader, err := client.Bucket(config.Bucket).Object(name).NewReader(ctx)
 	if err != nil {
-		return "", err
+		return "", 0, gcsCheck(client, err)
 	}
+	defer reader.Close()
 
 	buffer := new(bytes.Buffer)
-	buffer.ReadFrom(reader)
+	_, err = buffer.ReadFrom(reader)
+	if err != nil {
+		return "", 0, gcsCheck(client, err)
+	}
+	return buffer.String(), reader.Attrs.Generation, nil
+}
+
+// Primitive to replace a GCS object only if it is still at the given generation
+func gcsWriteIfGeneration(ctx context.Context, name string, contentType string, data []byte, generation int64) error {
+	ctx, span := tracer.Start(ctx, "gcsWriteIfGeneration")
+	defer span.End()
+	countOperation(opWrite, 1)
+	if localBucket != nil {
+		return localBucket.write(name, contentType, data, generation)
+	}
 
-	err = reader.Close()
+	client, err := gcsClient()
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	// Generation 0 stands for an object which doesn't exist yet
+	conditions := storage.Conditions{GenerationMatch: generation}
+	if generation == 0 {
+		conditions = storage.Conditions{DoesNotExist: true}
+	}
+	object := client.Bucket(config.Bucket).Object(name).If(conditions)
+	writer := object.NewWriter(ctx)
+	writer.ContentType = contentType
+	_, err = writer.Write(data)
+	if err != nil {
+		writer.Close()
+		return gcsCheck(client, err)
+	}
+	return gcsCheck(client, writer.Close())
+}
+
+// Report whether a conditional write failed because its precondition didn't hold
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.Is(err, errWriteConflict) || errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// Primitive to visit the names of the short code objects in the bucket after a name, all of them after "".
+// Auxiliary objects live under prefixes (e.g. screenshots/) and are skipped.
+func gcsListCodes(ctx context.Context, after string, visit func(name string) error) error {
+	return gcsList(ctx, &storage.Query{Delimiter: "/", StartOffset: after}, func(name string) error {
+		// The offset itself is included
+		if name <= after {
+			return nil
+		}
+		return visit(name)
+	})
+}
+
+// Primitive to visit the names of all objects below a prefix
+func gcsListPrefix(ctx context.Context, prefix string, visit func(name string) error) error {
+	return gcsList(ctx, &storage.Query{Prefix: prefix}, visit)
+}
+
+// Primitive to visit the names of the objects below a prefix after a name
+func gcsListPrefixAfter(ctx context.Context, prefix string, after string, visit func(name string) error) error {
+	return gcsList(ctx, &storage.Query{Prefix: prefix, StartOffset: after}, func(name string) error {
+		// The offset itself is included
+		if name <= after {
+			return nil
+		}
+		return visit(name)
+	})
+}
+
+// Primitive to visit the names of all objects matching a query
+func gcsList(ctx context.Context, query *storage.Query, visit func(name string) error) error {
+	ctx, span := tracer.Start(ctx, "gcsList")
+	defer span.End()
+	// One operation per page of up to 1000 objects
+	var listed int64
+	defer func() { countOperation(opList, 1+listed/1000) }()
+	if localBucket != nil {
+		return localBucket.list(query.Prefix, query.Delimiter, visit)
 	}
 
-	err = client.Close()
+	client, err := gcsClient()
 	if err != nil {
-		return "", err
+		return err
 	}
 
-	return buffer.String(), nil
+	objects := client.Bucket(config.Bucket).Objects(ctx, query)
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return gcsCheck(client, err)
+		}
+		listed++
+		if attrs.Name == "" {
+			continue
+		}
+		err = visit(attrs.Name)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Report whether codes are drawn at random instead of derived from the URL (CODE_GENERATION=random),
+// so they can't be guessed from a known URL and every request gets a code of its own
+func randomCodes() bool {
+	return config.CodeGeneration == "random"
+}
+
+// Create a URL-friendly short code from RANDOM_CODE_BYTES random bytes
+func randomShortCode(ctx context.Context) string {
+	ctx, span := tracer.Start(ctx, "randomShortCode")
+	defer span.End()
+	size := config.RandomCodeBytes
+	if size < minRandomCodeBytes {
+		size = defaultRandomCodeBytes
+	}
+	random := make([]byte, size)
+	rand.Read(random)
+	return base58.Encode(random)
 }
 
 // Create a URL-friendly short code with a dense name
-func generateShortCode(ctx context.Context, url string) string {
-	ctx, span := trace.StartSpan(ctx, "generateShortCode")
+func generateShortCode(ctx context.Context, url string, salt uint32) string {
+	ctx, span := tracer.Start(ctx, "generateShortCode")
 	defer span.End()
-	crc32 := crc32.ChecksumIEEE([]byte(url))
+	data := []byte(url)
+	if salt > 0 {
+		// URLs never contain a NUL byte, so salted input can't be another URL
+		data = append(data, 0)
+		data = append(data, make([]byte, 4)...)
+		binary.LittleEndian.PutUint32(data[len(data)-4:], salt)
+	}
+	crc32 := crc32.ChecksumIEEE(data)
 	num := make([]byte, 4)
 	binary.LittleEndian.PutUint32(num, crc32)
 	code := base58.Encode(num)
 	return code
 }
 
-// Respond to all HTTP requests
-func respond(ctx context.Context, resp response, code int, writer http.ResponseWriter) {
-	ctx, span := trace.StartSpan(ctx, "respond")
+// Respond to all HTTP requests.
+// Errors are rendered as HTML pages for browsers and as JSON for everybody else.
+func respond(ctx context.Context, resp interface{}, code int, writer http.ResponseWriter) {
+	ctx, span := tracer.Start(ctx, "respond")
 	defer span.End()
+	if negotiated, ok := writer.(*negotiatedWriter); ok && negotiated.html && code >= http.StatusBadRequest {
+		if m, ok := resp.(messenger); ok {
+			err := writeErrorPage(writer, m.message(), code)
+			if err != nil {
+				slog.Error("unable to render error page", "err", err)
+			}
+			return
+		}
+	}
+	if hypermedia(writer) && code < http.StatusBadRequest && writer.Header().Get("Content-Type") == "application/json" {
+		writer.Header().Set("Content-Type", halType)
+	}
 	marshalled, err := json.Marshal(resp)
 	if err != nil {
-		log.Println(err)
+		slog.Error("unable to marshal response", "err", err)
 	}
 	writer.WriteHeader(code)
 	writer.Write(marshalled)
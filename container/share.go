@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// How long shared stats stay readable by default, and at most
+const (
+	defaultShareTTL = 7 * 24 * time.Hour
+	maxShareTTL     = 90 * 24 * time.Hour
+)
+
+// struct shareResponse holds the signed URLs of shared stats.
+type shareResponse struct {
+	response
+	// Stats widget page, e.g. to send to stakeholders
+	WidgetURL string `json:"widget_url"`
+	// Stats as JSON
+	StatsURL string    `json:"stats_url"`
+	Expires  time.Time `json:"expires"`
+}
+
+// Subject signed for read-only access to the stats of a link until exp.
+// It includes the creation time, so shares don't carry over to a later link reusing the code.
+func shareSubject(code string, l *link, exp time.Time) string {
+	return fmt.Sprintf("share:%s:%d:%d", code, l.Created.UnixNano(), exp.Unix())
+}
+
+// Report whether a request carries an unexpired share of the link's stats (?exp= and ?sig=)
+func sharedStats(r *http.Request, code string, l *link) bool {
+	exp, err := strconv.ParseInt(r.URL.Query().Get("exp"), 10, 64)
+	if err != nil || !clock().Before(time.Unix(exp, 0)) {
+		return false
+	}
+	return verifySignature(shareSubject(code, l, time.Unix(exp, 0)), r.URL.Query().Get("sig"))
+}
+
+// POST handler sharing the stats of a link read-only with people who can't manage it, for its managers.
+// The signed URLs expire after ?ttl= (e.g. 72h, 7 days by default, at most 90 days) and can't be revoked.
+func shareStatsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "shareStatsHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		return
+	}
+	if config.SigningSecret == "" {
+		respond(ctx, response{"", "sharing stats needs a SIGNING_SECRET!"}, http.StatusNotImplemented, w)
+		return
+	}
+	ttl := defaultShareTTL
+	if raw := r.URL.Query().Get("ttl"); raw != "" {
+		var err error
+		ttl, err = time.ParseDuration(raw)
+		if err != nil || ttl <= 0 || ttl > maxShareTTL {
+			respond(ctx, response{"", "ttl should be a duration of at most 2160h!"}, http.StatusBadRequest, w)
+			return
+		}
+	}
+	code := mux.Vars(r)["id"]
+	l, ok := readManagedLink(ctx, w, r, code)
+	if !ok {
+		return
+	}
+	if l.NoAnalytics {
+		respond(ctx, response{"", "link doesn't collect clicks!"}, http.StatusNotFound, w)
+		return
+	}
+
+	exp := clock().Add(ttl).UTC().Truncate(time.Second)
+	query := url.Values{}
+	query.Set("exp", strconv.FormatInt(exp.Unix(), 10))
+	query.Set("sig", sign(shareSubject(code, l, exp)))
+	respond(ctx, shareResponse{
+		response:  response{shortLink(code), fmt.Sprintf("stats shared until %s!", exp.Format(time.RFC3339))},
+		WidgetURL: fmt.Sprintf("https://%s/%s/widget?%s", config.Domain, code, query.Encode()),
+		StatsURL:  fmt.Sprintf("https://%s/api/v1/links/%s/stats?%s", config.Domain, code, query.Encode()),
+		Expires:   exp,
+	}, http.StatusOK, w)
+}
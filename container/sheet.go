@@ -0,0 +1,226 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+)
+
+// Upper bound of codes rendered onto a single sheet
+const maxSheetCodes = 120
+
+// Layout of PNG sheets in pixels
+const (
+	sheetColumns  = 4
+	sheetQRSize   = 256
+	sheetCellSize = 300
+	sheetLabel    = 40
+)
+
+// Error returned when a sheet would exceed maxSheetCodes
+var errSheetTooLarge = fmt.Errorf("a sheet can hold at most %d codes", maxSheetCodes)
+
+// GET handler rendering a printable sheet of QR codes for a bundle of links.
+// The bundle is either an explicit comma separated list (codes=) or all links carrying a tag (tag=).
+func sheetHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "sheetHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+
+	list, tag := r.URL.Query().Get("codes"), r.URL.Query().Get("tag")
+	// Tag sheets scan the store, so only admins and signed-in users (for their own links) may ask for them
+	uid, admin := "", false
+	if list == "" && tag != "" {
+		var ok bool
+		uid, ok = signedInUser(ctx, w, r)
+		if !ok {
+			return
+		}
+		admin = isAdmin(r)
+		if !admin && uid == "" {
+			w.Header().Set("Content-Type", "application/json")
+			unauthorized(ctx, w, "user", authRequired, "admin token or ID token required for tag sheets!")
+			return
+		}
+	}
+	codes, err := sheetCodes(ctx, list, tag, uid, admin)
+	if err == errSheetTooLarge {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", err.Error()}, http.StatusBadRequest, w)
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if len(codes) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "no links found for this bundle!"}, http.StatusNotFound, w)
+		return
+	}
+
+	var sheet []byte
+	contentType := "image/png"
+	switch r.URL.Query().Get("format") {
+	case "", "png":
+		sheet, err = renderSheetPNG(ctx, codes)
+	case "pdf":
+		contentType = "application/pdf"
+		sheet, err = renderSheetPDF(ctx, codes)
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "format should be png or pdf!"}, http.StatusBadRequest, w)
+		return
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "unable to render sheet!"}, http.StatusInternalServerError, w)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Write(sheet)
+}
+
+// Resolve the codes making up a bundle. Explicit lists are checked against maxSheetCodes before anything is read.
+// Tag bundles hold the links of a user, all links for admins.
+func sheetCodes(ctx context.Context, list string, tag string, uid string, admin bool) ([]string, error) {
+	ctx, span := tracer.Start(ctx, "sheetCodes")
+	defer span.End()
+	if list != "" {
+		requested := []string{}
+		for _, code := range strings.Split(list, ",") {
+			code = strings.TrimSpace(code)
+			if code != "" {
+				requested = append(requested, code)
+			}
+		}
+		if len(requested) > maxSheetCodes {
+			return nil, errSheetTooLarge
+		}
+		codes := []string{}
+		for _, code := range requested {
+			_, err := readLink(ctx, code)
+			if err != nil {
+				continue
+			}
+			codes = append(codes, code)
+		}
+		return codes, nil
+	}
+	tag = strings.ToLower(strings.TrimSpace(tag))
+	if tag == "" {
+		return nil, nil
+	}
+	codes := []string{}
+	err := linkStorage.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil || !l.hasTag(tag) || (!admin && l.UID != uid) {
+			return nil
+		}
+		if len(codes) == maxSheetCodes {
+			return errSheetTooLarge
+		}
+		codes = append(codes, code)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// Lay out QR codes with their short URLs as a single PNG image
+func renderSheetPNG(ctx context.Context, codes []string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "renderSheetPNG")
+	defer span.End()
+	columns := sheetColumns
+	if len(codes) < columns {
+		columns = len(codes)
+	}
+	rows := (len(codes) + columns - 1) / columns
+	sheet := image.NewRGBA(image.Rect(0, 0, columns*sheetCellSize, rows*(sheetCellSize+sheetLabel)))
+	draw.Draw(sheet, sheet.Bounds(), image.White, image.Point{}, draw.Src)
+
+	drawer := &font.Drawer{Dst: sheet, Src: image.NewUniform(color.Black), Face: basicfont.Face7x13}
+	for i, code := range codes {
+		qr, err := qrImage(code, sheetQRSize)
+		if err != nil {
+			return nil, err
+		}
+		x := (i % columns) * sheetCellSize
+		y := (i / columns) * (sheetCellSize + sheetLabel)
+		offset := (sheetCellSize - sheetQRSize) / 2
+		draw.Draw(sheet, image.Rect(x+offset, y+offset, x+offset+sheetQRSize, y+offset+sheetQRSize), qr, image.Point{}, draw.Src)
+
+		label := strings.TrimPrefix(shortLink(code), "https://")
+		width := drawer.MeasureString(label).Ceil()
+		drawer.Dot = fixed.P(x+(sheetCellSize-width)/2, y+sheetCellSize+sheetLabel/2)
+		drawer.DrawString(label)
+	}
+
+	buffer := new(bytes.Buffer)
+	err := png.Encode(buffer, sheet)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+// Lay out QR codes with their short URLs on A4 pages
+func renderSheetPDF(ctx context.Context, codes []string) ([]byte, error) {
+	ctx, span := tracer.Start(ctx, "renderSheetPDF")
+	defer span.End()
+	const (
+		columns = 3
+		rows    = 4
+		margin  = 15.0
+		cellW   = (210 - 2*margin) / columns
+		cellH   = (297 - 2*margin) / rows
+		qrSize  = 50.0
+	)
+	pdf := gofpdf.New("P", "mm", "A4", "")
+	pdf.SetAutoPageBreak(false, 0)
+	pdf.SetFont("Helvetica", "", 10)
+	for i, code := range codes {
+		if i%(columns*rows) == 0 {
+			pdf.AddPage()
+		}
+		image, err := qrPNG(code, 512)
+		if err != nil {
+			return nil, err
+		}
+		options := gofpdf.ImageOptions{ImageType: "PNG"}
+		pdf.RegisterImageOptionsReader(code, options, bytes.NewReader(image))
+		slot := i % (columns * rows)
+		x := margin + float64(slot%columns)*cellW
+		y := margin + float64(slot/columns)*cellH
+		pdf.ImageOptions(code, x+(cellW-qrSize)/2, y+5, qrSize, qrSize, false, options, 0, "")
+		pdf.SetXY(x, y+qrSize+8)
+		pdf.CellFormat(cellW, 6, strings.TrimPrefix(shortLink(code), "https://"), "", 0, "C", false, 0, "")
+	}
+	if pdf.Err() {
+		return nil, pdf.Error()
+	}
+	buffer := new(bytes.Buffer)
+	err := pdf.Output(buffer)
+	if err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"contrib.go.opencensus.io/exporter/stackdriver"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// How long in-flight requests may take to finish after SIGTERM by default.
+// Cloud Run kills instances 10 seconds after SIGTERM, the rest is left for flushing.
+const defaultShutdownTimeout = 7 * time.Second
+
+// How long flushing pending clicks and counts may take before exiting
+const shutdownFlushTimeout = 2 * time.Second
+
+// Time in-flight requests get to finish, SHUTDOWN_TIMEOUT or 7s
+func shutdownTimeout() time.Duration {
+	d := config.ShutdownTimeout
+	if d <= 0 {
+		return defaultShutdownTimeout
+	}
+	return d
+}
+
+// Serve HTTP until SIGTERM or SIGINT, then stop accepting connections, drain in-flight requests
+// and flush whatever this instance still holds in memory before returning.
+func serve(exporter *stackdriver.Exporter, tracing *sdktrace.TracerProvider) {
+	server := &http.Server{Addr: fmt.Sprintf(":%s", config.Port)}
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, syscall.SIGINT)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-failed:
+		fatal("server failed", "err", err)
+	case sig := <-stop:
+		slog.Info("draining connections", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout())
+	defer cancel()
+	// Hijacked connections aren't drained by the server
+	closeLiveSessions()
+	err := server.Shutdown(ctx)
+	if err != nil {
+		slog.Error("unable to drain all connections", "err", err)
+	}
+	flushOnShutdown()
+	flushCtx, cancelFlush := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+	defer cancelFlush()
+	err = tracing.Shutdown(flushCtx)
+	if err != nil {
+		slog.Error("unable to export all spans", "err", err)
+	}
+	if exporter != nil {
+		exporter.Flush()
+		exporter.StopMetricsExporter()
+	}
+	slog.Info("shut down")
+}
+
+// Store the clicks, counts and changes which are only kept in memory until the next periodic flush
+func flushOnShutdown() {
+	ctx, cancel := context.WithTimeout(context.Background(), shutdownFlushTimeout)
+	defer cancel()
+	ctx, span := tracer.Start(ctx, "flushOnShutdown")
+	defer span.End()
+	flushClicks(ctx)
+	flushBandits(ctx)
+	if feedEnabled() {
+		flushChanges(ctx)
+	}
+	flushUsage(ctx)
+	flushStatus(ctx)
+}
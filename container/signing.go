@@ -0,0 +1,22 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+)
+
+// Sign an arbitrary value with the deployment's SIGNING_SECRET
+func sign(value string) string {
+	mac := hmac.New(sha256.New, []byte(config.SigningSecret))
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// Check a signature previously created with sign in constant time
+func verifySignature(value string, signature string) bool {
+	if config.SigningSecret == "" {
+		return false
+	}
+	return hmac.Equal([]byte(sign(value)), []byte(signature))
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Days of recent traffic simulations look at by default, and at most
+const (
+	defaultSimulationDays = 7
+	maxSimulationDays     = 90
+)
+
+// struct simulationRequest is a proposed policy change to try out against existing links.
+type simulationRequest struct {
+	// Managed domain lists replacing the current ones, as for PUT /admin/domains
+	Domains *domainLists `json:"domains,omitempty"`
+	// Custom names per minute and burst per registrant, as ALIAS_RATE_LIMIT and ALIAS_BURST
+	AliasRateLimit int `json:"alias_rate_limit,omitempty"`
+	AliasBurst     int `json:"alias_burst,omitempty"`
+	// Days of recent traffic and registrations to look at
+	Days int `json:"days,omitempty"`
+}
+
+// struct affectedLink is a link the proposed domain lists would have rejected.
+type affectedLink struct {
+	Code string `json:"code"`
+	URL  string `json:"url"`
+	// domain_blocked or domain_not_allowed
+	Reason string `json:"reason"`
+	// Clicks within the simulated days
+	Clicks  int64     `json:"clicks"`
+	Created time.Time `json:"created,omitempty"`
+}
+
+// struct domainSimulation sums up the effect of proposed domain lists.
+type domainSimulation struct {
+	Affected []affectedLink `json:"affected"`
+	// Affected links created within the simulated days, which would have been rejected
+	RecentlyCreated int `json:"recently_created"`
+	// Clicks on affected links within the simulated days
+	Clicks int64 `json:"clicks"`
+}
+
+// struct throttledRegistrant is a registrant the proposed alias throttling would have slowed down.
+type throttledRegistrant struct {
+	// Hash of the registrant, as in squatting reports
+	ID string `json:"id"`
+	// Custom names which would have been rejected
+	Rejected []string `json:"rejected"`
+	// Custom names registered within the simulated days
+	Registered int `json:"registered"`
+}
+
+// struct aliasSimulation sums up the effect of proposed alias throttling.
+type aliasSimulation struct {
+	Throttled []throttledRegistrant `json:"throttled"`
+	// Custom names registered within the simulated days, and how many would have been rejected
+	Registrations int `json:"registrations"`
+	Rejected      int `json:"rejected"`
+}
+
+// struct simulationResponse reports what a proposed change would affect.
+type simulationResponse struct {
+	response
+	From time.Time `json:"from"`
+	// Links looked at
+	Scanned int               `json:"scanned"`
+	Domains *domainSimulation `json:"domains,omitempty"`
+	Aliases *aliasSimulation  `json:"aliases,omitempty"`
+}
+
+// struct registration is a custom name registered by a registrant.
+type registration struct {
+	code       string
+	registrant string
+	created    time.Time
+}
+
+// Check a link's destinations against domain lists, returning the reason it would be rejected
+func domainListsReason(l *link, lists ...domainLists) string {
+	destinations := []string{l.URL}
+	for _, v := range l.Variants {
+		destinations = append(destinations, v.URL)
+	}
+	for _, destination := range destinations {
+		uri, err := url.Parse(destination)
+		if err != nil || uri.Host == "" {
+			continue
+		}
+		err = checkHostAgainst(strings.TrimSuffix(strings.ToLower(uri.Hostname()), "."), lists...)
+		var rejection *schemeError
+		if errors.As(err, &rejection) {
+			return rejection.Code
+		}
+	}
+	return ""
+}
+
+// Replay the custom names registered since from through the proposed throttling, in the order they were registered
+func simulateAliases(registrations []registration, rate int, burst int) *aliasSimulation {
+	if burst <= 0 {
+		burst = defaultAliasBurst
+	}
+	// Without newLimiter, which sweeps in the background for as long as the process runs
+	proposed := &limiter{rate: float64(rate) / 60, burst: float64(burst), buckets: map[string]*tokenBucket{}}
+	sort.Slice(registrations, func(i, j int) bool { return registrations[i].created.Before(registrations[j].created) })
+	sim := &aliasSimulation{Throttled: []throttledRegistrant{}, Registrations: len(registrations)}
+	byRegistrant := map[string]*throttledRegistrant{}
+	for _, reg := range registrations {
+		t, ok := byRegistrant[reg.registrant]
+		if !ok {
+			t = &throttledRegistrant{ID: reg.registrant, Rejected: []string{}}
+			byRegistrant[reg.registrant] = t
+		}
+		t.Registered++
+		if !proposed.allow(reg.registrant, reg.created) {
+			t.Rejected = append(t.Rejected, reg.code)
+			sim.Rejected++
+		}
+	}
+	for _, t := range byRegistrant {
+		if len(t.Rejected) > 0 {
+			sim.Throttled = append(sim.Throttled, *t)
+		}
+	}
+	sort.Slice(sim.Throttled, func(i, j int) bool { return len(sim.Throttled[i].Rejected) > len(sim.Throttled[j].Rejected) })
+	return sim
+}
+
+// Admin handler simulating a policy change against existing links and recent traffic without applying it.
+// Takes {"domains": {"blocklist", "allowlist"}} to try managed domain lists, {"alias_rate_limit", "alias_burst"}
+// to try alias throttling, or both, and {"days"} of recent traffic to look at.
+func simulationHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "simulationHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	req := simulationRequest{}
+	err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req)
+	if err != nil {
+		respond(ctx, response{"", "unable to decode request body!"}, http.StatusBadRequest, w)
+		return
+	}
+	if req.Domains == nil && req.AliasRateLimit <= 0 {
+		respond(ctx, response{"", "nothing to simulate, pass domains and/or alias_rate_limit!"}, http.StatusBadRequest, w)
+		return
+	}
+	if req.Days == 0 {
+		req.Days = defaultSimulationDays
+	}
+	if req.Days < 0 || req.Days > maxSimulationDays {
+		respond(ctx, response{"", fmt.Sprintf("days should be between 1 and %d!", maxSimulationDays)}, http.StatusBadRequest, w)
+		return
+	}
+	var proposed domainLists
+	if req.Domains != nil {
+		proposed = req.Domains.normalized()
+		if pattern := proposed.invalidPattern(); pattern != "" {
+			respond(ctx, response{"", "invalid pattern " + pattern + "!"}, http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	now := clock().UTC()
+	from := now.Add(-time.Duration(req.Days) * 24 * time.Hour)
+	resp := simulationResponse{From: from}
+	if req.Domains != nil {
+		resp.Domains = &domainSimulation{Affected: []affectedLink{}}
+	}
+	configured, current := configuredDomains(), currentManagedDomains()
+	registrations := []registration{}
+	err = linkStorage.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil {
+			return nil
+		}
+		resp.Scanned++
+		if l.Registrant != "" && l.Created.After(from) {
+			registrations = append(registrations, registration{code, l.Registrant, l.Created})
+		}
+		if resp.Domains == nil || !l.retired(now).IsZero() || !l.webDestination() {
+			return nil
+		}
+		reason := domainListsReason(l, configured, proposed)
+		// Links the current lists would reject already aren't news
+		if reason == "" || domainListsReason(l, configured, current) != "" {
+			return nil
+		}
+		affected := affectedLink{Code: code, URL: l.URL, Reason: reason, Created: l.Created}
+		rollups, err := readRollups(ctx, code, from, now)
+		if err != nil {
+			return err
+		}
+		for _, rollup := range rollups {
+			affected.Clicks += rollup.Clicks
+		}
+		resp.Domains.Affected = append(resp.Domains.Affected, affected)
+		resp.Domains.Clicks += affected.Clicks
+		if l.Created.After(from) {
+			resp.Domains.RecentlyCreated++
+		}
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	summary := []string{}
+	if resp.Domains != nil {
+		sort.Slice(resp.Domains.Affected, func(i, j int) bool { return resp.Domains.Affected[i].Clicks > resp.Domains.Affected[j].Clicks })
+		summary = append(summary, fmt.Sprintf("%d links would be rejected by the domain lists", len(resp.Domains.Affected)))
+	}
+	if req.AliasRateLimit > 0 {
+		resp.Aliases = simulateAliases(registrations, req.AliasRateLimit, req.AliasBurst)
+		summary = append(summary, fmt.Sprintf("%d of %d custom names would be throttled", resp.Aliases.Rejected, resp.Aliases.Registrations))
+	}
+	resp.Message = strings.Join(summary, ", ")
+	respond(ctx, resp, http.StatusOK, w)
+}
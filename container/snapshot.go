@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Objects of published snapshots
+const (
+	snapshotManifest = "snapshots/manifest.json"
+	snapshotPrefix   = "snapshots/links-"
+)
+
+// First bytes of an uncompressed snapshot, versioning the format
+const snapshotMagic = "UWSNAP1\n"
+
+// Error of snapshot files which are cut short or not snapshots at all
+var errBadSnapshot = errors.New("malformed snapshot")
+
+// struct snapshotInfo points edges to the latest published snapshot.
+type snapshotInfo struct {
+	Object    string    `json:"object"`
+	Links     int       `json:"links"`
+	Published time.Time `json:"published"`
+	// Latest change feed entry before the links were read
+	Sequence int64 `json:"sequence,omitempty"`
+}
+
+// Publish a snapshot of all links every SNAPSHOT_PUBLISH_INTERVAL for redirect-only instances to download
+func startSnapshotPublisher() {
+	interval := config.SnapshotPublishInterval
+	if interval <= 0 {
+		return
+	}
+	startSingleton("publish-snapshot", interval, publishSnapshot)
+}
+
+// Write all links into a new compressed snapshot, point the manifest at it and remove outdated ones.
+// The previous snapshot is kept for edges still downloading it.
+func publishSnapshot(ctx context.Context) error {
+	ctx, span := tracer.Start(ctx, "publishSnapshot")
+	defer span.End()
+	seq, err := readFeedHead(ctx)
+	if err != nil {
+		return err
+	}
+	codes := []string{}
+	records := map[string]*storedLink{}
+	err = linkStorage.list(ctx, "", func(code string) error {
+		rec, err := linkStorage.read(ctx, code, maxLinkObjectSize+1)
+		if err != nil {
+			// Removed while listing
+			return nil
+		}
+		codes = append(codes, code)
+		records[code] = rec
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(codes)
+
+	compressed := new(bytes.Buffer)
+	zipper := gzip.NewWriter(compressed)
+	err = encodeSnapshot(zipper, codes, records)
+	if err == nil {
+		err = zipper.Close()
+	}
+	if err != nil {
+		return err
+	}
+	now := clock().UTC()
+	info := snapshotInfo{fmt.Sprintf("%s%d.snap.gz", snapshotPrefix, now.UnixNano()), len(codes), now, seq}
+	err = gcsWriteBlob(ctx, info.Object, "application/gzip", compressed.Bytes())
+	if err != nil {
+		return err
+	}
+	previous, _, err := gcsReadBlob(ctx, snapshotManifest)
+	keep := snapshotInfo{}
+	if err == nil {
+		json.Unmarshal(previous, &keep)
+	}
+	marshalled, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	err = gcsWriteBlob(ctx, snapshotManifest, "application/json", marshalled)
+	if err != nil {
+		return err
+	}
+	span.SetAttributes(attribute.Int64("links", int64(len(codes))), attribute.Int64("bytes", int64(compressed.Len())))
+	return gcsListPrefix(ctx, snapshotPrefix, func(name string) error {
+		if name != info.Object && name != keep.Object {
+			err := gcsDelete(ctx, name)
+			if err != nil {
+				slog.Error("unable to remove outdated snapshot", "object", name, "err", err)
+			}
+		}
+		return nil
+	})
+}
+
+// Write links in the snapshot format: magic, link count (uint32) and the offsets of the records (uint64 each),
+// followed by the records in code order. A record is the code's length (uint16), the code, the generation and
+// the full size (int64 each), the data's length (uint32) and the data. All numbers are big endian.
+func encodeSnapshot(w io.Writer, codes []string, records map[string]*storedLink) error {
+	header := new(bytes.Buffer)
+	body := new(bytes.Buffer)
+	header.WriteString(snapshotMagic)
+	binary.Write(header, binary.BigEndian, uint32(len(codes)))
+	start := uint64(len(snapshotMagic) + 4 + 8*len(codes))
+	for _, code := range codes {
+		rec := records[code]
+		binary.Write(header, binary.BigEndian, start+uint64(body.Len()))
+		binary.Write(body, binary.BigEndian, uint16(len(code)))
+		body.WriteString(code)
+		binary.Write(body, binary.BigEndian, rec.generation)
+		binary.Write(body, binary.BigEndian, rec.size)
+		binary.Write(body, binary.BigEndian, uint32(len(rec.data)))
+		body.Write(rec.data)
+	}
+	_, err := header.WriteTo(w)
+	if err == nil {
+		_, err = body.WriteTo(w)
+	}
+	return err
+}
+
+// struct mappedSnapshot is a published snapshot mapped into memory from a local file.
+type mappedSnapshot struct {
+	data  []byte
+	count int
+}
+
+// Download a published snapshot, decompress it into a temporary file and map that into memory
+func downloadSnapshot(ctx context.Context, object string) (*mappedSnapshot, error) {
+	ctx, span := tracer.Start(ctx, "downloadSnapshot")
+	defer span.End()
+	compressed, _, err := gcsReadBlob(ctx, object)
+	if err != nil {
+		return nil, err
+	}
+	unzipper, err := gzip.NewReader(bytes.NewReader(compressed))
+	if err != nil {
+		return nil, err
+	}
+	file, err := ioutil.TempFile("", "urly-snapshot-")
+	if err != nil {
+		return nil, err
+	}
+	// The mapping stays valid after the file is gone
+	defer os.Remove(file.Name())
+	defer file.Close()
+	size, err := io.Copy(file, unzipper)
+	if err != nil {
+		return nil, err
+	}
+	if size < int64(len(snapshotMagic)+4) {
+		return nil, errBadSnapshot
+	}
+	data, err := syscall.Mmap(int(file.Fd()), 0, int(size), syscall.PROT_READ, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, err
+	}
+	s := &mappedSnapshot{data: data}
+	err = s.check()
+	if err != nil {
+		s.close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// Validate the header and offsets, so lookups can trust them
+func (s *mappedSnapshot) check() error {
+	if !bytes.HasPrefix(s.data, []byte(snapshotMagic)) {
+		return errBadSnapshot
+	}
+	s.count = int(binary.BigEndian.Uint32(s.data[len(snapshotMagic):]))
+	start := len(snapshotMagic) + 4
+	if len(s.data) < start+8*s.count {
+		return errBadSnapshot
+	}
+	limit := uint64(len(s.data))
+	for i := 0; i < s.count; i++ {
+		offset := binary.BigEndian.Uint64(s.data[start+8*i:])
+		if offset > limit || limit-offset < 2 {
+			return errBadSnapshot
+		}
+		codeEnd := offset + 2 + uint64(binary.BigEndian.Uint16(s.data[offset:]))
+		if codeEnd > limit || limit-codeEnd < 20 {
+			return errBadSnapshot
+		}
+		if uint64(binary.BigEndian.Uint32(s.data[codeEnd+16:])) > limit-codeEnd-20 {
+			return errBadSnapshot
+		}
+	}
+	return nil
+}
+
+// Code of the i-th record and the position following it
+func (s *mappedSnapshot) code(i int) (string, uint64) {
+	offset := binary.BigEndian.Uint64(s.data[len(snapshotMagic)+4+8*i:])
+	length := uint64(binary.BigEndian.Uint16(s.data[offset:]))
+	return string(s.data[offset+2 : offset+2+length]), offset + 2 + length
+}
+
+// Find a code by binary search, copying its record out of the mapping
+func (s *mappedSnapshot) lookup(code string) (*storedLink, bool) {
+	i := sort.Search(s.count, func(i int) bool {
+		found, _ := s.code(i)
+		return strings.Compare(found, code) >= 0
+	})
+	if i == s.count {
+		return nil, false
+	}
+	found, position := s.code(i)
+	if found != code {
+		return nil, false
+	}
+	rec := &storedLink{
+		generation: int64(binary.BigEndian.Uint64(s.data[position:])),
+		size:       int64(binary.BigEndian.Uint64(s.data[position+8:])),
+	}
+	length := uint64(binary.BigEndian.Uint32(s.data[position+16:]))
+	rec.data = append([]byte(nil), s.data[position+20:position+20+length]...)
+	return rec, true
+}
+
+func (s *mappedSnapshot) close() error {
+	return syscall.Munmap(s.data)
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/gorilla/mux"
+)
+
+// Limits and defaults of split links
+const (
+	maxVariants          = 10
+	defaultBanditEpsilon = 0.1
+	// How long bandit stats read from GCS are trusted before reading them again
+	banditRefresh = time.Minute
+)
+
+// struct variant is one destination of an A/B split link.
+type variant struct {
+	// Destination of the variant
+	URL string `json:"url"`
+	// Relative share of traffic outside bandit mode (0 means 1)
+	Weight int `json:"weight,omitempty"`
+}
+
+// struct banditStats counts redirects and conversions per variant of a split link.
+type banditStats struct {
+	Redirects   []int64 `json:"redirects"`
+	Conversions []int64 `json:"conversions"`
+}
+
+// Add the counts of other to the stats, growing them to fit
+func (b *banditStats) add(other *banditStats) {
+	grow := func(counts []int64, n int) []int64 {
+		for len(counts) < n {
+			counts = append(counts, 0)
+		}
+		return counts
+	}
+	b.Redirects = grow(b.Redirects, len(other.Redirects))
+	b.Conversions = grow(b.Conversions, len(other.Conversions))
+	for i, n := range other.Redirects {
+		b.Redirects[i] += n
+	}
+	for i, n := range other.Conversions {
+		b.Conversions[i] += n
+	}
+}
+
+// Estimated conversion rate of a variant, starting from an even prior
+func (b *banditStats) rate(i int) float64 {
+	var redirects, conversions int64
+	if i < len(b.Redirects) {
+		redirects = b.Redirects[i]
+	}
+	if i < len(b.Conversions) {
+		conversions = b.Conversions[i]
+	}
+	return float64(conversions+1) / float64(redirects+2)
+}
+
+// Bandit stats of split links, as read from GCS and as counted locally since the last flush
+var bandits = struct {
+	sync.Mutex
+	cached  map[string]*banditStats
+	fetched map[string]time.Time
+	pending map[string]*banditStats
+}{cached: map[string]*banditStats{}, fetched: map[string]time.Time{}, pending: map[string]*banditStats{}}
+
+// Source of randomness for picking variants
+var variantRand = struct {
+	sync.Mutex
+	*rand.Rand
+}{Rand: rand.New(rand.NewSource(time.Now().UnixNano()))}
+
+// Name of the GCS object holding the bandit stats of a split link
+func banditObject(code string) string {
+	return "bandit/" + code + ".json"
+}
+
+// Subject signed to accept conversion postbacks for a split link
+func postbackSubject(code string) string {
+	return "postback:" + code
+}
+
+// Signed URL reporting a conversion of a split link, the variant index is appended by the caller
+func postbackURL(code string) string {
+	query := url.Values{"sig": {sign(postbackSubject(code))}}
+	return fmt.Sprintf("https://%s/api/v1/links/%s/postback?%s", config.Domain, code, query.Encode())
+}
+
+// Check the variants of a split link request
+func validateVariants(variants []variant) error {
+	if len(variants) < 2 || len(variants) > maxVariants {
+		return fmt.Errorf("a split link needs between 2 and %d variants", maxVariants)
+	}
+	for _, v := range variants {
+		uri, err := url.Parse(v.URL)
+		if err != nil || (uri.Scheme != "https" && uri.Scheme != "http") || uri.Host == "" {
+			return fmt.Errorf("variant %q is not a HTTP/HTTPS URL", v.URL)
+		}
+		if err := checkDomainLists(v.URL); err != nil {
+			return fmt.Errorf("variant %q: %v", v.URL, err)
+		}
+		if v.Weight < 0 {
+			return fmt.Errorf("variant weights can't be negative")
+		}
+	}
+	return nil
+}
+
+// Pick the variant a visitor is sent to and count the redirect.
+// Bandit links mostly exploit the best converting variant and explore a BANDIT_EPSILON share of traffic.
+func pickVariant(ctx context.Context, code string, l *link) int {
+	ctx, span := tracer.Start(ctx, "pickVariant")
+	defer span.End()
+	variantRand.Lock()
+	roll := variantRand.Float64()
+	pick := variantRand.Intn(len(l.Variants))
+	variantRand.Unlock()
+
+	if l.Bandit {
+		epsilon := config.BanditEpsilon
+		if epsilon < 0 || epsilon > 1 {
+			epsilon = defaultBanditEpsilon
+		}
+		if roll >= epsilon {
+			stats := banditSnapshot(ctx, code)
+			best := 0
+			for i := range l.Variants {
+				if stats.rate(i) > stats.rate(best) {
+					best = i
+				}
+			}
+			pick = best
+		}
+	} else {
+		total := 0
+		for _, v := range l.Variants {
+			total += variantWeight(v)
+		}
+		target := roll * float64(total)
+		for i, v := range l.Variants {
+			target -= float64(variantWeight(v))
+			if target < 0 {
+				pick = i
+				break
+			}
+		}
+	}
+
+	bandits.Lock()
+	pending, ok := bandits.pending[code]
+	if !ok {
+		pending = &banditStats{}
+		bandits.pending[code] = pending
+	}
+	counted := &banditStats{Redirects: make([]int64, pick+1)}
+	counted.Redirects[pick] = 1
+	pending.add(counted)
+	bandits.Unlock()
+	return pick
+}
+
+// Traffic share of a variant
+func variantWeight(v variant) int {
+	if v.Weight == 0 {
+		return 1
+	}
+	return v.Weight
+}
+
+// Current stats of a split link: stored counts (refreshed every banditRefresh) plus local ones
+func banditSnapshot(ctx context.Context, code string) *banditStats {
+	bandits.Lock()
+	cached, ok := bandits.cached[code]
+	fresh := ok && time.Since(bandits.fetched[code]) < banditRefresh
+	bandits.Unlock()
+	if !fresh {
+		stored, err := readBanditStats(ctx, code)
+		if err != nil {
+			slog.Error("unable to read bandit stats", "code", code, "err", err)
+			stored = &banditStats{}
+			if ok {
+				stored = cached
+			}
+		}
+		bandits.Lock()
+		bandits.cached[code] = stored
+		bandits.fetched[code] = time.Now()
+		bandits.Unlock()
+		cached = stored
+	}
+	snapshot := &banditStats{}
+	snapshot.add(cached)
+	bandits.Lock()
+	if pending, ok := bandits.pending[code]; ok {
+		snapshot.add(pending)
+	}
+	bandits.Unlock()
+	return snapshot
+}
+
+// Read the stored bandit stats of a split link, empty if there are none yet
+func readBanditStats(ctx context.Context, code string) (*banditStats, error) {
+	ctx, span := tracer.Start(ctx, "readBanditStats")
+	defer span.End()
+	stats := &banditStats{}
+	data, _, err := gcsReadBlob(ctx, banditObject(code))
+	if err == storage.ErrObjectNotExist {
+		return stats, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(data, stats)
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// Add counts to the stored bandit stats, retrying when another instance wrote concurrently
+func mergeBanditStats(ctx context.Context, code string, delta *banditStats) error {
+	ctx, span := tracer.Start(ctx, "mergeBanditStats")
+	defer span.End()
+	var err error
+	for attempt := 0; attempt < rollupAttempts; attempt++ {
+		stored := &banditStats{}
+		content, generation, readErr := gcsReadGeneration(ctx, banditObject(code))
+		if readErr != nil && readErr != storage.ErrObjectNotExist {
+			return readErr
+		}
+		if readErr == nil {
+			err = json.Unmarshal([]byte(content), stored)
+			if err != nil {
+				return err
+			}
+		}
+		stored.add(delta)
+		var marshalled []byte
+		marshalled, err = json.Marshal(stored)
+		if err != nil {
+			return err
+		}
+		err = gcsWriteIfGeneration(ctx, banditObject(code), "application/json", marshalled, generation)
+		if err == nil {
+			bandits.Lock()
+			bandits.cached[code] = stored
+			bandits.fetched[code] = time.Now()
+			bandits.Unlock()
+			return nil
+		}
+		if !isPreconditionFailed(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: %s after %d attempts", errWriteConflict, banditObject(code), rollupAttempts)
+}
+
+// Merge locally counted redirects of split links into their stored stats
+func flushBandits(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "flushBandits")
+	defer span.End()
+	bandits.Lock()
+	pending := bandits.pending
+	bandits.pending = map[string]*banditStats{}
+	bandits.Unlock()
+
+	for code, delta := range pending {
+		err := mergeBanditStats(ctx, code, delta)
+		if err == nil {
+			continue
+		}
+		slog.Error("unable to flush bandit stats", "code", code, "err", err)
+		bandits.Lock()
+		if newer, ok := bandits.pending[code]; ok {
+			delta.add(newer)
+		}
+		bandits.pending[code] = delta
+		bandits.Unlock()
+	}
+}
+
+// POST handler reporting a conversion for a variant of a split link, answering with the current stats
+func postbackHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "postbackHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	code := mux.Vars(r)["id"]
+	if !verifySignature(postbackSubject(code), r.URL.Query().Get("sig")) {
+		forbidden(ctx, w, "invalid signature!")
+		return
+	}
+	l, err := readLink(ctx, code)
+	if err != nil || len(l.Variants) == 0 {
+		respond(ctx, response{"", "unable to find split link!"}, http.StatusNotFound, w)
+		return
+	}
+	index, err := strconv.Atoi(r.URL.Query().Get("variant"))
+	if err != nil || index < 0 || index >= len(l.Variants) {
+		respond(ctx, response{"", fmt.Sprintf("variant should be an index between 0 and %d!", len(l.Variants)-1)}, http.StatusBadRequest, w)
+		return
+	}
+	delta := &banditStats{Conversions: make([]int64, index+1)}
+	delta.Conversions[index] = 1
+	err = mergeBanditStats(ctx, code, delta)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	respond(ctx, banditSnapshot(ctx, code), http.StatusOK, w)
+}
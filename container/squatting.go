@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Objects of suspicious alias reservation bursts, named after the registrant's ID
+const squattingPrefix = "squatting/"
+
+// Defaults of the alias squatting protection
+const (
+	defaultAliasBurst = 10
+	// How long registrations are remembered per registrant, to be included in a report
+	aliasWindow = 10 * time.Minute
+	// Minimum time between updates of a registrant's report by one instance
+	aliasReportInterval = 10 * time.Second
+	// Registrants tracked, tracking starts over beyond that
+	maxTrackedRegistrants = 10000
+)
+
+// struct aliasRegistration is a custom name registered recently.
+type aliasRegistration struct {
+	code string
+	time time.Time
+}
+
+// State of the alias squatting protection, set up by setupAliasProtection
+var aliases struct {
+	sync.Mutex
+	// Custom names per registrant
+	limiter *limiter
+	// Registrations within aliasWindow by registrant
+	recent map[string][]aliasRegistration
+	// Time each registrant's report was last updated
+	reported map[string]time.Time
+	// Rejections by registrant not reported yet
+	throttled map[string]int
+}
+
+// struct squattingReport is a registrant who was throttled while registering custom names.
+type squattingReport struct {
+	// Hash of the registrant, as stored with the links
+	ID string `json:"id"`
+	// API key (its ID), signed-in user or IP of the registrant
+	Registrant string `json:"registrant"`
+	// Custom names registered shortly before and while being throttled
+	Aliases []string `json:"aliases"`
+	// Registrations rejected by the throttling
+	Throttled int       `json:"throttled"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+}
+
+// struct unwindResponse tells which names of a report were released.
+type unwindResponse struct {
+	response
+	Released []string `json:"released"`
+	// Names which were deleted or reissued to someone else in the meantime
+	Skipped []string `json:"skipped"`
+}
+
+// Configure the throttling of custom names from ALIAS_RATE_LIMIT (custom names per minute per
+// API key, signed-in user or IP) and ALIAS_BURST. Disabled without a rate.
+func setupAliasProtection() {
+	rate := config.AliasRateLimit
+	if rate <= 0 {
+		return
+	}
+	burst := config.AliasBurst
+	if burst <= 0 {
+		burst = defaultAliasBurst
+	}
+	aliases.limiter = newLimiter(rate, burst)
+	aliases.recent = map[string][]aliasRegistration{}
+	aliases.reported = map[string]time.Time{}
+	aliases.throttled = map[string]int{}
+}
+
+// Whoever registers custom names with a request: the API key, else the signed-in user, else the client IP.
+// Empty for admins, who aren't throttled.
+func registrant(r *http.Request, uid string) string {
+	if isAdmin(r) {
+		return ""
+	}
+	if key := suppliedAPIKey(r); key != "" {
+		return "key:" + apiKeyHash(key)[:12]
+	}
+	if uid != "" {
+		return "user:" + uid
+	}
+	return "ip:" + clientIP(r)
+}
+
+// ID of a registrant stored with its links, so IPs aren't kept with them
+func registrantID(registrant string) string {
+	hash := sha256.Sum256([]byte(registrant))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Report whether a registrant may register another custom name, reporting it if not
+func allowAlias(ctx context.Context, registrant string) bool {
+	if aliases.limiter == nil || registrant == "" {
+		return true
+	}
+	now := clock()
+	if aliases.limiter.allow(registrant, now) {
+		return true
+	}
+	aliases.Lock()
+	recent := recentAliases(registrant, now)
+	aliases.throttled[registrant]++
+	throttled := aliases.throttled[registrant]
+	due := now.Sub(aliases.reported[registrant]) >= aliasReportInterval
+	if due {
+		aliases.reported[registrant] = now
+		delete(aliases.throttled, registrant)
+	}
+	aliases.Unlock()
+	if due {
+		err := reportSquatting(ctx, registrant, recent, throttled, now)
+		if err != nil {
+			slog.Error("unable to report alias squatting", "registrant", registrant, "err", err)
+		}
+	}
+	return false
+}
+
+// Remember a custom name registered, for reporting its registrant later
+func rememberAlias(registrant string, code string) {
+	if aliases.limiter == nil || registrant == "" {
+		return
+	}
+	now := clock()
+	aliases.Lock()
+	defer aliases.Unlock()
+	if len(aliases.recent) >= maxTrackedRegistrants {
+		aliases.recent = map[string][]aliasRegistration{}
+		aliases.reported = map[string]time.Time{}
+		aliases.throttled = map[string]int{}
+	}
+	aliases.recent[registrant] = append(recentAliases(registrant, now), aliasRegistration{code, now})
+}
+
+// Names a registrant registered within aliasWindow, forgetting older ones. Needs the lock.
+func recentAliases(registrant string, now time.Time) []aliasRegistration {
+	registrations := aliases.recent[registrant]
+	for len(registrations) > 0 && now.Sub(registrations[0].time) > aliasWindow {
+		registrations = registrations[1:]
+	}
+	if len(registrations) == 0 {
+		delete(aliases.recent, registrant)
+		return nil
+	}
+	aliases.recent[registrant] = registrations
+	return append([]aliasRegistration(nil), registrations...)
+}
+
+// Add recent registrations and throttled attempts to a registrant's report, creating it if needed
+func reportSquatting(ctx context.Context, registrant string, recent []aliasRegistration, throttled int, now time.Time) error {
+	ctx, span := tracer.Start(ctx, "reportSquatting")
+	defer span.End()
+	id := registrantID(registrant)
+	name := squattingPrefix + id + ".json"
+	for attempt := 0; attempt < updateAttempts; attempt++ {
+		report := squattingReport{ID: id, Registrant: registrant, Aliases: []string{}, First: now.UTC()}
+		content, generation, err := gcsReadGeneration(ctx, name)
+		if err != nil && err != storage.ErrObjectNotExist {
+			return err
+		}
+		if err == nil {
+			err = json.Unmarshal([]byte(content), &report)
+			if err != nil {
+				return err
+			}
+		}
+		known := map[string]bool{}
+		for _, code := range report.Aliases {
+			known[code] = true
+		}
+		for _, registration := range recent {
+			if !known[registration.code] {
+				report.Aliases = append(report.Aliases, registration.code)
+				known[registration.code] = true
+			}
+		}
+		report.Throttled += throttled
+		report.Last = now.UTC()
+		marshalled, err := json.Marshal(report)
+		if err != nil {
+			return err
+		}
+		err = gcsWriteIfGeneration(ctx, name, "application/json", marshalled, generation)
+		if err == nil {
+			slog.Warn("alias squatting suspected", "registrant", registrant, "aliases", len(report.Aliases), "throttled", report.Throttled)
+			return nil
+		}
+		if !isPreconditionFailed(err) {
+			return err
+		}
+	}
+	return fmt.Errorf("report of %s kept changing, giving up", registrant)
+}
+
+// Admin handler for alias squatting: GET lists reports, most recent first. DELETE ?id= unwinds a report,
+// deleting the names it lists which are still registered to the registrant and making them available
+// again right away. Add &release=false to only dismiss the report.
+func squattingHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "squattingHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	if r.Method == http.MethodDelete {
+		unwindSquatting(ctx, w, r)
+		return
+	}
+	reports := []squattingReport{}
+	err := gcsListPrefix(ctx, squattingPrefix, func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			// Unwound while listing
+			return nil
+		}
+		report := squattingReport{}
+		if json.Unmarshal(data, &report) == nil {
+			reports = append(reports, report)
+		}
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(reports, func(i, j int) bool { return reports[i].Last.After(reports[j].Last) })
+	respond(ctx, reports, http.StatusOK, w)
+}
+
+// Release the names of a squatting report and remove the report
+func unwindSquatting(ctx context.Context, w http.ResponseWriter, r *http.Request) {
+	ctx, span := tracer.Start(ctx, "unwindSquatting")
+	defer span.End()
+	id := r.URL.Query().Get("id")
+	if len(id) != 16 || strings.Trim(id, "0123456789abcdef") != "" {
+		respond(ctx, response{"", "invalid report id!"}, http.StatusBadRequest, w)
+		return
+	}
+	name := squattingPrefix + id + ".json"
+	data, _, err := gcsReadBlob(ctx, name)
+	if err == storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to find report!"}, http.StatusNotFound, w)
+		return
+	}
+	report := squattingReport{}
+	if err == nil {
+		err = json.Unmarshal(data, &report)
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	resp := unwindResponse{Released: []string{}, Skipped: []string{}}
+	if r.URL.Query().Get("release") != "false" {
+		for _, code := range report.Aliases {
+			l, err := readLink(ctx, code)
+			if err == storage.ErrObjectNotExist || (err == nil && l.Registrant != report.ID) {
+				resp.Skipped = append(resp.Skipped, code)
+				continue
+			}
+			if err == nil {
+				err = deleteLink(ctx, code, false)
+			}
+			if err == nil {
+				// The name was never legitimately used, it needn't rest under the reuse policy
+				err = gcsDelete(ctx, tombstoneObject(code))
+			}
+			if err != nil && err != storage.ErrObjectNotExist {
+				respond(ctx, response{"", "unable to release " + code + "!"}, http.StatusInternalServerError, w)
+				return
+			}
+			resp.Released = append(resp.Released, code)
+		}
+	}
+	err = gcsDelete(ctx, name)
+	if err != nil && err != storage.ErrObjectNotExist {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	resp.Message = fmt.Sprintf("%d names released, %d skipped", len(resp.Released), len(resp.Skipped))
+	respond(ctx, resp, http.StatusOK, w)
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+// Referrers listed by the stats endpoint, unless ?top= says otherwise
+const (
+	defaultTopReferrers = 10
+	maxTopReferrers     = 100
+)
+
+// struct dailyClicks is the number of clicks of a day.
+type dailyClicks struct {
+	Date    string `json:"date"`
+	Clicks  int64  `json:"clicks"`
+	Uniques int64  `json:"uniques"`
+}
+
+// struct referrerClicks is the number of clicks a referring host sent.
+type referrerClicks struct {
+	// Referring host ("" for direct traffic)
+	Referrer string `json:"referrer"`
+	Clicks   int64  `json:"clicks"`
+}
+
+// struct statsResponse holds the statistics of a link.
+type statsResponse struct {
+	response
+	Code string `json:"code"`
+	// Clicks since the link was created
+	TotalClicks int64 `json:"total_clicks"`
+	// Time of the latest click, omitted if it wasn't clicked yet
+	LastClick *time.Time `json:"last_click,omitempty"`
+	From      string     `json:"from"`
+	To        string     `json:"to"`
+	// Clicks within the range
+	Clicks int64 `json:"clicks"`
+	// Every day of the range, including those without clicks
+	Days []dailyClicks `json:"days"`
+	// Referrers within the range, most clicks first
+	TopReferrers []referrerClicks `json:"top_referrers"`
+	// The link and the stats of the previous range, for clients asking for HAL
+	Links halLinks `json:"_links,omitempty"`
+}
+
+// Check that a request may read the stats of a link: anyone for links with public stats,
+// otherwise the embed token (?token=), an unexpired share (?exp= and ?sig=), the manage token or the admin token.
+// Responds and returns false if it may not, without telling others whether the code exists.
+func readStatsLink(ctx context.Context, w http.ResponseWriter, r *http.Request, code string) (*link, bool) {
+	l, err := readLink(ctx, code)
+	if err == nil && (l.PublicStats || verifySignature(embedSubject(code, l), r.URL.Query().Get("token")) || sharedStats(r, code, l)) {
+		return l, true
+	}
+	return readManagedLink(ctx, w, r, code)
+}
+
+// Sort referrers by clicks and keep the top ones
+func topReferrers(referrers map[string]int64, top int) []referrerClicks {
+	ranked := []referrerClicks{}
+	for referrer, clicks := range referrers {
+		ranked = append(ranked, referrerClicks{referrer, clicks})
+	}
+	sort.Slice(ranked, func(i, j int) bool {
+		if ranked[i].Clicks != ranked[j].Clicks {
+			return ranked[i].Clicks > ranked[j].Clicks
+		}
+		return ranked[i].Referrer < ranked[j].Referrer
+	})
+	if len(ranked) > top {
+		ranked = ranked[:top]
+	}
+	return ranked
+}
+
+// Links of a stats response: itself, its link and the stats of the range of the same length before it.
+// Credentials in the query (?token=, ?sig=) carry over.
+func statsRelations(r *http.Request, code string, from time.Time, to time.Time) halLinks {
+	query := r.URL.Query()
+	days := int(to.Sub(from).Hours()/24) + 1
+	query.Set("from", from.AddDate(0, 0, -days).Format(rollupDate))
+	query.Set("to", from.AddDate(0, 0, -1).Format(rollupDate))
+	return halLinks{
+		"self": {Href: apiURL(r.URL.RequestURI())},
+		"link": {Href: apiURL("/api/v1/links/" + code)},
+		"prev": {Href: apiURL(r.URL.Path + "?" + query.Encode())},
+	}
+}
+
+// GET handler returning the stats of a link: total clicks, last click, and clicks per day
+// and top referrers within ?from= and ?to= (YYYY-MM-DD, default the last 30 days).
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "statsHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization")
+		return
+	}
+	code := mux.Vars(r)["id"]
+	query := r.URL.Query()
+	from, to, err := parseRange(query.Get("from"), query.Get("to"), clock())
+	if err != nil {
+		respond(ctx, response{"", "invalid range!"}, http.StatusBadRequest, w)
+		return
+	}
+	top, err := strconv.Atoi(query.Get("top"))
+	if err != nil || top <= 0 {
+		top = defaultTopReferrers
+	}
+	if top > maxTopReferrers {
+		top = maxTopReferrers
+	}
+	l, ok := readStatsLink(ctx, w, r, code)
+	if !ok {
+		return
+	}
+	if l.NoAnalytics {
+		respond(ctx, response{"", "link doesn't collect clicks!"}, http.StatusNotFound, w)
+		return
+	}
+
+	resp, err := linkStats(ctx, code, l, from, to, top)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	if hypermedia(w) {
+		resp.Links = statsRelations(r, code, from, to)
+	}
+	if l.PublicStats {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	} else {
+		w.Header().Set("Cache-Control", "private, no-cache")
+	}
+	respond(ctx, resp, http.StatusOK, w)
+}
+
+// Stats of a link collecting clicks within a range of days, with the top referrers
+func linkStats(ctx context.Context, code string, l *link, from time.Time, to time.Time, top int) (statsResponse, error) {
+	ctx, span := tracer.Start(ctx, "linkStats")
+	defer span.End()
+	listed, err := listLink(ctx, code, l)
+	if err != nil {
+		return statsResponse{}, err
+	}
+	rollups, err := readRollups(ctx, code, from, to)
+	if err != nil {
+		return statsResponse{}, err
+	}
+	resp := statsResponse{Code: code, TotalClicks: *listed.Clicks, LastClick: listed.LastClick, From: from.Format(rollupDate), To: to.Format(rollupDate), Days: []dailyClicks{}}
+	byDate := map[string]*dailyRollup{}
+	referrers := map[string]int64{}
+	for _, rollup := range rollups {
+		byDate[rollup.Date] = rollup
+		resp.Clicks += rollup.Clicks
+		for referrer, clicks := range rollup.Referrers {
+			referrers[referrer] += clicks
+		}
+		// Links without a counter yet only know their last click from the rollups
+		if !rollup.LastClick.IsZero() && (resp.LastClick == nil || rollup.LastClick.After(*resp.LastClick)) {
+			last := rollup.LastClick
+			resp.LastClick = &last
+		}
+	}
+	for day := from; !day.After(to); day = day.AddDate(0, 0, 1) {
+		clicks := dailyClicks{Date: day.Format(rollupDate)}
+		if rollup, ok := byDate[clicks.Date]; ok {
+			clicks.Clicks = rollup.Clicks
+			clicks.Uniques = rollup.uniques()
+		}
+		resp.Days = append(resp.Days, clicks)
+	}
+	resp.TopReferrers = topReferrers(referrers, top)
+	resp.Message = "stats of " + code
+	return resp, nil
+}
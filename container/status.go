@@ -0,0 +1,370 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Hour buckets of request counts
+const statusHour = "2006010215"
+
+// Hours shown on the status page
+const statusHours = 24
+
+// Share of server errors in the last hour above which the service counts as degraded
+const degradedErrorRate = 0.05
+
+// Stages of an incident
+var incidentStatuses = map[string]bool{"investigating": true, "identified": true, "monitoring": true, "resolved": true}
+
+// struct statusCounts counts the requests of an hour, per instance when stored.
+type statusCounts struct {
+	Hour         string `json:"hour"`
+	Requests     int64  `json:"requests"`
+	ClientErrors int64  `json:"client_errors"`
+	ServerErrors int64  `json:"server_errors"`
+}
+
+// struct statusHourSummary sums up an hour on the status page.
+type statusHourSummary struct {
+	statusCounts
+	// Share of requests answered without a server error
+	Availability float64 `json:"availability"`
+	ErrorRate    float64 `json:"error_rate"`
+}
+
+// struct incidentUpdate is a note about the progress of an incident.
+type incidentUpdate struct {
+	Time   time.Time `json:"time"`
+	Status string    `json:"status"`
+	Note   string    `json:"note"`
+}
+
+// struct incident is an outage or degradation announced by the admins.
+type incident struct {
+	ID       string           `json:"id"`
+	Title    string           `json:"title"`
+	Status   string           `json:"status"`
+	Started  time.Time        `json:"started"`
+	Resolved *time.Time       `json:"resolved,omitempty"`
+	Updates  []incidentUpdate `json:"updates"`
+}
+
+// struct incidentRequest creates an incident (without ID) or adds an update to one.
+type incidentRequest struct {
+	ID     string `json:"id,omitempty"`
+	Title  string `json:"title,omitempty"`
+	Status string `json:"status"`
+	Note   string `json:"note"`
+}
+
+// struct statusResponse is the state of the service shown on the status page.
+type statusResponse struct {
+	response
+	// operational or degraded
+	Status    string              `json:"status"`
+	Hours     []statusHourSummary `json:"hours"`
+	Incidents []*incident         `json:"incidents"`
+}
+
+// Request counts of this instance which weren't flushed yet, by hour
+var statusCounter = struct {
+	sync.Mutex
+	hours map[string]*statusCounts
+}{hours: map[string]*statusCounts{}}
+
+// struct statusWriter captures the status code of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusWriter) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// Middleware counting requests and their errors for the status page.
+// Registered before negotiate, so handlers still see the negotiatedWriter.
+func countRequests(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		recorder := &statusWriter{w, http.StatusOK}
+		next.ServeHTTP(recorder, r)
+		hour := clock().UTC().Format(statusHour)
+		statusCounter.Lock()
+		counts, ok := statusCounter.hours[hour]
+		if !ok {
+			counts = &statusCounts{Hour: hour}
+			statusCounter.hours[hour] = counts
+		}
+		counts.Requests++
+		switch {
+		case recorder.code >= 500:
+			counts.ServerErrors++
+		case recorder.code >= 400:
+			counts.ClientErrors++
+		}
+		statusCounter.Unlock()
+	})
+}
+
+// Object holding an instance's request counts of an hour
+func statusObject(hour string, instance string) string {
+	return fmt.Sprintf("status/%s/%s.json", hour, instance)
+}
+
+// Object holding an incident
+func incidentObject(id string) string {
+	return "incidents/" + id + ".json"
+}
+
+// Periodically store this instance's request counts, so every instance can sum them up
+func startStatusRecorder() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			flushStatus(context.Background())
+		}
+	}()
+}
+
+// Write the counts of this instance, forgetting finished hours once they're stored
+func flushStatus(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "flushStatus")
+	defer span.End()
+	current := clock().UTC().Format(statusHour)
+	statusCounter.Lock()
+	hours := []statusCounts{}
+	for hour, counts := range statusCounter.hours {
+		hours = append(hours, *counts)
+		if hour != current {
+			delete(statusCounter.hours, hour)
+		}
+	}
+	statusCounter.Unlock()
+	for _, counts := range hours {
+		marshalled, err := json.Marshal(counts)
+		if err != nil {
+			slog.Error("unable to marshal request counts", "err", err)
+			continue
+		}
+		// Counts are cumulative per instance and hour, so overwriting is fine
+		err = gcsWriteBlob(ctx, statusObject(counts.Hour, instanceID), "application/json", marshalled)
+		if err != nil {
+			slog.Error("unable to store request counts", "err", err)
+		}
+	}
+}
+
+// Sum up the request counts of all instances for the last hours, oldest first
+func statusHistory(ctx context.Context, now time.Time) ([]statusHourSummary, error) {
+	ctx, span := tracer.Start(ctx, "statusHistory")
+	defer span.End()
+	hours := []statusHourSummary{}
+	for i := statusHours - 1; i >= 0; i-- {
+		summary := statusHourSummary{statusCounts: statusCounts{Hour: now.UTC().Add(time.Duration(-i) * time.Hour).Format(statusHour)}, Availability: 1}
+		err := gcsListPrefix(ctx, "status/"+summary.Hour+"/", func(name string) error {
+			data, _, err := gcsReadBlob(ctx, name)
+			if err != nil {
+				return err
+			}
+			counts := statusCounts{}
+			err = json.Unmarshal(data, &counts)
+			if err != nil {
+				return err
+			}
+			summary.Requests += counts.Requests
+			summary.ClientErrors += counts.ClientErrors
+			summary.ServerErrors += counts.ServerErrors
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		if summary.Requests > 0 {
+			summary.ErrorRate = float64(summary.ServerErrors) / float64(summary.Requests)
+			summary.Availability = 1 - summary.ErrorRate
+		}
+		hours = append(hours, summary)
+	}
+	return hours, nil
+}
+
+// Read all incidents, most recent first
+func readIncidents(ctx context.Context) ([]*incident, error) {
+	incidents := []*incident{}
+	err := gcsListPrefix(ctx, "incidents/", func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			return err
+		}
+		i := &incident{}
+		err = json.Unmarshal(data, i)
+		if err != nil {
+			return err
+		}
+		incidents = append(incidents, i)
+		return nil
+	})
+	sort.Slice(incidents, func(a, b int) bool { return incidents[a].Started.After(incidents[b].Started) })
+	return incidents, err
+}
+
+// Page showing the state of the service
+var statusTemplate = template.Must(template.New("status").Funcs(template.FuncMap{
+	"percent": func(share float64) float64 { return share * 100 },
+}).Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Status - Urly Wurly</title>
+<link rel="stylesheet" href="/style.css">
+</head>
+<body>
+<main class="status-page">
+<h1>{{if eq .Status "operational"}}All systems operational{{else}}Service degraded{{end}}</h1>
+<h2>Last {{len .Hours}} hours</h2>
+<table>
+<tr><th>Hour (UTC)</th><th>Requests</th><th>Availability</th></tr>
+{{range .Hours}}<tr><td>{{.Hour}}</td><td>{{.Requests}}</td><td>{{printf "%.2f" (percent .Availability)}}%</td></tr>
+{{end}}</table>
+<h2>Incidents</h2>
+{{range .Incidents}}<section>
+<h3>{{.Title}} ({{.Status}})</h3>
+{{range .Updates}}<p><time>{{.Time.Format "2006-01-02 15:04 MST"}}</time> <strong>{{.Status}}</strong> {{.Note}}</p>
+{{end}}</section>
+{{else}}<p>No incidents reported.</p>
+{{end}}
+</main>
+</body>
+</html>
+`))
+
+// GET handler showing recent availability and incidents, as a page for browsers and JSON otherwise
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "statusHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	hours, err := statusHistory(ctx, clock())
+	if err == nil {
+		var incidents []*incident
+		incidents, err = readIncidents(ctx)
+		if err == nil {
+			resp := statusResponse{response{"", "status"}, "operational", hours, incidents}
+			last := hours[len(hours)-1]
+			if last.ErrorRate > degradedErrorRate {
+				resp.Status = "degraded"
+			}
+			for _, i := range incidents {
+				if i.Status != "resolved" {
+					resp.Status = "degraded"
+				}
+			}
+			resp.Message = "service is " + resp.Status
+			w.Header().Set("Cache-Control", "public, max-age=60")
+			if nw, ok := w.(*negotiatedWriter); ok && nw.html {
+				w.Header().Set("Content-Type", "text/html; charset=utf-8")
+				err = statusTemplate.Execute(w, resp)
+				if err != nil {
+					slog.Error("unable to render status page", "err", err)
+				}
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			respond(ctx, resp, http.StatusOK, w)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+}
+
+// Admin handler for incidents: GET lists them, POST opens one or adds an update (with "id"), DELETE ?id= removes one
+func incidentsHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "incidentsHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	switch r.Method {
+	case http.MethodPost:
+		req := incidentRequest{}
+		err := json.NewDecoder(io.LimitReader(r.Body, 1<<20)).Decode(&req)
+		if err != nil || !incidentStatuses[req.Status] {
+			respond(ctx, response{"", "body should have a status of investigating, identified, monitoring or resolved!"}, http.StatusBadRequest, w)
+			return
+		}
+		now := clock().UTC()
+		i := &incident{}
+		if req.ID == "" {
+			if strings.TrimSpace(req.Title) == "" {
+				respond(ctx, response{"", "new incidents need a title!"}, http.StatusBadRequest, w)
+				return
+			}
+			i = &incident{ID: now.Format("20060102150405"), Title: strings.TrimSpace(req.Title), Started: now}
+		} else {
+			data, _, err := gcsReadBlob(ctx, incidentObject(req.ID))
+			if err == storage.ErrObjectNotExist {
+				respond(ctx, response{"", "unable to find incident!"}, http.StatusNotFound, w)
+				return
+			}
+			if err == nil {
+				err = json.Unmarshal(data, i)
+			}
+			if err != nil {
+				respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+				return
+			}
+		}
+		i.Status = req.Status
+		i.Updates = append(i.Updates, incidentUpdate{now, req.Status, strings.TrimSpace(req.Note)})
+		i.Resolved = nil
+		if req.Status == "resolved" {
+			i.Resolved = &now
+		}
+		marshalled, err := json.Marshal(i)
+		if err == nil {
+			err = gcsWriteBlob(ctx, incidentObject(i.ID), "application/json", marshalled)
+		}
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(ctx, i, http.StatusOK, w)
+	case http.MethodDelete:
+		err := gcsDelete(ctx, incidentObject(r.URL.Query().Get("id")))
+		if err == storage.ErrObjectNotExist {
+			respond(ctx, response{"", "unable to find incident!"}, http.StatusNotFound, w)
+			return
+		}
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(ctx, response{"", "incident removed!"}, http.StatusOK, w)
+	default:
+		incidents, err := readIncidents(ctx)
+		if err != nil {
+			respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+			return
+		}
+		respond(ctx, incidents, http.StatusOK, w)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Generation passed to linkStore.write to overwrite a record unconditionally
+const anyGeneration = -1
+
+// Default Firestore collection holding links
+const defaultFirestoreCollection = "links"
+
+// Error returned by stores other than GCS when a conditional write lost against a concurrent one
+var errWriteConflict = errors.New("record was changed concurrently")
+
+// struct storedLink is the stored form of a link as read from a linkStore.
+type storedLink struct {
+	// Encoded link, possibly truncated to the requested limit
+	data []byte
+	// Full size of the encoded link
+	size int64
+	// Version of the record for conditional writes
+	generation int64
+}
+
+// interface linkStore persists the records of short codes.
+// Missing records are reported as storage.ErrObjectNotExist by every implementation,
+// failed conditional writes are recognised by isPreconditionFailed.
+type linkStore interface {
+	// Read the record of a code, at most limit bytes of it if limit is positive
+	read(ctx context.Context, code string, limit int64) (*storedLink, error)
+	// Write the record of a code if it is still at generation (0 means it doesn't exist, anyGeneration skips the check)
+	write(ctx context.Context, code string, data []byte, generation int64) error
+	// Remove the record of a code
+	delete(ctx context.Context, code string) error
+	// Visit the short codes after a code in lexical order, all of them after ""
+	list(ctx context.Context, after string, visit func(code string) error) error
+}
+
+// Store holding links, selected by STORAGE in setupLinkStore
+var linkStorage linkStore = gcsLinkStore{}
+
+// Name of the store links are kept in: "memory" when running locally, otherwise as selected by STORAGE
+func storeName() string {
+	switch {
+	case localBucket != nil:
+		return "memory"
+	case config.Storage != "":
+		return config.Storage
+	}
+	return "gcs"
+}
+
+// Select where links are stored with STORAGE: "firestore", "redis", or the GCS bucket otherwise
+func setupLinkStore(ctx context.Context) error {
+	switch config.Storage {
+	case "firestore":
+		client, err := firestore.NewClient(ctx, config.Project)
+		if err != nil {
+			return err
+		}
+		collection := config.FirestoreCollection
+		if collection == "" {
+			collection = defaultFirestoreCollection
+		}
+		linkStorage = &firestoreLinkStore{client, collection}
+	case "redis":
+		linkStorage = newRedisLinkStore()
+	}
+	return nil
+}
+
+// struct gcsLinkStore keeps each link as an object named after its code in BUCKET.
+type gcsLinkStore struct{}
+
+func (gcsLinkStore) read(ctx context.Context, code string, limit int64) (_ *storedLink, err error) {
+	ctx, span := tracer.Start(ctx, "gcsLinkStore.read")
+	defer span.End()
+	countOperation(opRead, 1)
+	client, err := gcsClient()
+	if err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	defer func() { recordGCSLatency(ctx, "read", start, err) }()
+
+	object := client.Bucket(config.Bucket).Object(code)
+	var reader *storage.Reader
+	if limit > 0 {
+		reader, err = object.NewRangeReader(ctx, 0, limit)
+	} else {
+		reader, err = object.NewReader(ctx)
+	}
+	if err != nil {
+		return nil, gcsCheck(client, err)
+	}
+	defer reader.Close()
+
+	// A known length is read into a single allocation. Remain is -1 when the length is unknown,
+	// e.g. for decompressive transcoding, then the buffer has to grow.
+	var data []byte
+	if remain := reader.Remain(); remain >= 0 {
+		data = make([]byte, remain)
+		_, err = io.ReadFull(reader, data)
+	} else {
+		data, err = io.ReadAll(reader)
+	}
+	if err != nil {
+		return nil, gcsCheck(client, err)
+	}
+	return &storedLink{data, reader.Attrs.Size, reader.Attrs.Generation}, nil
+}
+
+func (gcsLinkStore) write(ctx context.Context, code string, data []byte, generation int64) (err error) {
+	start := time.Now()
+	defer func() { recordGCSLatency(ctx, "write", start, err) }()
+	if generation == anyGeneration {
+		return gcsWriteBlob(ctx, code, "application/json", data)
+	}
+	return gcsWriteIfGeneration(ctx, code, "application/json", data, generation)
+}
+
+func (gcsLinkStore) delete(ctx context.Context, code string) (err error) {
+	start := time.Now()
+	defer func() { recordGCSLatency(ctx, "delete", start, err) }()
+	return gcsDelete(ctx, code)
+}
+
+func (gcsLinkStore) list(ctx context.Context, after string, visit func(code string) error) error {
+	return gcsListCodes(ctx, after, visit)
+}
+
+// struct firestoreLinkStore keeps each link as a document named after its code.
+// Generations are the documents' update times in nanoseconds.
+type firestoreLinkStore struct {
+	client     *firestore.Client
+	collection string
+}
+
+// struct linkDocument is a link as stored in Firestore.
+// The queryable fields are copied from the encoded link, which stays authoritative.
+type linkDocument struct {
+	URL     string    `firestore:"url"`
+	Created time.Time `firestore:"created"`
+	Owner   string    `firestore:"owner"`
+	// Link as encoded in GCS objects
+	Record string `firestore:"record"`
+}
+
+// Translate Firestore errors into those of the GCS store
+func firestoreError(err error) error {
+	switch status.Code(err) {
+	case codes.NotFound:
+		return storage.ErrObjectNotExist
+	case codes.AlreadyExists, codes.FailedPrecondition:
+		return fmt.Errorf("%w: %v", errWriteConflict, err)
+	}
+	return err
+}
+
+func (s *firestoreLinkStore) read(ctx context.Context, code string, limit int64) (*storedLink, error) {
+	ctx, span := tracer.Start(ctx, "firestoreLinkStore.read")
+	defer span.End()
+	snapshot, err := s.client.Collection(s.collection).Doc(code).Get(ctx)
+	if err != nil {
+		return nil, firestoreError(err)
+	}
+	doc := linkDocument{}
+	err = snapshot.DataTo(&doc)
+	if err != nil {
+		return nil, err
+	}
+	data := []byte(doc.Record)
+	size := int64(len(data))
+	if limit > 0 && size > limit {
+		data = data[:limit]
+	}
+	return &storedLink{data, size, snapshot.UpdateTime.UnixNano()}, nil
+}
+
+func (s *firestoreLinkStore) write(ctx context.Context, code string, data []byte, generation int64) error {
+	ctx, span := tracer.Start(ctx, "firestoreLinkStore.write")
+	defer span.End()
+	doc := linkDocument{Record: string(data)}
+	if l, err := decodeLink(data); err == nil {
+		doc.URL, doc.Created, doc.Owner = l.URL, l.Created, l.Owner
+	}
+	ref := s.client.Collection(s.collection).Doc(code)
+	var err error
+	switch generation {
+	case anyGeneration:
+		_, err = ref.Set(ctx, doc)
+	case 0:
+		_, err = ref.Create(ctx, doc)
+	default:
+		_, err = ref.Update(ctx, []firestore.Update{
+			{Path: "url", Value: doc.URL},
+			{Path: "created", Value: doc.Created},
+			{Path: "owner", Value: doc.Owner},
+			{Path: "record", Value: doc.Record},
+		}, firestore.LastUpdateTime(time.Unix(0, generation)))
+	}
+	return firestoreError(err)
+}
+
+func (s *firestoreLinkStore) delete(ctx context.Context, code string) error {
+	ctx, span := tracer.Start(ctx, "firestoreLinkStore.delete")
+	defer span.End()
+	_, err := s.client.Collection(s.collection).Doc(code).Delete(ctx, firestore.Exists)
+	return firestoreError(err)
+}
+
+func (s *firestoreLinkStore) list(ctx context.Context, after string, visit func(code string) error) error {
+	ctx, span := tracer.Start(ctx, "firestoreLinkStore.list")
+	defer span.End()
+	query := s.client.Collection(s.collection).Select().OrderBy(firestore.DocumentID, firestore.Asc)
+	if after != "" {
+		query = query.StartAfter(after)
+	}
+	documents := query.Documents(ctx)
+	defer documents.Stop()
+	for {
+		snapshot, err := documents.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = visit(snapshot.Ref.ID)
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/firestore"
+	"cloud.google.com/go/storage"
+)
+
+// Codes the list step creates, one more than a page of GCS listings and of Redis SCAN
+const storeCheckListed = 1001
+
+// Writers creating the codes of the list step, and racing for the code of the concurrent create step
+const storeCheckWriters = 16
+
+// Time the whole check may take
+const storeCheckTimeout = 5 * time.Minute
+
+// Returned by list visitors once they've seen enough
+var errListDone = errors.New("listing done")
+
+// The in-memory store used with --local
+func TestMemoryLinkStore(t *testing.T) {
+	checkLinkStore(t, memoryLinkStore{&memoryBucket{objects: map[string]*memoryObject{}}})
+}
+
+// BUCKET on an emulator such as fake-gcs-server, e.g. STORAGE_EMULATOR_HOST=localhost:4443 BUCKET=links
+func TestGCSLinkStore(t *testing.T) {
+	host, bucket := os.Getenv("STORAGE_EMULATOR_HOST"), os.Getenv("BUCKET")
+	if host == "" || bucket == "" {
+		t.Skip("STORAGE_EMULATOR_HOST and BUCKET not set")
+	}
+	config.StorageEmulatorHost, config.Bucket = host, bucket
+	checkLinkStore(t, gcsLinkStore{})
+}
+
+// The Firestore emulator, e.g. FIRESTORE_EMULATOR_HOST=localhost:8081
+func TestFirestoreLinkStore(t *testing.T) {
+	if os.Getenv("FIRESTORE_EMULATOR_HOST") == "" {
+		t.Skip("FIRESTORE_EMULATOR_HOST not set")
+	}
+	client, err := firestore.NewClient(context.Background(), "storecheck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	checkLinkStore(t, &firestoreLinkStore{client, defaultFirestoreCollection})
+}
+
+// A scratch Redis, e.g. REDIS_ADDR=localhost:6379
+func TestRedisLinkStore(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		t.Skip("REDIS_ADDR not set")
+	}
+	config.RedisAddr = addr
+	store := newRedisLinkStore()
+	defer store.pool.Close()
+	checkLinkStore(t, store)
+}
+
+// Run the contract every link store has to fulfil against a store, with throwaway codes removed again afterwards.
+// Steps build on each other, so the check stops at the first failing one.
+func checkLinkStore(t *testing.T, store linkStore) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeCheckTimeout)
+	defer cancel()
+	random := make([]byte, 6)
+	rand.Read(random)
+	prefix := "storecheck-" + hex.EncodeToString(random) + "-"
+
+	var created sync.Map
+	code := func(name string) string {
+		created.Store(prefix+name, true)
+		return prefix + name
+	}
+	defer func() {
+		created.Range(func(key, _ interface{}) bool {
+			store.delete(ctx, key.(string))
+			return true
+		})
+	}()
+	step := func(name string, check func() error) {
+		if t.Failed() {
+			return
+		}
+		t.Run(name, func(t *testing.T) {
+			if err := check(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+
+	step("read missing", func() error {
+		_, err := store.read(ctx, code("missing"), 0)
+		return expectNotExist(err)
+	})
+	step("delete missing", func() error {
+		return expectNotExist(store.delete(ctx, code("missing")))
+	})
+	step("create", func() error {
+		data := storeCheckRecord("create")
+		err := store.write(ctx, code("create"), data, 0)
+		if err != nil {
+			return err
+		}
+		return expectRecord(ctx, store, prefix+"create", data)
+	})
+	step("create existing", func() error {
+		err := store.write(ctx, code("create"), storeCheckRecord("again"), 0)
+		if !isPreconditionFailed(err) {
+			return fmt.Errorf("expected a failed precondition, got %v", err)
+		}
+		return expectRecord(ctx, store, prefix+"create", storeCheckRecord("create"))
+	})
+	step("concurrent create", func() error {
+		return checkConcurrentCreate(ctx, store, code("race"))
+	})
+	step("limited read", func() error {
+		data := storeCheckRecord("create")
+		stored, err := store.read(ctx, code("create"), 10)
+		if err != nil {
+			return err
+		}
+		if string(stored.data) != string(data[:10]) || stored.size != int64(len(data)) {
+			return fmt.Errorf("expected the first 10 of %d bytes, got %d bytes of %d", len(data), len(stored.data), stored.size)
+		}
+		return nil
+	})
+	step("conditional update", func() error {
+		return checkConditionalUpdate(ctx, store, code("update"))
+	})
+	step("unconditional write", func() error {
+		for _, name := range []string{"create", "overwrite"} {
+			data := storeCheckRecord("overwritten")
+			err := store.write(ctx, code(name), data, anyGeneration)
+			if err != nil {
+				return err
+			}
+			err = expectRecord(ctx, store, prefix+name, data)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	step("delete", func() error {
+		err := store.delete(ctx, code("create"))
+		if err != nil {
+			return err
+		}
+		_, err = store.read(ctx, prefix+"create", 0)
+		if err = expectNotExist(err); err != nil {
+			return err
+		}
+		if err = expectNotExist(store.delete(ctx, prefix+"create")); err != nil {
+			return fmt.Errorf("deleting twice: %v", err)
+		}
+		// Deleted codes can be created again
+		data := storeCheckRecord("recreated")
+		err = store.write(ctx, prefix+"create", data, 0)
+		if err != nil {
+			return fmt.Errorf("creating again: %v", err)
+		}
+		return expectRecord(ctx, store, prefix+"create", data)
+	})
+	step("unicode code", func() error {
+		unicode := code("ünïcødé-✓-短")
+		data := storeCheckRecord("unicode")
+		err := store.write(ctx, unicode, data, 0)
+		if err != nil {
+			return err
+		}
+		err = expectRecord(ctx, store, unicode, data)
+		if err != nil {
+			return err
+		}
+		listed, err := listPrefix(ctx, store, prefix)
+		if err != nil {
+			return err
+		}
+		if !listed[unicode] {
+			return fmt.Errorf("%q isn't listed", unicode)
+		}
+		return nil
+	})
+	step("list", func() error {
+		return checkList(ctx, store, prefix, code)
+	})
+	step("list after", func() error {
+		first := ""
+		err := store.list(ctx, prefix+"list-0499", func(listedCode string) error {
+			first = listedCode
+			return errListDone
+		})
+		if err != errListDone || first != prefix+"list-0500" {
+			return fmt.Errorf("expected %q first, got %q (%v)", prefix+"list-0500", first, err)
+		}
+		return nil
+	})
+	step("list stops", func() error {
+		visited := 0
+		err := store.list(ctx, "", func(string) error {
+			visited++
+			return errListDone
+		})
+		if err != errListDone || visited != 1 {
+			return fmt.Errorf("expected the visitor's error after 1 code, got %v after %d", err, visited)
+		}
+		return nil
+	})
+}
+
+// Encoded link written by the check, distinguishable by its marker
+func storeCheckRecord(marker string) []byte {
+	data, _ := json.Marshal(link{URL: "https://example.com/storecheck/" + marker})
+	return data
+}
+
+func expectNotExist(err error) error {
+	if err != storage.ErrObjectNotExist {
+		return fmt.Errorf("expected storage.ErrObjectNotExist, got %v", err)
+	}
+	return nil
+}
+
+// Check a code holds exactly some data, at a generation usable for conditional writes
+func expectRecord(ctx context.Context, store linkStore, code string, data []byte) error {
+	stored, err := store.read(ctx, code, 0)
+	if err != nil {
+		return err
+	}
+	if string(stored.data) != string(data) || stored.size != int64(len(data)) {
+		return fmt.Errorf("%q holds %d bytes (size %d) other than the %d written", code, len(stored.data), stored.size, len(data))
+	}
+	if stored.generation == 0 || stored.generation == anyGeneration {
+		return fmt.Errorf("%q has the reserved generation %d", code, stored.generation)
+	}
+	return nil
+}
+
+// Let writers race to create the same code, exactly one of them has to win
+func checkConcurrentCreate(ctx context.Context, store linkStore, code string) error {
+	errs := make([]error, storeCheckWriters)
+	var wg sync.WaitGroup
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = store.write(ctx, code, storeCheckRecord(fmt.Sprint("writer-", i)), 0)
+		}(i)
+	}
+	wg.Wait()
+	winner := -1
+	for i, err := range errs {
+		switch {
+		case err == nil && winner >= 0:
+			return fmt.Errorf("writers %d and %d both created the code", winner, i)
+		case err == nil:
+			winner = i
+		case !isPreconditionFailed(err):
+			return fmt.Errorf("writer %d: %v", i, err)
+		}
+	}
+	if winner < 0 {
+		return fmt.Errorf("none of %d writers created the code", len(errs))
+	}
+	return expectRecord(ctx, store, code, storeCheckRecord(fmt.Sprint("writer-", winner)))
+}
+
+// Update at the current generation, then fail with the outdated one
+func checkConditionalUpdate(ctx context.Context, store linkStore, code string) error {
+	err := store.write(ctx, code, storeCheckRecord("v1"), 0)
+	if err != nil {
+		return err
+	}
+	first, err := store.read(ctx, code, 0)
+	if err != nil {
+		return err
+	}
+	err = store.write(ctx, code, storeCheckRecord("v2"), first.generation)
+	if err != nil {
+		return fmt.Errorf("writing at the current generation: %v", err)
+	}
+	second, err := store.read(ctx, code, 0)
+	if err != nil {
+		return err
+	}
+	if second.generation == first.generation {
+		return fmt.Errorf("generation %d didn't change with the update", first.generation)
+	}
+	err = store.write(ctx, code, storeCheckRecord("v3"), first.generation)
+	if !isPreconditionFailed(err) {
+		return fmt.Errorf("expected a failed precondition writing at an outdated generation, got %v", err)
+	}
+	return expectRecord(ctx, store, code, storeCheckRecord("v2"))
+}
+
+// Create more codes than fit a page and list them all back, each once and in lexical order
+func checkList(ctx context.Context, store linkStore, prefix string, code func(string) string) error {
+	names := make(chan string)
+	failed := make(chan error, storeCheckWriters)
+	var wg sync.WaitGroup
+	for i := 0; i < storeCheckWriters; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for name := range names {
+				err := store.write(ctx, name, storeCheckRecord("listed"), 0)
+				if err != nil {
+					failed <- err
+					return
+				}
+			}
+		}()
+	}
+	expected := []string{}
+	for i := 0; i < storeCheckListed; i++ {
+		name := code(fmt.Sprintf("list-%04d", i))
+		expected = append(expected, name)
+		select {
+		case names <- name:
+		case err := <-failed:
+			close(names)
+			wg.Wait()
+			return err
+		}
+	}
+	close(names)
+	wg.Wait()
+	select {
+	case err := <-failed:
+		return err
+	default:
+	}
+
+	listed := []string{}
+	previous := ""
+	err := store.list(ctx, "", func(listedCode string) error {
+		if listedCode <= previous {
+			return fmt.Errorf("%q listed after %q", listedCode, previous)
+		}
+		previous = listedCode
+		if strings.HasPrefix(listedCode, prefix+"list-") {
+			listed = append(listed, listedCode)
+		}
+		// Codes are listed in order, none of the check's can follow
+		if listedCode > prefix+"\U0010FFFF" {
+			return errListDone
+		}
+		return nil
+	})
+	if err != nil && err != errListDone {
+		return err
+	}
+	sort.Strings(expected)
+	if strings.Join(listed, "\n") != strings.Join(expected, "\n") {
+		return fmt.Errorf("listed %d of the %d codes created", len(listed), len(expected))
+	}
+	return nil
+}
+
+// Codes below a prefix, listed from the prefix on until the first code after them
+func listPrefix(ctx context.Context, store linkStore, prefix string) (map[string]bool, error) {
+	listed := map[string]bool{}
+	err := store.list(ctx, "", func(code string) error {
+		if strings.HasPrefix(code, prefix) {
+			listed[code] = true
+		} else if code > prefix {
+			return errListDone
+		}
+		return nil
+	})
+	if err != nil && err != errListDone {
+		return nil, err
+	}
+	return listed, nil
+}
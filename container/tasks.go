@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"golang.org/x/oauth2/google"
+)
+
+// Defaults of the task runner
+const (
+	defaultTaskWorkers  = 4
+	defaultTaskAttempts = 5
+	taskQueueSize       = 1000
+	// Delay before the first retry, doubled with every further attempt
+	taskBackoff = time.Second
+)
+
+// struct taskKind is a kind of background work and how to run it.
+type taskKind struct {
+	// Work to do for a payload
+	run func(ctx context.Context, payload []byte) error
+	// Attempts before a task is dead-lettered (0 means defaultTaskAttempts)
+	attempts int
+	// Whether the task depends on this instance's memory and must never leave it
+	local bool
+}
+
+// struct task is a single unit of background work.
+type task struct {
+	Kind    string          `json:"kind"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+	// Attempts made so far
+	Attempts int `json:"attempts"`
+}
+
+// struct deadLetter records a task which failed on every attempt.
+type deadLetter struct {
+	task
+	Error  string    `json:"error"`
+	Failed time.Time `json:"failed"`
+}
+
+// interface executor runs tasks somewhere.
+type executor interface {
+	submit(ctx context.Context, t task) error
+}
+
+// Registered kinds of tasks by name
+var taskKinds = map[string]*taskKind{}
+
+// Executor for tasks which may run anywhere, set up by startTaskRunner
+var remote executor
+
+// Executor running tasks on this instance
+var local *localExecutor
+
+// Register all kinds of background work
+func registerTasks() {
+	taskKinds["flush-analytics"] = &taskKind{local: true, attempts: 1, run: func(ctx context.Context, _ []byte) error {
+		flushClicks(ctx)
+		flushBandits(ctx)
+		return nil
+	}}
+	taskKinds["dispatch-link-events"] = &taskKind{run: func(ctx context.Context, payload []byte) error {
+		code := ""
+		err := json.Unmarshal(payload, &code)
+		if err != nil {
+			return err
+		}
+		return dispatchLinkEvents(ctx, code)
+	}}
+	taskKinds["dispatch-event"] = &taskKind{run: func(ctx context.Context, payload []byte) error {
+		name := ""
+		err := json.Unmarshal(payload, &name)
+		if err != nil {
+			return err
+		}
+		return dispatchStoredEvent(ctx, name)
+	}}
+	taskKinds["bulk-job"] = &taskKind{attempts: 3, run: func(ctx context.Context, payload []byte) error {
+		id := ""
+		err := json.Unmarshal(payload, &id)
+		if err != nil {
+			return err
+		}
+		err = runJob(ctx, id)
+		if err == errJobBusy || err == errJobLost {
+			return nil
+		}
+		return err
+	}}
+	taskKinds["store-anomaly"] = &taskKind{run: func(ctx context.Context, payload []byte) error {
+		a := anomaly{}
+		err := json.Unmarshal(payload, &a)
+		if err != nil {
+			return err
+		}
+		return storeAnomaly(ctx, a)
+	}}
+	taskKinds["screenshot"] = &taskKind{attempts: 3, run: func(ctx context.Context, payload []byte) error {
+		target := destinationTask{}
+		err := json.Unmarshal(payload, &target)
+		if err != nil {
+			return err
+		}
+		return captureScreenshot(ctx, target.Code, target.URL)
+	}}
+	taskKinds["fingerprint"] = &taskKind{attempts: 3, run: func(ctx context.Context, payload []byte) error {
+		target := destinationTask{}
+		err := json.Unmarshal(payload, &target)
+		if err != nil {
+			return err
+		}
+		return captureFingerprint(ctx, target.Code, target.URL)
+	}}
+}
+
+// struct destinationTask is the payload of tasks working on a link's destination.
+type destinationTask struct {
+	Code string `json:"code"`
+	URL  string `json:"url"`
+}
+
+// Set up the local worker pool (TASK_WORKERS) and the executor for tasks which may leave the instance.
+// TASK_EXECUTOR=cloudtasks hands them to the Cloud Tasks queue CLOUD_TASKS_QUEUE instead, callbacks need SIGNING_SECRET.
+func startTaskRunner() {
+	registerTasks()
+	workers := config.TaskWorkers
+	if workers <= 0 {
+		workers = defaultTaskWorkers
+	}
+	local = &localExecutor{queue: make(chan task, taskQueueSize)}
+	for i := 0; i < workers; i++ {
+		go local.work()
+	}
+	remote = local
+	if config.TaskExecutor == "cloudtasks" && config.CloudTasksQueue != "" && config.SigningSecret != "" {
+		remote = &cloudTasksExecutor{queue: config.CloudTasksQueue}
+	}
+}
+
+// Submit background work of a registered kind
+func enqueue(ctx context.Context, kind string, payload interface{}) error {
+	ctx, span := tracer.Start(ctx, "enqueue")
+	defer span.End()
+	k, ok := taskKinds[kind]
+	if !ok {
+		return fmt.Errorf("unknown task kind %q", kind)
+	}
+	t := task{Kind: kind}
+	if payload != nil {
+		marshalled, err := json.Marshal(payload)
+		if err != nil {
+			return err
+		}
+		t.Payload = marshalled
+	}
+	if k.local {
+		return local.submit(ctx, t)
+	}
+	return remote.submit(ctx, t)
+}
+
+// Maximum number of attempts of a kind of task
+func (k *taskKind) maxAttempts() int {
+	if k.attempts > 0 {
+		return k.attempts
+	}
+	return defaultTaskAttempts
+}
+
+// Run a task once with the handler of its kind
+func execute(ctx context.Context, t task) error {
+	ctx, span := tracer.Start(ctx, "execute")
+	defer span.End()
+	k, ok := taskKinds[t.Kind]
+	if !ok {
+		return fmt.Errorf("unknown task kind %q", t.Kind)
+	}
+	return k.run(ctx, t.Payload)
+}
+
+// Store a task which failed on every attempt under deadletter/ for inspection
+func deadLetterTask(ctx context.Context, t task, cause error) {
+	ctx, span := tracer.Start(ctx, "deadLetterTask")
+	defer span.End()
+	slog.Error("task failed too often, dead-lettering", "task", t.Kind, "attempts", t.Attempts, "err", cause)
+	now := clock().UTC()
+	random := make([]byte, 4)
+	rand.Read(random)
+	marshalled, err := json.Marshal(deadLetter{t, redactError(cause), now})
+	if err == nil {
+		name := fmt.Sprintf("deadletter/%s/%s-%s.json", t.Kind, now.Format("20060102T150405.000000000"), hex.EncodeToString(random))
+		err = gcsWriteBlob(ctx, name, "application/json", marshalled)
+	}
+	if err != nil {
+		slog.Error("unable to dead-letter task", "task", t.Kind, "err", err)
+	}
+}
+
+// struct localExecutor runs tasks on a bounded pool of goroutines, retrying with exponential backoff.
+type localExecutor struct {
+	queue chan task
+}
+
+// Queue a task, failing if the pool is saturated
+func (e *localExecutor) submit(ctx context.Context, t task) error {
+	select {
+	case e.queue <- t:
+		return nil
+	default:
+		return fmt.Errorf("task queue is full, dropping %s task", t.Kind)
+	}
+}
+
+// Process queued tasks until the queue is closed
+func (e *localExecutor) work() {
+	for t := range e.queue {
+		t.Attempts++
+		err := execute(context.Background(), t)
+		if err == nil {
+			continue
+		}
+		if t.Attempts >= taskKinds[t.Kind].maxAttempts() {
+			deadLetterTask(context.Background(), t, err)
+			continue
+		}
+		retry := t
+		time.AfterFunc(taskBackoff<<uint(t.Attempts-1), func() {
+			err := e.submit(context.Background(), retry)
+			if err != nil {
+				deadLetterTask(context.Background(), retry, err)
+			}
+		})
+	}
+}
+
+// struct cloudTasksExecutor hands tasks to a Cloud Tasks queue, which calls back /internal/tasks/{kind}.
+// Retries follow the queue's retry configuration.
+type cloudTasksExecutor struct {
+	// Queue as projects/<project>/locations/<location>/queues/<queue>
+	queue string
+}
+
+// Create an HTTP task in the queue
+func (e *cloudTasksExecutor) submit(ctx context.Context, t task) error {
+	ctx, span := tracer.Start(ctx, "cloudTasksSubmit")
+	defer span.End()
+	client, err := google.DefaultClient(ctx, "https://www.googleapis.com/auth/cloud-platform")
+	if err != nil {
+		return err
+	}
+	body := []byte(t.Payload)
+	request := map[string]interface{}{
+		"task": map[string]interface{}{
+			"httpRequest": map[string]interface{}{
+				"url":        fmt.Sprintf("https://%s/internal/tasks/%s", config.Domain, t.Kind),
+				"httpMethod": "POST",
+				"headers":    map[string]string{"Content-Type": "application/json", "X-Urly-Task-Signature": sign(taskSubject(t.Kind, body))},
+				"body":       base64.StdEncoding.EncodeToString(body),
+			},
+		},
+	}
+	marshalled, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://cloudtasks.googleapis.com/v2/"+e.queue+"/tasks", bytes.NewReader(marshalled))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("cloud tasks answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// Subject signed to authenticate task callbacks
+func taskSubject(kind string, payload []byte) string {
+	return "task:" + kind + ":" + string(payload)
+}
+
+// POST handler running a task delivered by Cloud Tasks.
+// Answers 500 to have the task retried and dead-letters it on the last attempt.
+func taskHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "taskHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	kind := mux.Vars(r)["kind"]
+	payload, err := ioutil.ReadAll(r.Body)
+	if err != nil || !verifySignature(taskSubject(kind, payload), r.Header.Get("X-Urly-Task-Signature")) {
+		forbidden(ctx, w, "invalid task signature!")
+		return
+	}
+	k, ok := taskKinds[kind]
+	if !ok {
+		respond(ctx, response{"", "unknown task kind!"}, http.StatusNotFound, w)
+		return
+	}
+	retries, _ := strconv.Atoi(r.Header.Get("X-CloudTasks-TaskRetryCount"))
+	t := task{Kind: kind, Payload: payload, Attempts: retries + 1}
+	err = execute(ctx, t)
+	if err == nil {
+		respond(ctx, response{"", "task done!"}, http.StatusOK, w)
+		return
+	}
+	if t.Attempts >= k.maxAttempts() {
+		deadLetterTask(ctx, t, err)
+		respond(ctx, response{"", "task dead-lettered!"}, http.StatusOK, w)
+		return
+	}
+	respond(ctx, response{"", redactError(err)}, http.StatusInternalServerError, w)
+}
+
+// GET handler listing dead-lettered tasks, newest first
+func deadLettersHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "deadLettersHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	letters := []deadLetter{}
+	err := gcsListPrefix(ctx, "deadletter/", func(name string) error {
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			return err
+		}
+		letter := deadLetter{}
+		if json.Unmarshal(data, &letter) == nil {
+			letters = append(letters, letter)
+		}
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(letters, func(i, j int) bool { return letters[i].Failed.After(letters[j].Failed) })
+	respond(ctx, letters, http.StatusOK, w)
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	texporter "github.com/GoogleCloudPlatform/opentelemetry-operations-go/exporter/trace"
+	octrace "go.opencensus.io/trace"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracegrpc"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Destinations of trace spans (TRACE_EXPORTER)
+const (
+	traceOTLP       = "otlp"
+	traceCloudTrace = "cloudtrace"
+	traceNone       = "none"
+)
+
+// Samplers of OTEL_TRACES_SAMPLER, named as in the OpenTelemetry specification
+var traceSamplers = []string{"always_on", "always_off", "traceidratio", "parentbased_always_on", "parentbased_always_off", "parentbased_traceidratio"}
+
+// Sampler used while OTEL_TRACES_SAMPLER is unset, tracing every request like before
+const defaultTraceSampler = "parentbased_always_on"
+
+// Tracer of all spans, it hands out no-op spans until setupTracing installed the provider
+var tracer = otel.Tracer("urly-wurly")
+
+// Sampler of OTEL_TRACES_SAMPLER, with the ratio of OTEL_TRACES_SAMPLER_ARG (default 1) for the ratio based ones
+func traceSampler() (sdktrace.Sampler, error) {
+	name := config.TracesSampler
+	if name == "" {
+		name = defaultTraceSampler
+	}
+	ratio := 1.0
+	if strings.HasSuffix(name, "traceidratio") {
+		ratio = config.TracesSamplerArg
+		if ratio < 0 || ratio > 1 {
+			return nil, fmt.Errorf("OTEL_TRACES_SAMPLER_ARG must be a ratio between 0 and 1, got %v", ratio)
+		}
+	}
+	var root sdktrace.Sampler
+	switch strings.TrimPrefix(name, "parentbased_") {
+	case "always_on":
+		root = sdktrace.AlwaysSample()
+	case "always_off":
+		root = sdktrace.NeverSample()
+	case "traceidratio":
+		root = sdktrace.TraceIDRatioBased(ratio)
+	default:
+		return nil, fmt.Errorf("unknown OTEL_TRACES_SAMPLER %q", name)
+	}
+	if strings.HasPrefix(name, "parentbased_") {
+		return sdktrace.ParentBased(root), nil
+	}
+	return root, nil
+}
+
+// Destination of spans: TRACE_EXPORTER, or by default OTLP if an endpoint is configured
+// and Cloud Trace unless running locally
+func traceExporter(local bool) string {
+	switch {
+	case config.TraceExporter != "":
+		return config.TraceExporter
+	case otlpEndpoint() != "":
+		return traceOTLP
+	case local:
+		return traceNone
+	}
+	return traceCloudTrace
+}
+
+// Endpoint spans are exported to over OTLP, OTEL_EXPORTER_OTLP_TRACES_ENDPOINT taking precedence like in the exporter
+func otlpEndpoint() string {
+	if config.OTLPTracesEndpoint != "" {
+		return config.OTLPTracesEndpoint
+	}
+	return config.OTLPEndpoint
+}
+
+// Install the OpenTelemetry tracer provider, exporting sampled spans with secrets masked.
+// Without an exporter spans are still sampled, so metrics keep their exemplars.
+func setupTracing(ctx context.Context, local bool) (*sdktrace.TracerProvider, error) {
+	sampler, err := traceSampler()
+	if err != nil {
+		return nil, err
+	}
+	// OTEL_SERVICE_NAME and OTEL_RESOURCE_ATTRIBUTES take precedence
+	res, err := resource.New(ctx,
+		resource.WithAttributes(attribute.String("service.name", "urly-wurly"), attribute.String("service.version", version)),
+		resource.WithFromEnv())
+	if err != nil {
+		return nil, err
+	}
+	options := []sdktrace.TracerProviderOption{sdktrace.WithSampler(sampler), sdktrace.WithResource(res)}
+
+	var exporter sdktrace.SpanExporter
+	switch kind := traceExporter(local); kind {
+	case traceOTLP:
+		// Headers and TLS are taken from the other OTEL_EXPORTER_OTLP_* variables
+		var otlpOptions []otlptracegrpc.Option
+		if endpoint, parseErr := url.Parse(otlpEndpoint()); otlpEndpoint() != "" && parseErr == nil {
+			otlpOptions = append(otlpOptions, otlptracegrpc.WithEndpoint(endpoint.Host))
+			if endpoint.Scheme == "http" {
+				otlpOptions = append(otlpOptions, otlptracegrpc.WithInsecure())
+			}
+		}
+		exporter, err = otlptracegrpc.New(ctx, otlpOptions...)
+	case traceCloudTrace:
+		var cloudOptions []texporter.Option
+		if project := config.Project; project != "" {
+			cloudOptions = append(cloudOptions, texporter.WithProjectID(project))
+		}
+		exporter, err = texporter.New(cloudOptions...)
+	case traceNone:
+	default:
+		return nil, fmt.Errorf("unknown TRACE_EXPORTER %q", kind)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if exporter != nil {
+		options = append(options, sdktrace.WithBatcher(redactingExporter{exporter}))
+	}
+	provider := sdktrace.NewTracerProvider(options...)
+	otel.SetTracerProvider(provider)
+	return provider, nil
+}
+
+// Sampled span of a context in the form OpenCensus metrics keep as exemplar
+func exemplarSpanContext(ctx context.Context) (octrace.SpanContext, bool) {
+	spanContext := trace.SpanContextFromContext(ctx)
+	if !spanContext.IsSampled() {
+		return octrace.SpanContext{}, false
+	}
+	return octrace.SpanContext{
+		TraceID:      octrace.TraceID(spanContext.TraceID()),
+		SpanID:       octrace.SpanID(spanContext.SpanID()),
+		TraceOptions: octrace.TraceOptions(spanContext.TraceFlags()),
+	}, true
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"math"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"go.opencensus.io/tag"
+	"go.opentelemetry.io/otel/attribute"
+)
+
+// Defaults of the limits of expensive endpoints
+const (
+	defaultHeavyConcurrency = 4
+	defaultHeavyQueue       = 16
+	defaultHeavyQueueWait   = 10 * time.Second
+)
+
+// Stats requests spanning more days than this are expensive
+const heavyStatsDays = 31
+
+// Limits of expensive endpoints, set up by setupThrottling.
+// They keep exports, batches and large stats from starving redirects of CPU, memory and storage calls.
+var heavy struct {
+	// Requests served at the same time
+	slots chan struct{}
+	// Requests waiting for a slot
+	waiting int32
+	// Maximum number of waiting requests
+	queue int32
+	// How long a request waits for a slot
+	wait time.Duration
+	// Expensive requests per client IP, nil without HEAVY_RATE_LIMIT
+	clients *limiter
+}
+
+// Configure the limits of expensive endpoints from HEAVY_CONCURRENCY (requests served at once per instance),
+// HEAVY_QUEUE (requests waiting for a slot), HEAVY_QUEUE_TIMEOUT and HEAVY_RATE_LIMIT (requests per minute per IP)
+func setupThrottling() {
+	concurrency := config.HeavyConcurrency
+	if concurrency <= 0 {
+		concurrency = defaultHeavyConcurrency
+	}
+	queue := config.HeavyQueue
+	if queue < 0 {
+		queue = defaultHeavyQueue
+	}
+	wait := config.HeavyQueueTimeout
+	if wait <= 0 {
+		wait = defaultHeavyQueueWait
+	}
+	heavy.slots = make(chan struct{}, concurrency)
+	heavy.queue = int32(queue)
+	heavy.wait = wait
+	if rate := config.HeavyRateLimit; rate > 0 {
+		heavy.clients = newLimiter(rate, rate)
+	}
+}
+
+// Wrap an expensive endpoint in the limits of setupThrottling
+func throttled(endpoint string, next http.HandlerFunc) http.HandlerFunc {
+	return throttledWhen(endpoint, nil, next)
+}
+
+// Wrap an endpoint which is expensive for some requests, those for which expensive returns true
+func throttledWhen(endpoint string, expensive func(r *http.Request) bool, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if heavy.slots == nil || r.Method == http.MethodOptions || (expensive != nil && !expensive(r)) {
+			next(w, r)
+			return
+		}
+		ctx := context.Background()
+		ctx, span := tracer.Start(ctx, "throttled")
+		defer span.End()
+		span.SetAttributes(attribute.String("endpoint", endpoint))
+		if heavy.clients != nil {
+			ip := clientIP(r)
+			if !heavy.clients.allow(ip, time.Now()) {
+				shed(ctx, w, endpoint, http.StatusTooManyRequests, heavy.clients.wait(ip), "too many expensive requests, slow down!")
+				return
+			}
+		}
+		if !acquireSlot(r) {
+			shed(ctx, w, endpoint, http.StatusServiceUnavailable, heavy.wait, "server is busy, try again later!")
+			return
+		}
+		defer func() { <-heavy.slots }()
+		next(w, r)
+	}
+}
+
+// Take a slot, waiting in the queue for one if there's room there.
+// Returns false if the queue is full, the wait times out or the client goes away.
+func acquireSlot(r *http.Request) bool {
+	select {
+	case heavy.slots <- struct{}{}:
+		return true
+	default:
+	}
+	if atomic.AddInt32(&heavy.waiting, 1) > heavy.queue {
+		atomic.AddInt32(&heavy.waiting, -1)
+		return false
+	}
+	defer atomic.AddInt32(&heavy.waiting, -1)
+	timer := time.NewTimer(heavy.wait)
+	defer timer.Stop()
+	select {
+	case heavy.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+		return false
+	case <-r.Context().Done():
+		return false
+	}
+}
+
+// Reject an expensive request, telling the client when to retry
+func shed(ctx context.Context, w http.ResponseWriter, endpoint string, status int, retry time.Duration, message string) {
+	record(ctx, []tag.Mutator{tag.Upsert(keyEndpoint, endpoint)}, throttledRequests.M(1))
+	rejectOverload(ctx, w, status, retry, message)
+}
+
+// Respond to a request turned away to protect the instance, with Retry-After in whole seconds
+func rejectOverload(ctx context.Context, w http.ResponseWriter, status int, retry time.Duration, message string) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Retry-After")
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(retry.Seconds())))))
+	respond(ctx, response{"", message}, status, w)
+}
+
+// Report whether a stats request spans more than heavyStatsDays
+func largeStatsRange(r *http.Request) bool {
+	from, to, err := parseRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"), clock())
+	// Invalid ranges are rejected by the handler
+	return err == nil && to.Sub(from) >= heavyStatsDays*24*time.Hour
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Error returned when a code was used before and the reuse policy forbids issuing it again
+var errCodeRetired = errors.New("short code is retired")
+
+// struct tombstone remembers a deleted link, so its code isn't reissued for another destination.
+type tombstone struct {
+	Code string `json:"code"`
+	// SHA-256 of the destination, reissuing the code for it is always allowed
+	Destination string `json:"destination"`
+	// Time the link was deleted
+	Deleted time.Time `json:"deleted"`
+	// Fallback of the link, shown to visitors of the deleted code
+	Fallback *fallback `json:"fallback,omitempty"`
+}
+
+// Name of the GCS object holding the tombstone of a code
+func tombstoneObject(code string) string {
+	return "tombstones/" + code + ".json"
+}
+
+// Hash of a destination as kept in tombstones
+func destinationHash(destination string) string {
+	sum := sha256.Sum256([]byte(destination))
+	return hex.EncodeToString(sum[:])
+}
+
+// Policy for reissuing codes of deleted, expired or consumed links, CODE_REUSE:
+// "immediately" (default), "never", or a number of days after which a code may be reissued.
+// Returns whether codes are never reissued and how long they rest otherwise.
+func codeReusePolicy() (bool, time.Duration) {
+	policy := strings.ToLower(strings.TrimSpace(config.CodeReuse))
+	if policy == "never" {
+		return true, 0
+	}
+	days, err := strconv.Atoi(policy)
+	if err != nil || days <= 0 {
+		return false, 0
+	}
+	return false, time.Duration(days) * 24 * time.Hour
+}
+
+// Report whether a code retired at the given time may be reissued now
+func reusable(retired time.Time, now time.Time) bool {
+	never, rest := codeReusePolicy()
+	return !never && !now.Before(retired.Add(rest))
+}
+
+// Time a stored link stopped being usable, zero if it still is
+func (l *link) retired(now time.Time) time.Time {
+	if !l.Consumed.IsZero() {
+		return l.Consumed
+	}
+	if l.expired(now) {
+		return l.Expires
+	}
+	return time.Time{}
+}
+
+// Check whether a code may be issued for a destination under the reuse policy.
+// Codes of expired or consumed links count as retired like those of deleted ones.
+func checkCodeReuse(ctx context.Context, code string, destination string, now time.Time) error {
+	ctx, span := tracer.Start(ctx, "checkCodeReuse")
+	defer span.End()
+	if l, err := readLink(ctx, code); err == nil {
+		retired := l.retired(now)
+		if retired.IsZero() || l.URL == destination || reusable(retired, now) {
+			return nil
+		}
+		return errCodeRetired
+	}
+	data, _, err := gcsReadBlob(ctx, tombstoneObject(code))
+	if err == storage.ErrObjectNotExist {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	t := tombstone{}
+	err = json.Unmarshal(data, &t)
+	if err != nil {
+		return err
+	}
+	if t.Destination == destinationHash(destination) || reusable(t.Deleted, now) {
+		return nil
+	}
+	return errCodeRetired
+}
+
+// Remember a link which is about to be deleted, with its fallback if kept
+func writeTombstone(ctx context.Context, code string, l *link, keepFallback bool) error {
+	ctx, span := tracer.Start(ctx, "writeTombstone")
+	defer span.End()
+	t := tombstone{code, destinationHash(l.URL), clock().UTC(), nil}
+	if keepFallback {
+		t.Fallback = l.Fallback
+	}
+	marshalled, err := json.Marshal(t)
+	if err != nil {
+		return err
+	}
+	return gcsWriteBlob(ctx, tombstoneObject(code), "application/json", marshalled)
+}
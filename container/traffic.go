@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Settings of the traffic anomaly detector
+const (
+	// Hours of history the detector learns from
+	trafficHistory = 7 * 24
+	// Weight of the newest hour in the moving average
+	trafficAlpha = 0.1
+	// Default hourly clicks below which a link is too quiet to judge
+	defaultTrafficMinClicks = 5
+)
+
+// Kinds of traffic anomalies
+const (
+	trafficSpike = "spike"
+	trafficDrop  = "drop"
+)
+
+// Client posting anomalies to TRAFFIC_WEBHOOK
+var webhookClient = &http.Client{Timeout: 10 * time.Second}
+
+// struct trafficAnomaly records an hour in which a link's clicks left their usual range.
+type trafficAnomaly struct {
+	// Short code of the link
+	Code string `json:"code"`
+	// Owner of the link, if any
+	Owner string `json:"owner,omitempty"`
+	// Start of the unusual hour
+	Hour time.Time `json:"hour"`
+	// Kind of anomaly (spike, drop)
+	Kind string `json:"kind"`
+	// Clicks in the hour
+	Clicks int64 `json:"clicks"`
+	// Clicks expected from the moving average
+	Expected float64 `json:"expected"`
+	// Distance from the expectation in standard deviations
+	Score float64 `json:"score"`
+}
+
+// Name of the GCS object recording a traffic anomaly
+func trafficAnomalyObject(code string, hour time.Time) string {
+	return fmt.Sprintf("traffic/%s/%s.json", code, hour.Format("2006-01-02T15"))
+}
+
+// Hourly clicks of a code for the hours ending with (and including) last
+func hourlyClicks(ctx context.Context, code string, last time.Time, hours int) ([]int64, error) {
+	first := last.Add(-time.Duration(hours-1) * time.Hour)
+	rollups, err := readRollups(ctx, code, first, last)
+	if err != nil {
+		return nil, err
+	}
+	byDate := map[string]*dailyRollup{}
+	for _, rollup := range rollups {
+		byDate[rollup.Date] = rollup
+	}
+	series := make([]int64, hours)
+	for i := range series {
+		hour := first.Add(time.Duration(i) * time.Hour)
+		if rollup, ok := byDate[hour.Format(rollupDate)]; ok {
+			series[i] = rollup.Hours[hour.Hour()]
+		}
+	}
+	return series, nil
+}
+
+// Judge the last value of a series against an exponentially weighted average of the ones before.
+// Returns the kind of anomaly ("" if none), the expected value and the score.
+func detectTraffic(series []int64, threshold float64, minClicks float64) (string, float64, float64) {
+	if len(series) < 2 {
+		return "", 0, 0
+	}
+	mean := float64(series[0])
+	variance := 0.0
+	for _, clicks := range series[1 : len(series)-1] {
+		diff := float64(clicks) - mean
+		increment := trafficAlpha * diff
+		mean += increment
+		variance = (1 - trafficAlpha) * (variance + diff*increment)
+	}
+	current := float64(series[len(series)-1])
+	// Poisson noise as floor, so perfectly steady links don't alert on a single extra click
+	deviation := math.Max(math.Sqrt(variance), math.Sqrt(math.Max(mean, 1)))
+	score := (current - mean) / deviation
+	switch {
+	case score >= threshold && current >= minClicks:
+		return trafficSpike, mean, score
+	case score <= -threshold && mean >= minClicks:
+		return trafficDrop, mean, score
+	}
+	return "", mean, score
+}
+
+// Check the last complete hour of every link hourly on one instance, if TRAFFIC_ANOMALY_THRESHOLD is set
+func startTrafficDetector() {
+	threshold := config.TrafficAnomalyThreshold
+	if threshold <= 0 {
+		return
+	}
+	minClicks := config.TrafficMinClicks
+	if minClicks <= 0 {
+		minClicks = defaultTrafficMinClicks
+	}
+	startSingleton("traffic-detector", time.Hour, func(ctx context.Context) error {
+		hour := clock().UTC().Truncate(time.Hour).Add(-time.Hour)
+		return detectTrafficAnomalies(ctx, hour, threshold, minClicks)
+	})
+}
+
+// Run the detector over the given hour of every link and record what it finds
+func detectTrafficAnomalies(ctx context.Context, hour time.Time, threshold float64, minClicks float64) error {
+	ctx, span := tracer.Start(ctx, "detectTrafficAnomalies")
+	defer span.End()
+	return linkStorage.list(ctx, "", func(code string) error {
+		l, err := readLink(ctx, code)
+		if err != nil || l.NoAnalytics {
+			return nil
+		}
+		series, err := hourlyClicks(ctx, code, hour, trafficHistory+1)
+		if err != nil {
+			return err
+		}
+		kind, expected, score := detectTraffic(series, threshold, minClicks)
+		if kind == "" {
+			return nil
+		}
+		a := trafficAnomaly{Code: code, Owner: l.Owner, Hour: hour, Kind: kind, Clicks: series[len(series)-1], Expected: expected, Score: score}
+		return recordTrafficAnomaly(ctx, a)
+	})
+}
+
+// Store a traffic anomaly and notify the webhook through the outbox.
+// The event's ID is derived from the anomaly, so only the first instance to store it notifies.
+func recordTrafficAnomaly(ctx context.Context, a trafficAnomaly) error {
+	ctx, span := tracer.Start(ctx, "recordTrafficAnomaly")
+	defer span.End()
+	marshalled, err := json.Marshal(a)
+	if err != nil {
+		return err
+	}
+	webhook := config.TrafficWebhook != ""
+	e := event{ID: "traffic-" + a.Code + "-" + a.Hour.Format("2006010215"), Type: eventTrafficAnomaly, Code: a.Code, Time: clock().UTC(), Data: marshalled}
+	if webhook {
+		err = storeEvent(ctx, e)
+		if isPreconditionFailed(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	err = gcsWriteIfGeneration(ctx, trafficAnomalyObject(a.Code, a.Hour), "application/json", marshalled, 0)
+	if isPreconditionFailed(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	slog.Warn("traffic anomaly", "kind", a.Kind, "code", a.Code, "clicks", a.Clicks, "expected", a.Expected)
+	if webhook {
+		err = enqueue(ctx, "dispatch-event", outboxObject(e.ID))
+		if err != nil {
+			slog.Error("unable to queue traffic webhook", "err", err)
+		}
+	}
+	return nil
+}
+
+// POST an anomaly to TRAFFIC_WEBHOOK, signed with SIGNING_SECRET if set
+func notifyTrafficWebhook(ctx context.Context, body []byte) error {
+	ctx, span := tracer.Start(ctx, "notifyTrafficWebhook")
+	defer span.End()
+	req, err := http.NewRequest(http.MethodPost, config.TrafficWebhook, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if config.SigningSecret != "" {
+		req.Header.Set("X-Urly-Signature", sign(string(body)))
+	}
+	resp, err := webhookClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("traffic webhook answered %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// GET handler listing recorded traffic anomalies of an owner's links (or of all links for admins), newest first
+func trafficAnomaliesHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "trafficAnomaliesHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	owner := r.URL.Query().Get("owner")
+	if !isAdmin(r) && (owner == "" || !verifySignature(insightsSubject(owner), r.URL.Query().Get("sig"))) {
+		denyAccess(ctx, w, r, r.URL.Query().Get("sig"))
+		return
+	}
+	from, to, err := parseRange(r.URL.Query().Get("from"), r.URL.Query().Get("to"), clock())
+	if err != nil {
+		respond(ctx, response{"", "from and to should be dates (YYYY-MM-DD) at most a year apart!"}, http.StatusBadRequest, w)
+		return
+	}
+	to = to.Add(24 * time.Hour)
+	code := r.URL.Query().Get("code")
+	prefix := "traffic/"
+	if code != "" {
+		prefix += code + "/"
+	}
+
+	anomalies := []trafficAnomaly{}
+	err = gcsListPrefix(ctx, prefix, func(name string) error {
+		stamp := strings.TrimSuffix(name[strings.LastIndex(name, "/")+1:], ".json")
+		hour, err := time.Parse("2006-01-02T15", stamp)
+		if err != nil || hour.Before(from) || !hour.Before(to) {
+			return nil
+		}
+		data, _, err := gcsReadBlob(ctx, name)
+		if err != nil {
+			return err
+		}
+		a := trafficAnomaly{}
+		if json.Unmarshal(data, &a) != nil || (owner != "" && a.Owner != owner) {
+			return nil
+		}
+		anomalies = append(anomalies, a)
+		return nil
+	})
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	sort.Slice(anomalies, func(i, j int) bool { return anomalies[i].Hour.After(anomalies[j].Hour) })
+	respond(ctx, anomalies, http.StatusOK, w)
+}
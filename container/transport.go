@@ -0,0 +1,140 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"go.opencensus.io/tag"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/option"
+)
+
+// Defaults of the HTTP transport of the GCS client.
+// Go keeps only 2 idle connections per host by default, too few for concurrent redirects all talking to one host.
+const (
+	defaultGCSMaxIdleConns          = 256
+	defaultGCSMaxIdleConnsPerHost   = 128
+	defaultGCSIdleConnTimeout       = 90 * time.Second
+	defaultGCSDialTimeout           = 5 * time.Second
+	defaultGCSTLSHandshakeTimeout   = 5 * time.Second
+	defaultGCSResponseHeaderTimeout = 30 * time.Second
+)
+
+// Transport for GCS tuned by GCS_MAX_IDLE_CONNS, GCS_MAX_IDLE_CONNS_PER_HOST, GCS_IDLE_CONN_TIMEOUT,
+// GCS_DIAL_TIMEOUT, GCS_TLS_HANDSHAKE_TIMEOUT and GCS_RESPONSE_HEADER_TIMEOUT. GCS_HTTP2=false sticks to HTTP/1.1.
+func gcsTransport() *http.Transport {
+	maxIdle := config.GCSMaxIdleConns
+	if maxIdle <= 0 {
+		maxIdle = defaultGCSMaxIdleConns
+	}
+	maxIdlePerHost := config.GCSMaxIdleConnsPerHost
+	if maxIdlePerHost <= 0 {
+		maxIdlePerHost = defaultGCSMaxIdleConnsPerHost
+	}
+	timeout := func(configured time.Duration, fallback time.Duration) time.Duration {
+		if configured <= 0 {
+			return fallback
+		}
+		return configured
+	}
+	dialer := &net.Dialer{Timeout: timeout(config.GCSDialTimeout, defaultGCSDialTimeout), KeepAlive: 30 * time.Second}
+	transport := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           dialer.DialContext,
+		MaxIdleConns:          maxIdle,
+		MaxIdleConnsPerHost:   maxIdlePerHost,
+		IdleConnTimeout:       timeout(config.GCSIdleConnTimeout, defaultGCSIdleConnTimeout),
+		TLSHandshakeTimeout:   timeout(config.GCSTLSHandshakeTimeout, defaultGCSTLSHandshakeTimeout),
+		ResponseHeaderTimeout: timeout(config.GCSResponseHeaderTimeout, defaultGCSResponseHeaderTimeout),
+		ExpectContinueTimeout: time.Second,
+		ForceAttemptHTTP2:     config.GCSHTTP2,
+	}
+	if !transport.ForceAttemptHTTP2 {
+		// A non-nil empty map turns off the automatic upgrade
+		transport.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	return transport
+}
+
+// APIs the GCS client can talk to GCS through
+const (
+	gcsJSON = "json"
+	gcsGRPC = "grpc"
+)
+
+// API the GCS client uses, GCS_API=grpc for the gRPC API, otherwise the JSON API.
+// gRPC saves the HTTP and JSON overhead per call and multiplexes calls over few connections.
+func gcsAPI() string {
+	if config.GCSAPI == gcsGRPC {
+		return gcsGRPC
+	}
+	return gcsJSON
+}
+
+// Create a GCS client for the configured API, authenticated with the default credentials.
+// The JSON API goes through the tuned transport.
+func newGCSClient(ctx context.Context) (*storage.Client, error) {
+	if gcsAPI() == gcsGRPC {
+		return storage.NewGRPCClient(ctx)
+	}
+	// Emulators such as fake-gcs-server take no credentials
+	if config.StorageEmulatorHost != "" {
+		return storage.NewClient(ctx, option.WithEndpoint(emulatorEndpoint(config.StorageEmulatorHost)), option.WithoutAuthentication())
+	}
+	source, err := google.DefaultTokenSource(ctx, storage.ScopeFullControl)
+	if err != nil {
+		return nil, err
+	}
+	client := &http.Client{Transport: &oauth2.Transport{Source: source, Base: tracedTransport{gcsTransport()}}}
+	return storage.NewClient(ctx, option.WithHTTPClient(client))
+}
+
+// JSON API endpoint of a GCS emulator, given as host:port or URL like STORAGE_EMULATOR_HOST for the client library
+func emulatorEndpoint(host string) string {
+	if !strings.Contains(host, "://") {
+		host = "http://" + host
+	}
+	return strings.TrimSuffix(host, "/") + "/storage/v1/"
+}
+
+// struct tracedTransport records whether requests to GCS got a fresh or a reused connection, and how long that took.
+type tracedTransport struct {
+	base http.RoundTripper
+}
+
+func (t tracedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	var asked time.Time
+	clientTrace := &httptrace.ClientTrace{
+		GetConn: func(string) {
+			asked = time.Now()
+		},
+		GotConn: func(info httptrace.GotConnInfo) {
+			reused := "false"
+			if info.Reused {
+				reused = "true"
+			}
+			mutators := []tag.Mutator{tag.Upsert(keyReused, reused)}
+			record(ctx, mutators, gcsConnections.M(1))
+			record(ctx, mutators, gcsConnectionWait.M(float64(time.Since(asked))/float64(time.Millisecond)))
+		},
+	}
+	return t.base.RoundTrip(req.WithContext(httptrace.WithClientTrace(ctx, clientTrace)))
+}
+
+// Record how long an operation on a link object took since start, to compare the APIs
+func recordGCSLatency(ctx context.Context, operation string, start time.Time, err error) {
+	if err != nil && err != storage.ErrObjectNotExist {
+		// Failures would skew the comparison
+		return
+	}
+	mutators := []tag.Mutator{tag.Upsert(keyAPI, gcsAPI()), tag.Upsert(keyOperation, operation)}
+	record(ctx, mutators, gcsLatency.M(float64(time.Since(start))/float64(time.Millisecond)))
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// Day buckets of operation counts
+const usageDay = "20060102"
+
+// Object holding the latest bucket scan
+const usageScanObject = "usage/scan.json"
+
+// Days of operation counts reported by default, and at most
+const (
+	defaultUsageDays = 30
+	maxUsageDays     = 90
+)
+
+// How often the bucket is scanned by default
+const defaultUsageScanInterval = 24 * time.Hour
+
+// Kinds of GCS operations, priced as class A (writes, lists) or class B (reads), deletes are free
+const (
+	opRead   = "read"
+	opWrite  = "write"
+	opList   = "list"
+	opDelete = "delete"
+)
+
+// GCS list prices in USD of a US multi-region: storage per GiB and month by storage class,
+// operations per 1000 by class. Estimates only, actual prices depend on location and contract.
+var (
+	storagePrices = map[string]float64{"STANDARD": 0.026, "NEARLINE": 0.015, "COLDLINE": 0.007, "ARCHIVE": 0.0025}
+	classAPrice   = 0.005
+	classBPrice   = 0.0004
+)
+
+// struct usageCounts counts the GCS operations of a day, per instance when stored.
+type usageCounts struct {
+	Day     string `json:"day"`
+	Reads   int64  `json:"reads"`
+	Writes  int64  `json:"writes"`
+	Lists   int64  `json:"lists"`
+	Deletes int64  `json:"deletes"`
+}
+
+// struct objectUsage sums up objects and their size.
+type objectUsage struct {
+	Objects int64 `json:"objects"`
+	Bytes   int64 `json:"bytes"`
+}
+
+// struct bucketScan is what a scan of the buckets found.
+type bucketScan struct {
+	Scanned time.Time `json:"scanned"`
+	objectUsage
+	// By top level prefix, "links" for the link objects themselves
+	Prefixes map[string]*objectUsage `json:"prefixes"`
+	// By storage class
+	Classes map[string]*objectUsage `json:"classes"`
+}
+
+// struct costEstimate is the estimated monthly GCS cost in USD.
+type costEstimate struct {
+	// Storage by storage class
+	Storage map[string]float64 `json:"storage"`
+	// Operations, extrapolated from the reported days
+	ClassA float64 `json:"class_a_operations"`
+	ClassB float64 `json:"class_b_operations"`
+	Total  float64 `json:"total"`
+}
+
+// struct usageResponse reports storage usage and its estimated cost.
+type usageResponse struct {
+	response
+	Scan *bucketScan   `json:"scan"`
+	Days []usageCounts `json:"days"`
+	// Estimated monthly cost
+	Estimate costEstimate `json:"estimate"`
+}
+
+// GCS operations of this instance which weren't flushed yet, by day
+var usageCounter = struct {
+	sync.Mutex
+	days map[string]*usageCounts
+}{days: map[string]*usageCounts{}}
+
+// Count GCS operations of a kind
+func countOperation(kind string, n int64) {
+	day := clock().UTC().Format(usageDay)
+	usageCounter.Lock()
+	defer usageCounter.Unlock()
+	counts, ok := usageCounter.days[day]
+	if !ok {
+		counts = &usageCounts{Day: day}
+		usageCounter.days[day] = counts
+	}
+	switch kind {
+	case opRead:
+		counts.Reads += n
+	case opWrite:
+		counts.Writes += n
+	case opList:
+		counts.Lists += n
+	case opDelete:
+		counts.Deletes += n
+	}
+}
+
+// Object holding an instance's operation counts of a day
+func usageObject(day string, instance string) string {
+	return fmt.Sprintf("usage/%s/%s.json", day, instance)
+}
+
+// Flush the operation counts every minute and scan the buckets every USAGE_SCAN_INTERVAL on one instance
+func startUsageRecorder() {
+	go func() {
+		for range time.Tick(time.Minute) {
+			flushUsage(context.Background())
+		}
+	}()
+	if redirectOnly() {
+		return
+	}
+	interval := config.UsageScanInterval
+	if interval <= 0 {
+		interval = defaultUsageScanInterval
+	}
+	startSingleton("scan-usage", interval, func(ctx context.Context) error {
+		_, err := scanUsage(ctx)
+		return err
+	})
+}
+
+// Write the counts of this instance, forgetting finished days once they're stored
+func flushUsage(ctx context.Context) {
+	ctx, span := tracer.Start(ctx, "flushUsage")
+	defer span.End()
+	current := clock().UTC().Format(usageDay)
+	usageCounter.Lock()
+	days := []usageCounts{}
+	for day, counts := range usageCounter.days {
+		days = append(days, *counts)
+		if day != current {
+			delete(usageCounter.days, day)
+		}
+	}
+	usageCounter.Unlock()
+	for _, counts := range days {
+		marshalled, err := json.Marshal(counts)
+		if err != nil {
+			slog.Error("unable to marshal operation counts", "err", err)
+			continue
+		}
+		// Counts are cumulative per instance and day, so overwriting is fine
+		err = gcsWriteBlob(ctx, usageObject(counts.Day, instanceID), "application/json", marshalled)
+		if err != nil {
+			slog.Error("unable to store operation counts", "err", err)
+		}
+	}
+}
+
+// Sum up the operation counts of all instances for the last days, oldest first
+func usageHistory(ctx context.Context, now time.Time, days int) ([]usageCounts, error) {
+	ctx, span := tracer.Start(ctx, "usageHistory")
+	defer span.End()
+	history := []usageCounts{}
+	for i := days - 1; i >= 0; i-- {
+		sum := usageCounts{Day: now.UTC().AddDate(0, 0, -i).Format(usageDay)}
+		err := gcsListPrefix(ctx, "usage/"+sum.Day+"/", func(name string) error {
+			data, _, err := gcsReadBlob(ctx, name)
+			if err != nil {
+				return err
+			}
+			counts := usageCounts{}
+			err = json.Unmarshal(data, &counts)
+			if err != nil {
+				return err
+			}
+			sum.Reads += counts.Reads
+			sum.Writes += counts.Writes
+			sum.Lists += counts.Lists
+			sum.Deletes += counts.Deletes
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, sum)
+	}
+	return history, nil
+}
+
+// Primitive to visit the name, size and storage class of all objects in a bucket
+func gcsScan(ctx context.Context, bucket string, visit func(name string, size int64, class string)) error {
+	ctx, span := tracer.Start(ctx, "gcsScan")
+	defer span.End()
+	if localBucket != nil {
+		return localBucket.list("", "", func(name string) error {
+			data, _, _, err := localBucket.read(name)
+			if err == nil {
+				visit(name, int64(len(data)), "STANDARD")
+			}
+			return nil
+		})
+	}
+
+	client, err := gcsClient()
+	if err != nil {
+		return err
+	}
+
+	var listed int64
+	defer func() { countOperation(opList, 1+listed/1000) }()
+	objects := client.Bucket(bucket).Objects(ctx, nil)
+	for {
+		attrs, err := objects.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return gcsCheck(client, err)
+		}
+		listed++
+		visit(attrs.Name, attrs.Size, attrs.StorageClass)
+	}
+}
+
+// Count the objects and bytes of the bucket and the archive, and store the result
+func scanUsage(ctx context.Context) (*bucketScan, error) {
+	ctx, span := tracer.Start(ctx, "scanUsage")
+	defer span.End()
+	scan := &bucketScan{Scanned: clock().UTC(), Prefixes: map[string]*objectUsage{}, Classes: map[string]*objectUsage{}}
+	add := func(usages map[string]*objectUsage, key string, size int64) {
+		usage, ok := usages[key]
+		if !ok {
+			usage = &objectUsage{}
+			usages[key] = usage
+		}
+		usage.Objects++
+		usage.Bytes += size
+	}
+	visit := func(name string, size int64, class string) {
+		prefix := "links"
+		if i := strings.Index(name, "/"); i >= 0 {
+			prefix = name[:i]
+		}
+		scan.Objects++
+		scan.Bytes += size
+		add(scan.Prefixes, prefix, size)
+		add(scan.Classes, class, size)
+	}
+	buckets := []string{config.Bucket}
+	if archiveBucket() != buckets[0] && localBucket == nil {
+		buckets = append(buckets, archiveBucket())
+	}
+	for _, bucket := range buckets {
+		err := gcsScan(ctx, bucket, visit)
+		if err != nil {
+			return nil, err
+		}
+	}
+	marshalled, err := json.Marshal(scan)
+	if err == nil {
+		err = gcsWriteBlob(ctx, usageScanObject, "application/json", marshalled)
+	}
+	return scan, err
+}
+
+// Estimate the monthly cost of the scanned objects and of operations at the rate of the given days
+func estimateCost(scan *bucketScan, days []usageCounts) costEstimate {
+	estimate := costEstimate{Storage: map[string]float64{}}
+	for class, usage := range scan.Classes {
+		price, ok := storagePrices[class]
+		if !ok {
+			price = storagePrices["STANDARD"]
+		}
+		estimate.Storage[class] = float64(usage.Bytes) / (1 << 30) * price
+		estimate.Total += estimate.Storage[class]
+	}
+	var classA, classB int64
+	for _, day := range days {
+		classA += day.Writes + day.Lists
+		classB += day.Reads
+	}
+	if len(days) > 0 {
+		perMonth := 30 / float64(len(days))
+		estimate.ClassA = float64(classA) * perMonth / 1000 * classAPrice
+		estimate.ClassB = float64(classB) * perMonth / 1000 * classBPrice
+	}
+	estimate.Total += estimate.ClassA + estimate.ClassB
+	return estimate
+}
+
+// Admin handler reporting object counts and bytes from the latest bucket scan, GCS operations per day
+// and the estimated monthly cost. Takes ?days= of operations (30 by default) and ?scan=true to scan now.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "usageHandler")
+	defer span.End()
+	w.Header().Set("Content-Type", "application/json")
+	if !requireAdmin(ctx, w, r) {
+		return
+	}
+	days := defaultUsageDays
+	if raw := r.URL.Query().Get("days"); raw != "" {
+		var err error
+		days, err = strconv.Atoi(raw)
+		if err != nil || days < 1 || days > maxUsageDays {
+			respond(ctx, response{"", fmt.Sprintf("days should be between 1 and %d!", maxUsageDays)}, http.StatusBadRequest, w)
+			return
+		}
+	}
+
+	scan := &bucketScan{}
+	data, _, err := gcsReadBlob(ctx, usageScanObject)
+	if err == nil {
+		err = json.Unmarshal(data, scan)
+	}
+	// Until the first scheduled scan ran, scan right away
+	if err == storage.ErrObjectNotExist || r.URL.Query().Get("scan") == "true" {
+		scan, err = scanUsage(ctx)
+	}
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	history, err := usageHistory(ctx, clock(), days)
+	if err != nil {
+		respond(ctx, response{"", "unable to access GCS!"}, http.StatusInternalServerError, w)
+		return
+	}
+	resp := usageResponse{Scan: scan, Days: history, Estimate: estimateCost(scan, history)}
+	resp.Message = fmt.Sprintf("%d objects, %d bytes, about %.2f USD per month", scan.Objects, scan.Bytes, resp.Estimate.Total)
+	respond(ctx, resp, http.StatusOK, w)
+}
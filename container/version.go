@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"runtime"
+)
+
+// Build information, injected at build time via
+// -ldflags "-X main.version=... -X main.commit=... -X main.buildTime=..."
+var (
+	version   = "1.0.0"
+	commit    = "unknown"
+	buildTime = "unknown"
+)
+
+// struct versionResponse describes the running build.
+type versionResponse struct {
+	// Release version of the server
+	Version string `json:"version"`
+	// Git commit the server was built from
+	Commit string `json:"commit"`
+	// Time the binary was built
+	BuildTime string `json:"build_time"`
+	// Go toolchain used for the build
+	GoVersion string `json:"go_version"`
+	// Storage backend links are kept in
+	Storage string `json:"storage"`
+	// Optional features enabled by configuration
+	Features []string `json:"features"`
+}
+
+// Names of the optional features enabled by the current configuration
+func enabledFeatures() []string {
+	features := []string{}
+	if screenshotsEnabled() {
+		features = append(features, "screenshots")
+	}
+	if config.SigningSecret != "" {
+		features = append(features, "expiry-calendar", "insights")
+	}
+	if config.SecurityContact != "" || config.AbuseContact != "" {
+		features = append(features, "abuse-contact")
+	}
+	if config.TrafficAnomalyThreshold > 0 {
+		features = append(features, "traffic-anomalies")
+	}
+	if cloakingEnabled() {
+		features = append(features, "cloaking-detection")
+	}
+	if config.AdminToken != "" {
+		features = append(features, "admin")
+	}
+	if redirectOnly() {
+		features = append(features, "redirect-only")
+	}
+	if apiKeysRequired() {
+		features = append(features, "api-keys")
+	}
+	if config.ClickExportTable != "" {
+		features = append(features, "click-export")
+	}
+	if firebaseProject() != "" {
+		features = append(features, "firebase-auth")
+	}
+	if aliases.limiter != nil {
+		features = append(features, "alias-throttling")
+	}
+	if safeBrowsingEnabled() {
+		features = append(features, "safe-browsing")
+	}
+	if config.SigningSecret != "" && !redirectOnly() {
+		features = append(features, "domain-claims")
+	}
+	if randomCodes() {
+		features = append(features, "random-codes")
+	}
+	if linkArchive != nil {
+		features = append(features, "link-archive")
+	}
+	if gcsAPI() == gcsGRPC {
+		features = append(features, "gcs-grpc")
+	}
+	return features
+}
+
+// GET handler reporting build and configuration details
+func versionHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "versionHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	respond(ctx, versionResponse{
+		Version:   version,
+		Commit:    commit,
+		BuildTime: buildTime,
+		GoVersion: runtime.Version(),
+		Storage:   storeName(),
+		Features:  enabledFeatures(),
+	}, http.StatusOK, w)
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Retries of a webhook within one delivery, before the task runner retries the delivery as a whole
+const (
+	webhookAttempts = 3
+	// Delay before the first retry, doubled with every further attempt
+	webhookBackoff = 500 * time.Millisecond
+)
+
+// Receiver key of the events topic in the delivered list of an event
+const topicReceiver = "topic"
+
+// URLs receiving link events, a comma-separated list in EVENTS_WEBHOOK
+func eventWebhooks() []string {
+	webhooks := []string{}
+	for _, webhook := range strings.Split(config.EventsWebhook, ",") {
+		if webhook = strings.TrimSpace(webhook); webhook != "" {
+			webhooks = append(webhooks, webhook)
+		}
+	}
+	return webhooks
+}
+
+// Key of a webhook in the delivered list of an event, so URLs (and tokens in them) aren't stored with links
+func webhookReceiver(webhook string) string {
+	hash := sha256.Sum256([]byte(webhook))
+	return hex.EncodeToString(hash[:8])
+}
+
+// Report whether an event reached a receiver in an earlier attempt
+func (e *event) deliveredTo(receiver string) bool {
+	for _, delivered := range e.Delivered {
+		if delivered == receiver {
+			return true
+		}
+	}
+	return false
+}
+
+// Body of an event as sent to receivers, without the delivery bookkeeping
+func (e event) payload() ([]byte, error) {
+	e.Delivered = nil
+	return json.Marshal(e)
+}
+
+// POST a signed event to a webhook, retrying with backoff on network errors, 408, 429 and server errors
+func postEvent(ctx context.Context, webhook string, e *event, body []byte) error {
+	ctx, span := tracer.Start(ctx, "postEvent")
+	defer span.End()
+	backoff := webhookBackoff
+	var err error
+	for attempt := 1; ; attempt++ {
+		var retry bool
+		retry, err = postEventOnce(ctx, webhook, e, body)
+		if err == nil || !retry || attempt == webhookAttempts {
+			break
+		}
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+	return err
+}
+
+// POST an event once, reporting whether a failure is worth retrying
+func postEventOnce(ctx context.Context, webhook string, e *event, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook, bytes.NewReader(body))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Urly-Event", e.Type)
+	req.Header.Set("X-Urly-Event-Id", e.ID)
+	if config.SigningSecret != "" {
+		req.Header.Set("X-Urly-Signature", sign(string(body)))
+	}
+	resp, err := webhookClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusRequestTimeout
+		return retry, fmt.Errorf("events webhook %s answered %d", req.URL.Host, resp.StatusCode)
+	}
+	return false, nil
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// GUID appended to the key of a WebSocket handshake (RFC 6455, section 1.3)
+const websocketGUID = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+
+// Opcodes of WebSocket frames
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+// Status codes of WebSocket close frames
+const (
+	wsNormalClosure   = 1000
+	wsGoingAway       = 1001
+	wsUnsupportedData = 1003
+	wsPolicyViolation = 1008
+	wsTooBig          = 1009
+	wsTryAgainLater   = 1013
+)
+
+// How long writing a frame may take before the connection is given up
+const wsWriteTimeout = 10 * time.Second
+
+var (
+	errNotWebSocket  = errors.New("not a websocket handshake")
+	errUnmaskedFrame = errors.New("unmasked client frame")
+	errFrameTooBig   = errors.New("frame too big")
+	errFragmented    = errors.New("fragmented message")
+	errSocketClosed  = errors.New("websocket closed")
+)
+
+// struct wsConn is the server side of a WebSocket connection, writing from several goroutines and reading from one.
+type wsConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	sync.Mutex
+	closed bool
+}
+
+// Report whether a request asks for a WebSocket, any version
+func isWebSocketRequest(r *http.Request) bool {
+	return headerHasToken(r.Header.Get("Connection"), "upgrade") && strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// Report whether a comma-separated header value contains a token, ignoring case
+func headerHasToken(value string, token string) bool {
+	for _, t := range strings.Split(value, ",") {
+		if strings.EqualFold(strings.TrimSpace(t), token) {
+			return true
+		}
+	}
+	return false
+}
+
+// Take the connection of a response over, looking through the writers of the middlewares
+func hijack(w http.ResponseWriter) (net.Conn, *bufio.ReadWriter, error) {
+	for {
+		switch wrapped := w.(type) {
+		case *statusWriter:
+			w = wrapped.ResponseWriter
+		case authWriter:
+			w = wrapped.ResponseWriter
+		case *negotiatedWriter:
+			w = wrapped.ResponseWriter
+		case http.Hijacker:
+			return wrapped.Hijack()
+		default:
+			return nil, nil, errNotWebSocket
+		}
+	}
+}
+
+// Complete the handshake of a WebSocket request with version 13, the only one browsers speak.
+// Nothing is written to w if it fails, so the caller can still respond.
+func upgradeWebSocket(w http.ResponseWriter, r *http.Request) (*wsConn, error) {
+	key := r.Header.Get("Sec-WebSocket-Key")
+	decoded, err := base64.StdEncoding.DecodeString(key)
+	if r.Method != http.MethodGet || !isWebSocketRequest(r) || r.Header.Get("Sec-WebSocket-Version") != "13" || err != nil || len(decoded) != 16 {
+		return nil, errNotWebSocket
+	}
+	conn, buffered, err := hijack(w)
+	if err != nil {
+		return nil, err
+	}
+	accept := sha1.Sum([]byte(key + websocketGUID))
+	conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Accept: "+
+		base64.StdEncoding.EncodeToString(accept[:])+"\r\n\r\n")
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return &wsConn{conn: conn, reader: buffered.Reader}, nil
+}
+
+// Write a single unfragmented frame, server frames aren't masked
+func (c *wsConn) writeFrame(opcode byte, payload []byte) error {
+	header := []byte{0x80 | opcode, 0, 0, 0, 0, 0, 0, 0, 0, 0}
+	n := 2
+	switch {
+	case len(payload) < 126:
+		header[1] = byte(len(payload))
+	case len(payload) <= 0xffff:
+		header[1] = 126
+		binary.BigEndian.PutUint16(header[2:], uint16(len(payload)))
+		n = 4
+	default:
+		header[1] = 127
+		binary.BigEndian.PutUint64(header[2:], uint64(len(payload)))
+		n = 10
+	}
+	c.Lock()
+	defer c.Unlock()
+	if c.closed {
+		return errSocketClosed
+	}
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+	_, err := c.conn.Write(append(header[:n], payload...))
+	return err
+}
+
+// Send a text message
+func (c *wsConn) writeText(message []byte) error {
+	return c.writeFrame(wsText, message)
+}
+
+// Send a close frame with a status and reason, then close the connection
+func (c *wsConn) close(status int, reason string) {
+	payload := make([]byte, 2, 2+len(reason))
+	binary.BigEndian.PutUint16(payload, uint16(status))
+	c.writeFrame(wsClose, append(payload, reason...))
+	c.Lock()
+	c.closed = true
+	c.Unlock()
+	c.conn.Close()
+}
+
+// Read the next message of at most limit bytes, answering pings on the way.
+// Returns io.EOF once the client closes the connection.
+func (c *wsConn) readMessage(limit int64, timeout time.Duration) (byte, []byte, error) {
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(timeout))
+		header := make([]byte, 2)
+		_, err := io.ReadFull(c.reader, header)
+		if err != nil {
+			return 0, nil, err
+		}
+		fin, opcode := header[0]&0x80 != 0, header[0]&0x0f
+		if header[1]&0x80 == 0 {
+			return 0, nil, errUnmaskedFrame
+		}
+		length := int64(header[1] & 0x7f)
+		switch length {
+		case 126:
+			extended := make([]byte, 2)
+			_, err = io.ReadFull(c.reader, extended)
+			length = int64(binary.BigEndian.Uint16(extended))
+		case 127:
+			extended := make([]byte, 8)
+			_, err = io.ReadFull(c.reader, extended)
+			length = int64(binary.BigEndian.Uint64(extended) & 0x7fffffffffffffff)
+		}
+		if err != nil {
+			return 0, nil, err
+		}
+		if length > limit {
+			return 0, nil, errFrameTooBig
+		}
+		mask := make([]byte, 4)
+		_, err = io.ReadFull(c.reader, mask)
+		if err != nil {
+			return 0, nil, err
+		}
+		payload := make([]byte, length)
+		_, err = io.ReadFull(c.reader, payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+		switch opcode {
+		case wsPing:
+			err = c.writeFrame(wsPong, payload)
+			if err != nil {
+				return 0, nil, err
+			}
+		case wsPong:
+		case wsClose:
+			return 0, nil, io.EOF
+		default:
+			// Browsers don't split messages as small as those accepted here
+			if !fin || opcode == wsContinuation {
+				return 0, nil, errFragmented
+			}
+			return opcode, payload, nil
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// struct abuseContact tells reporters where to send abuse of short links.
+type abuseContact struct {
+	// Contact URIs for abuse reports (mailto: or https:)
+	Contacts []string `json:"contacts"`
+	// Page describing how reports are handled
+	Policy string `json:"policy,omitempty"`
+	// Languages reports may be written in
+	Languages []string `json:"languages,omitempty"`
+	// Information reporters should include
+	Instructions string `json:"instructions"`
+}
+
+// Split a comma separated configuration value
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
+
+// Turn a plain email address into a mailto: URI, leaving URIs untouched
+func contactURI(contact string) string {
+	if strings.Contains(contact, ":") {
+		return contact
+	}
+	return "mailto:" + contact
+}
+
+// GET handler serving RFC 9116 security.txt from SECURITY_CONTACT, SECURITY_POLICY,
+// SECURITY_LANGUAGES and SECURITY_EXPIRES (RFC 3339, defaults to one year ahead)
+func securityTxtHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "securityTxtHandler")
+	defer span.End()
+	contacts := splitList(config.SecurityContact)
+	if len(contacts) == 0 {
+		w.Header().Set("Content-Type", "application/json")
+		respond(ctx, response{"", "no security contact configured!"}, http.StatusNotFound, w)
+		return
+	}
+
+	expires := clock().UTC().AddDate(1, 0, 0).Truncate(24 * time.Hour)
+	if !config.SecurityExpires.IsZero() {
+		expires = config.SecurityExpires.UTC()
+	}
+
+	body := new(strings.Builder)
+	for _, contact := range contacts {
+		fmt.Fprintf(body, "Contact: %s\n", contactURI(contact))
+	}
+	fmt.Fprintf(body, "Expires: %s\n", expires.Format(time.RFC3339))
+	if policy := config.SecurityPolicy; policy != "" {
+		fmt.Fprintf(body, "Policy: %s\n", policy)
+	}
+	if languages := config.SecurityLanguages; languages != "" {
+		fmt.Fprintf(body, "Preferred-Languages: %s\n", strings.Join(splitList(languages), ", "))
+	}
+	fmt.Fprintf(body, "Canonical: https://%s/.well-known/security.txt\n", config.Domain)
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Cache-Control", "public, max-age=86400")
+	w.Write([]byte(body.String()))
+}
+
+// GET handler describing where to report abusive short links, from ABUSE_CONTACT and ABUSE_POLICY.
+// Falls back to the security contact if no dedicated abuse contact is configured.
+func abuseHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "abuseHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Content-Type", "application/json")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	contacts := splitList(config.AbuseContact)
+	if len(contacts) == 0 {
+		contacts = splitList(config.SecurityContact)
+	}
+	if len(contacts) == 0 {
+		respond(ctx, response{"", "no abuse contact configured!"}, http.StatusNotFound, w)
+		return
+	}
+	for i := range contacts {
+		contacts[i] = contactURI(contacts[i])
+	}
+	respond(ctx, abuseContact{
+		Contacts:     contacts,
+		Policy:       config.AbusePolicy,
+		Languages:    splitList(config.SecurityLanguages),
+		Instructions: fmt.Sprintf("Include the full short link (https://%s/<code>) and why it is abusive.", config.Domain),
+	}, http.StatusOK, w)
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"html/template"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/codes"
+)
+
+// Size of the click chart of the stats widget in pixels
+const (
+	widgetWidth  = 300
+	widgetHeight = 80
+)
+
+// Page rendered into the iframe of the stats widget
+var widgetTemplate = template.Must(template.New("widget").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="robots" content="noindex, nofollow">
+<title>{{.ShortLink}} - Urly Wurly</title>
+<style>
+body { margin: 0; font: 12px/1.4 -apple-system, "Segoe UI", Roboto, sans-serif; color: #333; }
+.widget { padding: 8px; }
+.widget a { color: #007bff; text-decoration: none; }
+.widget .total { font-size: 20px; font-weight: bold; }
+.widget rect { fill: #007bff; }
+</style>
+</head>
+<body>
+<div class="widget">
+<div><a href="{{.ShortLink}}" target="_blank" rel="noopener">{{.ShortLink}}</a></div>
+{{if .Message}}<p>{{.Message}}</p>{{else}}
+<div><span class="total">{{.Total}}</span> clicks in the last {{.Days}} days</div>
+<svg width="{{.Width}}" height="{{.Height}}" viewBox="0 0 {{.Width}} {{.Height}}" role="img" aria-label="clicks per day">
+{{range .Bars}}<rect x="{{.X}}" y="{{.Y}}" width="{{.Width}}" height="{{.Height}}"><title>{{.Date}}: {{.Clicks}}</title></rect>
+{{end}}</svg>
+{{end}}
+</div>
+</body>
+</html>
+`))
+
+// struct widgetBar is a day in the click chart of the stats widget.
+type widgetBar struct {
+	Date   string
+	Clicks int64
+	X      int
+	Y      int
+	Width  int
+	Height int
+}
+
+// Subject signed to embed the stats of a private link, tied to the link's creation like manage tokens
+func embedSubject(code string, l *link) string {
+	return fmt.Sprintf("embed:%s:%d", code, l.Created.UnixNano())
+}
+
+// Iframe URL of the stats widget, signed unless the link's stats are public.
+// Empty for private links if there is no SIGNING_SECRET.
+func embedURL(code string, l *link) string {
+	query := url.Values{}
+	if !l.PublicStats {
+		if config.SigningSecret == "" {
+			return ""
+		}
+		query.Set("token", sign(embedSubject(code, l)))
+	}
+	embed := fmt.Sprintf("https://%s/%s/widget", config.Domain, code)
+	if len(query) > 0 {
+		embed += "?" + query.Encode()
+	}
+	return embed
+}
+
+// Lay out daily clicks as bars, one per day of [from, to] including days without clicks
+func widgetBars(rollups []*dailyRollup, from time.Time, days int) []widgetBar {
+	clicks := map[string]int64{}
+	var most int64 = 1
+	for _, rollup := range rollups {
+		clicks[rollup.Date] = rollup.Clicks
+		if rollup.Clicks > most {
+			most = rollup.Clicks
+		}
+	}
+	step := widgetWidth / days
+	bars := []widgetBar{}
+	for i := 0; i < days; i++ {
+		date := from.AddDate(0, 0, i).Format(rollupDate)
+		height := int(clicks[date] * (widgetHeight - 1) / most)
+		if clicks[date] > 0 && height == 0 {
+			height = 1
+		}
+		bars = append(bars, widgetBar{date, clicks[date], i * step, widgetHeight - height, step - 1, height})
+	}
+	return bars
+}
+
+// GET handler rendering the stats widget of a link for embedding as iframe.
+// Links created with public_stats are open, others need the signed ?token= from their embed URL.
+// ?days= picks the period of the chart (default 30, at most 90).
+func widgetHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "widgetHandler")
+	defer span.End()
+	if r.Method == http.MethodOptions {
+		return
+	}
+	code := mux.Vars(r)["id"]
+	days, err := strconv.Atoi(r.URL.Query().Get("days"))
+	if err != nil || days <= 0 {
+		days = 30
+	}
+	if days > 90 {
+		days = 90
+	}
+	page := struct {
+		ShortLink     string
+		Message       string
+		Total         int64
+		Days          int
+		Width, Height int
+		Bars          []widgetBar
+	}{ShortLink: shortLink(code), Days: days, Width: widgetWidth, Height: widgetHeight}
+
+	status := http.StatusOK
+	l, err := readLink(ctx, code)
+	switch {
+	case err != nil:
+		status, page.Message = http.StatusNotFound, "This link doesn't exist."
+	case !l.PublicStats && !verifySignature(embedSubject(code, l), r.URL.Query().Get("token")) && !sharedStats(r, code, l) && !isAdmin(r):
+		status, page.Message = http.StatusForbidden, "The stats of this link are private."
+	case l.NoAnalytics:
+		page.Message = "This link doesn't collect clicks."
+	default:
+		to := clock().UTC().Truncate(24 * time.Hour)
+		from := to.AddDate(0, 0, -days+1)
+		rollups, err := readRollups(ctx, code, from, to)
+		if err != nil {
+			status, page.Message = http.StatusInternalServerError, "Stats are unavailable right now."
+			break
+		}
+		for _, rollup := range rollups {
+			page.Total += rollup.Clicks
+		}
+		page.Bars = widgetBars(rollups, from, days)
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if l != nil && l.PublicStats {
+		w.Header().Set("Cache-Control", "public, max-age=300")
+	} else {
+		w.Header().Set("Cache-Control", "private, max-age=300")
+	}
+	w.WriteHeader(status)
+	err = widgetTemplate.Execute(w, page)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+	}
+}
+
+// GET handler returning a script which inserts the stats widget iframe next to its own <script> tag.
+// Its query (token, days) is passed on to the iframe.
+func widgetScriptHandler(w http.ResponseWriter, r *http.Request) {
+	ctx := context.Background()
+	ctx, span := tracer.Start(ctx, "widgetScriptHandler")
+	defer span.End()
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	if r.Method == http.MethodOptions {
+		return
+	}
+	src := fmt.Sprintf("https://%s/%s/widget", config.Domain, mux.Vars(r)["id"])
+	if r.URL.RawQuery != "" {
+		src += "?" + r.URL.RawQuery
+	}
+	encoded, err := json.Marshal(src)
+	if err != nil {
+		span.SetStatus(codes.Error, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	fmt.Fprintf(w, `(function() {
+  var script = document.currentScript;
+  var frame = document.createElement('iframe');
+  frame.src = %s;
+  frame.width = %d;
+  frame.height = %d;
+  frame.style.border = '0';
+  frame.title = 'Link stats';
+  script.parentNode.insertBefore(frame, script.nextSibling);
+})();
+`, encoded, widgetWidth+16, widgetHeight+64)
+}